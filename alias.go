@@ -0,0 +1,313 @@
+package Onyx
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// An alias is another name of a node, such as an email address or a legacy ID. Unlike a
+// redirect it doesn't move anything: the node keeps its canonical ID, and aliases are only
+// looked up by Resolve, or by every API that takes node IDs with WithAliasResolution.
+
+// ErrAliasTaken is returned by AddAlias when the alias already names another node. Without
+// WithAliasResolution it is also returned by the writes that would create a node, or an edge
+// to one, under the name of an alias: that node would be hidden behind the alias by Resolve.
+type ErrAliasTaken struct {
+	Alias string
+	// Canonical is the node the alias names, empty if the alias is a node or a redirected ID.
+	Canonical string
+}
+
+func (e *ErrAliasTaken) Error() string {
+	if e.Canonical == "" {
+		return fmt.Sprintf("onyx: alias %q is already a node ID", e.Alias)
+	}
+	return fmt.Sprintf("onyx: alias %q is already an alias of %s", e.Alias, e.Canonical)
+}
+
+// WithAliasResolution makes the APIs that take node IDs accept aliases, see AddAlias: reads
+// of an alias read its node, and writes to an alias write to its node, the way redirects are
+// followed. Without it aliases are only resolved by Resolve.
+func WithAliasResolution() Option {
+	return func(g *Graph) {
+		g.aliasResolution = true
+	}
+}
+
+func aliasKey(alias string) []byte {
+	return []byte(aliasPrefix + alias)
+}
+
+// aliasOfKey returns the key of the index entry of alias under canonical. With an empty
+// alias it is the prefix of all aliases of canonical.
+func aliasOfKey(canonical string, alias string) []byte {
+	return []byte(aliasOfPrefix + canonical + keySep + alias)
+}
+
+// readAlias returns the node alias names, or "" if it isn't an alias.
+func readAlias(txn *badger.Txn, alias string) (string, error) {
+	item, err := txn.Get(aliasKey(alias))
+	if err == badger.ErrKeyNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	canonical, err := item.ValueCopy(nil)
+	return string(canonical), err
+}
+
+// resolveAlias returns the canonical ID of id, following its alias and then its redirects.
+func (g *Graph) resolveAlias(txn *badger.Txn, id string) (string, error) {
+	canonical, err := readAlias(txn, id)
+	if err != nil {
+		return "", err
+	}
+	if canonical != "" {
+		id = canonical
+	}
+	return g.followRedirects(txn, id)
+}
+
+// nodeExists reports whether node has an edge list or properties.
+func nodeExists(txn *badger.Txn, node string) (bool, error) {
+	_, exists, err := readEdgeMap(txn, node)
+	if err != nil || exists {
+		return exists, err
+	}
+	props, err := readNodeProperties(txn, node, nil)
+	return len(props) > 0, err
+}
+
+// AddAlias makes alias another name of canonical. An alias names exactly one node: adding an
+// alias that names another node, or that is a node or a redirected ID itself, fails with
+// *ErrAliasTaken, and adding it again for the same node does nothing. canonical is resolved
+// first, so aliasing an alias or a redirected ID aliases its node. RemoveNode deletes the
+// aliases of the node, and MergeNodes and Redirect move them to the surviving node.
+//
+// Without WithAliasResolution, AddEdge, SetEdges, AddSourcedEdge, SetNodeProperties and the
+// add_node mutation fail with *ErrAliasTaken on an alias rather than write a node of its name.
+func (g *Graph) AddAlias(alias string, canonical string, txn *badger.Txn) error {
+	alias, canonical = g.nodeID(alias), g.nodeID(canonical)
+	if err := validateNodeID(alias); err != nil {
+		return err
+	}
+	if err := validateNodeID(canonical); err != nil {
+		return err
+	}
+
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("AddAlias")
+		if err != nil {
+			return err
+		}
+		defer end()
+		txn = g.DB.NewTransaction(true)
+		defer txn.Discard()
+	}
+
+	err := g.addAlias(txn, alias, canonical)
+	if err != nil {
+		return err
+	}
+
+	if localTxn {
+		err = txn.Commit()
+		if err != nil {
+			g.recordConflict(err, alias)
+			return err
+		}
+	}
+	return nil
+}
+
+// addAlias is AddAlias on IDs that are already normalized.
+func (g *Graph) addAlias(txn *badger.Txn, alias string, canonical string) error {
+	canonical, err := g.resolveAlias(txn, canonical)
+	if err != nil {
+		return err
+	}
+	current, err := readAlias(txn, alias)
+	if err != nil {
+		return err
+	}
+	if current == canonical {
+		return nil
+	} else if current != "" {
+		return &ErrAliasTaken{Alias: alias, Canonical: current}
+	}
+	if alias == canonical {
+		return &ErrAliasTaken{Alias: alias}
+	}
+	if target, err := readRedirect(txn, alias); err != nil {
+		return err
+	} else if target != "" {
+		return &ErrAliasTaken{Alias: alias}
+	}
+	if exists, err := nodeExists(txn, alias); err != nil {
+		return err
+	} else if exists {
+		return &ErrAliasTaken{Alias: alias}
+	}
+
+	// Set before the commit, so reads that see the alias resolve it.
+	g.hasAliases.Store(true)
+	if err := txn.Set(aliasKey(alias), []byte(canonical)); err != nil {
+		return err
+	}
+	return txn.Set(aliasOfKey(canonical, alias), nil)
+}
+
+// RemoveAlias deletes alias. Removing an alias that doesn't exist is not an error.
+func (g *Graph) RemoveAlias(alias string, txn *badger.Txn) error {
+	alias = g.nodeID(alias)
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("RemoveAlias")
+		if err != nil {
+			return err
+		}
+		defer end()
+		txn = g.DB.NewTransaction(true)
+		defer txn.Discard()
+	}
+
+	canonical, err := readAlias(txn, alias)
+	if err != nil || canonical == "" {
+		return err
+	}
+	if err := txn.Delete(aliasKey(alias)); err != nil {
+		return err
+	}
+	if err := txn.Delete(aliasOfKey(canonical, alias)); err != nil {
+		return err
+	}
+
+	if localTxn {
+		err = txn.Commit()
+		if err != nil {
+			g.recordConflict(err, alias)
+			return err
+		}
+	}
+	return nil
+}
+
+// Aliases returns the aliases of node, sorted.
+func (g *Graph) Aliases(node string, txn *badger.Txn) ([]string, error) {
+	node = g.nodeID(node)
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("Aliases")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	node, err := g.resolveAlias(txn, node)
+	if err != nil {
+		return nil, err
+	}
+	return listAliases(txn, node), nil
+}
+
+// Resolve returns the canonical ID of id: the node it is an alias of, with its redirects
+// followed. The canonical ID of a node that is neither an alias nor redirected is its ID,
+// whether the node exists or not.
+func (g *Graph) Resolve(id string, txn *badger.Txn) (string, error) {
+	id = g.nodeID(id)
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("Resolve")
+		if err != nil {
+			return "", err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	return g.resolveAlias(txn, id)
+}
+
+// checkNotAlias fails with *ErrAliasTaken if id is an alias and the graph doesn't resolve
+// aliases, for the writes that would create a node named id.
+func (g *Graph) checkNotAlias(txn *badger.Txn, id string) error {
+	if g.aliasResolution || !g.hasAliases.Load() {
+		return nil
+	}
+	canonical, err := readAlias(txn, id)
+	if err != nil {
+		return err
+	} else if canonical != "" {
+		return &ErrAliasTaken{Alias: id, Canonical: canonical}
+	}
+	return nil
+}
+
+// resolveWriteID is resolveID for writes that may create id, see checkNotAlias.
+func (g *Graph) resolveWriteID(txn *badger.Txn, id string) (string, error) {
+	if err := g.checkNotAlias(txn, id); err != nil {
+		return "", err
+	}
+	return g.resolveID(txn, id)
+}
+
+// listAliases returns the aliases naming canonical, sorted.
+func listAliases(txn *badger.Txn, canonical string) []string {
+	prefix := aliasOfKey(canonical, "")
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	var aliases []string
+	for it.Rewind(); it.Valid(); it.Next() {
+		aliases = append(aliases, string(it.Item().Key()[len(prefix):]))
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+// deleteAliases deletes the aliases of the removed node.
+func deleteAliases(txn *badger.Txn, node string) error {
+	for _, alias := range listAliases(txn, node) {
+		if err := txn.Delete(aliasKey(alias)); err != nil {
+			return err
+		}
+		if err := txn.Delete(aliasOfKey(node, alias)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveAliases points the aliases of from at to, when from is merged into to.
+func moveAliases(txn *badger.Txn, from string, to string) error {
+	for _, alias := range listAliases(txn, from) {
+		if err := txn.Delete(aliasOfKey(from, alias)); err != nil {
+			return err
+		}
+		if alias == to {
+			// to was an alias of from and is now the node itself.
+			if err := txn.Delete(aliasKey(alias)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := txn.Set(aliasKey(alias), []byte(to)); err != nil {
+			return err
+		}
+		if err := txn.Set(aliasOfKey(to, alias), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,412 @@
+package Onyx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// AnalyticsStage is an algorithm run by an AnalyticsPipeline. Stages that read the graph in one
+// scan of the edge lists set Pass, and the others set Run.
+type AnalyticsStage struct {
+	Name string
+	// Pass starts the stage on the snapshot txn. consume is called with every edge list, in
+	// key order, from a goroutine of the stage; dstNodes is shared with the other stages and
+	// must not be modified. finish is called once the scan is done and returns the result.
+	Pass func(g *Graph, txn *badger.Txn) (consume func(from string, dstNodes map[string]bool) error, finish func() (any, error))
+	// Run computes the result on the snapshot txn, after the shared scan.
+	Run func(ctx context.Context, g *Graph, txn *badger.Txn) (any, error)
+}
+
+// AnalyticsSink receives the result of every stage it was added with, once the stage is done.
+// Sinks are called one at a time, in the order the stages were added.
+type AnalyticsSink func(stage string, result any) error
+
+// AnalyticsReport is returned by AnalyticsPipeline.Run.
+type AnalyticsReport struct {
+	// ReadTs is the timestamp of the snapshot the stages read.
+	ReadTs uint64
+	// EdgeLists is the number of edge lists the shared scan read, and ScanDuration the time from
+	// its start until the last stage in it was finished.
+	EdgeLists    int
+	ScanDuration time.Duration
+	Stages       []StageReport
+}
+
+// StageReport is the timing of a stage. Duration is the time spent in the stage itself:
+// consuming the edge lists and finishing for the stages of the shared scan, which run
+// concurrently, and Run for the others. SinkDuration is the time its sink took.
+type StageReport struct {
+	Name         string
+	Shared       bool
+	Duration     time.Duration
+	SinkDuration time.Duration
+}
+
+type analyticsStep struct {
+	stage AnalyticsStage
+	sink  AnalyticsSink
+}
+
+// AnalyticsPipeline runs several algorithms on one snapshot of the graph. The algorithms
+// that read the graph in one scan of the edge lists share a single scan: every edge list read
+// is fanned out to all of them, each running in its own goroutine. The algorithms that need
+// several passes run after it, one at a time, on the same snapshot.
+type AnalyticsPipeline struct {
+	g     *Graph
+	steps []analyticsStep
+}
+
+// NewAnalyticsPipeline returns an empty pipeline running on g.
+func (g *Graph) NewAnalyticsPipeline() *AnalyticsPipeline {
+	return &AnalyticsPipeline{g: g}
+}
+
+// Add adds stage to the pipeline, with sink receiving its result. sink may be nil.
+func (p *AnalyticsPipeline) Add(stage AnalyticsStage, sink AnalyticsSink) *AnalyticsPipeline {
+	p.steps = append(p.steps, analyticsStep{stage: stage, sink: sink})
+	return p
+}
+
+// AddAlgorithm adds the stage of the registered algorithm name, made with params, see
+// RegisterAnalyticsAlgorithm.
+func (p *AnalyticsPipeline) AddAlgorithm(name string, params map[string]string, sink AnalyticsSink) error {
+	analyticsMu.RLock()
+	newStage, ok := analyticsAlgorithms[name]
+	analyticsMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("onyx: unknown analytics algorithm %q", name)
+	}
+	stage, err := newStage(params)
+	if err != nil {
+		return fmt.Errorf("onyx: analytics algorithm %s: %w", name, err)
+	}
+	p.Add(stage, sink)
+	return nil
+}
+
+// analyticsBatchSize is the number of edge lists the shared scan sends to the stages at once,
+// and analyticsFeedDepth the number of batches a stage may lag behind the scan.
+const (
+	analyticsBatchSize = 256
+	analyticsFeedDepth = 4
+)
+
+type scannedEdgeList struct {
+	from     string
+	dstNodes map[string]bool
+}
+
+// Run runs the stages of the pipeline on a new snapshot and passes every result to its sink.
+// The first error of a stage or a sink stops the pipeline, and so does cancelling ctx, which
+// Run then returns the cause of. The report has the timings of the stages that ran.
+func (p *AnalyticsPipeline) Run(ctx context.Context) (*AnalyticsReport, error) {
+	for _, step := range p.steps {
+		if (step.stage.Pass == nil) == (step.stage.Run == nil) {
+			return nil, fmt.Errorf("onyx: analytics stage %s must set exactly one of Pass and Run", step.stage.Name)
+		}
+	}
+	ctx, end, err := p.g.track(ctx, "AnalyticsPipeline")
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	txn := p.g.DB.NewTransaction(false)
+	defer txn.Discard()
+
+	report := &AnalyticsReport{ReadTs: txn.ReadTs(), Stages: make([]StageReport, len(p.steps))}
+	results := make([]any, len(p.steps))
+	var shared []int
+	for i, step := range p.steps {
+		report.Stages[i] = StageReport{Name: step.stage.Name, Shared: step.stage.Pass != nil}
+		if step.stage.Pass != nil {
+			shared = append(shared, i)
+		}
+	}
+	if len(shared) > 0 {
+		if err := p.scan(ctx, txn, shared, report, results); err != nil {
+			return report, err
+		}
+	}
+
+	for i, step := range p.steps {
+		if ctx.Err() != nil {
+			return report, context.Cause(ctx)
+		}
+		if step.stage.Run != nil {
+			start := time.Now()
+			result, err := step.stage.Run(ctx, p.g, txn)
+			report.Stages[i].Duration = time.Since(start)
+			if err != nil {
+				return report, fmt.Errorf("onyx: analytics stage %s: %w", step.stage.Name, err)
+			}
+			results[i] = result
+		}
+		if step.sink != nil {
+			start := time.Now()
+			err := step.sink(step.stage.Name, results[i])
+			report.Stages[i].SinkDuration = time.Since(start)
+			if err != nil {
+				return report, fmt.Errorf("onyx: analytics sink of %s: %w", step.stage.Name, err)
+			}
+		}
+	}
+	return report, nil
+}
+
+// scan runs the shared stages on one scan of the edge lists of txn.
+func (p *AnalyticsPipeline) scan(ctx context.Context, txn *badger.Txn, shared []int, report *AnalyticsReport, results []any) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	feeds := make([]chan []scannedEdgeList, len(shared))
+	for j, i := range shared {
+		name := p.steps[i].stage.Name
+		consume, finish := p.steps[i].stage.Pass(p.g, txn)
+		feed := make(chan []scannedEdgeList, analyticsFeedDepth)
+		feeds[j] = feed
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var busy time.Duration
+			defer func() {
+				report.Stages[i].Duration = busy
+			}()
+			failed := false
+			for batch := range feed {
+				if failed {
+					// Drain the feed, the scan stops once it sees the cancellation.
+					continue
+				}
+				begin := time.Now()
+				for _, list := range batch {
+					if err := consume(list.from, list.dstNodes); err != nil {
+						cancel(fmt.Errorf("onyx: analytics stage %s: %w", name, err))
+						failed = true
+						break
+					}
+				}
+				busy += time.Since(begin)
+			}
+			if failed || ctx.Err() != nil {
+				return
+			}
+			begin := time.Now()
+			result, err := finish()
+			busy += time.Since(begin)
+			if err != nil {
+				cancel(fmt.Errorf("onyx: analytics stage %s: %w", name, err))
+				return
+			}
+			results[i] = result
+		}()
+	}
+
+	var batch []scannedEdgeList
+	send := func() bool {
+		for _, feed := range feeds {
+			select {
+			case feed <- batch:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		batch = nil
+		return true
+	}
+	err := forEachEdgeList(txn, func(from string, dstNodes map[string]bool) error {
+		report.EdgeLists++
+		batch = append(batch, scannedEdgeList{from: from, dstNodes: dstNodes})
+		if len(batch) == analyticsBatchSize && !send() {
+			return context.Cause(ctx)
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 && !send() {
+		err = context.Cause(ctx)
+	}
+	for _, feed := range feeds {
+		close(feed)
+	}
+	wg.Wait()
+	report.ScanDuration = time.Since(start)
+
+	if ctx.Err() != nil {
+		// The cause is the error of the stage that failed, or the cancellation of the caller.
+		return context.Cause(ctx)
+	}
+	return err
+}
+
+var (
+	analyticsMu         sync.RWMutex
+	analyticsAlgorithms = map[string]func(params map[string]string) (AnalyticsStage, error){}
+)
+
+// RegisterAnalyticsAlgorithm registers the algorithm name for AddAlgorithm, so pipelines can be
+// configured by names and string parameters. newStage makes the stage from the parameters.
+// Registering a name again replaces it. The built-in algorithms are:
+//
+//	components     WeaklyConnectedComponents
+//	degree-stats   DegreeStats
+//	pagerank       PageRank, with the parameters damping, max-iterations, tolerance,
+//	               weighted and teleport-label
+//	topk-strength  TopKByStrength, with the parameters k and direction, out or in
+func RegisterAnalyticsAlgorithm(name string, newStage func(params map[string]string) (AnalyticsStage, error)) {
+	analyticsMu.Lock()
+	defer analyticsMu.Unlock()
+	analyticsAlgorithms[name] = newStage
+}
+
+func init() {
+	RegisterAnalyticsAlgorithm("components", func(params map[string]string) (AnalyticsStage, error) {
+		return ComponentsStage(), checkAnalyticsParams(params)
+	})
+	RegisterAnalyticsAlgorithm("degree-stats", func(params map[string]string) (AnalyticsStage, error) {
+		return DegreeStatsStage(), checkAnalyticsParams(params)
+	})
+	RegisterAnalyticsAlgorithm("pagerank", func(params map[string]string) (AnalyticsStage, error) {
+		var opts PageRankOptions
+		var err error
+		if v, ok := params["damping"]; ok {
+			if opts.Damping, err = strconv.ParseFloat(v, 64); err != nil {
+				return AnalyticsStage{}, fmt.Errorf("damping: %w", err)
+			}
+		}
+		if v, ok := params["max-iterations"]; ok {
+			if opts.MaxIterations, err = strconv.Atoi(v); err != nil {
+				return AnalyticsStage{}, fmt.Errorf("max-iterations: %w", err)
+			}
+		}
+		if v, ok := params["tolerance"]; ok {
+			if opts.Tolerance, err = strconv.ParseFloat(v, 64); err != nil {
+				return AnalyticsStage{}, fmt.Errorf("tolerance: %w", err)
+			}
+		}
+		if v, ok := params["weighted"]; ok {
+			if opts.Weighted, err = strconv.ParseBool(v); err != nil {
+				return AnalyticsStage{}, fmt.Errorf("weighted: %w", err)
+			}
+		}
+		opts.TeleportLabel = params["teleport-label"]
+		return PageRankStage(opts), checkAnalyticsParams(params, "damping", "max-iterations", "tolerance", "weighted", "teleport-label")
+	})
+	RegisterAnalyticsAlgorithm("topk-strength", func(params map[string]string) (AnalyticsStage, error) {
+		k, err := strconv.Atoi(params["k"])
+		if err != nil {
+			return AnalyticsStage{}, fmt.Errorf("k: %w", err)
+		}
+		direction := Outgoing
+		switch params["direction"] {
+		case "", "out":
+		case "in":
+			direction = Incoming
+		default:
+			return AnalyticsStage{}, fmt.Errorf("direction must be out or in, got %q", params["direction"])
+		}
+		return TopKByStrengthStage(k, direction), checkAnalyticsParams(params, "k", "direction")
+	})
+}
+
+// checkAnalyticsParams rejects the parameters not in known, so typos don't go unnoticed.
+func checkAnalyticsParams(params map[string]string, known ...string) error {
+	var unknown []string
+	for name := range params {
+		found := false
+		for _, k := range known {
+			found = found || name == k
+		}
+		if !found {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown parameters %v", unknown)
+	}
+	return nil
+}
+
+// JSONSink writes every result to w as a line of JSON, {"stage": name, "result": result}.
+func JSONSink(w io.Writer) AnalyticsSink {
+	enc := json.NewEncoder(w)
+	return func(stage string, result any) error {
+		return enc.Encode(struct {
+			Stage  string `json:"stage"`
+			Result any    `json:"result"`
+		}{stage, result})
+	}
+}
+
+// PropertySink writes the value of every node in the results to its property: the rank of
+// PageRank and the strength of TopKByStrength as 8 big endian bytes of a float64, like weights,
+// and the first node of the component of WeaklyConnectedComponents. The properties are
+// written in chunks, so a failure may leave some of them written.
+func PropertySink(g *Graph, property string) AnalyticsSink {
+	return func(stage string, result any) error {
+		values := make(map[string][]byte)
+		switch result := result.(type) {
+		case map[string]float64:
+			for node, value := range result {
+				values[node] = encodeFloat64(value)
+			}
+		case []NodeStrength:
+			for _, s := range result {
+				values[s.Node] = encodeFloat64(s.Strength)
+			}
+		case [][]string:
+			for _, component := range result {
+				for _, node := range component {
+					values[node] = []byte(component[0])
+				}
+			}
+		default:
+			return fmt.Errorf("onyx: can't write a %T to node properties", result)
+		}
+
+		nodes := make([]string, 0, len(values))
+		for node := range values {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		w := &chunkedWriter{g: g, point: "PropertySink"}
+		defer w.discard()
+		for _, node := range nodes {
+			err := w.do(func(txn *badger.Txn) error {
+				return g.SetNodeProperties(node, map[string][]byte{property: values[node]}, txn)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return w.commit()
+	}
+}
+
+// NodeSetSink passes the node sets of the results to fn: the components of
+// WeaklyConnectedComponents, and the nodes of TopKByStrength as a single set, strongest first.
+func NodeSetSink(fn func(stage string, sets [][]string) error) AnalyticsSink {
+	return func(stage string, result any) error {
+		switch result := result.(type) {
+		case [][]string:
+			return fn(stage, result)
+		case []NodeStrength:
+			set := make([]string, len(result))
+			for i, s := range result {
+				set[i] = s.Node
+			}
+			return fn(stage, [][]string{set})
+		default:
+			return fmt.Errorf("onyx: a %T is not a node set", result)
+		}
+	}
+}
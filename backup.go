@@ -0,0 +1,86 @@
+package Onyx
+
+import (
+	"io"
+	"os"
+)
+
+// Backup writes a full, point in time backup of the graph to w, including properties,
+// the changelog and all other internal keys.
+func (g *Graph) Backup(w io.Writer) error {
+	end, err := g.begin("Backup")
+	if err != nil {
+		return err
+	}
+	defer end()
+	return g.backup(w)
+}
+
+func (g *Graph) backup(w io.Writer) error {
+	_, err := g.DB.Backup(w, 0)
+	return err
+}
+
+// Restore loads a backup written by Backup into the graph. Keys in the backup overwrite
+// existing keys, so Restore is normally used on an empty graph.
+func (g *Graph) Restore(r io.Reader) error {
+	end, err := g.begin("Restore")
+	if err != nil {
+		return err
+	}
+	defer end()
+	if err := g.DB.Load(r, 256); err != nil {
+		return err
+	}
+	if err := g.detectRedirects(); err != nil {
+		return err
+	}
+	return g.loadStorageMode()
+}
+
+// WithPersistOnClose makes Close write a backup of an in-memory graph to path, which
+// WithRestoreFrom can load again. The file is replaced atomically.
+func WithPersistOnClose(path string) Option {
+	return func(g *Graph) {
+		g.persistOnClose = path
+	}
+}
+
+// WithRestoreFrom loads the backup at path when the graph is opened. It is an error if the file doesn't exist.
+func WithRestoreFrom(path string) Option {
+	return func(g *Graph) {
+		g.restoreFrom = path
+	}
+}
+
+func (g *Graph) restoreOnOpen() error {
+	if g.restoreFrom == "" {
+		return nil
+	}
+	f, err := os.Open(g.restoreFrom)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return g.Restore(f)
+}
+
+func (g *Graph) persist() error {
+	tmp := g.persistOnClose + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = g.backup(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, g.persistOnClose)
+}
@@ -0,0 +1,235 @@
+// Package bench generates configurable read/write load against an Onyx graph and reports
+// throughput, latency percentiles and conflict retries. It only uses the public Onyx API,
+// so running it under the race detector doubles as an end to end stress test.
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Dynaclo/Onyx"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Workload describes the load to generate. It is usually loaded from a JSON file with LoadWorkload.
+type Workload struct {
+	// Duration of the measured run, as a time.ParseDuration string such as "30s".
+	Duration string `json:"duration"`
+	// Workers is the number of concurrent goroutines issuing operations.
+	Workers int `json:"workers"`
+	// ReadRatio is the fraction of operations that are reads, between 0 and 1.
+	ReadRatio float64 `json:"read_ratio"`
+	// RemoveRatio is the fraction of writes that remove an edge instead of adding one.
+	RemoveRatio float64 `json:"remove_ratio"`
+	// Nodes is the number of distinct node IDs used.
+	Nodes uint64 `json:"nodes"`
+	// ZipfS (> 1) skews which nodes are touched, and so also the degree distribution
+	// and the size of the stored edge lists: higher values concentrate edges on fewer hot nodes.
+	ZipfS float64 `json:"zipf_s"`
+	// PreloadEdges are added before the measured run to reach the target degree distribution.
+	PreloadEdges int `json:"preload_edges"`
+	// MaxRetries bounds the retries of an operation that keeps failing with a conflict.
+	MaxRetries int `json:"max_retries"`
+	// Seed makes the generated operations reproducible for a given number of workers.
+	Seed int64 `json:"seed"`
+}
+
+func (w *Workload) setDefaults() {
+	if w.Duration == "" {
+		w.Duration = "10s"
+	}
+	if w.Workers == 0 {
+		w.Workers = 4
+	}
+	if w.Nodes == 0 {
+		w.Nodes = 10000
+	}
+	if w.ZipfS == 0 {
+		w.ZipfS = 1.1
+	}
+	if w.MaxRetries == 0 {
+		w.MaxRetries = 10
+	}
+}
+
+func LoadWorkload(path string) (Workload, error) {
+	var w Workload
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return w, err
+	}
+	err = json.Unmarshal(data, &w)
+	return w, err
+}
+
+type LatencyStats struct {
+	Count int     `json:"count"`
+	P50Us float64 `json:"p50_us"`
+	P90Us float64 `json:"p90_us"`
+	P99Us float64 `json:"p99_us"`
+	MaxUs float64 `json:"max_us"`
+}
+
+type Report struct {
+	Workload        Workload                `json:"workload"`
+	ElapsedSeconds  float64                 `json:"elapsed_seconds"`
+	Ops             int                     `json:"ops"`
+	OpsPerSecond    float64                 `json:"ops_per_second"`
+	Errors          int                     `json:"errors"`
+	ConflictRetries int                     `json:"conflict_retries"`
+	Latency         map[string]LatencyStats `json:"latency"`
+	LSMBytes        int64                   `json:"lsm_bytes"`
+	VlogBytes       int64                   `json:"vlog_bytes"`
+}
+
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+type workerResult struct {
+	latencies map[string][]time.Duration
+	errors    int
+	retries   int
+}
+
+// Run preloads the graph and then generates the workload against it until the duration
+// elapses or ctx is cancelled.
+func Run(ctx context.Context, g *Onyx.Graph, w Workload) (*Report, error) {
+	w.setDefaults()
+	duration, err := time.ParseDuration(w.Duration)
+	if err != nil {
+		return nil, fmt.Errorf("bench: invalid duration: %w", err)
+	}
+	if w.ZipfS <= 1 {
+		return nil, errors.New("bench: zipf_s must be greater than 1")
+	}
+
+	rng := rand.New(rand.NewSource(w.Seed))
+	zipf := rand.NewZipf(rng, w.ZipfS, 1, w.Nodes-1)
+	for i := 0; i < w.PreloadEdges; i++ {
+		from, to := nodeID(zipf.Uint64()), nodeID(rng.Uint64()%w.Nodes)
+		if _, err := withRetries(w.MaxRetries, func() error { return g.AddEdge(from, to, nil) }); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	results := make([]workerResult, w.Workers)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < w.Workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = runWorker(ctx, g, w, w.Seed+int64(i)+1)
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	report := &Report{Workload: w, ElapsedSeconds: elapsed.Seconds(), Latency: map[string]LatencyStats{}}
+	merged := map[string][]time.Duration{}
+	for _, r := range results {
+		report.Errors += r.errors
+		report.ConflictRetries += r.retries
+		for op, l := range r.latencies {
+			merged[op] = append(merged[op], l...)
+			report.Ops += len(l)
+		}
+	}
+	for op, l := range merged {
+		report.Latency[op] = latencyStats(l)
+	}
+	report.OpsPerSecond = float64(report.Ops) / elapsed.Seconds()
+	report.LSMBytes, report.VlogBytes = g.DB.Size()
+	return report, nil
+}
+
+func runWorker(ctx context.Context, g *Onyx.Graph, w Workload, seed int64) workerResult {
+	rng := rand.New(rand.NewSource(seed))
+	zipf := rand.NewZipf(rng, w.ZipfS, 1, w.Nodes-1)
+	result := workerResult{latencies: map[string][]time.Duration{}}
+
+	for ctx.Err() == nil {
+		from := nodeID(zipf.Uint64())
+		var op string
+		var fn func() error
+		switch r := rng.Float64(); {
+		case r < w.ReadRatio:
+			op = "get_edges"
+			fn = func() error {
+				_, err := g.GetEdges(from, nil)
+				if err == badger.ErrKeyNotFound {
+					return nil
+				}
+				return err
+			}
+		case rng.Float64() < w.RemoveRatio:
+			op = "remove_edge"
+			to := nodeID(rng.Uint64() % w.Nodes)
+			fn = func() error {
+				_, err := g.RemoveEdge(from, to, nil)
+				if errors.Is(err, Onyx.ErrNodeNotFound) || errors.Is(err, Onyx.ErrEdgeNotFound) {
+					return nil
+				}
+				return err
+			}
+		default:
+			op = "add_edge"
+			to := nodeID(rng.Uint64() % w.Nodes)
+			fn = func() error { return g.AddEdge(from, to, nil) }
+		}
+
+		start := time.Now()
+		retries, err := withRetries(w.MaxRetries, fn)
+		result.latencies[op] = append(result.latencies[op], time.Since(start))
+		result.retries += retries
+		if err != nil {
+			result.errors++
+		}
+	}
+	return result
+}
+
+// withRetries runs fn until it doesn't fail with a conflict, at most maxRetries more times.
+func withRetries(maxRetries int, fn func() error) (int, error) {
+	retries := 0
+	for {
+		err := fn()
+		if err != badger.ErrConflict || retries == maxRetries {
+			return retries, err
+		}
+		retries++
+	}
+}
+
+func nodeID(i uint64) string {
+	return fmt.Sprintf("n%d", i)
+}
+
+func latencyStats(l []time.Duration) LatencyStats {
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	us := func(d time.Duration) float64 { return float64(d) / float64(time.Microsecond) }
+	percentile := func(p float64) float64 {
+		return us(l[int(p*float64(len(l)-1))])
+	}
+	return LatencyStats{
+		Count: len(l),
+		P50Us: percentile(0.5),
+		P90Us: percentile(0.9),
+		P99Us: percentile(0.99),
+		MaxUs: us(l[len(l)-1]),
+	}
+}
@@ -0,0 +1,38 @@
+package bench
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Dynaclo/Onyx"
+)
+
+func TestRunMixedWorkload(T *testing.T) {
+	graph, err := Onyx.NewGraph("", true)
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer graph.Close()
+
+	report, err := Run(context.Background(), graph, Workload{
+		Duration:     "200ms",
+		Workers:      4,
+		ReadRatio:    0.5,
+		RemoveRatio:  0.2,
+		Nodes:        50,
+		ZipfS:        1.5,
+		PreloadEdges: 100,
+	})
+	if err != nil {
+		T.Fatal(err)
+	}
+	if report.Ops == 0 || report.Errors != 0 {
+		T.Fatalf("unexpected report %+v", report)
+	}
+	for _, op := range []string{"get_edges", "add_edge", "remove_edge"} {
+		stats := report.Latency[op]
+		if stats.Count == 0 || stats.P50Us > stats.P99Us || stats.P99Us > stats.MaxUs {
+			T.Fatalf("%s: unexpected latency stats %+v", op, stats)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package Onyx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+const defaultMaxPivotDegree = 1000
+
+// NodeClass is one of the two classes of nodes of a bipartite graph, such as users and items.
+type NodeClass string
+
+// BipartiteSchema declares the node classes of a bipartite graph.
+type BipartiteSchema struct {
+	Classes [2]NodeClass
+	// ClassOf returns the class of a node from its ID, for example from a "user:" prefix.
+	// It must be cheap, as every edge write calls it, and must return one of Classes for
+	// every node of the graph.
+	ClassOf func(node string) NodeClass
+	// MaxPivotDegree skips the nodes with more neighbors than it when ProjectBipartite
+	// intersects neighborhoods through them, which bounds the work and memory per projected
+	// node. Such hubs connect nearly everything and carry little signal. Defaults to 1000.
+	MaxPivotDegree int
+}
+
+// WithBipartite makes the graph bipartite: AddEdge and SetEdges reject edges between nodes of
+// the same class, or of a class that isn't declared, with ErrNotBipartite.
+func WithBipartite(schema BipartiteSchema) Option {
+	return func(g *Graph) {
+		if schema.MaxPivotDegree == 0 {
+			schema.MaxPivotDegree = defaultMaxPivotDegree
+		}
+		g.bipartite = &schema
+	}
+}
+
+var ErrNotBipartite = errors.New("onyx: edge doesn't connect the two classes of the bipartite graph")
+
+// checkBipartiteEdge returns ErrNotBipartite if from->to doesn't join the two node classes.
+func (g *Graph) checkBipartiteEdge(from string, to string) error {
+	if g.bipartite == nil {
+		return nil
+	}
+	fromClass, toClass := g.bipartite.ClassOf(from), g.bipartite.ClassOf(to)
+	if !g.bipartite.declared(fromClass) || !g.bipartite.declared(toClass) || fromClass == toClass {
+		return fmt.Errorf("%w: %s (%q) -> %s (%q)", ErrNotBipartite, from, fromClass, to, toClass)
+	}
+	return nil
+}
+
+func (s *BipartiteSchema) declared(class NodeClass) bool {
+	return class == s.Classes[0] || class == s.Classes[1]
+}
+
+// ProjectionWeight returns the weight of the projected edge between two nodes sharing shared
+// neighbors, out of degreeA and degreeB neighbors.
+type ProjectionWeight func(shared int, degreeA int, degreeB int) float64
+
+var (
+	// ProjectionCount weighs projected edges by the number of shared neighbors.
+	ProjectionCount ProjectionWeight = func(shared int, degreeA int, degreeB int) float64 {
+		return float64(shared)
+	}
+	// ProjectionJaccard weighs projected edges by the Jaccard similarity of the neighborhoods.
+	ProjectionJaccard ProjectionWeight = func(shared int, degreeA int, degreeB int) float64 {
+		return float64(shared) / float64(degreeA+degreeB-shared)
+	}
+)
+
+// ProjectBipartite writes the one-mode projection of the nodes of class into dest: an edge in
+// both directions between every two nodes of class sharing at least minSharedNeighbors
+// neighbors, weighted by weightFn (ProjectionCount if nil, see SetEdgeWeight). Edges count in
+// both directions, so the graph must have a reverse edge index, see IndexReverseEdges.
+//
+// The projection is computed one node of class at a time, by intersecting the neighborhoods
+// of its neighbors, so memory is bounded by the two-hop neighborhood of a node; neighbors
+// above BipartiteSchema.MaxPivotDegree are skipped. dest is written in chunks of
+// transactions, see ImportJSON.
+func (g *Graph) ProjectBipartite(class NodeClass, dest *Graph, minSharedNeighbors int, weightFn ProjectionWeight) error {
+	if g.bipartite == nil {
+		return errors.New("onyx: ProjectBipartite needs a graph opened WithBipartite")
+	}
+	if !g.bipartite.declared(class) {
+		return fmt.Errorf("onyx: node class %q is not declared", class)
+	}
+	if dest == g {
+		return errors.New("onyx: ProjectBipartite can't write into the graph it projects")
+	}
+	if minSharedNeighbors < 1 {
+		minSharedNeighbors = 1
+	}
+	if weightFn == nil {
+		weightFn = ProjectionCount
+	}
+
+	end, err := g.begin("ProjectBipartite")
+	if err != nil {
+		return err
+	}
+	defer end()
+	txn := g.DB.NewTransaction(false)
+	defer txn.Discard()
+
+	state, err := readIndexStateAt(txn, reverseIndexMetaKey())
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return ErrNoReverseIndex
+	}
+	if !state.Ready {
+		return ErrReverseIndexNotReady
+	}
+
+	p := &projection{g: g, txn: txn, class: class, degrees: make(map[string]int)}
+	w := &chunkedWriter{g: dest, point: "ProjectBipartite"}
+	defer w.discard()
+
+	err = p.forEachNode(func(a string) error {
+		if g.closing() {
+			return ErrClosed
+		}
+		shared, degree, err := p.sharedNeighbors(a)
+		if err != nil {
+			return err
+		}
+		for _, b := range sortedNeighborCounts(shared) {
+			if shared[b] < minSharedNeighbors {
+				continue
+			}
+			degreeB, err := p.degree(b)
+			if err != nil {
+				return err
+			}
+			weight := weightFn(shared[b], degree, degreeB)
+			err = w.do(func(txn *badger.Txn) error {
+				for _, edge := range [][2]string{{a, b}, {b, a}} {
+					if err := dest.AddEdge(edge[0], edge[1], txn); err != nil {
+						return err
+					}
+					if err := dest.SetEdgeWeight(edge[0], edge[1], weight, txn); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		clear(p.degrees)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return w.commit()
+}
+
+type projection struct {
+	g     *Graph
+	txn   *badger.Txn
+	class NodeClass
+	// degrees caches the degrees of the nodes of class read while projecting one node.
+	degrees map[string]int
+}
+
+// neighbors returns the in- and out-neighbors of node.
+func (p *projection) neighbors(node string) (map[string]bool, error) {
+	neighbors, _, err := readEdgeMap(p.txn, node)
+	if err != nil {
+		return nil, err
+	}
+	in, _, err := p.g.inEdges(p.txn, node)
+	if err != nil {
+		return nil, err
+	}
+	for from := range in {
+		neighbors[from] = true
+	}
+	return neighbors, nil
+}
+
+func (p *projection) degree(node string) (int, error) {
+	if degree, ok := p.degrees[node]; ok {
+		return degree, nil
+	}
+	neighbors, err := p.neighbors(node)
+	if err != nil {
+		return 0, err
+	}
+	p.degrees[node] = len(neighbors)
+	return len(neighbors), nil
+}
+
+// sharedNeighbors counts the neighbors a shares with every node of class after it in key
+// order, so every pair is projected once, and returns the degree of a.
+func (p *projection) sharedNeighbors(a string) (map[string]int, int, error) {
+	pivots, err := p.neighbors(a)
+	if err != nil {
+		return nil, 0, err
+	}
+	shared := make(map[string]int)
+	for pivot := range pivots {
+		neighbors, err := p.neighbors(pivot)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(neighbors) > p.g.bipartite.MaxPivotDegree {
+			continue
+		}
+		for b := range neighbors {
+			if b > a && p.g.bipartite.ClassOf(b) == p.class {
+				shared[b]++
+			}
+		}
+	}
+	return shared, len(pivots), nil
+}
+
+// forEachNode calls fn with every node of class, both the ones with an edge list and the ones
+// that are only edge destinations, each once.
+func (p *projection) forEachNode(fn func(node string) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := newNodeIterator(p.txn, opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		node := string(it.Item().Key())
+		if p.g.bipartite.ClassOf(node) != p.class {
+			continue
+		}
+		if err := fn(node); err != nil {
+			return err
+		}
+	}
+
+	opts.Prefix = []byte(reverseEdgePrefix)
+	rev := p.txn.NewIterator(opts)
+	defer rev.Close()
+	var last []byte
+	for rev.Rewind(); rev.Valid(); rev.Next() {
+		to, _, _ := bytes.Cut(rev.Item().Key()[len(opts.Prefix):], []byte(keySep))
+		if bytes.Equal(to, last) {
+			continue
+		}
+		last = append(last[:0], to...)
+		node := string(to)
+		if p.g.bipartite.ClassOf(node) != p.class {
+			continue
+		}
+		if _, err := p.txn.Get([]byte(node)); err == nil {
+			continue
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		if err := fn(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedNeighborCounts(counts map[string]int) []string {
+	nodes := make(map[string]bool, len(counts))
+	for node := range counts {
+		nodes[node] = true
+	}
+	return sortedNeighbors(nodes)
+}
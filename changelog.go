@@ -0,0 +1,377 @@
+package Onyx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// The changelog records every edge-level mutation in the transaction that makes it, and the
+// removal of nodes, after the removal of their out-edges.
+// Records are numbered by a monotonically increasing sequence, which doubles as the
+// version of the graph: version v is the state after applying every record with Seq <= v.
+// Versions start at 1, so version 0 is the graph before any recorded change.
+// Sequence numbers are allocated from the head of the changelog, a key every transaction
+// recording changes reads and writes, so two of them running concurrently conflict and
+// records commit in sequence order: once a reader sees record N, no record below N can
+// still commit. Databases written before the head existed may have gaps in the sequence.
+//
+// Changes made while the graph is opened without WithChangelog are not recorded.
+
+type ChangeOp int
+
+const (
+	ChangeAddEdge ChangeOp = iota + 1
+	ChangeRemoveEdge
+	// ChangeRemoveNode records that From stopped being a node. To is empty.
+	ChangeRemoveNode
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangeAddEdge:
+		return "add_edge"
+	case ChangeRemoveEdge:
+		return "remove_edge"
+	case ChangeRemoveNode:
+		return "remove_node"
+	}
+	return fmt.Sprintf("ChangeOp(%d)", int(op))
+}
+
+type ChangeRecord struct {
+	Seq  uint64
+	Time time.Time
+	Op   ChangeOp
+	From string
+	To   string
+}
+
+// ErrVersionUnavailable is returned when a version is older than the retained changelog.
+type ErrVersionUnavailable struct {
+	Requested uint64
+	Earliest  uint64
+}
+
+func (e *ErrVersionUnavailable) Error() string {
+	return fmt.Sprintf("onyx: version %d is no longer in the changelog, earliest available version is %d", e.Requested, e.Earliest)
+}
+
+// WithChangelog records every edge mutation in the changelog. See NeighborDiff and Changes.
+// Transactions recording changes conflict with each other on the head of the changelog, so
+// concurrent writers see more badger.ErrConflict, which Update retries.
+func WithChangelog() Option {
+	return func(g *Graph) {
+		g.changelog = true
+	}
+}
+
+// recordChange appends a change to the changelog in txn and counts it in the mutation stats.
+// Both are no-ops unless enabled with WithChangelog and WithMutationStats.
+func (g *Graph) recordChange(txn *badger.Txn, op ChangeOp, from string, to string) error {
+	err := g.recordMutationStats(txn, op, from)
+	if err != nil || !g.changelog {
+		return err
+	}
+	head, err := changelogHead(txn)
+	if err != nil {
+		return err
+	}
+
+	record := ChangeRecord{Seq: head + 1, Time: time.Now().UTC(), Op: op, From: from, To: to}
+	return writeChangeRecord(txn, record)
+}
+
+// changelogHead returns the sequence number of the latest record, or of the last pruned one
+// if none is left. Databases written before the head key existed fall back to the last record.
+func changelogHead(txn *badger.Txn) (uint64, error) {
+	item, err := txn.Get(metaKey(metaChangelogHeadKey))
+	if err == nil {
+		var head uint64
+		err = item.Value(func(val []byte) error {
+			head = binary.BigEndian.Uint64(val)
+			return nil
+		})
+		return head, err
+	} else if err != badger.ErrKeyNotFound {
+		return 0, err
+	}
+
+	head, err := earliestVersion(txn)
+	if err != nil {
+		return 0, err
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(changelogPrefix)
+	opts.PrefetchValues = false
+	opts.Reverse = true
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	// Seeking to the largest possible sequence finds the last record when iterating in reverse.
+	it.Seek(changelogKey(^uint64(0)))
+	if it.Valid() {
+		key := it.Item().Key()
+		head = max(head, binary.BigEndian.Uint64(key[len(changelogPrefix):]))
+	}
+	return head, nil
+}
+
+func writeChangeRecord(txn *badger.Txn, record ChangeRecord) error {
+	head, err := changelogHead(txn)
+	if err != nil {
+		return err
+	}
+	b := new(bytes.Buffer)
+	err = gob.NewEncoder(b).Encode(record)
+	if err != nil {
+		return err
+	}
+	err = txn.Set(changelogKey(record.Seq), b.Bytes())
+	if err != nil {
+		return err
+	}
+	err = txn.Set(changelogNodeKey(record.From, record.Seq), nil)
+	if err != nil || head >= record.Seq {
+		return err
+	}
+	return txn.Set(metaKey(metaChangelogHeadKey), binary.BigEndian.AppendUint64(nil, record.Seq))
+}
+
+func decodeChangeRecord(item *badger.Item) (ChangeRecord, error) {
+	var record ChangeRecord
+	err := item.Value(func(val []byte) error {
+		return gob.NewDecoder(bytes.NewReader(val)).Decode(&record)
+	})
+	return record, err
+}
+
+// earliestVersion returns the oldest version the changelog can still answer questions about.
+func earliestVersion(txn *badger.Txn) (uint64, error) {
+	item, err := txn.Get(metaKey(metaChangelogPrunedKey))
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var earliest uint64
+	err = item.Value(func(val []byte) error {
+		earliest = binary.BigEndian.Uint64(val)
+		return nil
+	})
+	return earliest, err
+}
+
+// CurrentVersion returns the sequence number of the latest change in the changelog. Every
+// record up to it is visible to txn: records below it can't commit later.
+func (g *Graph) CurrentVersion(txn *badger.Txn) (uint64, error) {
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("CurrentVersion")
+		if err != nil {
+			return 0, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	return changelogHead(txn)
+}
+
+// Changes calls fn with every retained change record with Seq > since, in sequence order.
+func (g *Graph) Changes(since uint64, fn func(record ChangeRecord) error, txn *badger.Txn) error {
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("Changes")
+		if err != nil {
+			return err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	earliest, err := earliestVersion(txn)
+	if err != nil {
+		return err
+	}
+	if since < earliest {
+		return &ErrVersionUnavailable{Requested: since, Earliest: earliest}
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(changelogPrefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Seek(changelogKey(since + 1)); it.Valid(); it.Next() {
+		record, err := decodeChangeRecord(it.Item())
+		if err != nil {
+			return err
+		}
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+	}
+	it.Close()
+
+	return nil
+}
+
+// NeighborDiff returns the out-edges of node that were added and removed between fromVersion
+// and toVersion, by folding the changelog records for node. An edge that was added and then
+// removed again in between shows up in neither list.
+func (g *Graph) NeighborDiff(node string, fromVersion uint64, toVersion uint64, txn *badger.Txn) (added []string, removed []string, err error) {
+	node = g.nodeID(node)
+	if toVersion < fromVersion {
+		return nil, nil, fmt.Errorf("onyx: NeighborDiff from version %d is after to version %d", fromVersion, toVersion)
+	}
+
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("NeighborDiff")
+		if err != nil {
+			return nil, nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	earliest, err := earliestVersion(txn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fromVersion < earliest {
+		return nil, nil, &ErrVersionUnavailable{Requested: fromVersion, Earliest: earliest}
+	}
+
+	// For every neighbor, whether it existed at fromVersion and whether it exists at toVersion.
+	// Only actual changes are logged, so the first op tells the state before it.
+	type span struct{ before, after bool }
+	spans := make(map[string]*span)
+	var order []string
+
+	prefix := []byte(changelogNodePrefix + node + keySep)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	for it.Seek(changelogNodeKey(node, fromVersion+1)); it.Valid(); it.Next() {
+		seq := binary.BigEndian.Uint64(it.Item().Key()[len(prefix):])
+		if seq > toVersion {
+			break
+		}
+		item, err := txn.Get(changelogKey(seq))
+		if err != nil {
+			it.Close()
+			return nil, nil, err
+		}
+		record, err := decodeChangeRecord(item)
+		if err != nil {
+			it.Close()
+			return nil, nil, err
+		}
+		if record.Op == ChangeRemoveNode {
+			// The out-edges of the node were removed by the records before.
+			continue
+		}
+
+		s, ok := spans[record.To]
+		if !ok {
+			s = &span{before: record.Op == ChangeRemoveEdge}
+			spans[record.To] = s
+			order = append(order, record.To)
+		}
+		s.after = record.Op == ChangeAddEdge
+	}
+	it.Close()
+
+	for _, to := range order {
+		s := spans[to]
+		if !s.before && s.after {
+			added = append(added, to)
+		} else if s.before && !s.after {
+			removed = append(removed, to)
+		}
+	}
+
+	return added, removed, nil
+}
+
+// PruneChangelog deletes change records older than before, in batches of separate transactions,
+// and returns how many were deleted. Versions older than the last pruned record become unavailable.
+func (g *Graph) PruneChangelog(before time.Time) (int, error) {
+	end, err := g.begin("PruneChangelog")
+	if err != nil {
+		return 0, err
+	}
+	defer end()
+
+	const batchSize = 1000
+	pruned := 0
+	for {
+		if g.closing() {
+			return pruned, ErrClosed
+		}
+		if err := g.faultPoint("PruneChangelog"); err != nil {
+			return pruned, err
+		}
+		n, done, err := g.pruneChangelogBatch(before, batchSize)
+		pruned += n
+		if err != nil || done {
+			return pruned, err
+		}
+	}
+}
+
+func (g *Graph) pruneChangelogBatch(before time.Time, batchSize int) (int, bool, error) {
+	txn := g.DB.NewTransaction(true)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(changelogPrefix)
+	it := txn.NewIterator(opts)
+	var records []ChangeRecord
+	done := true
+	for it.Rewind(); it.Valid(); it.Next() {
+		record, err := decodeChangeRecord(it.Item())
+		if err != nil {
+			it.Close()
+			return 0, false, err
+		}
+		if !record.Time.Before(before) {
+			break
+		}
+		if len(records) == batchSize {
+			done = false
+			break
+		}
+		records = append(records, record)
+	}
+	it.Close()
+
+	if len(records) == 0 {
+		return 0, true, nil
+	}
+	for _, record := range records {
+		if err := txn.Delete(changelogKey(record.Seq)); err != nil {
+			return 0, false, err
+		}
+		if err := txn.Delete(changelogNodeKey(record.From, record.Seq)); err != nil {
+			return 0, false, err
+		}
+	}
+	lastPruned := binary.BigEndian.AppendUint64(nil, records[len(records)-1].Seq)
+	if err := txn.Set(metaKey(metaChangelogPrunedKey), lastPruned); err != nil {
+		return 0, false, err
+	}
+	return len(records), done, txn.Commit()
+}
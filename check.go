@@ -0,0 +1,190 @@
+package Onyx
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+type CheckLevel int
+
+const (
+	// CheckOff skips all verification on open.
+	CheckOff CheckLevel = iota
+	// CheckQuick verifies the metadata keys and that the journal is empty, and decodes
+	// a bounded sample of edge lists.
+	CheckQuick
+	// CheckFull runs CheckIntegrity over the whole graph.
+	CheckFull
+)
+
+// quickCheckSampleSize bounds the number of values CheckQuick decodes, regardless of graph size.
+const quickCheckSampleSize = 256
+
+func (l CheckLevel) String() string {
+	switch l {
+	case CheckOff:
+		return "off"
+	case CheckQuick:
+		return "quick"
+	case CheckFull:
+		return "full"
+	}
+	return fmt.Sprintf("CheckLevel(%d)", int(l))
+}
+
+type ConsistencyProblem struct {
+	Key    string
+	Reason string
+}
+
+type ConsistencyReport struct {
+	Level       CheckLevel
+	KeysChecked int
+	Problems    []ConsistencyProblem
+}
+
+func (r *ConsistencyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *ConsistencyReport) addProblem(key []byte, format string, args ...any) {
+	r.Problems = append(r.Problems, ConsistencyProblem{Key: string(key), Reason: fmt.Sprintf(format, args...)})
+}
+
+// ErrConsistency is returned by NewGraph when the open check finds problems.
+type ErrConsistency struct {
+	Report ConsistencyReport
+}
+
+func (e *ErrConsistency) Error() string {
+	reasons := make([]string, 0, len(e.Report.Problems))
+	for _, p := range e.Report.Problems {
+		reasons = append(reasons, fmt.Sprintf("%q: %s", p.Key, p.Reason))
+	}
+	return fmt.Sprintf("onyx: %s consistency check failed with %d problem(s): %s",
+		e.Report.Level, len(e.Report.Problems), strings.Join(reasons, "; "))
+}
+
+// CheckIntegrity decodes every edge list in the graph and verifies the metadata keys.
+func (g *Graph) CheckIntegrity(txn *badger.Txn) (ConsistencyReport, error) {
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("CheckIntegrity")
+		if err != nil {
+			return ConsistencyReport{}, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	report := ConsistencyReport{Level: CheckFull}
+	checkMetadata(txn, &report)
+	checkJournal(txn, &report)
+
+	it := newNodeIterator(txn, badger.DefaultIteratorOptions)
+	for it.Rewind(); it.Valid(); it.Next() {
+		if err := checkEdgeListItem(it.Item(), &report); err != nil {
+			it.Close()
+			return report, err
+		}
+	}
+	it.Close()
+
+	return report, nil
+}
+
+func (g *Graph) quickCheck(txn *badger.Txn) (ConsistencyReport, error) {
+	report := ConsistencyReport{Level: CheckQuick}
+	checkMetadata(txn, &report)
+	checkJournal(txn, &report)
+
+	// Sample from the start of the keyspace and from the left boundary of every
+	// table, so the sample is spread over the graph instead of its first keys.
+	seeks := [][]byte{nodeKeyStart}
+	for _, t := range g.DB.Tables() {
+		// Table boundaries are stored with an 8 byte version suffix.
+		if len(t.Left) > 8 && !isInternalKey(t.Left) {
+			seeks = append(seeks, t.Left[:len(t.Left)-8])
+		}
+	}
+	perSeek := quickCheckSampleSize / len(seeks)
+	if perSeek == 0 {
+		perSeek = 1
+		seeks = seeks[:quickCheckSampleSize]
+	}
+
+	it := newNodeIterator(txn, badger.DefaultIteratorOptions)
+	defer it.Close()
+	seen := make(map[string]bool)
+	for _, seek := range seeks {
+		n := 0
+		for it.Seek(seek); it.Valid() && n < perSeek; it.Next() {
+			item := it.Item()
+			n++
+			if seen[string(item.Key())] {
+				continue
+			}
+			seen[string(item.Key())] = true
+			if err := checkEdgeListItem(item, &report); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// checkJournal reports journal entries, which NewGraph should have resumed and finished.
+func checkJournal(txn *badger.Txn, report *ConsistencyReport) {
+	entries, err := readJournal(txn)
+	if err != nil {
+		report.addProblem([]byte(journalPrefix), "unreadable journal: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		report.addProblem(journalKey(entry.ID), "unfinished %s(%q) in the journal", entry.Op, entry.Arg)
+	}
+}
+
+func checkMetadata(txn *badger.Txn, report *ConsistencyReport) {
+	key := metaKey(metaFormatKey)
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		report.addProblem(key, "missing format metadata")
+		return
+	} else if err != nil {
+		report.addProblem(key, "unreadable: %v", err)
+		return
+	}
+	report.KeysChecked++
+
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		report.addProblem(key, "unreadable: %v", err)
+		return
+	}
+	if len(val) != 1 || val[0] == 0 || int(val[0]) > latestFormatVersion() {
+		report.addProblem(key, "unknown format version %v", val)
+	}
+}
+
+// checkEdgeListItem records a problem for undecodable values. The returned error is
+// reserved for storage errors, which abort the check.
+func checkEdgeListItem(item *badger.Item, report *ConsistencyReport) error {
+	report.KeysChecked++
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	// The edge list of a node in StoragePerEdge layout is in its edge keys.
+	if len(val) == 0 {
+		return nil
+	}
+	if _, err := deserializeEdgeMap(val); err != nil {
+		report.addProblem(item.Key(), "undecodable edge list: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+// Command onyx provides maintenance and benchmarking tools for Onyx graph databases.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/Dynaclo/Onyx"
+	"github.com/Dynaclo/Onyx/bench"
+	"github.com/Dynaclo/Onyx/onyxhttp"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: onyx <command> [flags]
+
+commands:
+  bench    run a workload against a database and print a JSON report
+  compact  reclaim the space held by deleted data within a time budget
+  explain  run a BFS and print how it was executed
+  gateway  serve the read-only HTTP API with response caching
+  run      run a saved query, onyx run <name> --db path --param name=value`)
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "bench":
+		err = runBench(os.Args[2:])
+	case "compact":
+		err = runCompact(os.Args[2:])
+	case "explain":
+		err = runExplain(os.Args[2:])
+	case "gateway":
+		err = runGateway(os.Args[2:])
+	case "run":
+		err = runQuery(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "onyx:", err)
+		os.Exit(1)
+	}
+}
+
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	dbPath := fs.String("db", "", "database directory, empty for an in-memory graph")
+	workloadPath := fs.String("workload", "", "workload JSON file")
+	fs.Parse(args)
+
+	var workload bench.Workload
+	if *workloadPath != "" {
+		var err error
+		workload, err = bench.LoadWorkload(*workloadPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	graph, err := Onyx.NewGraph(*dbPath, *dbPath == "")
+	if err != nil {
+		return err
+	}
+	defer graph.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := bench.Run(ctx, graph, workload)
+	if err != nil {
+		return err
+	}
+	return report.WriteJSON(os.Stdout)
+}
+
+type compactReport struct {
+	Before Onyx.CompactionReport `json:"before"`
+	Result Onyx.ReclaimResult    `json:"result"`
+	After  Onyx.CompactionReport `json:"after"`
+}
+
+func runCompact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	dbPath := fs.String("db", "", "database directory")
+	maxDuration := fs.Duration("max-duration", 10*time.Minute, "time budget for reclaiming space")
+	fs.Parse(args)
+	if *dbPath == "" {
+		return errors.New("compact: --db is required")
+	}
+
+	graph, err := Onyx.NewGraph(*dbPath, false)
+	if err != nil {
+		return err
+	}
+	defer graph.Close()
+
+	var report compactReport
+	report.Before, err = graph.CompactionReport()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report.Result, err = graph.ReclaimSpaceWithResult(ctx, *maxDuration)
+	if err != nil {
+		return err
+	}
+	report.After, err = graph.CompactionReport()
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func runExplain(args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	dbPath := fs.String("db", "", "database directory")
+	from := fs.String("from", "", "start node of the traversal")
+	depth := fs.Int("depth", 0, "maximum depth, 0 for no limit")
+	maxFanout := fs.Int("max-fanout", 0, "maximum neighbors expanded per node, 0 for no limit")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+	if *dbPath == "" || *from == "" {
+		return errors.New("explain: --db and --from are required")
+	}
+
+	graph, err := Onyx.NewGraph(*dbPath, false)
+	if err != nil {
+		return err
+	}
+	defer graph.Close()
+
+	opts := Onyx.TraversalOptions{MaxDepth: *depth, Explain: true}
+	opts.MaxFanoutPerNode = *maxFanout
+	result, err := graph.BFS(*from, opts, nil)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result.Explain)
+	}
+	return result.Explain.WriteText(os.Stdout)
+}
+
+func runGateway(args []string) error {
+	fs := flag.NewFlagSet("gateway", flag.ExitOnError)
+	dbPath := fs.String("db", "", "database directory")
+	addr := fs.String("addr", ":8080", "address to listen on")
+	maxStaleness := fs.Duration("max-staleness", 0, "serve reads from a snapshot at most this old, 0 for fresh reads")
+	cacheEntries := fs.Int("cache-entries", onyxhttp.DefaultCacheEntries, "number of rendered responses to cache")
+	fs.Parse(args)
+	if *dbPath == "" {
+		return errors.New("gateway: --db is required")
+	}
+
+	var opts []Onyx.Option
+	if *maxStaleness > 0 {
+		opts = append(opts, Onyx.WithSnapshotPool(*maxStaleness))
+	}
+	graph, err := Onyx.NewGraph(*dbPath, false, opts...)
+	if err != nil {
+		return err
+	}
+	defer graph.Close()
+
+	server := &http.Server{Addr: *addr, Handler: onyxhttp.NewGateway(graph, onyxhttp.WithCacheEntries(*cacheEntries))}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// queryParams collects repeated --param name=value flags.
+type queryParams map[string]string
+
+func (p queryParams) String() string {
+	return fmt.Sprint(map[string]string(p))
+}
+
+func (p queryParams) Set(value string) error {
+	name, v, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("parameter %q is not name=value", value)
+	}
+	p[name] = v
+	return nil
+}
+
+func runQuery(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New("run: usage: onyx run <name> --db path [--param name=value ...]")
+	}
+	name := args[0]
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	dbPath := fs.String("db", "", "database directory")
+	params := make(queryParams)
+	fs.Var(params, "param", "query parameter as name=value, may be repeated")
+	fs.Parse(args[1:])
+	if *dbPath == "" {
+		return errors.New("run: --db is required")
+	}
+
+	graph, err := Onyx.NewGraph(*dbPath, false)
+	if err != nil {
+		return err
+	}
+	defer graph.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	result, err := graph.RunSavedQueryContext(ctx, name, params)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
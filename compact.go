@@ -0,0 +1,211 @@
+package Onyx
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// vlogGCDiscardRatio is the fraction of a value log file that must be stale for ReclaimSpace
+// to rewrite it.
+const vlogGCDiscardRatio = 0.5
+
+const flattenWorkers = 2
+
+// CompactionReport estimates how much of the database is stale data that compaction and
+// value log garbage collection could reclaim. Data still in the memtables isn't included.
+type CompactionReport struct {
+	Tables int
+	// Levels is the number of LSM levels holding tables. Flattening leaves one.
+	Levels int
+	// LSMBytes is the on-disk size of the tables, StaleLSMBytes the part of it holding
+	// overwritten and deleted keys, according to the table metadata.
+	LSMBytes      int64
+	StaleLSMBytes int64
+	// VlogBytes is the size of the value log files, StaleVlogBytes the part of it the
+	// discard stats of the value log record as no longer referenced.
+	VlogBytes      int64
+	StaleVlogBytes int64
+}
+
+// ReclaimableBytes is the estimated total of stale data.
+func (r CompactionReport) ReclaimableBytes() int64 {
+	return r.StaleLSMBytes + r.StaleVlogBytes
+}
+
+// ReclaimResult is the outcome of ReclaimSpaceWithResult.
+type ReclaimResult struct {
+	// BytesReclaimed is how much smaller the database files are afterwards.
+	BytesReclaimed int64
+	// VlogFilesRewritten is the number of value log files garbage collected.
+	VlogFilesRewritten int
+	Flattened          bool
+	// MoreWork is set when the time budget ran out before the value log was fully collected.
+	MoreWork bool
+}
+
+// CompactionReport reads the table metadata and value log discard stats of the database.
+func (g *Graph) CompactionReport() (CompactionReport, error) {
+	var report CompactionReport
+	levels := make(map[int]bool)
+	for _, table := range g.DB.Tables() {
+		report.Tables++
+		levels[table.Level] = true
+		report.LSMBytes += int64(table.OnDiskSize)
+		report.StaleLSMBytes += int64(table.StaleDataSize)
+	}
+	report.Levels = len(levels)
+
+	if g.inMemory {
+		return report, nil
+	}
+	opts := g.DB.Opts()
+	vlogs, err := filepath.Glob(filepath.Join(opts.ValueDir, "*.vlog"))
+	if err != nil {
+		return report, err
+	}
+	for _, name := range vlogs {
+		info, err := os.Stat(name)
+		if errors.Is(err, os.ErrNotExist) {
+			// Removed by a concurrent garbage collection.
+			continue
+		} else if err != nil {
+			return report, err
+		}
+		report.VlogBytes += allocatedSize(info)
+	}
+	report.StaleVlogBytes, err = readDiscardStats(opts.ValueDir)
+	return report, err
+}
+
+// readDiscardStats sums the stale bytes badger records per value log file in its DISCARD
+// file: 16 byte slots holding the file ID and the discarded bytes, both big endian, up to
+// the first empty slot. badger doesn't export the stats, so this reads the file it keeps
+// memory mapped; a missing file means nothing was discarded yet.
+func readDiscardStats(dir string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "DISCARD"))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var stale int64
+	for off := 0; off+16 <= len(data); off += 16 {
+		if binary.BigEndian.Uint64(data[off:]) == 0 {
+			break
+		}
+		stale += int64(binary.BigEndian.Uint64(data[off+8:]))
+	}
+	return stale, nil
+}
+
+// diskUsage returns the size of the table and value log files, or of the tables in memory
+// for in-memory graphs.
+func (g *Graph) diskUsage() (int64, error) {
+	if g.inMemory {
+		report, err := g.CompactionReport()
+		return report.LSMBytes, err
+	}
+	var size int64
+	opts := g.DB.Opts()
+	for _, dir := range []string{opts.Dir, opts.ValueDir} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return 0, err
+		}
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name(), ".sst") && !strings.HasSuffix(entry.Name(), ".vlog") {
+				continue
+			}
+			info, err := entry.Info()
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return 0, err
+			}
+			size += allocatedSize(info)
+		}
+		if opts.ValueDir == opts.Dir {
+			break
+		}
+	}
+	return size, nil
+}
+
+// ReclaimSpace compacts the LSM tree into one level if it holds stale data, then garbage
+// collects value log files until none is worth rewriting or maxDuration has passed.
+// Both run online, so readers and writers can keep using the graph. Flattening can't be
+// interrupted: it is only started with time left, but can overrun the budget by the time
+// it takes. Cancelling ctx stops between value log files, like running out of time.
+// See ReclaimSpaceWithResult for what was reclaimed.
+func (g *Graph) ReclaimSpace(ctx context.Context, maxDuration time.Duration) error {
+	_, err := g.ReclaimSpaceWithResult(ctx, maxDuration)
+	return err
+}
+
+// ReclaimSpaceWithResult is ReclaimSpace and reports the bytes reclaimed and whether work
+// is left.
+func (g *Graph) ReclaimSpaceWithResult(ctx context.Context, maxDuration time.Duration) (ReclaimResult, error) {
+	var result ReclaimResult
+	ctx, end, err := g.track(ctx, "ReclaimSpace")
+	if err != nil {
+		return result, err
+	}
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, maxDuration)
+	defer cancel()
+
+	before, err := g.diskUsage()
+	if err != nil {
+		return result, err
+	}
+	report, err := g.CompactionReport()
+	if err != nil {
+		return result, err
+	}
+
+	if report.StaleLSMBytes > 0 && ctx.Err() == nil {
+		if err := g.DB.Flatten(flattenWorkers); err != nil {
+			return result, err
+		}
+		result.Flattened = true
+	}
+
+	if !g.inMemory {
+		for {
+			if ctx.Err() != nil {
+				result.MoreWork = true
+				if context.Cause(ctx) == ErrClosed {
+					return result, ErrClosed
+				}
+				break
+			}
+			err := g.DB.RunValueLogGC(vlogGCDiscardRatio)
+			if err == badger.ErrNoRewrite {
+				break
+			} else if err == badger.ErrRejected {
+				// Another garbage collection is running, it is left to finish the work.
+				result.MoreWork = true
+				break
+			} else if err != nil {
+				return result, err
+			}
+			result.VlogFilesRewritten++
+		}
+	}
+
+	after, err := g.diskUsage()
+	if err != nil {
+		return result, err
+	}
+	if after < before {
+		result.BytesReclaimed = before - after
+	}
+	return result, nil
+}
@@ -0,0 +1,111 @@
+package Onyx
+
+import (
+	"sort"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// WeaklyConnectedComponents returns the weakly connected components of the graph: the sets of
+// nodes connected by edges in either direction. Every component is sorted, and the components
+// are sorted by decreasing size, then by their first node. Redirected neighbors count as their
+// canonical node.
+func (g *Graph) WeaklyConnectedComponents(txn *badger.Txn) ([][]string, error) {
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("WeaklyConnectedComponents")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	pass := newComponentsPass(g, txn)
+	if err := forEachEdgeList(txn, pass.consume); err != nil {
+		return nil, err
+	}
+	return pass.finish(), nil
+}
+
+// ComponentsStage is WeaklyConnectedComponents as a stage of an AnalyticsPipeline. Its result
+// is the [][]string of the components.
+func ComponentsStage() AnalyticsStage {
+	return AnalyticsStage{
+		Name: "components",
+		Pass: func(g *Graph, txn *badger.Txn) (func(string, map[string]bool) error, func() (any, error)) {
+			pass := newComponentsPass(g, txn)
+			return pass.consume, func() (any, error) {
+				return pass.finish(), nil
+			}
+		},
+	}
+}
+
+// componentsPass unions the nodes of every edge over one scan of the edge lists.
+type componentsPass struct {
+	resolver *redirectResolver
+	index    map[string]int
+	nodes    []string
+	parent   []int
+}
+
+func newComponentsPass(g *Graph, txn *badger.Txn) *componentsPass {
+	return &componentsPass{resolver: g.newRedirectResolver(txn), index: make(map[string]int)}
+}
+
+func (p *componentsPass) nodeIndex(node string) int {
+	i, ok := p.index[node]
+	if !ok {
+		i = len(p.nodes)
+		p.index[node] = i
+		p.nodes = append(p.nodes, node)
+		p.parent = append(p.parent, i)
+	}
+	return i
+}
+
+func (p *componentsPass) root(i int) int {
+	for p.parent[i] != i {
+		p.parent[i] = p.parent[p.parent[i]]
+		i = p.parent[i]
+	}
+	return i
+}
+
+func (p *componentsPass) consume(from string, dstNodes map[string]bool) error {
+	neighbors, err := p.resolver.resolveNeighbors(dstNodes)
+	if err != nil {
+		return err
+	}
+	src := p.root(p.nodeIndex(from))
+	for neighbor := range neighbors {
+		dst := p.root(p.nodeIndex(neighbor))
+		if dst != src {
+			p.parent[dst] = src
+		}
+	}
+	return nil
+}
+
+func (p *componentsPass) finish() [][]string {
+	byRoot := make(map[int][]string)
+	for i, node := range p.nodes {
+		root := p.root(i)
+		byRoot[root] = append(byRoot[root], node)
+	}
+	components := make([][]string, 0, len(byRoot))
+	for _, component := range byRoot {
+		sort.Strings(component)
+		components = append(components, component)
+	}
+	sort.Slice(components, func(i, j int) bool {
+		if len(components[i]) != len(components[j]) {
+			return len(components[i]) > len(components[j])
+		}
+		return components[i][0] < components[j][0]
+	})
+	return components
+}
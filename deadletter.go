@@ -0,0 +1,238 @@
+package Onyx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Dead letters are mutations that failed after their caller stopped waiting for them, or
+// after every retry. Each one is written in its own transaction under a unique key in the
+// dead letter keyspace, so persisting it can't conflict with the keys that made it fail.
+
+type DeadLetter struct {
+	ID        uint64
+	Time      time.Time
+	Mutations []Mutation
+	// Error is the error of the last failed attempt.
+	Error    string
+	Attempts int
+}
+
+func deadLetterKey(id uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(deadLetterPrefix), id)
+}
+
+// lastDeadLetterID makes IDs unique when several dead letters are written in the same nanosecond.
+var lastDeadLetterID atomic.Uint64
+
+func newDeadLetterID() uint64 {
+	for {
+		last := lastDeadLetterID.Load()
+		id := uint64(time.Now().UnixNano())
+		if id <= last {
+			id = last + 1
+		}
+		if lastDeadLetterID.CompareAndSwap(last, id) {
+			return id
+		}
+	}
+}
+
+func writeDeadLetter(txn *badger.Txn, dl *DeadLetter) error {
+	b := new(bytes.Buffer)
+	err := gob.NewEncoder(b).Encode(dl)
+	if err != nil {
+		return err
+	}
+	return txn.Set(deadLetterKey(dl.ID), b.Bytes())
+}
+
+func decodeDeadLetter(item *badger.Item) (DeadLetter, error) {
+	var dl DeadLetter
+	err := item.Value(func(val []byte) error {
+		return gob.NewDecoder(bytes.NewReader(val)).Decode(&dl)
+	})
+	return dl, err
+}
+
+// deadLetter persists mutations that failed with cause and returns cause, combined with the
+// error of persisting them if that failed too.
+func (g *Graph) deadLetter(mutations []Mutation, cause error) error {
+	dl := &DeadLetter{
+		ID:        newDeadLetterID(),
+		Time:      time.Now().UTC(),
+		Mutations: mutations,
+		Error:     cause.Error(),
+		Attempts:  1,
+	}
+	err := g.DB.Update(func(txn *badger.Txn) error {
+		return writeDeadLetter(txn, dl)
+	})
+	if err != nil {
+		return errors.Join(cause, fmt.Errorf("onyx: writing dead letter: %w", err))
+	}
+	g.metrics.deadLetters.Add(1)
+	return cause
+}
+
+// countDeadLetters initializes the dead letter depth metric.
+func (g *Graph) countDeadLetters() error {
+	return g.DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(deadLetterPrefix)
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		var n int64
+		for it.Rewind(); it.Valid(); it.Next() {
+			n++
+		}
+		g.metrics.deadLetters.Store(n)
+		return nil
+	})
+}
+
+// DeadLetters calls fn with every dead letter, oldest first.
+func (g *Graph) DeadLetters(fn func(dl DeadLetter) error, txn *badger.Txn) error {
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("DeadLetters")
+		if err != nil {
+			return err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(deadLetterPrefix)
+	it := txn.NewIterator(opts)
+	for it.Rewind(); it.Valid(); it.Next() {
+		dl, err := decodeDeadLetter(it.Item())
+		if err == nil {
+			err = fn(dl)
+		}
+		if err != nil {
+			it.Close()
+			return err
+		}
+	}
+	it.Close()
+
+	return nil
+}
+
+// RetryDeadLetters applies every dead letter again, each in its own transaction. Dead letters
+// that succeed are deleted, the others keep their place with the new error and attempt count.
+// It returns how many succeeded.
+func (g *Graph) RetryDeadLetters() (int, error) {
+	end, err := g.begin("RetryDeadLetters")
+	if err != nil {
+		return 0, err
+	}
+	defer end()
+
+	var letters []DeadLetter
+	err = g.DeadLetters(func(dl DeadLetter) error {
+		letters = append(letters, dl)
+		return nil
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	succeeded := 0
+	for _, dl := range letters {
+		if g.closing() {
+			return succeeded, ErrClosed
+		}
+		applyErr := g.applyMutations(dl.Mutations)
+		err = g.DB.Update(func(txn *badger.Txn) error {
+			if applyErr == nil {
+				return txn.Delete(deadLetterKey(dl.ID))
+			}
+			dl.Error = applyErr.Error()
+			dl.Attempts++
+			return writeDeadLetter(txn, &dl)
+		})
+		if err != nil {
+			return succeeded, err
+		}
+		if applyErr == nil {
+			succeeded++
+			g.metrics.deadLetters.Add(-1)
+		}
+	}
+	return succeeded, nil
+}
+
+// PurgeDeadLetters deletes the dead letters written before before and returns how many were deleted.
+func (g *Graph) PurgeDeadLetters(before time.Time) (int, error) {
+	end, err := g.begin("PurgeDeadLetters")
+	if err != nil {
+		return 0, err
+	}
+	defer end()
+
+	purged := 0
+	for {
+		if g.closing() {
+			return purged, ErrClosed
+		}
+		if err := g.faultPoint("PurgeDeadLetters"); err != nil {
+			return purged, err
+		}
+		n, done, err := g.purgeDeadLettersBatch(before, 1000)
+		purged += n
+		if err != nil || done {
+			return purged, err
+		}
+	}
+}
+
+func (g *Graph) purgeDeadLettersBatch(before time.Time, batchSize int) (int, bool, error) {
+	txn := g.DB.NewTransaction(true)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(deadLetterPrefix)
+	it := txn.NewIterator(opts)
+	var keys [][]byte
+	done := true
+	for it.Rewind(); it.Valid(); it.Next() {
+		dl, err := decodeDeadLetter(it.Item())
+		if err != nil {
+			it.Close()
+			return 0, false, err
+		}
+		if !dl.Time.Before(before) {
+			continue
+		}
+		if len(keys) == batchSize {
+			done = false
+			break
+		}
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+	it.Close()
+
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return 0, false, err
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return 0, false, err
+	}
+	g.metrics.deadLetters.Add(-int64(len(keys)))
+	return len(keys), done, nil
+}
@@ -0,0 +1,166 @@
+package Onyx
+
+import (
+	"math"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// DegreeStats summarizes the degrees and strengths of the nodes of the graph. Nodes are the
+// nodes with an edge list or an incoming edge, and redirected neighbors count as their
+// canonical node. The strength of a node is the sum of the weights of its edges, see
+// OutStrength.
+type DegreeStats struct {
+	Nodes        int
+	Edges        int
+	MaxOutDegree int
+	MaxInDegree  int
+	// MeanDegree is Edges / Nodes, the mean of both the out and the in-degrees.
+	MeanDegree float64
+	// OutDegrees and InDegrees count the nodes of every degree.
+	OutDegrees map[int]int
+	InDegrees  map[int]int
+
+	MaxOutStrength float64
+	MaxInStrength  float64
+	// TotalStrength is the sum of the weights of all edges, MeanStrength is TotalStrength / Nodes.
+	TotalStrength float64
+	MeanStrength  float64
+	// OutStrengths and InStrengths count the nodes of every strength rounded down to an
+	// integer, so on an unweighted graph they are OutDegrees and InDegrees.
+	OutStrengths map[int]int
+	InStrengths  map[int]int
+}
+
+// DegreeStats computes the DegreeStats of the graph. Like TopKByStrength it fails with an
+// *ErrInvalidStrength on a weight that is not a finite number.
+func (g *Graph) DegreeStats(txn *badger.Txn) (*DegreeStats, error) {
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("DegreeStats")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	pass := newDegreePass(g, txn)
+	if err := forEachEdgeList(txn, pass.consume); err != nil {
+		return nil, err
+	}
+	return pass.finish(), nil
+}
+
+// DegreeStatsStage is DegreeStats as a stage of an AnalyticsPipeline. Its result is the
+// *DegreeStats.
+func DegreeStatsStage() AnalyticsStage {
+	return AnalyticsStage{
+		Name: "degree-stats",
+		Pass: func(g *Graph, txn *badger.Txn) (func(string, map[string]bool) error, func() (any, error)) {
+			pass := newDegreePass(g, txn)
+			return pass.consume, func() (any, error) {
+				return pass.finish(), nil
+			}
+		},
+	}
+}
+
+// degreePass counts the degrees and sums the strengths of the nodes over one scan of the
+// edge lists.
+type degreePass struct {
+	txn         *badger.Txn
+	resolver    *redirectResolver
+	out         map[string]int
+	in          map[string]int
+	outStrength map[string]float64
+	inStrength  map[string]float64
+	total       float64
+}
+
+func newDegreePass(g *Graph, txn *badger.Txn) *degreePass {
+	return &degreePass{
+		txn:         txn,
+		resolver:    g.newRedirectResolver(txn),
+		out:         make(map[string]int),
+		in:          make(map[string]int),
+		outStrength: make(map[string]float64),
+		inStrength:  make(map[string]float64),
+	}
+}
+
+func (p *degreePass) consume(from string, dstNodes map[string]bool) error {
+	neighbors, err := p.resolver.resolveNeighbors(dstNodes)
+	if err != nil {
+		return err
+	}
+	p.out[from] = len(neighbors)
+	for neighbor := range neighbors {
+		p.in[neighbor]++
+	}
+
+	// The weights are stored under the IDs the edge list holds, before resolving redirects.
+	for _, to := range sortedNeighbors(dstNodes) {
+		weight, err := edgeStrength(p.txn, from, to)
+		if err != nil {
+			return err
+		}
+		neighbor, err := p.resolver.resolve(to)
+		if err != nil {
+			return err
+		}
+		if p.outStrength[from], err = sumStrength(p.outStrength[from], weight, from, to); err != nil {
+			return err
+		}
+		if p.inStrength[neighbor], err = sumStrength(p.inStrength[neighbor], weight, from, to); err != nil {
+			return err
+		}
+		if p.total, err = sumStrength(p.total, weight, from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *degreePass) finish() *DegreeStats {
+	stats := &DegreeStats{
+		OutDegrees:   make(map[int]int),
+		InDegrees:    make(map[int]int),
+		OutStrengths: make(map[int]int),
+		InStrengths:  make(map[int]int),
+	}
+	for node, degree := range p.out {
+		stats.Nodes++
+		stats.Edges += degree
+		stats.MaxOutDegree = max(stats.MaxOutDegree, degree)
+		stats.OutDegrees[degree]++
+		stats.InDegrees[p.in[node]]++
+		stats.MaxOutStrength = max(stats.MaxOutStrength, p.outStrength[node])
+		stats.OutStrengths[strengthBin(p.outStrength[node])]++
+		stats.InStrengths[strengthBin(p.inStrength[node])]++
+	}
+	for node, degree := range p.in {
+		if _, ok := p.out[node]; !ok {
+			stats.Nodes++
+			stats.OutDegrees[0]++
+			stats.InDegrees[degree]++
+			stats.OutStrengths[0]++
+			stats.InStrengths[strengthBin(p.inStrength[node])]++
+		}
+		stats.MaxInDegree = max(stats.MaxInDegree, degree)
+		stats.MaxInStrength = max(stats.MaxInStrength, p.inStrength[node])
+	}
+	stats.TotalStrength = p.total
+	if stats.Nodes > 0 {
+		stats.MeanDegree = float64(stats.Edges) / float64(stats.Nodes)
+		stats.MeanStrength = stats.TotalStrength / float64(stats.Nodes)
+	}
+	return stats
+}
+
+// strengthBin returns the bin of strength in DegreeStats.OutStrengths and InStrengths.
+func strengthBin(strength float64) int {
+	return int(max(min(math.Floor(strength), math.MaxInt32), math.MinInt32))
+}
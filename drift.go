@@ -0,0 +1,301 @@
+package Onyx
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Drift snapshots record a few cheap invariants of the graph, so that comparing consecutive
+// snapshots catches data going missing or changing behind the API's back, for example by
+// a bug or by writes to the badger database that don't go through the graph.
+
+const driftShards = 16
+
+type DriftOptions struct {
+	// EdgeDropThreshold is the fraction of the edges that may disappear between two snapshots
+	// without being explained by removals in the changelog. Defaults to 0.3.
+	EdgeDropThreshold float64
+	// NodeDropThreshold is the fraction of the nodes that may disappear between two snapshots
+	// while the changelog recorded no removal at all. Defaults to 0.3.
+	NodeDropThreshold float64
+	// ReverseIndexSample is the number of edges, the first ones in key order, checked against
+	// the reverse edge index if there is one. Defaults to 100.
+	ReverseIndexSample int
+	// History is the number of snapshots kept. Defaults to 48.
+	History int
+}
+
+// DriftSnapshot holds the invariants of the graph at one point in time.
+type DriftSnapshot struct {
+	Time time.Time
+	// Version is the changelog version the snapshot was taken at, 0 without a changelog.
+	Version uint64
+	Nodes   int
+	Edges   int
+	// DegreeChecksums are order independent checksums of the out-degree of every node, per
+	// shard of the node IDs. A shard whose checksum changed had nodes added, removed or
+	// rewired.
+	DegreeChecksums [driftShards]uint64
+	// ReverseIndexChecked is the number of edges looked up in the reverse edge index, and
+	// ReverseIndexMissing how many of them had no entry.
+	ReverseIndexChecked int
+	ReverseIndexMissing int
+}
+
+// DriftAlert is an anomaly found comparing a snapshot with the previous one.
+type DriftAlert struct {
+	// Check is "edge-count", "node-count", "unrecorded-change" or "reverse-index".
+	Check   string
+	Message string
+}
+
+type DriftReport struct {
+	Current *DriftSnapshot
+	// Previous is nil for the first snapshot.
+	Previous *DriftSnapshot
+	Alerts   []DriftAlert
+}
+
+// driftRecord is how a snapshot is stored, with the alerts raised when it was taken.
+type driftRecord struct {
+	Snapshot DriftSnapshot
+	Alerts   []DriftAlert
+}
+
+func driftKey(t time.Time) []byte {
+	return binary.BigEndian.AppendUint64([]byte(driftPrefix), uint64(t.UnixNano()))
+}
+
+// TakeDriftSnapshot takes a snapshot of the invariants of the graph, compares it with the
+// previous snapshot and adds it to the history. Alerts are logged as warnings, see WithLogger,
+// and counted in Metrics.DriftAlerts. Taking a snapshot scans every edge list.
+func (g *Graph) TakeDriftSnapshot(opts DriftOptions) (*DriftReport, error) {
+	if opts.EdgeDropThreshold == 0 {
+		opts.EdgeDropThreshold = 0.3
+	}
+	if opts.NodeDropThreshold == 0 {
+		opts.NodeDropThreshold = 0.3
+	}
+	if opts.ReverseIndexSample == 0 {
+		opts.ReverseIndexSample = 100
+	}
+	if opts.History <= 0 {
+		opts.History = 48
+	}
+
+	end, err := g.begin("TakeDriftSnapshot")
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	// The scan runs in a read-only transaction, so it doesn't conflict with concurrent writes.
+	txn := g.DB.NewTransaction(false)
+	defer txn.Discard()
+
+	current, err := g.driftSnapshot(txn, opts.ReverseIndexSample)
+	if err != nil {
+		return nil, err
+	}
+	records, err := readDriftHistory(txn)
+	if err != nil {
+		return nil, err
+	}
+	report := &DriftReport{Current: current}
+	if len(records) > 0 {
+		report.Previous = &records[len(records)-1].Snapshot
+		report.Alerts, err = g.compareDrift(txn, report.Previous, current, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b := new(bytes.Buffer)
+	err = gob.NewEncoder(b).Encode(driftRecord{Snapshot: *current, Alerts: report.Alerts})
+	if err != nil {
+		return nil, err
+	}
+	err = g.DB.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(driftKey(current.Time), b.Bytes()); err != nil {
+			return err
+		}
+		for i := 0; i < len(records)+1-opts.History; i++ {
+			if err := txn.Delete(driftKey(records[i].Snapshot.Time)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, alert := range report.Alerts {
+		g.metrics.driftAlerts.Add(1)
+		g.log().Warn("onyx: drift detected", "check", alert.Check, "message", alert.Message)
+	}
+	return report, nil
+}
+
+// DriftReport returns the latest drift snapshot compared with the one before it, with the
+// alerts raised when it was taken. It returns a nil report if no snapshot was taken yet.
+func (g *Graph) DriftReport() (*DriftReport, error) {
+	end, err := g.begin("DriftReport")
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	txn, release := g.readTxn()
+	defer release()
+
+	records, err := readDriftHistory(txn)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	latest := records[len(records)-1]
+	report := &DriftReport{Current: &latest.Snapshot, Alerts: latest.Alerts}
+	if len(records) > 1 {
+		report.Previous = &records[len(records)-2].Snapshot
+	}
+	return report, nil
+}
+
+// DriftSnapshotTask returns a task that takes a drift snapshot every interval.
+func (g *Graph) DriftSnapshotTask(opts DriftOptions, interval time.Duration) MaintenanceTask {
+	return MaintenanceTask{
+		Name:     "drift-snapshot",
+		Interval: interval,
+		Run: func(ctx context.Context) error {
+			_, err := g.TakeDriftSnapshot(opts)
+			return err
+		},
+	}
+}
+
+func (g *Graph) driftSnapshot(txn *badger.Txn, sample int) (*DriftSnapshot, error) {
+	s := &DriftSnapshot{Time: time.Now()}
+	if g.changelog {
+		version, err := g.CurrentVersion(txn)
+		if err != nil {
+			return nil, err
+		}
+		s.Version = version
+	}
+	reverse, err := readIndexStateAt(txn, reverseIndexMetaKey())
+	if err != nil {
+		return nil, err
+	}
+	checkReverse := reverse != nil && reverse.Ready
+
+	err = forEachEdgeList(txn, func(from string, dstNodes map[string]bool) error {
+		s.Nodes++
+		s.Edges += len(dstNodes)
+
+		h := fnv.New64a()
+		h.Write([]byte(from))
+		shard := h.Sum64() % driftShards
+		h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(dstNodes))))
+		s.DegreeChecksums[shard] += h.Sum64()
+
+		for to := range dstNodes {
+			if !checkReverse || s.ReverseIndexChecked >= sample {
+				break
+			}
+			s.ReverseIndexChecked++
+			_, err := txn.Get(reverseEdgeKey(to, from))
+			if err == badger.ErrKeyNotFound {
+				s.ReverseIndexMissing++
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// compareDrift returns the alerts raised by current compared with prev.
+func (g *Graph) compareDrift(txn *badger.Txn, prev *DriftSnapshot, current *DriftSnapshot, opts DriftOptions) ([]DriftAlert, error) {
+	var alerts []DriftAlert
+	alert := func(check string, format string, args ...any) {
+		alerts = append(alerts, DriftAlert{Check: check, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// Edges removed through the graph are in the changelog. Without a changelog, or once it
+	// was pruned past the previous snapshot, no removal is explained.
+	removals, known := 0, false
+	if g.changelog && current.Version >= prev.Version {
+		earliest, err := earliestVersion(txn)
+		if err != nil {
+			return nil, err
+		}
+		if earliest <= prev.Version {
+			known = true
+			err = g.Changes(prev.Version, func(record ChangeRecord) error {
+				if record.Seq <= current.Version && record.Op == ChangeRemoveEdge {
+					removals++
+				}
+				return nil
+			}, txn)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if dropped := prev.Edges - current.Edges - removals; prev.Edges > 0 && float64(dropped) > opts.EdgeDropThreshold*float64(prev.Edges) {
+		alert("edge-count", "edge count dropped from %d to %d with %d removals in the changelog", prev.Edges, current.Edges, removals)
+	}
+	if dropped := prev.Nodes - current.Nodes; removals == 0 && prev.Nodes > 0 && float64(dropped) > opts.NodeDropThreshold*float64(prev.Nodes) {
+		alert("node-count", "node count dropped from %d to %d with no removals in the changelog", prev.Nodes, current.Nodes)
+	}
+	// Adding and removing nodes without edges isn't recorded, so degrees are only expected to
+	// stay the same while the nodes do.
+	if known && current.Version == prev.Version && current.Edges != prev.Edges {
+		alert("unrecorded-change", "edge count changed from %d to %d without changelog records", prev.Edges, current.Edges)
+	} else if known && current.Version == prev.Version && current.Nodes == prev.Nodes {
+		changed := 0
+		for i := range current.DegreeChecksums {
+			if current.DegreeChecksums[i] != prev.DegreeChecksums[i] {
+				changed++
+			}
+		}
+		if changed > 0 {
+			alert("unrecorded-change", "degrees changed in %d of %d shards without changelog records", changed, driftShards)
+		}
+	}
+	if current.ReverseIndexMissing > 0 {
+		alert("reverse-index", "%d of %d sampled edges are missing from the reverse edge index", current.ReverseIndexMissing, current.ReverseIndexChecked)
+	}
+	return alerts, nil
+}
+
+// readDriftHistory returns the stored drift records, oldest first.
+func readDriftHistory(txn *badger.Txn) ([]driftRecord, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(driftPrefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	var records []driftRecord
+	for it.Rewind(); it.Valid(); it.Next() {
+		var record driftRecord
+		err := it.Item().Value(func(val []byte) error {
+			return gob.NewDecoder(bytes.NewReader(val)).Decode(&record)
+		})
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -0,0 +1,290 @@
+// Package social is an example of embedding Onyx in an application: a follower graph
+// with labeled edges, served over HTTP next to the application's own routes, with a
+// periodic backup and a follower count kept up to date from the changelog.
+//
+// The order of App.Run's shutdown matters: the HTTP server stops accepting writes first,
+// then the maintenance tasks finish, the change feed is drained one last time so the
+// derived counts match the graph, and only then is the graph closed.
+package social
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Dynaclo/Onyx"
+	"github.com/Dynaclo/Onyx/onyxhttp"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Labels of follow edges, stored in the label edge property.
+const (
+	LabelFollows     = "follows"
+	LabelCloseFriend = "close-friend"
+)
+
+// FollowersProperty is the node property holding the number of followers of a user,
+// derived from the follow edges by SyncFollowerCounts.
+const FollowersProperty = "followers"
+
+type Options struct {
+	// BackupPath is where the periodic backup is written. Empty disables it.
+	BackupPath     string
+	BackupInterval time.Duration
+	// SyncInterval is how often follower counts are updated from the changelog.
+	SyncInterval time.Duration
+}
+
+type App struct {
+	graph *Onyx.Graph
+	opts  Options
+
+	mu      sync.Mutex
+	version uint64
+}
+
+// New returns an App using graph, which must have been opened WithChangelog.
+func New(graph *Onyx.Graph, opts Options) *App {
+	if opts.BackupInterval == 0 {
+		opts.BackupInterval = time.Hour
+	}
+	if opts.SyncInterval == 0 {
+		opts.SyncInterval = time.Second
+	}
+	return &App{graph: graph, opts: opts}
+}
+
+// Follow adds an edge from follower to followee, or changes the label of an existing one.
+// Update retries the closure when it conflicts with a concurrent follow of the same user.
+func (a *App) Follow(follower string, followee string, label string) error {
+	return a.graph.Update(func(tx *Onyx.Tx) error {
+		if err := tx.AddEdge(follower, followee); err != nil {
+			return err
+		}
+		return tx.SetEdgeProperty(follower, followee, Onyx.LabelProperty, []byte(label))
+	})
+}
+
+func (a *App) Unfollow(follower string, followee string) error {
+	return a.graph.Update(func(tx *Onyx.Tx) error {
+		_, err := tx.RemoveEdge(follower, followee)
+		return err
+	})
+}
+
+// Following returns the users user follows with the label of each follow edge.
+func (a *App) Following(user string) (map[string]string, error) {
+	txn := a.graph.DB.NewTransaction(false)
+	defer txn.Discard()
+	return a.following(user, txn)
+}
+
+func (a *App) following(user string, txn *badger.Txn) (map[string]string, error) {
+	dstNodes, err := a.graph.GetEdges(user, txn)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	following := make(map[string]string, len(dstNodes))
+	for to := range dstNodes {
+		props, err := a.graph.GetEdgeProperties(user, to, txn)
+		if err != nil {
+			return nil, err
+		}
+		following[to] = string(props[Onyx.LabelProperty])
+	}
+	return following, nil
+}
+
+// Suggestions returns the users two hops away from user that user doesn't follow yet,
+// closest first. The traversal and the filtering read the same snapshot of the graph.
+func (a *App) Suggestions(user string) ([]string, error) {
+	txn := a.graph.DB.NewTransaction(false)
+	defer txn.Discard()
+
+	result, err := a.graph.BFS(user, Onyx.TraversalOptions{MaxDepth: 2}, txn)
+	if err != nil {
+		return nil, err
+	}
+	following, err := a.following(user, txn)
+	if err != nil {
+		return nil, err
+	}
+	var suggestions []string
+	for _, node := range result.Order {
+		if _, known := following[node]; result.Depth[node] == 2 && !known && node != user {
+			suggestions = append(suggestions, node)
+		}
+	}
+	return suggestions, nil
+}
+
+// Followers returns the derived follower count of user.
+func (a *App) Followers(user string) (int64, error) {
+	count, err := a.graph.GetNodePropertyInt64(user, FollowersProperty, nil)
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	return count, err
+}
+
+// SyncFollowerCounts applies the changes since the last sync to the follower counts.
+// Changes and the count updates are applied in one transaction, and changelog records commit
+// in sequence order, so no change below the last one read can commit after the sync: counts
+// don't drift.
+func (a *App) SyncFollowerCounts() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var version uint64
+	err := a.graph.Update(func(tx *Onyx.Tx) error {
+		txn := tx.Txn()
+		version = 0
+		deltas := make(map[string]int64)
+		err := a.graph.Changes(a.version, func(record Onyx.ChangeRecord) error {
+			version = record.Seq
+			switch record.Op {
+			case Onyx.ChangeAddEdge:
+				deltas[record.To]++
+			case Onyx.ChangeRemoveEdge:
+				deltas[record.To]--
+			}
+			return nil
+		}, txn)
+		if err != nil {
+			return err
+		}
+
+		for user, delta := range deltas {
+			count, err := a.graph.GetNodePropertyInt64(user, FollowersProperty, txn)
+			if err != nil && err != badger.ErrKeyNotFound {
+				return err
+			}
+			props := map[string][]byte{FollowersProperty: Onyx.EncodeInt64(count + delta)}
+			if err := tx.SetNodeProperties(user, props); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if version > a.version {
+		a.version = version
+	}
+	return nil
+}
+
+// Backup writes a backup of the graph to BackupPath, replacing the previous one only once
+// the new one is complete.
+func (a *App) Backup() error {
+	tmp := a.opts.BackupPath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = a.graph.Backup(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, a.opts.BackupPath)
+}
+
+// Mount registers the Onyx HTTP API under /graph/ and the application routes on mux.
+func (a *App) Mount(mux *http.ServeMux) {
+	mux.Handle("/graph/", http.StripPrefix("/graph", onyxhttp.NewHandler(a.graph)))
+	mux.HandleFunc("GET /users/{id}/followers", func(w http.ResponseWriter, r *http.Request) {
+		count, err := a.Followers(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int64{"followers": count})
+	})
+	mux.HandleFunc("GET /users/{id}/suggestions", func(w http.ResponseWriter, r *http.Request) {
+		suggestions, err := a.Suggestions(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"suggestions": suggestions})
+	})
+}
+
+// Run serves mux on listener and runs the maintenance tasks until ctx is cancelled, then
+// shuts down in order and closes the graph. Errors of background tasks are sent to logw.
+func (a *App) Run(ctx context.Context, listener net.Listener, mux *http.ServeMux, logw io.Writer) error {
+	server := &http.Server{Handler: mux}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	tasks := []Onyx.MaintenanceTask{{
+		Name:     "follower-counts",
+		Interval: a.opts.SyncInterval,
+		Run:      func(context.Context) error { return a.SyncFollowerCounts() },
+	}}
+	if a.opts.BackupPath != "" {
+		tasks = append(tasks, Onyx.MaintenanceTask{
+			Name:     "backup",
+			Interval: a.opts.BackupInterval,
+			Run:      func(context.Context) error { return a.Backup() },
+		})
+	}
+	maintenanceCtx, stopMaintenance := context.WithCancel(context.Background())
+	maintenanceDone := make(chan struct{})
+	go func() {
+		a.graph.RunMaintenance(maintenanceCtx, tasks, func(task string, err error) {
+			io.WriteString(logw, task+": "+err.Error()+"\n")
+		})
+		close(maintenanceDone)
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-serveErr:
+	}
+
+	// Stop taking requests before anything they depend on goes away.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if shutdownErr := server.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+		err = shutdownErr
+	}
+	stopMaintenance()
+	<-maintenanceDone
+	if syncErr := a.SyncFollowerCounts(); syncErr != nil && err == nil {
+		err = syncErr
+	}
+	if a.opts.BackupPath != "" {
+		if backupErr := a.Backup(); backupErr != nil && err == nil {
+			err = backupErr
+		}
+	}
+	if closeErr := a.graph.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return err
+}
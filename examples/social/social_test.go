@@ -0,0 +1,123 @@
+package social
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dynaclo/Onyx"
+)
+
+func TestSocial(T *testing.T) {
+	graph, err := Onyx.NewGraph("", true, Onyx.WithChangelog())
+	if err != nil {
+		T.Fatal(err)
+	}
+	backup := filepath.Join(T.TempDir(), "social.bak")
+	app := New(graph, Options{BackupPath: backup, BackupInterval: 10 * time.Millisecond, SyncInterval: 10 * time.Millisecond})
+
+	// Concurrent follows of the same user conflict on its edge list and are retried.
+	var wg sync.WaitGroup
+	for _, follower := range []string{"alice", "bob", "carol", "dave"} {
+		wg.Add(1)
+		go func(follower string) {
+			defer wg.Done()
+			if err := app.Follow(follower, "erin", LabelFollows); err != nil {
+				T.Error(err)
+			}
+		}(follower)
+	}
+	wg.Wait()
+	_ = app.Follow("alice", "bob", LabelCloseFriend)
+	_ = app.Follow("bob", "carol", LabelFollows)
+	_ = app.Follow("bob", "frank", LabelFollows)
+	_ = app.Unfollow("dave", "erin")
+
+	if following, _ := app.Following("alice"); !reflect.DeepEqual(following, map[string]string{"bob": LabelCloseFriend, "erin": LabelFollows}) {
+		T.Fatal("unexpected following ", following)
+	}
+	if suggestions, _ := app.Suggestions("alice"); !reflect.DeepEqual(suggestions, []string{"carol", "frank"}) {
+		T.Fatal("unexpected suggestions ", suggestions)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("home")) })
+	app.Mount(mux)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		T.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var logs bytes.Buffer
+	done := make(chan error, 1)
+	go func() { done <- app.Run(ctx, listener, mux, &logs) }()
+
+	base := "http://" + listener.Addr().String()
+	get := func(path string, v any) {
+		T.Helper()
+		resp, err := http.Get(base + path)
+		if err != nil {
+			T.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			T.Fatalf("GET %s: status %d", path, resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			T.Fatal(err)
+		}
+	}
+
+	req, _ := http.NewRequest("PUT", base+"/graph/edges/frank/erin", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		T.Fatal("PUT through the mounted graph API failed ", err)
+	}
+	var edges struct{ Edges []string }
+	get("/graph/nodes/frank/edges", &edges)
+	if !reflect.DeepEqual(edges.Edges, []string{"erin"}) {
+		T.Fatal("unexpected edges ", edges)
+	}
+
+	var followers map[string]int64
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		get("/users/erin/followers", &followers)
+		if followers["followers"] == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			T.Fatal("follower count not synced ", followers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_ = app.Follow("dave", "frank", LabelFollows)
+	cancel()
+	if err := <-done; err != nil {
+		T.Fatal(err)
+	}
+	if logs.Len() > 0 {
+		T.Fatal("background task errors: ", logs.String())
+	}
+
+	// Shutdown synced the last follow before taking the final backup.
+	restored, err := Onyx.NewGraph("", true, Onyx.WithRestoreFrom(backup))
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer restored.Close()
+	if _, err := os.Stat(backup + ".tmp"); !os.IsNotExist(err) {
+		T.Fatal("temporary backup file left behind")
+	}
+	if count, _ := New(restored, Options{}).Followers("frank"); count != 2 {
+		T.Fatal("expected frank to have 2 followers in the backup, got ", count)
+	}
+}
@@ -0,0 +1,71 @@
+package Onyx
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// ExpansionLimits bound how much of a high degree node a traversal expands, so a few
+// supernodes can't blow up its frontier. Nodes that are not fully expanded are reported as
+// truncated in the result, which is then partial. The limits apply to BFS, ParallelBFS,
+// Neighborhood, MultiSourceNeighborhood and bfs saved queries, see SaveQuery.
+type ExpansionLimits struct {
+	// MaxFanoutPerNode expands at most this many neighbors of any node. 0 means no limit.
+	MaxFanoutPerNode int
+	// FanoutByWeight keeps the neighbors with the highest edge weight, missing weights
+	// counting as 1 and ties going to the smaller ID. Otherwise a sample chosen with
+	// FanoutSeed is kept, which is the same for a given seed and edge list.
+	FanoutByWeight bool
+	FanoutSeed     int64
+	// SkipNodesAboveDegree doesn't expand nodes with more out-edges than this at all,
+	// treating them as leaves. 0 means no limit.
+	SkipNodesAboveDegree int
+}
+
+// limit returns the neighbors of node to expand, in lexicographic order, and whether some
+// were left out. neighbors must be sorted.
+func (l ExpansionLimits) limit(txn *badger.Txn, node string, neighbors []string) ([]string, bool, error) {
+	if l.SkipNodesAboveDegree > 0 && len(neighbors) > l.SkipNodesAboveDegree {
+		return nil, true, nil
+	}
+	if l.MaxFanoutPerNode <= 0 || len(neighbors) <= l.MaxFanoutPerNode {
+		return neighbors, false, nil
+	}
+
+	ranked := make([]string, len(neighbors))
+	copy(ranked, neighbors)
+	if l.FanoutByWeight {
+		weights := make(map[string]float64, len(ranked))
+		for _, neighbor := range ranked {
+			w, ok, err := readEdgeWeight(txn, node, neighbor)
+			if err != nil {
+				return nil, false, err
+			}
+			if !ok {
+				w = 1
+			}
+			weights[neighbor] = w
+		}
+		sort.SliceStable(ranked, func(i, j int) bool {
+			return weights[ranked[i]] > weights[ranked[j]]
+		})
+	} else {
+		scores := make(map[string]uint64, len(ranked))
+		for _, neighbor := range ranked {
+			h := fnv.New64a()
+			h.Write(binary.BigEndian.AppendUint64(nil, uint64(l.FanoutSeed)))
+			h.Write([]byte(node + keySep + neighbor))
+			scores[neighbor] = h.Sum64()
+		}
+		sort.SliceStable(ranked, func(i, j int) bool {
+			return scores[ranked[i]] < scores[ranked[j]]
+		})
+	}
+
+	kept := ranked[:l.MaxFanoutPerNode]
+	sort.Strings(kept)
+	return kept, true, nil
+}
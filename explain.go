@@ -0,0 +1,200 @@
+package Onyx
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// Limits an ExplainReport can list as triggered.
+const (
+	LimitMaxDepth             = "max_depth"
+	LimitMaxFanoutPerNode     = "max_fanout_per_node"
+	LimitSkipNodesAboveDegree = "skip_nodes_above_degree"
+)
+
+// ExplainReport describes how a traversal was executed, see TraversalOptions.Explain.
+type ExplainReport struct {
+	Levels []ExplainLevel `json:"levels"`
+	// KeysRead counts the edge lists, properties and edge weights read.
+	KeysRead int `json:"keys_read"`
+	// BytesDecoded is the encoded size of the edge lists read.
+	BytesDecoded int64 `json:"bytes_decoded"`
+	// RedirectCacheHits and RedirectCacheMisses count the redirect lookups served from the
+	// traversal's cache and from the database. Both are 0 for graphs without redirects.
+	RedirectCacheHits   int            `json:"redirect_cache_hits"`
+	RedirectCacheMisses int            `json:"redirect_cache_misses"`
+	Phases              []ExplainPhase `json:"phases"`
+	// LimitsTriggered lists the limits that cut the traversal short, see the Limit constants.
+	LimitsTriggered []string      `json:"limits_triggered"`
+	Total           time.Duration `json:"total_ns"`
+}
+
+type ExplainLevel struct {
+	Depth int `json:"depth"`
+	// Expanded is the number of nodes at Depth whose edge lists were read.
+	Expanded int `json:"expanded"`
+	// Discovered is the number of nodes first reached from them, at Depth+1.
+	Discovered int `json:"discovered"`
+	// Truncated is the number of expanded nodes the ExpansionLimits didn't fully expand.
+	Truncated int `json:"truncated"`
+}
+
+type ExplainPhase struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// CacheHitRate is the fraction of redirect lookups served from the cache, 0 if there were none.
+func (r *ExplainReport) CacheHitRate() float64 {
+	lookups := r.RedirectCacheHits + r.RedirectCacheMisses
+	if lookups == 0 {
+		return 0
+	}
+	return float64(r.RedirectCacheHits) / float64(lookups)
+}
+
+// WriteText writes the report as aligned columns, for terminals.
+func (r *ExplainReport) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "depth\texpanded\tdiscovered\ttruncated\t")
+	for _, level := range r.Levels {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t\n", level.Depth, level.Expanded, level.Discovered, level.Truncated)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw)
+	for _, phase := range r.Phases {
+		fmt.Fprintf(tw, "%s\t%v\n", phase.Name, phase.Duration)
+	}
+	fmt.Fprintf(tw, "total\t%v\n", r.Total)
+	fmt.Fprintf(tw, "keys read\t%d\n", r.KeysRead)
+	fmt.Fprintf(tw, "bytes decoded\t%d\n", r.BytesDecoded)
+	fmt.Fprintf(tw, "redirect cache hit rate\t%.2f (%d/%d)\n", r.CacheHitRate(), r.RedirectCacheHits, r.RedirectCacheHits+r.RedirectCacheMisses)
+	limits := "none"
+	if len(r.LimitsTriggered) > 0 {
+		limits = fmt.Sprint(r.LimitsTriggered)
+	}
+	fmt.Fprintf(tw, "limits triggered\t%s\n", limits)
+	return tw.Flush()
+}
+
+// explainer collects an ExplainReport. All methods do nothing on a nil explainer, so
+// traversals call them unconditionally and only pay for a nil check when not explaining.
+type explainer struct {
+	report ExplainReport
+	start  time.Time
+	phases map[string]time.Duration
+	limits map[string]bool
+}
+
+func newExplainer(enabled bool) *explainer {
+	if !enabled {
+		return nil
+	}
+	return &explainer{start: time.Now(), phases: make(map[string]time.Duration), limits: make(map[string]bool)}
+}
+
+// now returns the start time of a phase.
+func (e *explainer) now() time.Time {
+	if e == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// phase adds the time since start to the named phase.
+func (e *explainer) phase(name string, start time.Time) {
+	if e == nil {
+		return
+	}
+	if _, ok := e.phases[name]; !ok {
+		e.report.Phases = append(e.report.Phases, ExplainPhase{Name: name})
+	}
+	e.phases[name] += time.Since(start)
+}
+
+func (e *explainer) level(depth int) *ExplainLevel {
+	for len(e.report.Levels) <= depth {
+		e.report.Levels = append(e.report.Levels, ExplainLevel{Depth: len(e.report.Levels)})
+	}
+	return &e.report.Levels[depth]
+}
+
+// expanded records reading the edge list of a node at depth, size bytes long.
+func (e *explainer) expanded(depth int, size int) {
+	if e == nil {
+		return
+	}
+	e.level(depth).Expanded++
+	e.report.KeysRead++
+	if size > 0 {
+		e.report.BytesDecoded += int64(size)
+	}
+}
+
+func (e *explainer) discovered(depth int) {
+	if e == nil {
+		return
+	}
+	e.level(depth).Discovered++
+}
+
+// truncated records a node at depth cut short by limit, after reading weightKeys edge weights.
+func (e *explainer) truncated(depth int, limit string, weightKeys int) {
+	if e == nil {
+		return
+	}
+	e.level(depth).Truncated++
+	e.report.KeysRead += weightKeys
+	e.limitTriggered(limit)
+}
+
+func (e *explainer) limitTriggered(limit string) {
+	if e == nil || e.limits[limit] {
+		return
+	}
+	e.limits[limit] = true
+	e.report.LimitsTriggered = append(e.report.LimitsTriggered, limit)
+}
+
+func (e *explainer) keysRead(n int) {
+	if e == nil {
+		return
+	}
+	e.report.KeysRead += n
+}
+
+// finish returns the report, taking the cache counters from resolver.
+func (e *explainer) finish(resolver *redirectResolver) *ExplainReport {
+	if e == nil {
+		return nil
+	}
+	for i := range e.report.Phases {
+		e.report.Phases[i].Duration = e.phases[e.report.Phases[i].Name]
+	}
+	e.report.RedirectCacheHits = resolver.hits
+	e.report.RedirectCacheMisses = resolver.misses
+	e.report.Total = time.Since(e.start)
+	return &e.report
+}
+
+// truncatedBy returns the limit that truncates a node with degree out-edges.
+func (l ExpansionLimits) truncatedBy(degree int) string {
+	if l.SkipNodesAboveDegree > 0 && degree > l.SkipNodesAboveDegree {
+		return LimitSkipNodesAboveDegree
+	}
+	return LimitMaxFanoutPerNode
+}
+
+// weightKeysRead returns how many edge weights limit read for a node with degree out-edges.
+func (l ExpansionLimits) weightKeysRead(degree int) int {
+	if l.truncatedBy(degree) == LimitMaxFanoutPerNode && l.FanoutByWeight {
+		return degree
+	}
+	return 0
+}
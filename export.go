@@ -0,0 +1,458 @@
+package Onyx
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+type ExportOptions struct {
+	// IncludeProperties exports node and edge properties, including edge weights.
+	IncludeProperties bool
+}
+
+type ImportOptions struct {
+	// SkipMutationStats doesn't count the imported edges in the mutation stats.
+	SkipMutationStats bool
+	// Source records the imported edges as asserted by this source, see AddSourcedEdge.
+	Source string
+}
+
+type ImportStats struct {
+	Nodes int
+	Edges int
+	// Rejected are the writes rejected by write policies, see RegisterWritePolicy. A node or
+	// edge with a rejected write isn't imported.
+	Rejected []*ErrPolicyRejected
+}
+
+// Property values are []byte, so text formats export them with a type hint:
+// "string" for values that are valid UTF-8 and "base64" for everything else.
+const (
+	propTypeString = "string"
+	propTypeBase64 = "base64"
+)
+
+type exportedProperty struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type exportedNode struct {
+	ID         string                      `json:"id"`
+	Properties map[string]exportedProperty `json:"properties,omitempty"`
+}
+
+type exportedEdge struct {
+	From       string                      `json:"from"`
+	To         string                      `json:"to"`
+	Weight     *float64                    `json:"weight,omitempty"`
+	Properties map[string]exportedProperty `json:"properties,omitempty"`
+}
+
+type exportedGraph struct {
+	Nodes []exportedNode `json:"nodes"`
+	Edges []exportedEdge `json:"edges"`
+}
+
+func encodeExportedProperties(props map[string][]byte) map[string]exportedProperty {
+	if len(props) == 0 {
+		return nil
+	}
+	exported := make(map[string]exportedProperty, len(props))
+	for name, value := range props {
+		if utf8.Valid(value) {
+			exported[name] = exportedProperty{Type: propTypeString, Value: string(value)}
+		} else {
+			exported[name] = exportedProperty{Type: propTypeBase64, Value: base64.StdEncoding.EncodeToString(value)}
+		}
+	}
+	return exported
+}
+
+func sortedPropertyNames(props map[string][]byte) []string {
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func decodeExportedProperties(exported map[string]exportedProperty) (map[string][]byte, error) {
+	props := make(map[string][]byte, len(exported))
+	for name, p := range exported {
+		switch p.Type {
+		case propTypeString:
+			props[name] = []byte(p.Value)
+		case propTypeBase64:
+			value, err := base64.StdEncoding.DecodeString(p.Value)
+			if err != nil {
+				return nil, fmt.Errorf("onyx: property %q: %w", name, err)
+			}
+			props[name] = value
+		default:
+			return nil, fmt.Errorf("onyx: property %q has unknown type %q", name, p.Type)
+		}
+	}
+	return props, nil
+}
+
+// ExportJSON writes the graph to w as a JSON document with a "nodes" and an "edges" array.
+func (g *Graph) ExportJSON(w io.Writer, opts ExportOptions, txn *badger.Txn) error {
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("ExportJSON")
+		if err != nil {
+			return err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	doc, err := g.exportGraph(opts, txn)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// exportGraph collects the nodes and edges of the graph for the exporters, sorted by ID.
+func (g *Graph) exportGraph(opts ExportOptions, txn *badger.Txn) (*exportedGraph, error) {
+	doc := &exportedGraph{Nodes: []exportedNode{}, Edges: []exportedEdge{}}
+	nodes := make(map[string]bool)
+	err := forEachEdgeList(txn, func(from string, dstNodes map[string]bool) error {
+		nodes[from] = true
+		for _, to := range sortedNeighbors(dstNodes) {
+			edge := exportedEdge{From: from, To: to}
+			if opts.IncludeProperties {
+				props, err := g.GetEdgeProperties(from, to, txn)
+				if err != nil {
+					return err
+				}
+				if weight, ok, err := readEdgeWeight(txn, from, to); err != nil {
+					return err
+				} else if ok {
+					edge.Weight = &weight
+					delete(props, WeightProperty)
+				}
+				edge.Properties = encodeExportedProperties(props)
+			}
+			doc.Edges = append(doc.Edges, edge)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.IncludeProperties {
+		// Nodes can have properties without having an edge list.
+		itOpts := badger.DefaultIteratorOptions
+		itOpts.Prefix = []byte(nodePropPrefix)
+		itOpts.PrefetchValues = false
+		it := txn.NewIterator(itOpts)
+		for it.Rewind(); it.Valid(); it.Next() {
+			rest := string(it.Item().Key()[len(nodePropPrefix):])
+			nodes[rest[:strings.Index(rest, keySep)]] = true
+		}
+		it.Close()
+	}
+
+	ids := sortedNeighbors(nodes)
+	for _, id := range ids {
+		node := exportedNode{ID: id}
+		if opts.IncludeProperties {
+			props, err := readNodeProperties(txn, id, nil)
+			if err != nil {
+				return nil, err
+			}
+			node.Properties = encodeExportedProperties(props)
+		}
+		doc.Nodes = append(doc.Nodes, node)
+	}
+	return doc, nil
+}
+
+// ImportJSON adds the nodes, edges and properties of a document written by ExportJSON to the graph.
+// Large imports don't fit in one transaction, so ImportJSON commits whenever the current
+// transaction is full and is not atomic. See ImportJSONWithStats.
+func (g *Graph) ImportJSON(r io.Reader, opts ImportOptions) error {
+	_, err := g.ImportJSONWithStats(r, opts)
+	return err
+}
+
+// ImportJSONWithStats is ImportJSON and reports what was imported. Writes rejected by a write
+// policy don't stop the import: they are reported in the stats.
+func (g *Graph) ImportJSONWithStats(r io.Reader, opts ImportOptions) (ImportStats, error) {
+	var stats ImportStats
+	end, err := g.begin("ImportJSON")
+	if err != nil {
+		return stats, err
+	}
+	defer end()
+
+	var doc exportedGraph
+	err = json.NewDecoder(r).Decode(&doc)
+	if err != nil {
+		return stats, err
+	}
+	return g.importGraph(&doc, opts, "ImportJSON")
+}
+
+// importGraph writes the nodes and edges of doc decoded by an importer, reaching the fault
+// point point after every chunk it commits before the last.
+func (g *Graph) importGraph(doc *exportedGraph, opts ImportOptions, point string) (ImportStats, error) {
+	var stats ImportStats
+	// rejected records err in stats if a write policy rejected it.
+	rejected := func(err error) bool {
+		var rejection *ErrPolicyRejected
+		if errors.As(err, &rejection) {
+			stats.Rejected = append(stats.Rejected, rejection)
+			return true
+		}
+		return false
+	}
+
+	imp := &chunkedWriter{g: g, skipStats: opts.SkipMutationStats, point: point}
+	defer imp.discard()
+
+	for _, node := range doc.Nodes {
+		props, err := decodeExportedProperties(node.Properties)
+		if err != nil {
+			return stats, fmt.Errorf("onyx: node %q: %w", node.ID, err)
+		}
+		node.ID = g.nodeID(node.ID)
+		err = imp.do(func(txn *badger.Txn) error {
+			if _, exists, err := readEdgeMap(txn, node.ID); err != nil {
+				return err
+			} else if !exists {
+				if err := validateNodeID(node.ID); err != nil {
+					return err
+				}
+				if err := g.checkWritePolicies(txn, MutationOp{Kind: MutationAddNode, From: node.ID}); err != nil {
+					return err
+				}
+				if err := g.writeEdgeMap(txn, node.ID, map[string]bool{}); err != nil {
+					return err
+				}
+			}
+			return g.SetNodeProperties(node.ID, props, txn)
+		})
+		if err == nil {
+			stats.Nodes++
+		} else if !rejected(err) {
+			return stats, err
+		}
+	}
+
+	for _, edge := range doc.Edges {
+		props, err := decodeExportedProperties(edge.Properties)
+		if err != nil {
+			return stats, fmt.Errorf("onyx: edge %q->%q: %w", edge.From, edge.To, err)
+		}
+		err = imp.do(func(txn *badger.Txn) error {
+			add := g.AddEdge
+			if opts.Source != "" {
+				add = func(from string, to string, txn *badger.Txn) error {
+					return g.AddSourcedEdge(from, to, opts.Source, txn)
+				}
+			}
+			if err := add(edge.From, edge.To, txn); err != nil {
+				return err
+			}
+			for name, value := range props {
+				if err := g.SetEdgeProperty(edge.From, edge.To, name, value, txn); err != nil {
+					return err
+				}
+			}
+			if edge.Weight != nil {
+				return g.SetEdgeWeight(edge.From, edge.To, *edge.Weight, txn)
+			}
+			return nil
+		})
+		if err == nil {
+			stats.Edges++
+		} else if !rejected(err) {
+			return stats, err
+		}
+	}
+
+	return stats, imp.commit()
+}
+
+// chunkedWriter runs operations in a read-write transaction and commits it whenever it becomes
+// too big. Badger doesn't undo the writes an operation made before failing, so the operations
+// applied to the transaction are kept: when one fails after writing, the transaction is dropped
+// and they run again in a fresh one. Operations must therefore only depend on the state they
+// read through txn and on values they captured that don't change afterwards.
+// Once the graph is closing the writer stops with ErrClosed instead of starting a new transaction.
+type chunkedWriter struct {
+	g   *Graph
+	txn *badger.Txn
+	// ops are the operations applied to txn since it began.
+	ops []func(txn *badger.Txn) error
+	// point is the fault point reached after every chunk committed before the last.
+	point string
+	// skipStats excludes the writes from the mutation stats, see WithoutMutationStats.
+	skipStats bool
+}
+
+func (c *chunkedWriter) begin() {
+	c.txn = c.g.DB.NewTransaction(true)
+	if c.skipStats {
+		c.g.statsSkips.add(c.txn)
+	}
+}
+
+func (c *chunkedWriter) end() {
+	if c.skipStats {
+		c.g.statsSkips.remove(c.txn)
+	}
+	c.txn, c.ops = nil, nil
+}
+
+// do applies op to the current transaction. If op doesn't fit, the operations before it are
+// committed without it and op starts the next transaction. An op failing with another error
+// leaves no writes behind.
+func (c *chunkedWriter) do(op func(txn *badger.Txn) error) error {
+	if c.txn == nil {
+		c.begin()
+	}
+	written := txnStats(c.txn).PendingWrites
+	err := op(c.txn)
+	if err == badger.ErrTxnTooBig && len(c.ops) > 0 {
+		if err := c.replay(); err != nil {
+			return err
+		}
+		if err := c.commit(); err != nil {
+			return err
+		}
+		if c.g.closing() {
+			return ErrClosed
+		}
+		if err := c.g.faultPoint(c.point); err != nil {
+			return err
+		}
+		c.begin()
+		written = 0
+		err = op(c.txn)
+	}
+	if err == nil {
+		c.ops = append(c.ops, op)
+		return nil
+	}
+	if txnStats(c.txn).PendingWrites > written {
+		if err := c.replay(); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// replay drops the transaction and runs the operations applied to it again in a fresh one.
+func (c *chunkedWriter) replay() error {
+	ops := c.ops
+	c.discard()
+	c.begin()
+	for _, op := range ops {
+		if err := op(c.txn); err != nil {
+			return err
+		}
+	}
+	c.ops = ops
+	return nil
+}
+
+func (c *chunkedWriter) commit() error {
+	if c.txn == nil {
+		return nil
+	}
+	err := c.txn.Commit()
+	c.end()
+	return err
+}
+
+func (c *chunkedWriter) discard() {
+	if c.txn != nil {
+		c.txn.Discard()
+		c.end()
+	}
+}
+
+// ExportDOT writes the graph in Graphviz DOT format. Coordinates persisted by ComputeLayout
+// are written as pinned positions and edge weights as the weight attribute.
+func (g *Graph) ExportDOT(w io.Writer, txn *badger.Txn) error {
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("ExportDOT")
+		if err != nil {
+			return err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	var b strings.Builder
+	b.WriteString("digraph {\n")
+	writtenNodes := make(map[string]bool)
+	writeNode := func(node string) error {
+		if writtenNodes[node] {
+			return nil
+		}
+		writtenNodes[node] = true
+		props, err := readNodeProperties(txn, node, []string{LayoutXProperty, LayoutYProperty})
+		if err != nil {
+			return err
+		}
+		x, errX := decodeFloat64(props[LayoutXProperty])
+		y, errY := decodeFloat64(props[LayoutYProperty])
+		if errX == nil && errY == nil {
+			fmt.Fprintf(&b, "  %q [pos=\"%g,%g!\"];\n", node, x, y)
+		} else {
+			fmt.Fprintf(&b, "  %q;\n", node)
+		}
+		return nil
+	}
+
+	err := forEachEdgeList(txn, func(from string, dstNodes map[string]bool) error {
+		if err := writeNode(from); err != nil {
+			return err
+		}
+		for _, to := range sortedNeighbors(dstNodes) {
+			if err := writeNode(to); err != nil {
+				return err
+			}
+			weight, ok, err := readEdgeWeight(txn, from, to)
+			if err != nil {
+				return err
+			}
+			if ok {
+				fmt.Fprintf(&b, "  %q -> %q [weight=%g];\n", from, to, weight)
+			} else {
+				fmt.Fprintf(&b, "  %q -> %q;\n", from, to)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.WriteString("}\n")
+
+	_, err = io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,44 @@
+package Onyx
+
+import "errors"
+
+// Fault points are the places between two transactions of the operations that take several,
+// where a crash leaves the transactions before committed and the ones after never started.
+// They are named after the operation, with a suffix for the steps of operations that have
+// several kinds of transactions, and most are reached several times by one operation.
+//
+//	RemoveNodesWithPrefix            before every batch, after the journal entry
+//	RemoveSource                     before every batch, after the journal entry
+//	ConvertStorageMode               before every batch, after the journal entry
+//	Migrate                          before every step, after the journal entry
+//	ResolveRedirects                 before every batch of edge rewrites
+//	ResolveRedirects:markers         before the redirect markers are deleted
+//	IndexProperty                    before every batch of the backfill
+//	IndexReverseEdges                before every batch of the backfill
+//	PruneChangelog                   before every batch
+//	PurgeDeadLetters                 before every batch
+//	PruneMutationStats               before every batch
+//	ChunkedUpdate                    before every chunk after the first
+//	ImportJSON, ImportGraphML, ImportSQLite, ProjectBipartite, StopShadowCodec,
+//	BuildDistanceOracle, RebuildLandmark, DropDistanceOracle and PropertySink
+//	                                 after every chunk committed before the last
+
+// ErrFault is the error of the operations stopped at a fault point, see WithFaultPoints.
+var ErrFault = errors.New("onyx: stopped at a fault point")
+
+// WithFaultPoints calls fault at every fault point reached. An operation stops at the first
+// point fault returns an error for, with that error, as if the process had crashed there.
+// It is meant for crash tests, see the onyxtest package.
+func WithFaultPoints(fault func(point string) error) Option {
+	return func(g *Graph) {
+		g.fault = fault
+	}
+}
+
+// faultPoint returns the error injected at point, if any.
+func (g *Graph) faultPoint(point string) error {
+	if g.fault == nil {
+		return nil
+	}
+	return g.fault(point)
+}
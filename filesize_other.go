@@ -0,0 +1,10 @@
+//go:build !unix
+
+package Onyx
+
+import "os"
+
+// allocatedSize returns the disk space used by a file, approximated by its apparent size.
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package Onyx
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocatedSize returns the disk space used by a file. badger preallocates value log files
+// as sparse files, so their apparent size overstates it.
+func allocatedSize(info os.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512
+	}
+	return info.Size()
+}
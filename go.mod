@@ -2,10 +2,15 @@ module github.com/Dynaclo/Onyx
 
 go 1.22.4
 
+require (
+	github.com/dgraph-io/badger/v4 v4.3.0
+	github.com/dgraph-io/ristretto v0.1.2-0.20240116140435-c67e07994f91
+	golang.org/x/text v0.17.0
+	google.golang.org/grpc v1.65.0
+)
+
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
-	github.com/dgraph-io/badger/v4 v4.3.0 // indirect
-	github.com/dgraph-io/ristretto v0.1.2-0.20240116140435-c67e07994f91 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e // indirect
@@ -16,5 +21,6 @@ require (
 	go.opencensus.io v0.24.0 // indirect
 	golang.org/x/net v0.28.0 // indirect
 	golang.org/x/sys v0.24.0 // indirect
-	google.golang.org/protobuf v1.33.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240528184218-531527333157 // indirect
+	google.golang.org/protobuf v1.34.1 // indirect
 )
@@ -0,0 +1,266 @@
+package Onyx
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+type graphmlDocument struct {
+	XMLName xml.Name     `xml:"http://graphml.graphdrawing.org/xmlns graphml"`
+	Keys    []graphmlKey `xml:"key"`
+	Graph   graphmlGraph `xml:"graph"`
+}
+
+// graphmlKey declares a data attribute. Onyx declares one key per property name and type hint,
+// with the hint in the onyx encoding attribute: readers that don't know it see the base64 text.
+type graphmlKey struct {
+	ID       string  `xml:"id,attr"`
+	For      string  `xml:"for,attr"`
+	Name     string  `xml:"attr.name,attr"`
+	Type     string  `xml:"attr.type,attr"`
+	Encoding string  `xml:"https://github.com/Dynaclo/Onyx encoding,attr,omitempty"`
+	Default  *string `xml:"default"`
+}
+
+type graphmlGraph struct {
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphmlNode `xml:"node"`
+	Edges       []graphmlEdge `xml:"edge"`
+}
+
+type graphmlNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphmlData `xml:"data"`
+}
+
+type graphmlEdge struct {
+	Source   string        `xml:"source,attr"`
+	Target   string        `xml:"target,attr"`
+	Directed string        `xml:"directed,attr,omitempty"`
+	Data     []graphmlData `xml:"data"`
+}
+
+type graphmlData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// validXMLText reports whether s can be written in an XML document as is. XML has no escape
+// for most control characters, encoding/xml replaces them.
+func validXMLText(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' || r == 0xFFFE || r == 0xFFFF {
+			return false
+		}
+	}
+	return true
+}
+
+// ExportGraphML writes the graph to w as a GraphML document. Property values that can't be
+// written as XML text are base64 encoded, with the type hint in an attribute of their key.
+// Node IDs and property names must be valid XML text.
+func (g *Graph) ExportGraphML(w io.Writer, opts ExportOptions, txn *badger.Txn) error {
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("ExportGraphML")
+		if err != nil {
+			return err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	doc, err := g.exportGraph(opts, txn)
+	if err != nil {
+		return err
+	}
+
+	out := graphmlDocument{Graph: graphmlGraph{EdgeDefault: "directed"}}
+	keys := make(map[graphmlKey]string)
+	keyFor := func(key graphmlKey) string {
+		if id, ok := keys[key]; ok {
+			return id
+		}
+		id := fmt.Sprintf("%s%d", key.For[:1], len(keys))
+		keys[key] = id
+		key.ID = id
+		out.Keys = append(out.Keys, key)
+		return id
+	}
+	data := func(element string, props map[string][]byte) ([]graphmlData, error) {
+		var data []graphmlData
+		for _, name := range sortedPropertyNames(props) {
+			if !validXMLText(name) {
+				return nil, fmt.Errorf("onyx: property name %q can't be written as GraphML", name)
+			}
+			key := graphmlKey{For: element, Name: name, Type: "string"}
+			value := string(props[name])
+			if !validXMLText(value) {
+				key.Encoding = propTypeBase64
+				value = base64.StdEncoding.EncodeToString(props[name])
+			}
+			data = append(data, graphmlData{Key: keyFor(key), Value: value})
+		}
+		return data, nil
+	}
+
+	for _, node := range doc.Nodes {
+		if !validXMLText(node.ID) {
+			return fmt.Errorf("onyx: node ID %q can't be written as GraphML", node.ID)
+		}
+		props, err := decodeExportedProperties(node.Properties)
+		if err != nil {
+			return err
+		}
+		element := graphmlNode{ID: node.ID}
+		if element.Data, err = data("node", props); err != nil {
+			return err
+		}
+		out.Graph.Nodes = append(out.Graph.Nodes, element)
+	}
+	for _, edge := range doc.Edges {
+		if !validXMLText(edge.To) {
+			return fmt.Errorf("onyx: node ID %q can't be written as GraphML", edge.To)
+		}
+		props, err := decodeExportedProperties(edge.Properties)
+		if err != nil {
+			return err
+		}
+		element := graphmlEdge{Source: edge.From, Target: edge.To}
+		if element.Data, err = data("edge", props); err != nil {
+			return err
+		}
+		if edge.Weight != nil {
+			key := keyFor(graphmlKey{For: "edge", Name: WeightProperty, Type: "double"})
+			element.Data = append(element.Data,
+				graphmlData{Key: key, Value: strconv.FormatFloat(*edge.Weight, 'g', -1, 64)})
+		}
+		out.Graph.Edges = append(out.Graph.Edges, element)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// ImportGraphML adds the nodes, edges and data of a directed GraphML document to the graph, as
+// ImportJSONWithStats does. Data is stored as node and edge properties with the text of the
+// value, except for the base64 values of ExportGraphML, which are decoded, and an edge's
+// numeric weight data, which becomes its weight. Hyperedges, ports and nested graphs are not
+// supported.
+func (g *Graph) ImportGraphML(r io.Reader, opts ImportOptions) (ImportStats, error) {
+	var stats ImportStats
+	end, err := g.begin("ImportGraphML")
+	if err != nil {
+		return stats, err
+	}
+	defer end()
+
+	var in graphmlDocument
+	if err := xml.NewDecoder(r).Decode(&in); err != nil {
+		return stats, err
+	}
+	doc, err := in.exportedGraph()
+	if err != nil {
+		return stats, err
+	}
+	return g.importGraph(doc, opts, "ImportGraphML")
+}
+
+// exportedGraph converts the document to the form the importers write.
+func (in *graphmlDocument) exportedGraph() (*exportedGraph, error) {
+	keys := make(map[string]graphmlKey, len(in.Keys))
+	for _, key := range in.Keys {
+		keys[key.ID] = key
+	}
+	// properties decodes the data of an element, with the defaults of the keys it has no data for.
+	properties := func(element string, data []graphmlData) (map[string]exportedProperty, *float64, error) {
+		var props map[string]exportedProperty
+		var weight *float64
+		set := func(key graphmlKey, value string) error {
+			if key.For != element && key.For != "all" {
+				return fmt.Errorf("onyx: GraphML key %q is not declared for %ss", key.ID, element)
+			}
+			if element == "edge" && key.Name == WeightProperty && key.Encoding == "" {
+				switch key.Type {
+				case "double", "float", "int", "long":
+					w, err := strconv.ParseFloat(value, 64)
+					if err != nil {
+						return fmt.Errorf("onyx: GraphML weight: %w", err)
+					}
+					weight = &w
+					return nil
+				}
+			}
+			if props == nil {
+				props = make(map[string]exportedProperty)
+			}
+			p := exportedProperty{Type: propTypeString, Value: value}
+			if key.Encoding != "" {
+				p.Type = key.Encoding
+			}
+			props[key.Name] = p
+			return nil
+		}
+		seen := make(map[string]bool, len(data))
+		for _, d := range data {
+			key, ok := keys[d.Key]
+			if !ok {
+				return nil, nil, fmt.Errorf("onyx: GraphML data refers to undeclared key %q", d.Key)
+			}
+			seen[d.Key] = true
+			if err := set(key, d.Value); err != nil {
+				return nil, nil, err
+			}
+		}
+		for _, key := range in.Keys {
+			if key.Default != nil && !seen[key.ID] && (key.For == element || key.For == "all") {
+				if err := set(key, *key.Default); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		return props, weight, nil
+	}
+
+	if in.Graph.EdgeDefault != "directed" {
+		return nil, fmt.Errorf("onyx: only directed GraphML graphs can be imported, got edgedefault %q", in.Graph.EdgeDefault)
+	}
+	doc := &exportedGraph{}
+	for _, node := range in.Graph.Nodes {
+		props, _, err := properties("node", node.Data)
+		if err != nil {
+			return nil, fmt.Errorf("onyx: node %q: %w", node.ID, err)
+		}
+		doc.Nodes = append(doc.Nodes, exportedNode{ID: node.ID, Properties: props})
+	}
+	for _, edge := range in.Graph.Edges {
+		if edge.Directed == "false" {
+			return nil, fmt.Errorf("onyx: edge %q->%q is undirected", edge.Source, edge.Target)
+		}
+		props, weight, err := properties("edge", edge.Data)
+		if err != nil {
+			return nil, fmt.Errorf("onyx: edge %q->%q: %w", edge.Source, edge.Target, err)
+		}
+		doc.Edges = append(doc.Edges, exportedEdge{From: edge.Source, To: edge.Target, Weight: weight, Properties: props})
+	}
+	return doc, nil
+}
@@ -0,0 +1,82 @@
+package Onyx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultMaxReplicationLag is the replication lag above which a follower isn't ready, see
+// ReadinessChecks.
+const DefaultMaxReplicationLag = 30 * time.Second
+
+// HealthCheck is a named check of a liveness or readiness probe. Check returns nil when the
+// check passes. Probes run often, so checks must be cheap and must not write.
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// LivenessChecks returns the checks of a liveness probe: the graph is open.
+func (g *Graph) LivenessChecks() []HealthCheck {
+	return []HealthCheck{{Name: "db", Check: g.checkOpen}}
+}
+
+// ReadinessChecks returns the checks of a readiness probe: the graph is open, no journaled
+// operation waits for recovery (see PendingRecovery), the schema is migrated and, for
+// followers, replication has synced and lags at most maxReplicationLag behind. They only
+// read a few keys.
+func (g *Graph) ReadinessChecks(maxReplicationLag time.Duration) []HealthCheck {
+	return []HealthCheck{
+		{Name: "db", Check: g.checkOpen},
+		{Name: "journal", Check: g.checkJournal},
+		{Name: "migrations", Check: g.checkMigrations},
+		{Name: "replication", Check: func(ctx context.Context) error {
+			return g.checkReplication(maxReplicationLag)
+		}},
+	}
+}
+
+func (g *Graph) checkOpen(ctx context.Context) error {
+	if g.Closed() {
+		return ErrClosed
+	}
+	return nil
+}
+
+func (g *Graph) checkJournal(ctx context.Context) error {
+	pending, err := g.PendingRecovery()
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		return fmt.Errorf("%d journaled operations waiting for recovery", pending)
+	}
+	return nil
+}
+
+func (g *Graph) checkMigrations(ctx context.Context) error {
+	current, latest, err := g.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current < latest {
+		return fmt.Errorf("schema version %d, migrations to %d pending", current, latest)
+	}
+	return nil
+}
+
+func (g *Graph) checkReplication(maxLag time.Duration) error {
+	status := g.ReplicationStatus()
+	if status.Role != RoleFollower {
+		return nil
+	}
+	if status.LastContact.IsZero() {
+		return errors.New("follower has not synced yet")
+	}
+	if status.LagTime > maxLag {
+		return fmt.Errorf("replication lag %v is above %v", status.LagTime, maxLag)
+	}
+	return nil
+}
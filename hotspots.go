@@ -0,0 +1,169 @@
+package Onyx
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Conflicting keys are counted with the space-saving algorithm: at most capacity keys are
+// tracked, and a new key evicts the key with the smallest count and inherits that count as
+// its overestimation error. Keys that conflict often stay in the table, rare ones churn.
+
+const defaultHotspotCapacity = 128
+
+type ConflictKeyMode int
+
+const (
+	// ConflictKeyRaw records conflicting node IDs as they are.
+	ConflictKeyRaw ConflictKeyMode = iota
+	// ConflictKeyTruncate records the first 8 bytes of conflicting node IDs, fewer if the 8th
+	// byte is within a multi-byte character, so the recorded key is valid UTF-8.
+	ConflictKeyTruncate
+	// ConflictKeyHash records a 64 bit FNV-1a hash of conflicting node IDs.
+	ConflictKeyHash
+)
+
+const truncatedConflictKeyLen = 8
+
+type HotspotEntry struct {
+	Key   string
+	Count uint64
+	// Error bounds the overestimation of Count: the true count is between Count-Error and Count.
+	Error uint64
+}
+
+// WithConflictKeyPrivacy controls how conflicting node IDs are recorded for ConflictHotspots.
+func WithConflictKeyPrivacy(mode ConflictKeyMode) Option {
+	return func(g *Graph) {
+		g.hotspots.mode = mode
+	}
+}
+
+// WithConflictHotspotCapacity sets how many distinct conflicting keys are tracked. Defaults to 128.
+func WithConflictHotspotCapacity(capacity int) Option {
+	return func(g *Graph) {
+		g.hotspots.capacity = capacity
+	}
+}
+
+type hotspotTracker struct {
+	mu       sync.Mutex
+	mode     ConflictKeyMode
+	capacity int
+	entries  map[string]*HotspotEntry
+}
+
+func newHotspotTracker() *hotspotTracker {
+	return &hotspotTracker{capacity: defaultHotspotCapacity, entries: make(map[string]*HotspotEntry)}
+}
+
+func (h *hotspotTracker) displayKey(key string) string {
+	switch h.mode {
+	case ConflictKeyTruncate:
+		if len(key) > truncatedConflictKeyLen {
+			n := truncatedConflictKeyLen
+			for n > 0 && !utf8.RuneStart(key[n]) {
+				n--
+			}
+			return key[:n]
+		}
+	case ConflictKeyHash:
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		return fmt.Sprintf("%016x", hash.Sum64())
+	}
+	return key
+}
+
+func (h *hotspotTracker) record(key string) {
+	if h.capacity <= 0 {
+		return
+	}
+	key = h.displayKey(key)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if e, ok := h.entries[key]; ok {
+		e.Count++
+		return
+	}
+	if len(h.entries) < h.capacity {
+		h.entries[key] = &HotspotEntry{Key: key, Count: 1}
+		return
+	}
+
+	var min *HotspotEntry
+	for _, e := range h.entries {
+		if min == nil || e.Count < min.Count || (e.Count == min.Count && e.Key < min.Key) {
+			min = e
+		}
+	}
+	delete(h.entries, min.Key)
+	h.entries[key] = &HotspotEntry{Key: key, Count: min.Count + 1, Error: min.Count}
+}
+
+func (h *hotspotTracker) top(k int) []HotspotEntry {
+	h.mu.Lock()
+	entries := make([]HotspotEntry, 0, len(h.entries))
+	for _, e := range h.entries {
+		entries = append(entries, *e)
+	}
+	h.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if k < len(entries) {
+		entries = entries[:k]
+	}
+	return entries
+}
+
+func (h *hotspotTracker) reset() {
+	h.mu.Lock()
+	h.entries = make(map[string]*HotspotEntry)
+	h.mu.Unlock()
+}
+
+// recordConflict counts err once if it is a transaction conflict, attributed to every node
+// whose keys the transaction wrote. Callers pass canonical IDs, the ones the keys are under.
+func (g *Graph) recordConflict(err error, nodes ...string) {
+	if !errors.Is(err, badger.ErrConflict) {
+		return
+	}
+	g.metrics.conflicts.Add(1)
+	for _, node := range nodes {
+		g.hotspots.record(node)
+	}
+}
+
+// RecordConflict counts a transaction conflict on node key. Onyx records conflicts of the
+// transactions it commits itself; callers that commit their own transactions can use
+// RecordConflict to make their retries show up in ConflictHotspots too.
+func (g *Graph) RecordConflict(key string) {
+	g.metrics.conflicts.Add(1)
+	g.hotspots.record(key)
+}
+
+// ConflictHotspots returns the k keys with the most recorded conflicts, most conflicts first.
+func (g *Graph) ConflictHotspots(k int) ([]HotspotEntry, error) {
+	if k < 0 {
+		return nil, fmt.Errorf("onyx: invalid hotspot count %d", k)
+	}
+	return g.hotspots.top(k), nil
+}
+
+// ResetConflictHotspots clears the recorded conflicts, and the Conflicts count of Metrics.
+func (g *Graph) ResetConflictHotspots() {
+	g.hotspots.reset()
+	g.metrics.conflicts.Store(0)
+}
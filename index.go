@@ -0,0 +1,450 @@
+package Onyx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// A property index maps the values of one node property to the nodes holding them:
+//
+//	propIndexPrefix + name + keySep + orderedValue + indexValueEnd + node
+//
+// orderedValue is an encoding of the value whose byte order matches the order of the
+// values for the kind in the property schema, so equality and range queries are prefix
+// and range scans. Index entries are maintained in the transaction of every node property
+// write once the index is created, and the existing properties are backfilled in batches
+// that record their progress, so an interrupted IndexProperty resumes where it stopped.
+
+const (
+	metaPropIndexPrefix = "propindex:"
+	indexBackfillBatch  = 1000
+)
+
+// Inside orderedValue NUL bytes are escaped as 0x00 0xff, so indexValueEnd can't appear in it
+// and values order correctly regardless of their length.
+var indexValueEnd = []byte{0x00, 0x01}
+
+var (
+	ErrNoIndex       = errors.New("onyx: property is not indexed")
+	ErrIndexNotReady = errors.New("onyx: property index is still being backfilled")
+)
+
+type indexState struct {
+	Ready bool
+	// Cursor is the last node property key the backfill processed.
+	Cursor []byte
+}
+
+func indexMetaKey(name string) []byte {
+	return metaKey(metaPropIndexPrefix + name)
+}
+
+func indexNamePrefix(name string) []byte {
+	return []byte(propIndexPrefix + name + keySep)
+}
+
+func escapeIndexValue(value []byte) []byte {
+	escaped := make([]byte, 0, len(value)+len(indexValueEnd))
+	for _, b := range value {
+		escaped = append(escaped, b)
+		if b == 0x00 {
+			escaped = append(escaped, 0xff)
+		}
+	}
+	return escaped
+}
+
+func indexKey(name string, ordered []byte, node string) []byte {
+	key := indexNamePrefix(name)
+	key = append(key, escapeIndexValue(ordered)...)
+	key = append(key, indexValueEnd...)
+	return append(key, node...)
+}
+
+// orderedEncoding converts a stored property value of kind into its order preserving form.
+func orderedEncoding(kind PropKind, value []byte) ([]byte, error) {
+	switch kind {
+	case PropInt64, PropTime:
+		if reason := checkPropKind(kind, value); reason != "" {
+			return nil, errors.New(reason)
+		}
+		// Flipping the sign bit orders two's complement integers as unsigned ones.
+		v := binary.BigEndian.Uint64(value) ^ (1 << 63)
+		return binary.BigEndian.AppendUint64(nil, v), nil
+	case PropFloat64:
+		f, err := decodeFloat64(value)
+		if err != nil {
+			return nil, err
+		}
+		bits := math.Float64bits(f)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		return binary.BigEndian.AppendUint64(nil, bits), nil
+	}
+	return value, nil
+}
+
+// encodeQueryValue converts a Go value used in a query into the stored encoding of kind.
+func encodeQueryValue(kind PropKind, v any) ([]byte, error) {
+	switch kind {
+	case PropInt64:
+		switch n := v.(type) {
+		case int:
+			return EncodeInt64(int64(n)), nil
+		case int64:
+			return EncodeInt64(n), nil
+		}
+	case PropFloat64:
+		switch f := v.(type) {
+		case float64:
+			return EncodeFloat64(f), nil
+		case int:
+			return EncodeFloat64(float64(f)), nil
+		}
+	case PropTime:
+		if t, ok := v.(time.Time); ok {
+			return EncodeTime(t), nil
+		}
+	case PropBool:
+		if b, ok := v.(bool); ok {
+			return EncodeBool(b), nil
+		}
+	default:
+		switch s := v.(type) {
+		case string:
+			return []byte(s), nil
+		case []byte:
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("onyx: can't query a %s property with a %T", kind, v)
+}
+
+func readIndexState(txn *badger.Txn, name string) (*indexState, error) {
+	return readIndexStateAt(txn, indexMetaKey(name))
+}
+
+// readIndexStateAt returns the index state stored under key, or nil if there is none.
+func readIndexStateAt(txn *badger.Txn, key []byte) (*indexState, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state := &indexState{}
+	err = item.Value(func(val []byte) error {
+		state.Ready = val[0] == 1
+		state.Cursor = append([]byte{}, val[1:]...)
+		return nil
+	})
+	return state, err
+}
+
+func writeIndexState(txn *badger.Txn, name string, state *indexState) error {
+	return writeIndexStateAt(txn, indexMetaKey(name), state)
+}
+
+func writeIndexStateAt(txn *badger.Txn, key []byte, state *indexState) error {
+	val := []byte{0}
+	if state.Ready {
+		val[0] = 1
+	}
+	return txn.Set(key, append(val, state.Cursor...))
+}
+
+func indexKind(txn *badger.Txn, name string) (PropKind, error) {
+	kind, ok, err := readPropertySchema(txn, name)
+	if !ok && err == nil {
+		kind = PropBytes
+	}
+	return kind, err
+}
+
+// updatePropertyIndex replaces the index entry of node for property name, if name is indexed.
+// A nil value only removes the old entry.
+func updatePropertyIndex(txn *badger.Txn, node string, name string, value []byte) error {
+	state, err := readIndexState(txn, name)
+	if err != nil || state == nil {
+		return err
+	}
+	kind, err := indexKind(txn, name)
+	if err != nil {
+		return err
+	}
+
+	item, err := txn.Get(nodePropKey(node, name))
+	if err == nil {
+		old, err := copyPropertyValue(item)
+		if err != nil {
+			return err
+		}
+		ordered, err := orderedEncoding(kind, old)
+		if err == nil {
+			if err := txn.Delete(indexKey(name, ordered, node)); err != nil {
+				return err
+			}
+		}
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	if value == nil {
+		return nil
+	}
+	ordered, err := orderedEncoding(kind, value)
+	if err != nil {
+		return &ErrPropertyType{Name: name, Kind: kind, Reason: err.Error()}
+	}
+	return txn.Set(indexKey(name, ordered, node), nil)
+}
+
+// IndexProperty creates an index over the node property name, or finishes building it if a
+// previous call was interrupted, and returns once every existing value has been indexed.
+// The kind in the property schema determines the order of the index; properties without a
+// schema are ordered as bytes. Writes made while the index is being built are indexed too.
+func (g *Graph) IndexProperty(name string) error {
+	end, err := g.begin("IndexProperty")
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	err = g.DB.Update(func(txn *badger.Txn) error {
+		state, err := readIndexState(txn, name)
+		if err != nil || state != nil {
+			return err
+		}
+		return writeIndexState(txn, name, &indexState{})
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		if g.closing() {
+			return ErrClosed
+		}
+		if err := g.faultPoint("IndexProperty"); err != nil {
+			return err
+		}
+		done, err := g.backfillIndexBatch(name, indexBackfillBatch)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+func (g *Graph) backfillIndexBatch(name string, batchSize int) (bool, error) {
+	txn := g.DB.NewTransaction(true)
+	defer txn.Discard()
+
+	state, err := readIndexState(txn, name)
+	if err != nil {
+		return false, err
+	}
+	if state == nil {
+		return false, ErrNoIndex
+	}
+	if state.Ready {
+		return true, nil
+	}
+	kind, err := indexKind(txn, name)
+	if err != nil {
+		return false, err
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(nodePropPrefix)
+	it := txn.NewIterator(opts)
+	n := 0
+	it.Seek(append([]byte(nodePropPrefix), state.Cursor...))
+	if it.Valid() && bytes.Equal(it.Item().Key()[len(nodePropPrefix):], state.Cursor) {
+		it.Next()
+	}
+	done := true
+	for ; it.Valid(); it.Next() {
+		if n == batchSize {
+			done = false
+			break
+		}
+		n++
+		item := it.Item()
+		rest := item.Key()[len(nodePropPrefix):]
+		state.Cursor = append(state.Cursor[:0], rest...)
+		sep := bytes.IndexByte(rest, keySep[0])
+		if string(rest[sep+1:]) != name {
+			continue
+		}
+		value, err := copyPropertyValue(item)
+		if err != nil {
+			it.Close()
+			return false, err
+		}
+		ordered, err := orderedEncoding(kind, value)
+		if err != nil {
+			// Values written before the schema was defined can't be indexed.
+			continue
+		}
+		err = txn.Set(indexKey(name, ordered, string(rest[:sep])), nil)
+		if err != nil {
+			it.Close()
+			return false, err
+		}
+	}
+	it.Close()
+
+	state.Ready = done
+	err = writeIndexState(txn, name, state)
+	if err != nil {
+		return false, err
+	}
+	return done, txn.Commit()
+}
+
+// DropPropertyIndex deletes the index over name and all its entries, in batches of separate transactions.
+func (g *Graph) DropPropertyIndex(name string) error {
+	end, err := g.begin("DropPropertyIndex")
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	err = g.DB.Update(func(txn *badger.Txn) error {
+		return txn.Delete(indexMetaKey(name))
+	})
+	if err != nil {
+		return err
+	}
+	return g.deletePrefix(indexNamePrefix(name))
+}
+
+// deletePrefix deletes every key with prefix, committing whenever the transaction is full.
+func (g *Graph) deletePrefix(prefix []byte) error {
+	for {
+		txn := g.DB.NewTransaction(true)
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		var keys [][]byte
+		for it.Rewind(); it.Valid() && len(keys) < indexBackfillBatch; it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		it.Close()
+
+		for _, key := range keys {
+			if err := txn.Delete(key); err != nil {
+				txn.Discard()
+				return err
+			}
+		}
+		if err := txn.Commit(); err != nil {
+			return err
+		}
+		if len(keys) < indexBackfillBatch {
+			return nil
+		}
+	}
+}
+
+// NodesWhereEq returns up to limit nodes whose property prop equals value, in node order.
+// A limit of 0 means no limit. prop must be indexed, see IndexProperty.
+func (g *Graph) NodesWhereEq(prop string, value any, limit int, txn *badger.Txn) ([]string, error) {
+	return g.nodesWhere(prop, value, value, true, limit, txn)
+}
+
+// NodesWhereRange returns up to limit nodes whose property prop is between min and max,
+// inclusive, ordered by value. A nil min or max leaves that end of the range open.
+func (g *Graph) NodesWhereRange(prop string, min any, max any, limit int, txn *badger.Txn) ([]string, error) {
+	return g.nodesWhere(prop, min, max, false, limit, txn)
+}
+
+func (g *Graph) nodesWhere(prop string, min any, max any, eq bool, limit int, txn *badger.Txn) ([]string, error) {
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("NodesWhere")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	state, err := readIndexState(txn, prop)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, ErrNoIndex
+	}
+	if !state.Ready {
+		return nil, ErrIndexNotReady
+	}
+	kind, err := indexKind(txn, prop)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := indexNamePrefix(prop)
+	boundKey := func(v any) ([]byte, error) {
+		value, err := encodeQueryValue(kind, v)
+		if err != nil {
+			return nil, err
+		}
+		ordered, err := orderedEncoding(kind, value)
+		if err != nil {
+			return nil, err
+		}
+		return append(append(append([]byte{}, prefix...), escapeIndexValue(ordered)...), indexValueEnd...), nil
+	}
+
+	start := prefix
+	if min != nil {
+		if start, err = boundKey(min); err != nil {
+			return nil, err
+		}
+	}
+	var end []byte
+	if max != nil {
+		if end, err = boundKey(max); err != nil {
+			return nil, err
+		}
+	}
+
+	var nodes []string
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	for it.Seek(start); it.Valid(); it.Next() {
+		if limit > 0 && len(nodes) == limit {
+			break
+		}
+		key := it.Item().Key()
+		valueEnd := bytes.Index(key[len(prefix):], indexValueEnd) + len(prefix) + len(indexValueEnd)
+		if end != nil {
+			if eq && !bytes.Equal(key[:valueEnd], end) {
+				break
+			}
+			if bytes.Compare(key[:valueEnd], end) > 0 {
+				break
+			}
+		}
+		nodes = append(nodes, string(key[valueEnd:]))
+	}
+	it.Close()
+
+	return nodes, nil
+}
@@ -0,0 +1,196 @@
+package Onyx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// The journal makes operations that span several transactions resumable. Such an operation
+// writes a journal entry before its first transaction and updates the entry in the same
+// transaction as every step it takes, so the entry always describes the work that is left.
+// NewGraph resumes every entry it finds, and the operation deletes the entry when it is done.
+
+type journalEntry struct {
+	ID     uint64
+	Op     string
+	Arg    string
+	Phase  int
+	Cursor []byte
+	Counts map[string]int
+}
+
+// journalOps maps the Op of a journal entry to the function that runs it to completion.
+var journalOps = map[string]func(g *Graph, entry *journalEntry) error{}
+
+func journalKey(id uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(journalPrefix), id)
+}
+
+// newJournalEntry writes a new entry for op. The entry is claimed, see claimJournalEntry, and
+// the caller calls release once it stops running it.
+func (g *Graph) newJournalEntry(op string, arg string) (entry *journalEntry, release func(), err error) {
+	entry = &journalEntry{Op: op, Arg: arg, Counts: map[string]int{}}
+	for attempt := 0; ; attempt++ {
+		release = func() {}
+		err = g.DB.Update(func(txn *badger.Txn) error {
+			id, err := nextJournalID(txn)
+			if err != nil {
+				return err
+			}
+			entry.ID = id
+			// Claimed before the commit, so PendingRecovery never counts it as left over.
+			release = g.claimJournalEntry(id)
+			return writeJournalEntry(txn, entry)
+		})
+		if err == nil {
+			return entry, release, nil
+		}
+		release()
+		if err != badger.ErrConflict || attempt >= g.updateRetries {
+			return nil, nil, err
+		}
+	}
+}
+
+// nextJournalID allocates the ID of a new entry from the head of the journal, a counter every
+// new entry reads and writes, so entries are numbered in the order they are written and
+// resumed in that order whatever the clock does. Databases written before the head existed
+// continue after their last entry, whose ID was the time it was written.
+func nextJournalID(txn *badger.Txn) (uint64, error) {
+	var head uint64
+	item, err := txn.Get(metaKey(metaJournalHeadKey))
+	if err == nil {
+		err = item.Value(func(val []byte) error {
+			head = binary.BigEndian.Uint64(val)
+			return nil
+		})
+	} else if err == badger.ErrKeyNotFound {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(journalPrefix)
+		opts.PrefetchValues = false
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		// Seeking to the largest possible ID finds the last entry when iterating in reverse.
+		it.Seek(journalKey(^uint64(0)))
+		if it.Valid() {
+			head = binary.BigEndian.Uint64(it.Item().Key()[len(journalPrefix):])
+		}
+		it.Close()
+		err = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	head++
+	return head, txn.Set(metaKey(metaJournalHeadKey), binary.BigEndian.AppendUint64(nil, head))
+}
+
+func writeJournalEntry(txn *badger.Txn, entry *journalEntry) error {
+	b := new(bytes.Buffer)
+	err := gob.NewEncoder(b).Encode(entry)
+	if err != nil {
+		return err
+	}
+	return txn.Set(journalKey(entry.ID), b.Bytes())
+}
+
+func deleteJournalEntry(txn *badger.Txn, entry *journalEntry) error {
+	return txn.Delete(journalKey(entry.ID))
+}
+
+func readJournal(txn *badger.Txn) ([]*journalEntry, error) {
+	var entries []*journalEntry
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(journalPrefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		entry := &journalEntry{}
+		err := it.Item().Value(func(val []byte) error {
+			return gob.NewDecoder(bytes.NewReader(val)).Decode(entry)
+		})
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// PendingRecovery returns how many journaled operations are unfinished and not running: the
+// operations that failed part way, for example on a write conflict, and are left for the
+// next NewGraph to resume. Until then the graph holds their partial work, such as half of
+// the nodes of a RemoveNodesWithPrefix. It only reads the journal keys.
+func (g *Graph) PendingRecovery() (int, error) {
+	end, err := g.begin("PendingRecovery")
+	if err != nil {
+		return 0, err
+	}
+	defer end()
+
+	pending := 0
+	err = g.DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(journalPrefix)
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		g.journalMu.Lock()
+		defer g.journalMu.Unlock()
+		for it.Rewind(); it.Valid(); it.Next() {
+			id := binary.BigEndian.Uint64(it.Item().Key()[len(journalPrefix):])
+			if !g.journalRunning[id] {
+				pending++
+			}
+		}
+		return nil
+	})
+	return pending, err
+}
+
+// claimJournalEntry marks the entry with id as running until release is called, so
+// PendingRecovery doesn't count it.
+func (g *Graph) claimJournalEntry(id uint64) (release func()) {
+	g.journalMu.Lock()
+	defer g.journalMu.Unlock()
+	if g.journalRunning == nil {
+		g.journalRunning = make(map[uint64]bool)
+	}
+	g.journalRunning[id] = true
+	return func() {
+		g.journalMu.Lock()
+		defer g.journalMu.Unlock()
+		delete(g.journalRunning, id)
+	}
+}
+
+// recoverJournal resumes every operation left in the journal, oldest first.
+func (g *Graph) recoverJournal() error {
+	var entries []*journalEntry
+	err := g.DB.View(func(txn *badger.Txn) error {
+		var err error
+		entries, err = readJournal(txn)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		run, ok := journalOps[entry.Op]
+		if !ok {
+			return fmt.Errorf("onyx: journal entry %d has unknown operation %q", entry.ID, entry.Op)
+		}
+		release := g.claimJournalEntry(entry.ID)
+		err = run(g, entry)
+		release()
+		if err != nil {
+			return fmt.Errorf("onyx: resuming %s(%q) from the journal: %w", entry.Op, entry.Arg, err)
+		}
+	}
+	return nil
+}
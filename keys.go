@@ -0,0 +1,112 @@
+package Onyx
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// All keys written by Onyx for its own bookkeeping start with internalKeyPrefix.
+// User node IDs are stored as plain keys, so node IDs may not contain this byte.
+const internalKeyPrefix = "\x00"
+
+// nodeKeyStart is the smallest key that can hold a node, ie the first key after the internal keyspace.
+var nodeKeyStart = []byte{0x01}
+
+const (
+	metaPrefix     = internalKeyPrefix + "meta:"
+	nodePropPrefix = internalKeyPrefix + "np:"
+	edgePropPrefix = internalKeyPrefix + "ep:"
+	journalPrefix  = internalKeyPrefix + "journal:"
+	// propIndexPrefix holds the entries of property indexes, see IndexProperty.
+	propIndexPrefix = internalKeyPrefix + "pi:"
+	// changelogPrefix holds change records keyed by sequence number, changelogNodePrefix
+	// indexes them by source node.
+	changelogPrefix     = internalKeyPrefix + "log:"
+	changelogNodePrefix = internalKeyPrefix + "logn:"
+	// redirectPrefix holds the redirect markers left by Redirect, keyed by the old node ID.
+	redirectPrefix = internalKeyPrefix + "redir:"
+	// mutationStatsPrefix holds the per-node edge change counters, see WithMutationStats.
+	mutationStatsPrefix = internalKeyPrefix + "mstat:"
+	// deadLetterPrefix holds mutations that failed asynchronously, see DeadLetters.
+	deadLetterPrefix = internalKeyPrefix + "dlq:"
+	// reverseEdgePrefix holds the reverse edge index, see IndexReverseEdges.
+	reverseEdgePrefix = internalKeyPrefix + "rev:"
+	// sketchPrefix holds the MinHash signatures of edge lists, see WithMinHashSketches.
+	sketchPrefix = internalKeyPrefix + "sketch:"
+	// provenancePrefix holds the sources asserting every edge, sourcePrefix the same
+	// assertions keyed by source, see AddSourcedEdge.
+	provenancePrefix = internalKeyPrefix + "prov:"
+	sourcePrefix     = internalKeyPrefix + "src:"
+	// crossEdgePrefix holds the edges into other graphs of a Store, crossRefPrefix the same
+	// edges keyed by target graph, see Store.AddCrossEdge.
+	crossEdgePrefix = internalKeyPrefix + "xe:"
+	crossRefPrefix  = internalKeyPrefix + "xr:"
+	// driftPrefix holds the history of drift snapshots keyed by time, see TakeDriftSnapshot.
+	driftPrefix = internalKeyPrefix + "drift:"
+	// edgeKeyPrefix holds the edges of the nodes stored in StoragePerEdge layout, see
+	// StorageMode.
+	edgeKeyPrefix = internalKeyPrefix + "edge:"
+	// shadowPrefix holds the shadow codec mismatches by node, see WithShadowCodec.
+	shadowPrefix = internalKeyPrefix + "shadow:"
+	// aliasPrefix holds the node named by each alias, aliasOfPrefix the same aliases keyed
+	// by node, see AddAlias.
+	aliasPrefix   = internalKeyPrefix + "alias:"
+	aliasOfPrefix = internalKeyPrefix + "aliasof:"
+	// oraclePrefix holds the landmark distances of the distance oracle, see
+	// BuildDistanceOracle.
+	oraclePrefix = internalKeyPrefix + "oracle:"
+)
+
+// keySep separates the components of composite internal keys. Node IDs can't contain it.
+const keySep = "\x00"
+
+const (
+	// metaFormatKey holds the schema version, see Migrate.
+	metaFormatKey = "format"
+
+	// metaChangelogHeadKey holds the sequence number of the latest change record.
+	metaChangelogHeadKey   = "changelog-head"
+	metaChangelogPrunedKey = "changelog-pruned"
+
+	// metaJournalHeadKey holds the ID of the latest journal entry.
+	metaJournalHeadKey = "journal-head"
+)
+
+var ErrInvalidNodeID = errors.New("onyx: node id must be non-empty and must not contain a NUL byte")
+
+func metaKey(name string) []byte {
+	return []byte(metaPrefix + name)
+}
+
+// nodePropKey returns the key of one property of node. With an empty name it is the
+// prefix of all properties of node.
+func nodePropKey(node string, name string) []byte {
+	return []byte(nodePropPrefix + node + keySep + name)
+}
+
+// edgePropKey returns the key of one property of the edge from->to. With an empty name
+// it is the prefix of all properties of that edge.
+func edgePropKey(from string, to string, name string) []byte {
+	return []byte(edgePropPrefix + from + keySep + to + keySep + name)
+}
+
+func changelogKey(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(changelogPrefix), seq)
+}
+
+// changelogNodeKey returns the index key of the change with seq to the edge list of from.
+func changelogNodeKey(from string, seq uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(changelogNodePrefix+from+keySep), seq)
+}
+
+func isInternalKey(key []byte) bool {
+	return len(key) > 0 && key[0] == internalKeyPrefix[0]
+}
+
+func validateNodeID(id string) error {
+	if id == "" || strings.Contains(id, keySep) {
+		return ErrInvalidNodeID
+	}
+	return nil
+}
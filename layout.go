@@ -0,0 +1,307 @@
+package Onyx
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+type LayoutAlgo int
+
+const (
+	// LayoutForceDirected is the Fruchterman-Reingold spring embedder.
+	LayoutForceDirected LayoutAlgo = iota
+	// LayoutHierarchical places the nodes of a DAG in layers by longest path from a source,
+	// and orders every layer by the barycenter of its predecessors to reduce crossings.
+	LayoutHierarchical
+)
+
+const (
+	defaultLayoutMaxNodes = 1000
+	maxLayoutIterations   = 1000
+
+	// LayoutXProperty and LayoutYProperty hold coordinates persisted by ComputeLayout.
+	LayoutXProperty = "layout.x"
+	LayoutYProperty = "layout.y"
+)
+
+var ErrNotDAG = errors.New("onyx: hierarchical layout requires an acyclic graph")
+
+type LayoutOptions struct {
+	// Seed makes the force directed layout deterministic.
+	Seed int64
+	// MaxNodes bounds the laid out subgraph. Defaults to 1000.
+	MaxNodes int
+	// Start lays out the MaxNodes nodes closest to Start instead of the first MaxNodes nodes in key order.
+	Start string
+	// Persist stores the coordinates in the LayoutXProperty and LayoutYProperty node properties.
+	// txn must then be a read-write transaction.
+	Persist bool
+}
+
+// ComputeLayout computes 2D coordinates for a bounded subgraph. The number of iterations is capped at 1000.
+func (g *Graph) ComputeLayout(algo LayoutAlgo, iterations int, opts LayoutOptions, txn *badger.Txn) (map[string][2]float64, error) {
+	if opts.MaxNodes <= 0 {
+		opts.MaxNodes = defaultLayoutMaxNodes
+	}
+	if iterations > maxLayoutIterations {
+		iterations = maxLayoutIterations
+	}
+
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("ComputeLayout")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		txn = g.DB.NewTransaction(opts.Persist)
+		defer txn.Discard()
+	}
+
+	nodes, edges, err := layoutSubgraph(txn, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var positions [][2]float64
+	switch algo {
+	case LayoutForceDirected:
+		positions = forceDirectedLayout(len(nodes), edges, iterations, opts.Seed)
+	case LayoutHierarchical:
+		positions, err = hierarchicalLayout(len(nodes), edges, iterations)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("onyx: unknown layout algorithm %d", algo)
+	}
+
+	layout := make(map[string][2]float64, len(nodes))
+	for i, node := range nodes {
+		layout[node] = positions[i]
+		if opts.Persist {
+			err = g.SetNodeProperties(node, map[string][]byte{
+				LayoutXProperty: encodeFloat64(positions[i][0]),
+				LayoutYProperty: encodeFloat64(positions[i][1]),
+			}, txn)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if localTxn {
+		err = txn.Commit()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return layout, nil
+}
+
+// layoutSubgraph picks at most opts.MaxNodes nodes and returns them sorted, along with the edges between them as index pairs.
+func layoutSubgraph(txn *badger.Txn, opts LayoutOptions) ([]string, [][2]int, error) {
+	selected := make(map[string]bool)
+	if opts.Start != "" {
+		frontier := []string{opts.Start}
+		selected[opts.Start] = true
+		for len(frontier) > 0 && len(selected) < opts.MaxNodes {
+			var next []string
+			for _, node := range frontier {
+				dstNodes, _, err := readEdgeMap(txn, node)
+				if err != nil {
+					return nil, nil, err
+				}
+				for _, neighbor := range sortedNeighbors(dstNodes) {
+					if len(selected) == opts.MaxNodes {
+						break
+					}
+					if !selected[neighbor] {
+						selected[neighbor] = true
+						next = append(next, neighbor)
+					}
+				}
+			}
+			frontier = next
+		}
+	} else {
+		errFull := errors.New("full")
+		err := forEachEdgeList(txn, func(from string, dstNodes map[string]bool) error {
+			for _, node := range append([]string{from}, sortedNeighbors(dstNodes)...) {
+				if len(selected) == opts.MaxNodes {
+					return errFull
+				}
+				selected[node] = true
+			}
+			return nil
+		})
+		if err != nil && err != errFull {
+			return nil, nil, err
+		}
+	}
+
+	nodes := sortedNeighbors(selected)
+	index := make(map[string]int, len(nodes))
+	for i, node := range nodes {
+		index[node] = i
+	}
+	var edges [][2]int
+	for i, node := range nodes {
+		dstNodes, _, err := readEdgeMap(txn, node)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, neighbor := range sortedNeighbors(dstNodes) {
+			if j, ok := index[neighbor]; ok && j != i {
+				edges = append(edges, [2]int{i, j})
+			}
+		}
+	}
+	return nodes, edges, nil
+}
+
+// forceDirectedLayout places n nodes in the unit square using Fruchterman-Reingold.
+func forceDirectedLayout(n int, edges [][2]int, iterations int, seed int64) [][2]float64 {
+	rng := rand.New(rand.NewSource(seed))
+	pos := make([][2]float64, n)
+	for i := range pos {
+		pos[i] = [2]float64{rng.Float64(), rng.Float64()}
+	}
+	if n < 2 {
+		return pos
+	}
+
+	k := math.Sqrt(1 / float64(n))
+	temperature := 0.1
+	disp := make([][2]float64, n)
+	for iter := 0; iter < iterations; iter++ {
+		for i := range disp {
+			disp[i] = [2]float64{}
+		}
+		for i := 0; i < n; i++ {
+			for j := i + 1; j < n; j++ {
+				dx, dy, dist := delta(pos[i], pos[j])
+				force := k * k / dist
+				disp[i][0] += dx / dist * force
+				disp[i][1] += dy / dist * force
+				disp[j][0] -= dx / dist * force
+				disp[j][1] -= dy / dist * force
+			}
+		}
+		for _, e := range edges {
+			dx, dy, dist := delta(pos[e[0]], pos[e[1]])
+			force := dist * dist / k
+			disp[e[0]][0] -= dx / dist * force
+			disp[e[0]][1] -= dy / dist * force
+			disp[e[1]][0] += dx / dist * force
+			disp[e[1]][1] += dy / dist * force
+		}
+
+		cool := temperature * (1 - float64(iter)/float64(iterations))
+		for i := range pos {
+			length := math.Hypot(disp[i][0], disp[i][1])
+			if length == 0 {
+				continue
+			}
+			step := math.Min(length, cool)
+			pos[i][0] = math.Min(1, math.Max(0, pos[i][0]+disp[i][0]/length*step))
+			pos[i][1] = math.Min(1, math.Max(0, pos[i][1]+disp[i][1]/length*step))
+		}
+	}
+	return pos
+}
+
+func delta(a [2]float64, b [2]float64) (float64, float64, float64) {
+	dx, dy := a[0]-b[0], a[1]-b[1]
+	dist := math.Hypot(dx, dy)
+	if dist < 1e-9 {
+		// Coincident nodes are pushed apart along a fixed direction to stay deterministic.
+		dx, dy, dist = 1e-9, 0, 1e-9
+	}
+	return dx, dy, dist
+}
+
+// hierarchicalLayout puts node i at (position in its layer, layer).
+func hierarchicalLayout(n int, edges [][2]int, iterations int) ([][2]float64, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	succ := make([][]int, n)
+	pred := make([][]int, n)
+	inDegree := make([]int, n)
+	for _, e := range edges {
+		succ[e[0]] = append(succ[e[0]], e[1])
+		pred[e[1]] = append(pred[e[1]], e[0])
+		inDegree[e[1]]++
+	}
+
+	layer := make([]int, n)
+	var queue []int
+	for i := 0; i < n; i++ {
+		if inDegree[i] == 0 {
+			queue = append(queue, i)
+		}
+	}
+	visited := 0
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		visited++
+		for _, j := range succ[i] {
+			if layer[i]+1 > layer[j] {
+				layer[j] = layer[i] + 1
+			}
+			inDegree[j]--
+			if inDegree[j] == 0 {
+				queue = append(queue, j)
+			}
+		}
+	}
+	if visited != n {
+		return nil, ErrNotDAG
+	}
+
+	var layers [][]int
+	for i := 0; i < n; i++ {
+		for len(layers) <= layer[i] {
+			layers = append(layers, nil)
+		}
+		layers[layer[i]] = append(layers[layer[i]], i)
+	}
+
+	order := make([]float64, n)
+	for _, nodes := range layers {
+		for x, i := range nodes {
+			order[i] = float64(x)
+		}
+	}
+	for iter := 0; iter < iterations; iter++ {
+		for _, nodes := range layers[1:] {
+			barycenter := make(map[int]float64, len(nodes))
+			for _, i := range nodes {
+				sum := 0.0
+				for _, p := range pred[i] {
+					sum += order[p]
+				}
+				barycenter[i] = sum / float64(len(pred[i]))
+			}
+			sort.SliceStable(nodes, func(a, b int) bool {
+				return barycenter[nodes[a]] < barycenter[nodes[b]]
+			})
+			for x, i := range nodes {
+				order[i] = float64(x)
+			}
+		}
+	}
+
+	pos := make([][2]float64, n)
+	for i := range pos {
+		pos[i] = [2]float64{order[i], float64(layer[i])}
+	}
+	return pos, nil
+}
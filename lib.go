@@ -4,18 +4,110 @@ import (
 	"bytes"
 	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"github.com/dgraph-io/badger/v4"
 	"github.com/dgraph-io/ristretto/z"
+	"log/slog"
 	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // TODO: Add Label support for edgess
 type Graph struct {
 	DB *badger.DB
+
+	openCheck CheckLevel
+	changelog bool
+
+	replication *replicationState
+
+	metrics  graphMetrics
+	hotspots *hotspotTracker
+
+	inMemory       bool
+	persistOnClose string
+	restoreFrom    string
+
+	redirectDepth   int
+	aliasResolution bool
+	// hasRedirects and hasAliases are set once the graph may have a redirect or an alias,
+	// so the reads of graphs without any don't resolve IDs, see newRedirectResolver.
+	hasRedirects atomic.Bool
+	hasAliases   atomic.Bool
+	// storageMode is the StorageMode edge lists are written in, and hasEdgeKeys is set
+	// once the graph may hold edge lists in StoragePerEdge layout.
+	storageMode   atomic.Int32
+	hasEdgeKeys   atomic.Bool
+	removeMode    RemoveMode
+	updateRetries int
+	txGuard       bool
+
+	statsGranularity time.Duration
+	statsSkips       statsSkips
+
+	readRepair    bool
+	repairLimiter *repairLimiter
+
+	sketchSize int
+
+	normalizer NodeNormalizer
+	bipartite  *BipartiteSchema
+	shadow     *shadowMode
+	// fault is called at the fault points, see WithFaultPoints.
+	fault func(point string) error
+
+	// policies are the write policies in registration order, see RegisterWritePolicy.
+	policies atomic.Pointer[[]func(op MutationOp, tx *Tx) error]
+	policyMu sync.Mutex
+
+	logger *slog.Logger
+
+	// snapshots serves the reads without a transaction, see WithSnapshotPool.
+	snapshots *snapshotPool
+
+	manualMigrations bool
+	// migrateMu serializes Migrate calls.
+	migrateMu sync.Mutex
+	// convertMu serializes ConvertStorageMode calls, conversion is the one running.
+	convertMu  sync.Mutex
+	conversion atomic.Pointer[conversionRun]
+
+	life         *lifecycle
+	drainTimeout time.Duration
+	// journalRunning holds the IDs of the journal entries this graph is running, see
+	// PendingRecovery.
+	journalMu      sync.Mutex
+	journalRunning map[uint64]bool
 }
 
-func NewGraph(path string, inMemory bool) (*Graph, error) {
+var ErrInMemoryPath = errors.New("onyx: in-memory graphs are not persisted to path, pass an empty path or use WithPersistOnClose")
+
+func NewGraph(path string, inMemory bool, opts ...Option) (*Graph, error) {
+	if inMemory && path != "" {
+		return nil, ErrInMemoryPath
+	}
+
+	g := &Graph{
+		hotspots:      newHotspotTracker(),
+		inMemory:      inMemory,
+		redirectDepth: defaultRedirectDepth,
+		updateRetries: defaultUpdateRetries,
+		txGuard:       defaultTxGuard,
+		repairLimiter: newRepairLimiter(readRepairRate, readRepairBurst),
+		life:          newLifecycle(),
+		drainTimeout:  defaultDrainTimeout,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	if g.persistOnClose != "" && !inMemory {
+		return nil, errors.New("onyx: WithPersistOnClose is only supported for in-memory graphs")
+	}
+
 	var db *badger.DB
 	var err error
 
@@ -24,48 +116,208 @@ func NewGraph(path string, inMemory bool) (*Graph, error) {
 	} else {
 		db, err = badger.Open(badger.DefaultOptions(path))
 	}
+	if err != nil {
+		return nil, err
+	}
+	g.DB = db
 
-	return &Graph{db}, err
-}
+	err = g.restoreOnOpen()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-func (g *Graph) Close() {
-	g.DB.Close()
-}
+	err = g.detectRedirects()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-func (g *Graph) AddEdge(from string, to string, txn *badger.Txn) error {
-	localTxn := txn == nil
-	if localTxn {
-		txn = g.DB.NewTransaction(true)
-		defer txn.Discard()
+	err = g.loadStorageMode()
+	if err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	var dstNodes map[string]bool
+	err = g.initMetadata()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	item, err := txn.Get([]byte(from))
+	err = g.openNormalizer()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = g.openSketches()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = g.recoverJournal()
 	if err != nil {
+		g.closeAfterFailedOpen()
+		return nil, err
+	}
+
+	if !g.manualMigrations {
+		err = g.Migrate(context.Background())
+		if err != nil {
+			g.closeAfterFailedOpen()
+			return nil, err
+		}
+	}
+
+	err = g.countDeadLetters()
+	if err != nil {
+		g.closeAfterFailedOpen()
+		return nil, err
+	}
+
+	err = g.runOpenCheck()
+	if err != nil {
+		g.closeAfterFailedOpen()
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// closeAfterFailedOpen closes a graph NewGraph is not going to return, without persisting it.
+func (g *Graph) closeAfterFailedOpen() {
+	g.persistOnClose = ""
+	g.Close()
+}
+
+func (g *Graph) IsInMemory() bool {
+	return g.inMemory
+}
+
+// initMetadata writes the metadata of a new database, and fails with ErrSchemaVersion for
+// databases written by a newer version of the library.
+func (g *Graph) initMetadata() error {
+	return g.DB.Update(func(txn *badger.Txn) error {
+		version, err := readFormatVersion(txn)
 		if err == badger.ErrKeyNotFound {
-			dstNodes = make(map[string]bool)
-		} else {
+			return writeFormatVersion(txn, latestFormatVersion())
+		} else if err != nil {
 			return err
 		}
-	} else { //if err==nil
-		valCopy, err := item.ValueCopy(nil)
-		if err != nil {
-			return err
+		if version > latestFormatVersion() {
+			return &ErrSchemaVersion{Found: version, Supported: latestFormatVersion()}
 		}
-		dstNodes, err = deserializeEdgeMap(valCopy)
+		return nil
+	})
+}
+
+func (g *Graph) runOpenCheck() error {
+	var report ConsistencyReport
+	var err error
+
+	switch g.openCheck {
+	case CheckOff:
+		return nil
+	case CheckQuick:
+		txn := g.DB.NewTransaction(false)
+		defer txn.Discard()
+		report, err = g.quickCheck(txn)
+	case CheckFull:
+		report, err = g.CheckIntegrity(nil)
+	default:
+		return fmt.Errorf("onyx: unknown check level %d", g.openCheck)
+	}
+
+	if err != nil {
+		return err
+	}
+	if !report.OK() {
+		return &ErrConsistency{Report: report}
+	}
+	return nil
+}
+
+// Close closes the graph. New operations fail with ErrClosed from then on; running ones
+// that take a context are cancelled, imports stop at their next commit, and Close waits for
+// all of them, including the commits of ApplyAsync, to finish before closing badger. If they
+// don't within the drain timeout, see WithDrainTimeout, badger is closed anyway and an
+// ErrDrainTimeout listing them is returned. Closing a closed graph returns ErrClosed.
+// For in-memory graphs opened WithPersistOnClose the graph is written to the persist file
+// after draining, and an error is returned if that fails.
+func (g *Graph) Close() error {
+	drainErr := g.drain()
+	if drainErr == ErrClosed {
+		return drainErr
+	}
+	if g.snapshots != nil {
+		g.snapshots.close()
+	}
+
+	var persistErr error
+	if g.persistOnClose != "" {
+		persistErr = g.persist()
+	}
+	err := g.DB.Close()
+	if drainErr != nil {
+		return drainErr
+	}
+	if persistErr != nil {
+		return persistErr
+	}
+	return err
+}
+
+func (g *Graph) AddEdge(from string, to string, txn *badger.Txn) error {
+	from, to = g.nodeID(from), g.nodeID(to)
+	if err := validateNodeID(from); err != nil {
+		return err
+	}
+	if err := validateNodeID(to); err != nil {
+		return err
+	}
+	if err := g.checkBipartiteEdge(from, to); err != nil {
+		return err
+	}
+
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("AddEdge")
 		if err != nil {
 			return err
 		}
+		defer end()
+		txn = g.DB.NewTransaction(true)
+		defer txn.Discard()
 	}
 
-	dstNodes[to] = true
+	from, err := g.resolveWriteID(txn, from)
+	if err != nil {
+		return err
+	}
+	to, err = g.resolveWriteID(txn, to)
+	if err != nil {
+		return err
+	}
+	if err := g.checkWritePolicies(txn, MutationOp{Kind: MutationAddEdge, From: from, To: to}); err != nil {
+		return err
+	}
 
-	serializedEdgeMap, err := serializeEdgeMap(dstNodes)
+	dstNodes, _, err := readEdgeMap(txn, from)
 	if err != nil {
 		return err
 	}
-	err = txn.Set([]byte(from), serializedEdgeMap)
+
+	if !dstNodes[to] {
+		err = g.recordChange(txn, ChangeAddEdge, from, to)
+		if err != nil {
+			return err
+		}
+	}
+	dstNodes[to] = true
+
+	err = g.writeEdgeMap(txn, from, dstNodes)
 	if err != nil {
 		return err
 	}
@@ -73,6 +325,7 @@ func (g *Graph) AddEdge(from string, to string, txn *badger.Txn) error {
 	if localTxn {
 		err = txn.Commit()
 		if err != nil {
+			g.recordConflict(err, from)
 			return err
 		}
 	}
@@ -80,53 +333,158 @@ func (g *Graph) AddEdge(from string, to string, txn *badger.Txn) error {
 	return nil
 }
 
-func (g *Graph) RemoveEdge(from string, to string, txn *badger.Txn) error {
+// RemoveEdge removes the edge from->to and reports whether it existed. Edges that point at
+// an ID redirected to the canonical ID of to are removed as well. What happens when from or
+// the edge doesn't exist depends on the RemoveMode of the graph, see WithRemoveMode.
+func (g *Graph) RemoveEdge(from string, to string, txn *badger.Txn) (bool, error) {
+	from, to = g.nodeID(from), g.nodeID(to)
 	localTxn := txn == nil
 	if localTxn {
+		end, err := g.begin("RemoveEdge")
+		if err != nil {
+			return false, err
+		}
+		defer end()
 		txn = g.DB.NewTransaction(true)
 		defer txn.Discard()
 	}
 
-	item, err := txn.Get([]byte(from))
+	from, err := g.resolveID(txn, from)
 	if err != nil {
-		return err
+		return false, err
 	}
-
-	valCopy, err := item.ValueCopy(nil)
+	removed, err := g.removeEdges(txn, from, []string{to})
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	dstNodes, err := deserializeEdgeMap(valCopy)
-	if err != nil {
-		return err
+	if localTxn {
+		err = txn.Commit()
+		if err != nil {
+			g.recordConflict(err, from)
+			return false, err
+		}
 	}
-	delete(dstNodes, to)
 
-	serializedEdgeMap, err := serializeEdgeMap(dstNodes)
+	return removed > 0, nil
+}
+
+// SetEdges replaces the out-edges of from with exactly neighbors and reports how many
+// edges were added and removed. The edge list is only rewritten when it changes.
+// Like RemoveEdge, clearing every edge keeps from as a node with an empty edge list,
+// while an empty neighbors slice for a node that doesn't exist writes nothing.
+// Every added and removed edge is recorded in the changelog as its own change.
+func (g *Graph) SetEdges(from string, neighbors []string, txn *badger.Txn) (added int, removed int, err error) {
+	from = g.nodeID(from)
+	neighbors = g.nodeIDs(neighbors)
+	if err := validateNodeID(from); err != nil {
+		return 0, 0, err
+	}
+	for _, to := range neighbors {
+		if err := validateNodeID(to); err != nil {
+			return 0, 0, err
+		}
+		if err := g.checkBipartiteEdge(from, to); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("SetEdges")
+		if err != nil {
+			return 0, 0, err
+		}
+		defer end()
+		txn = g.DB.NewTransaction(true)
+		defer txn.Discard()
+	}
+
+	from, err = g.resolveWriteID(txn, from)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
-	err = txn.Set([]byte(from), serializedEdgeMap)
+	current, exists, err := readEdgeMap(txn, from)
 	if err != nil {
-		return err
+		return 0, 0, err
+	}
+
+	target := make(map[string]bool, len(neighbors))
+	for _, to := range neighbors {
+		to, err = g.resolveWriteID(txn, to)
+		if err != nil {
+			return 0, 0, err
+		}
+		if target[to] {
+			continue
+		}
+		target[to] = true
+		if !current[to] {
+			if err := g.checkWritePolicies(txn, MutationOp{Kind: MutationAddEdge, From: from, To: to}); err != nil {
+				return 0, 0, err
+			}
+			added++
+			err = g.recordChange(txn, ChangeAddEdge, from, to)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	for _, to := range sortedNeighbors(current) {
+		if !target[to] {
+			if err := g.checkWritePolicies(txn, MutationOp{Kind: MutationRemoveEdge, From: from, To: to}); err != nil {
+				return 0, 0, err
+			}
+			removed++
+			err = g.recordChange(txn, ChangeRemoveEdge, from, to)
+			if err != nil {
+				return 0, 0, err
+			}
+			err = deleteEdgeProperties(txn, from, to)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	if added > 0 || removed > 0 || (!exists && len(target) > 0) {
+		err = g.writeEdgeMap(txn, from, target)
+		if err != nil {
+			return 0, 0, err
+		}
 	}
 
 	if localTxn {
 		err = txn.Commit()
 		if err != nil {
-			return err
+			g.recordConflict(err, from)
+			return 0, 0, err
 		}
 	}
 
-	return nil
+	return added, removed, nil
 }
 
+// GetEdges returns the out-neighbors of from. Redirected IDs are resolved, both for from
+// and for the returned neighbors, so only canonical IDs are returned.
 func (g *Graph) GetEdges(from string, txn *badger.Txn) (map[string]bool, error) {
+	from = g.nodeID(from)
 	localTxn := txn == nil
 	if localTxn {
-		txn = g.DB.NewTransaction(false)
-		defer txn.Discard()
+		end, err := g.begin("GetEdges")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	resolver := g.newRedirectResolver(txn)
+	from, err := resolver.resolve(from)
+	if err != nil {
+		return nil, err
 	}
 
 	item, err := txn.Get([]byte(from))
@@ -134,23 +492,93 @@ func (g *Graph) GetEdges(from string, txn *badger.Txn) (map[string]bool, error)
 		return nil, err
 	}
 
+	valCopy, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	neighbors, _, err := decodeEdgeList(txn, from, valCopy)
+	if err != nil {
+		return nil, err
+	}
+	neighbors, err = resolver.resolveNeighbors(neighbors)
+	if err != nil {
+		return nil, err
+	}
+
+	return neighbors, nil
+}
+
+// HasEdge reports whether the edge from->to exists, following redirects of both IDs.
+func (g *Graph) HasEdge(from string, to string, txn *badger.Txn) (bool, error) {
+	from, to = g.nodeID(from), g.nodeID(to)
+	localTxn := txn == nil
 	if localTxn {
-		err = txn.Commit()
+		end, err := g.begin("HasEdge")
 		if err != nil {
-			return nil, err
+			return false, err
 		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
 	}
 
-	valCopy, err := item.ValueCopy(nil)
+	resolver := g.newRedirectResolver(txn)
+	from, err := resolver.resolve(from)
 	if err != nil {
-		return nil, err
+		return false, err
+	}
+	to, err = resolver.resolve(to)
+	if err != nil {
+		return false, err
+	}
+	dstNodes, _, err := readEdgeMap(txn, from)
+	if err != nil {
+		return false, err
+	}
+	dstNodes, err = resolver.resolveNeighbors(dstNodes)
+	if err != nil {
+		return false, err
 	}
 
-	neighbors, err := deserializeEdgeMap(valCopy)
-	return neighbors, err
+	return dstNodes[to], nil
+}
+
+var ErrPageLimit = errors.New("onyx: page limit must be positive")
+
+// GetEdgesPage returns up to limit out-neighbors of from that sort after afterNeighbor, in
+// lexicographic order, and the cursor to pass as afterNeighbor for the next page. The cursor
+// is empty after the last page, and an empty afterNeighbor starts at the first neighbor.
+// Like GetEdges, redirected IDs are resolved.
+// Pages are positioned by neighbor, not by offset, so edges added or removed between pages
+// never cause a neighbor to be returned twice or skipped, except that a neighbor added
+// before the cursor is only seen when paging starts over.
+func (g *Graph) GetEdgesPage(from string, afterNeighbor string, limit int, txn *badger.Txn) ([]string, string, error) {
+	from, afterNeighbor = g.nodeID(from), g.nodeID(afterNeighbor)
+	if limit <= 0 {
+		return nil, "", ErrPageLimit
+	}
+	dstNodes, err := g.GetEdges(from, txn)
+	if err != nil {
+		return nil, "", err
+	}
+
+	neighbors := sortedNeighbors(dstNodes)
+	start := sort.SearchStrings(neighbors, afterNeighbor)
+	if start < len(neighbors) && neighbors[start] == afterNeighbor {
+		start++
+	}
+	page := neighbors[start:]
+	if len(page) <= limit {
+		return page, "", nil
+	}
+	page = page[:limit]
+	return page, page[limit-1], nil
 }
 
 func (g *Graph) OutDegree(from string, txn *badger.Txn) (int, error) {
+	from = g.nodeID(from)
 	dstNodes, err := g.GetEdges(from, txn)
 	if err != nil {
 		return 0, err
@@ -161,13 +589,19 @@ func (g *Graph) OutDegree(from string, txn *badger.Txn) (int, error) {
 func (g *Graph) IterAllEdges(f func(src string, dst string) error, prefetchSize int, txn *badger.Txn) error {
 	localTxn := txn == nil
 	if localTxn {
-		txn = g.DB.NewTransaction(false)
-		defer txn.Discard()
+		end, err := g.begin("IterAllEdges")
+		if err != nil {
+			return err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
 	}
 
 	opts := badger.DefaultIteratorOptions
 	opts.PrefetchSize = prefetchSize
-	it := txn.NewIterator(opts)
+	it := newNodeIterator(txn, opts)
 	defer it.Close()
 	for it.Rewind(); it.Valid(); it.Next() {
 		item := it.Item()
@@ -177,7 +611,7 @@ func (g *Graph) IterAllEdges(f func(src string, dst string) error, prefetchSize
 		if err != nil {
 			return err
 		}
-		neighbors, err := deserializeEdgeMap(serVal)
+		neighbors, _, err := decodeEdgeList(txn, src, serVal)
 		if err != nil {
 			return err
 		}
@@ -188,47 +622,42 @@ func (g *Graph) IterAllEdges(f func(src string, dst string) error, prefetchSize
 				return err
 			}
 		}
-
-		return nil
 	}
+	it.Close()
 
-	if localTxn {
-		err := txn.Commit()
-		if err != nil {
-			return nil
-		}
-	}
 	return nil
 }
 
 func (g *Graph) PickRandomVertex(txn *badger.Txn) (string, error) {
 	localTxn := txn == nil
 	if localTxn {
-		txn = g.DB.NewTransaction(false)
-		defer txn.Discard()
+		end, err := g.begin("PickRandomVertex")
+		if err != nil {
+			return "", err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
 	}
 
 	keys := make([][]byte, 0)
 	opts := badger.DefaultIteratorOptions
 	opts.PrefetchValues = false
-	it := txn.NewIterator(opts)
+	it := newNodeIterator(txn, opts)
 	defer it.Close()
 	c := 0
 	for it.Rewind(); it.Valid() && c < 1000; it.Next() {
 		item := it.Item()
-		k := item.Key()
+		k := item.KeyCopy(nil)
 		keys = append(keys, k)
 		c++
 	}
 	it.Close()
 
-	if localTxn {
-		err := txn.Commit()
-		if err != nil {
-			return "", nil
-		}
+	if len(keys) == 0 {
+		return "", ErrNodeNotFound
 	}
-
 	return string(keys[rand.Intn(len(keys))]), nil
 }
 
@@ -289,3 +718,174 @@ func deserializeEdgeMap(serializedMap []byte) (map[string]bool, error) {
 	err := d.Decode(&deserializedMap)
 	return deserializedMap, err
 }
+
+// readEdgeMap returns the edge list of from, or an empty edge list and false if from has never been written.
+func readEdgeMap(txn *badger.Txn, from string) (map[string]bool, bool, error) {
+	dstNodes, size, err := readEdgeMapSize(txn, from)
+	return dstNodes, size >= 0, err
+}
+
+// readEdgeMapSize is readEdgeMap reporting the size of the encoded edge list instead, or -1
+// if from has never been written, see decodeEdgeList.
+func readEdgeMapSize(txn *badger.Txn, from string) (map[string]bool, int, error) {
+	item, err := txn.Get([]byte(from))
+	if err == badger.ErrKeyNotFound {
+		return make(map[string]bool), -1, nil
+	} else if err != nil {
+		return nil, -1, err
+	}
+
+	valCopy, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, -1, err
+	}
+	dstNodes, size, err := decodeEdgeList(txn, from, valCopy)
+	if err != nil {
+		return nil, -1, err
+	}
+	return dstNodes, size, nil
+}
+
+// writeEdgeMap stores the edge list of from in the storage mode of the graph. Every edge list
+// write goes through writeEdgeMap or deleteEdgeMap, which keep the data derived from edge
+// lists in sync.
+func (g *Graph) writeEdgeMap(txn *badger.Txn, from string, dstNodes map[string]bool) error {
+	if err := g.checkShadow(from, dstNodes); err != nil {
+		return err
+	}
+	if err := updateEdgeListIndexes(txn, from, dstNodes); err != nil {
+		return err
+	}
+	if g.StorageMode() == StoragePerEdge {
+		return writeEdgeKeys(txn, from, dstNodes)
+	}
+	if g.hasEdgeKeys.Load() {
+		return writeEdgeBlob(txn, from, dstNodes)
+	}
+	serializedEdgeMap, err := serializeEdgeMap(dstNodes)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(from), serializedEdgeMap)
+}
+
+// deleteEdgeMap deletes the edge list of from, so from is no longer a node.
+func deleteEdgeMap(txn *badger.Txn, from string) error {
+	if err := updateEdgeListIndexes(txn, from, nil); err != nil {
+		return err
+	}
+	if err := deleteEdgeKeys(txn, from); err != nil {
+		return err
+	}
+	return txn.Delete([]byte(from))
+}
+
+// updateEdgeListIndexes updates the reverse edge index and the MinHash sketch of from, if
+// they are enabled, for the edge list of from changing to dstNodes. A nil dstNodes means
+// from is deleted.
+func updateEdgeListIndexes(txn *badger.Txn, from string, dstNodes map[string]bool) error {
+	reverse, err := readIndexStateAt(txn, reverseIndexMetaKey())
+	if err != nil {
+		return err
+	}
+	k, err := readSketchSize(txn)
+	if err != nil {
+		return err
+	}
+	if reverse == nil && k == 0 {
+		return nil
+	}
+
+	old, _, err := readEdgeMap(txn, from)
+	if err != nil {
+		return err
+	}
+	if reverse != nil {
+		if err := updateReverseIndex(txn, from, old, dstNodes); err != nil {
+			return err
+		}
+	}
+	if k > 0 {
+		return updateSketch(txn, k, from, old, dstNodes)
+	}
+	return nil
+}
+
+// nodeIterator is an iterator restricted to the node keyspace: Rewind and Seek never go
+// below nodeKeyStart and Valid is false on internal keys. Every scan over nodes must use it,
+// so internal records can't show up as nodes.
+type nodeIterator struct {
+	*badger.Iterator
+	prefix []byte
+}
+
+// newNodeIterator returns a forward iterator over the nodes of txn, restricted to the node
+// IDs starting with opts.Prefix if it is set. opts.Reverse must not be set.
+func newNodeIterator(txn *badger.Txn, opts badger.IteratorOptions) *nodeIterator {
+	return &nodeIterator{Iterator: txn.NewIterator(opts), prefix: opts.Prefix}
+}
+
+func (it *nodeIterator) Rewind() {
+	it.Seek(it.prefix)
+}
+
+func (it *nodeIterator) Seek(key []byte) {
+	if bytes.Compare(key, nodeKeyStart) < 0 {
+		key = nodeKeyStart
+	}
+	it.Iterator.Seek(key)
+}
+
+func (it *nodeIterator) Valid() bool {
+	return it.Iterator.Valid() && !isInternalKey(it.Item().Key())
+}
+
+// ForEachNode calls fn with the ID of every node that has an edge list, in key order.
+func (g *Graph) ForEachNode(fn func(node string) error, txn *badger.Txn) error {
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("ForEachNode")
+		if err != nil {
+			return err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := newNodeIterator(txn, opts)
+	for it.Rewind(); it.Valid(); it.Next() {
+		if err := fn(string(it.Item().Key())); err != nil {
+			it.Close()
+			return err
+		}
+	}
+	it.Close()
+
+	return nil
+}
+
+// forEachEdgeList calls fn with the edge list of every node in the graph, in key order.
+func forEachEdgeList(txn *badger.Txn, fn func(from string, dstNodes map[string]bool) error) error {
+	it := newNodeIterator(txn, badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		serVal, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		dstNodes, _, err := decodeEdgeList(txn, string(item.Key()), serVal)
+		if err != nil {
+			return err
+		}
+		err = fn(string(item.Key()), dstNodes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
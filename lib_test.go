@@ -1,6 +1,28 @@
 package Onyx
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
 
 func TestPickRandomVertext(T *testing.T) {
 	graph, _ := NewGraph("/tmp/onyxsdlkjf", false)
@@ -41,3 +63,4346 @@ func TestInsertAndRead(T *testing.T) {
 		}
 	}
 }
+
+func TestOpenCheck(T *testing.T) {
+	dir := T.TempDir()
+	graph, err := NewGraph(dir, false, WithOpenCheck(CheckFull))
+	if err != nil {
+		T.Fatal(err)
+	}
+	_ = graph.AddEdge("a", "b", nil)
+	_ = graph.AddEdge("b", "c", nil)
+	err = graph.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("corrupt"), []byte("not a gob edge list"))
+	})
+	if err != nil {
+		T.Fatal(err)
+	}
+	graph.Close()
+
+	graph, err = NewGraph(dir, false)
+	if err != nil {
+		T.Fatal("CheckOff should not verify the database: ", err)
+	}
+	graph.Close()
+
+	for _, level := range []CheckLevel{CheckQuick, CheckFull} {
+		_, err = NewGraph(dir, false, WithOpenCheck(level))
+		var consistencyErr *ErrConsistency
+		if !errors.As(err, &consistencyErr) {
+			T.Fatalf("%s: expected ErrConsistency, got %v", level, err)
+		}
+		problems := consistencyErr.Report.Problems
+		if len(problems) != 1 || problems[0].Key != "corrupt" {
+			T.Fatalf("%s: unexpected problems %+v", level, problems)
+		}
+	}
+}
+
+func TestQuickCheckIsBounded(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	txn := graph.DB.NewTransaction(true)
+	for i := 0; i < 2*quickCheckSampleSize; i++ {
+		_ = graph.AddEdge(fmt.Sprintf("n%d", i), "x", txn)
+	}
+	if err := txn.Commit(); err != nil {
+		T.Fatal(err)
+	}
+
+	rtxn := graph.DB.NewTransaction(false)
+	defer rtxn.Discard()
+	report, err := graph.quickCheck(rtxn)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if !report.OK() {
+		T.Fatal(report.Problems)
+	}
+	// The format key plus at most quickCheckSampleSize edge lists.
+	if report.KeysChecked > quickCheckSampleSize+1 {
+		T.Fatalf("quick check read %d keys", report.KeysChecked)
+	}
+}
+
+func TestSetEdges(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	_ = graph.AddEdge("a", "b", nil)
+	_ = graph.AddEdge("a", "c", nil)
+
+	added, removed, err := graph.SetEdges("a", []string{"c", "d", "e"}, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if added != 2 || removed != 1 {
+		T.Fatalf("expected 2 added and 1 removed, got %d and %d", added, removed)
+	}
+	dstNodes, _ := graph.GetEdges("a", nil)
+	if len(dstNodes) != 3 || !dstNodes["c"] || !dstNodes["d"] || !dstNodes["e"] {
+		T.Fatalf("unexpected edge list %v", dstNodes)
+	}
+
+	added, removed, _ = graph.SetEdges("a", []string{"e", "d", "c"}, nil)
+	if added != 0 || removed != 0 {
+		T.Fatalf("expected no delta, got %d added and %d removed", added, removed)
+	}
+
+	added, removed, _ = graph.SetEdges("a", []string{}, nil)
+	if added != 0 || removed != 3 {
+		T.Fatalf("expected 3 removed, got %d added and %d removed", added, removed)
+	}
+	dstNodes, err = graph.GetEdges("a", nil)
+	if err != nil || len(dstNodes) != 0 {
+		T.Fatalf("expected a to remain with no edges, got %v, %v", dstNodes, err)
+	}
+
+	_, _, _ = graph.SetEdges("z", nil, nil)
+	if _, err = graph.GetEdges("z", nil); err != badger.ErrKeyNotFound {
+		T.Fatal("empty SetEdges should not create a node, got ", err)
+	}
+}
+
+func TestNodeProperties(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+
+	err := graph.SetNodeProperties("a", map[string][]byte{"name": []byte("Alice"), "empty": {}}, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	_ = graph.SetNodeProperties("a", map[string][]byte{"age": []byte("30")}, nil)
+	_ = graph.SetNodeProperties("ab", map[string][]byte{"name": []byte("not a")}, nil)
+
+	props, err := graph.GetNodeProperties("a", nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if len(props) != 3 || string(props["name"]) != "Alice" || string(props["age"]) != "30" || props["empty"] == nil {
+		T.Fatalf("unexpected properties %q", props)
+	}
+
+	_ = graph.RemoveNodeProperty("a", "age", nil)
+	props, _ = graph.GetNodeProperties("a", nil)
+	if _, ok := props["age"]; ok {
+		T.Fatal("age was not removed")
+	}
+
+	props, err = graph.GetNodeProperties("nobody", nil)
+	if err != nil || len(props) != 0 {
+		T.Fatalf("expected no properties, got %q, %v", props, err)
+	}
+}
+
+func TestBFSIncludeProperties(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	_ = graph.AddEdge("a", "b", nil)
+	_ = graph.AddEdge("a", "c", nil)
+	_ = graph.AddEdge("b", "d", nil)
+	_ = graph.AddEdge("d", "e", nil)
+	_ = graph.SetNodeProperties("b", map[string][]byte{"name": []byte("B"), "blob": make([]byte, 1<<16)}, nil)
+	_ = graph.SetNodeProperties("d", map[string][]byte{"name": []byte("D")}, nil)
+
+	result, err := graph.BFS("a", TraversalOptions{MaxDepth: 2}, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if fmt.Sprint(result.Order) != "[a b c d]" || result.Depth["d"] != 2 {
+		T.Fatalf("unexpected traversal %v %v", result.Order, result.Depth)
+	}
+	if result.Properties != nil {
+		T.Fatal("properties fetched without IncludeProperties")
+	}
+
+	result, err = graph.BFS("a", TraversalOptions{IncludeProperties: true, PropertyAllowlist: []string{"name"}}, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if len(result.Properties) != 5 {
+		T.Fatalf("expected properties for 5 nodes, got %d", len(result.Properties))
+	}
+	if string(result.Properties["b"]["name"]) != "B" || string(result.Properties["d"]["name"]) != "D" {
+		T.Fatalf("unexpected properties %q", result.Properties)
+	}
+	if _, ok := result.Properties["b"]["blob"]; ok {
+		T.Fatal("blob fetched despite allowlist")
+	}
+	if props, ok := result.Properties["e"]; !ok || len(props) != 0 {
+		T.Fatal("expected an empty property map for e")
+	}
+
+	// The properties of a level are read in key order, so an ID that prefixes another one
+	// must not get its properties.
+	_ = graph.AddEdge("a", "bb", nil)
+	_ = graph.SetNodeProperties("bb", map[string][]byte{"name": []byte("BB")}, nil)
+	result, err = graph.BFS("a", TraversalOptions{IncludeProperties: true}, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if len(result.Properties["b"]) != 2 || len(result.Properties["b"]["blob"]) != 1<<16 || string(result.Properties["bb"]["name"]) != "BB" || len(result.Properties["c"]) != 0 {
+		T.Fatalf("unexpected properties without allowlist %q", result.Properties["bb"])
+	}
+}
+
+func TestEdgeProperties(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	_ = graph.AddEdge("a", "b", nil)
+
+	if err := graph.SetEdgeProperty("a", "c", "since", []byte("2020"), nil); !errors.Is(err, ErrEdgeNotFound) || !errors.Is(err, badger.ErrKeyNotFound) {
+		T.Fatal("expected ErrEdgeNotFound for a missing edge, got ", err)
+	}
+	if err := graph.SetEdgeWeight("c", "a", 2, nil); !errors.Is(err, ErrEdgeNotFound) || !strings.Contains(err.Error(), "c->a") {
+		T.Fatal("expected ErrEdgeNotFound naming the edge, got ", err)
+	}
+	_ = graph.SetEdgeProperty("a", "b", "since", []byte("2020"), nil)
+	_ = graph.SetEdgeWeight("a", "b", 2.5, nil)
+
+	props, err := graph.GetEdgeProperties("a", "b", nil)
+	if err != nil || string(props["since"]) != "2020" || len(props) != 2 {
+		T.Fatalf("unexpected edge properties %q, %v", props, err)
+	}
+	weight, ok, err := graph.GetEdgeWeight("a", "b", nil)
+	if err != nil || !ok || weight != 2.5 {
+		T.Fatalf("unexpected weight %v %v %v", weight, ok, err)
+	}
+
+	_, _ = graph.RemoveEdge("a", "b", nil)
+	_ = graph.AddEdge("a", "b", nil)
+	props, _ = graph.GetEdgeProperties("a", "b", nil)
+	if len(props) != 0 {
+		T.Fatal("edge properties survived RemoveEdge: ", props)
+	}
+}
+
+func pageRankTestGraph(T *testing.T) *Graph {
+	graph, _ := NewGraph("", true)
+	edges := [][2]string{{"a", "b"}, {"a", "c"}, {"b", "c"}, {"c", "a"}, {"d", "c"}, {"c", "e"}}
+	for _, e := range edges {
+		if err := graph.AddEdge(e[0], e[1], nil); err != nil {
+			T.Fatal(err)
+		}
+	}
+	return graph
+}
+
+func TestPageRankWeightedMatchesUnweighted(T *testing.T) {
+	graph := pageRankTestGraph(T)
+	defer graph.Close()
+
+	unweighted, err := graph.PageRank(PageRankOptions{}, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	_ = graph.IterAllEdges(func(src string, dst string) error {
+		return graph.SetEdgeWeight(src, dst, 3, nil)
+	}, 10, nil)
+	weighted, err := graph.PageRank(PageRankOptions{Weighted: true}, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+
+	sum := 0.0
+	for node, rank := range unweighted {
+		sum += rank
+		if math.Abs(rank-weighted[node]) > 1e-9 {
+			T.Fatalf("%s: unweighted %v, weighted %v", node, rank, weighted[node])
+		}
+	}
+	if math.Abs(sum-1) > 1e-9 {
+		T.Fatal("ranks sum to ", sum)
+	}
+}
+
+func TestPageRankWeights(T *testing.T) {
+	graph := pageRankTestGraph(T)
+	defer graph.Close()
+	_ = graph.SetEdgeWeight("a", "b", 9, nil)
+	_ = graph.SetEdgeWeight("a", "c", 1, nil)
+
+	ranks, _ := graph.PageRank(PageRankOptions{Weighted: true}, nil)
+	if ranks["b"] <= ranks["d"]*2 {
+		T.Fatalf("heavy edge a->b did not raise b: %v", ranks)
+	}
+
+	// With a zero total weight d is dangling and its rank is spread over all nodes instead of c.
+	_ = graph.SetEdgeWeight("d", "c", 0, nil)
+	dangling, _ := graph.PageRank(PageRankOptions{Weighted: true}, nil)
+	if dangling["c"] >= ranks["c"] {
+		T.Fatalf("zero weight edge still carried rank: %v vs %v", dangling["c"], ranks["c"])
+	}
+
+	_ = graph.SetEdgeWeight("d", "c", math.NaN(), nil)
+	if _, err := graph.PageRank(PageRankOptions{Weighted: true}, nil); err == nil {
+		T.Fatal("expected an error for a NaN weight")
+	}
+}
+
+func TestPageRankTeleportLabel(T *testing.T) {
+	graph := pageRankTestGraph(T)
+	defer graph.Close()
+
+	if _, err := graph.PageRank(PageRankOptions{TeleportLabel: "article"}, nil); err != ErrNoTeleportNodes {
+		T.Fatal("expected ErrNoTeleportNodes, got ", err)
+	}
+
+	_ = graph.SetNodeProperties("a", map[string][]byte{LabelProperty: []byte("article")}, nil)
+	ranks, err := graph.PageRank(PageRankOptions{TeleportLabel: "article"}, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	// d has no in-edges, so without teleportation mass it can't have any rank.
+	if ranks["d"] != 0 || ranks["a"] == 0 {
+		T.Fatal("unexpected ranks ", ranks)
+	}
+}
+
+func TestNeighborDiff(T *testing.T) {
+	graph, _ := NewGraph("", true, WithChangelog())
+	defer graph.Close()
+
+	v0, _ := graph.CurrentVersion(nil)
+	_ = graph.AddEdge("a", "b", nil)
+	_ = graph.AddEdge("a", "c", nil)
+	_ = graph.AddEdge("x", "y", nil)
+	v1, _ := graph.CurrentVersion(nil)
+	_, _ = graph.RemoveEdge("a", "b", nil)
+	_, _, _ = graph.SetEdges("a", []string{"c", "d", "e"}, nil)
+	_, _ = graph.RemoveEdge("a", "e", nil)
+	_ = graph.AddEdge("a", "c", nil)
+	v2, err := graph.CurrentVersion(nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if !(v0 < v1 && v1 < v2) {
+		T.Fatalf("versions did not increase: %d %d %d", v0, v1, v2)
+	}
+
+	added, removed, err := graph.NeighborDiff("a", v1, v2, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if fmt.Sprint(added) != "[d]" || fmt.Sprint(removed) != "[b]" {
+		T.Fatalf("v1..v2: added %v, removed %v", added, removed)
+	}
+	added, removed, _ = graph.NeighborDiff("a", v0, v2, nil)
+	if fmt.Sprint(added) != "[c d]" || len(removed) != 0 {
+		T.Fatalf("v0..v2: added %v, removed %v", added, removed)
+	}
+	added, removed, _ = graph.NeighborDiff("a", v0, v1, nil)
+	if fmt.Sprint(added) != "[b c]" || len(removed) != 0 {
+		T.Fatalf("v0..v1: added %v, removed %v", added, removed)
+	}
+
+	n := 0
+	_ = graph.Changes(v1, func(record ChangeRecord) error {
+		n++
+		return nil
+	}, nil)
+	if n != 4 {
+		T.Fatalf("expected 4 changes after v1, got %d", n)
+	}
+
+	pruned, err := graph.PruneChangelog(time.Now().Add(time.Minute))
+	if err != nil || pruned != 7 {
+		T.Fatalf("expected 7 pruned records, got %d, %v", pruned, err)
+	}
+	_, _, err = graph.NeighborDiff("a", v0, v2, nil)
+	var unavailable *ErrVersionUnavailable
+	if !errors.As(err, &unavailable) || unavailable.Earliest != v2 {
+		T.Fatal("expected ErrVersionUnavailable naming v2, got ", err)
+	}
+}
+
+func TestChangelogCommitOrder(T *testing.T) {
+	graph, _ := NewGraph("", true, WithChangelog())
+	defer graph.Close()
+
+	// a allocates its record first but commits last: it must not commit below a version
+	// readers have already moved past.
+	a := graph.DB.NewTransaction(true)
+	defer a.Discard()
+	b := graph.DB.NewTransaction(true)
+	defer b.Discard()
+	if err := graph.AddEdge("a", "b", a); err != nil {
+		T.Fatal(err)
+	}
+	if err := graph.AddEdge("c", "d", b); err != nil {
+		T.Fatal(err)
+	}
+	if err := graph.AddEdge("c", "e", b); err != nil {
+		T.Fatal(err)
+	}
+	if err := b.Commit(); err != nil {
+		T.Fatal(err)
+	}
+	cursor, _ := graph.CurrentVersion(nil)
+	if cursor != 2 {
+		T.Fatalf("version %d after two records", cursor)
+	}
+	if err := a.Commit(); err != badger.ErrConflict {
+		T.Fatal("expected the late commit to conflict, got ", err)
+	}
+
+	if err := graph.AddEdge("a", "b", nil); err != nil {
+		T.Fatal(err)
+	}
+	var seen []string
+	_ = graph.Changes(cursor, func(record ChangeRecord) error {
+		seen = append(seen, fmt.Sprint(record.Seq, record.From, record.To))
+		return nil
+	}, nil)
+	if fmt.Sprint(seen) != "[3ab]" {
+		T.Fatalf("changes after the cursor: %v", seen)
+	}
+	err := graph.DB.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(metaKey(metaChangelogHeadKey))
+		return err
+	})
+	if err != nil {
+		T.Fatal("changelog head not stored: ", err)
+	}
+}
+
+func TestChunkedWriterReplaysHalfAppliedOps(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+
+	// Every op increments a counter and then writes a blob, so an op that doesn't fit has
+	// already incremented the counter in the transaction it fails in.
+	counter := []byte("counter")
+	increment := func(txn *badger.Txn) error {
+		n := uint64(0)
+		if item, err := txn.Get(counter); err == nil {
+			value, _ := item.ValueCopy(nil)
+			n = binary.BigEndian.Uint64(value)
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		return txn.Set(counter, binary.BigEndian.AppendUint64(nil, n+1))
+	}
+	const n = 40
+	w := &chunkedWriter{g: graph}
+	defer w.discard()
+	for i := 0; i < n; i++ {
+		err := w.do(func(txn *badger.Txn) error {
+			if err := increment(txn); err != nil {
+				return err
+			}
+			return txn.Set([]byte(fmt.Sprint("blob", i)), make([]byte, 512<<10))
+		})
+		if err != nil {
+			T.Fatal(err)
+		}
+	}
+	failure := errors.New("failed after writing")
+	if err := w.do(func(txn *badger.Txn) error {
+		if err := increment(txn); err != nil {
+			return err
+		}
+		return failure
+	}); err != failure {
+		T.Fatal("expected the op error, got ", err)
+	}
+	if err := w.commit(); err != nil {
+		T.Fatal(err)
+	}
+
+	err := graph.DB.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(counter)
+		if err != nil {
+			return err
+		}
+		value, _ := item.ValueCopy(nil)
+		if got := binary.BigEndian.Uint64(value); got != n {
+			return fmt.Errorf("counter is %d after %d ops", got, n)
+		}
+		_, err = txn.Get([]byte(fmt.Sprint("blob", n-1)))
+		return err
+	})
+	if err != nil {
+		T.Fatal(err)
+	}
+}
+
+func TestExportImportJSONRoundTrip(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+
+	odd := "we\"ird/ node\t✓"
+	_ = graph.AddEdge("a", odd, nil)
+	_ = graph.AddEdge(odd, "a", nil)
+	_ = graph.AddEdge("a", "b", nil)
+	_ = graph.SetEdgeWeight("a", "b", 0.25, nil)
+	_ = graph.SetEdgeProperty("a", odd, "kind", []byte("friend"), nil)
+	_ = graph.SetNodeProperties("a", map[string][]byte{
+		"name":   []byte("Alice"),
+		"empty":  {},
+		"binary": {0xff, 0x00, 0xfe},
+		"":       []byte("unnamed"),
+	}, nil)
+	_ = graph.SetNodeProperties("loner", map[string][]byte{"k=v": []byte("x")}, nil)
+
+	var buf bytes.Buffer
+	if err := graph.ExportJSON(&buf, ExportOptions{IncludeProperties: true}, nil); err != nil {
+		T.Fatal(err)
+	}
+	exported := buf.String()
+
+	restored, _ := NewGraph("", true)
+	defer restored.Close()
+	if err := restored.ImportJSON(&buf, ImportOptions{}); err != nil {
+		T.Fatal(err)
+	}
+
+	props, _ := restored.GetNodeProperties("a", nil)
+	if len(props) != 4 || !bytes.Equal(props["binary"], []byte{0xff, 0x00, 0xfe}) ||
+		props["empty"] == nil || len(props["empty"]) != 0 || string(props[""]) != "unnamed" {
+		T.Fatalf("unexpected restored properties %q", props)
+	}
+	if weight, ok, _ := restored.GetEdgeWeight("a", "b", nil); !ok || weight != 0.25 {
+		T.Fatal("weight not restored: ", weight)
+	}
+	edgeProps, _ := restored.GetEdgeProperties("a", odd, nil)
+	if string(edgeProps["kind"]) != "friend" {
+		T.Fatalf("edge property not restored: %q", edgeProps)
+	}
+
+	var again bytes.Buffer
+	_ = restored.ExportJSON(&again, ExportOptions{IncludeProperties: true}, nil)
+	if again.String() != exported {
+		T.Fatalf("round trip changed the export:\n%s\nvs\n%s", exported, again.String())
+	}
+
+	var plain bytes.Buffer
+	_ = graph.ExportJSON(&plain, ExportOptions{}, nil)
+	if strings.Contains(plain.String(), "Alice") || strings.Contains(plain.String(), "loner") {
+		T.Fatal("properties exported without IncludeProperties")
+	}
+}
+
+// newExportFixture returns a graph with the values text formats have trouble with.
+func newExportFixture(T *testing.T) *Graph {
+	graph, _ := NewGraph("", true)
+	odd := "we\"ird/ 'node'\t✓<&>"
+	_ = graph.AddEdge("a", odd, nil)
+	_ = graph.AddEdge(odd, "a", nil)
+	_ = graph.AddEdge("a", "b", nil)
+	_ = graph.AddEdge("b", "sink", nil)
+	_ = graph.SetEdgeWeight("a", "b", 0.25, nil)
+	_ = graph.SetEdgeWeight("b", "sink", math.Inf(1), nil)
+	_ = graph.SetEdgeProperty("a", odd, "kind", []byte("friend"), nil)
+	err := graph.SetNodeProperties("a", map[string][]byte{
+		"name":    []byte("Alice\r\n"),
+		"empty":   {},
+		"binary":  {0xff, 0x00, 0xfe},
+		"control": []byte("bell\x07"),
+		"":        []byte("unnamed"),
+	}, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	_ = graph.SetNodeProperties("loner", map[string][]byte{"k=v": []byte("x")}, nil)
+	return graph
+}
+
+// checkExportRoundTrip asserts restored holds what newExportFixture wrote, property for property.
+func checkExportRoundTrip(T *testing.T, graph *Graph, restored *Graph) {
+	var want, got bytes.Buffer
+	_ = graph.ExportJSON(&want, ExportOptions{IncludeProperties: true}, nil)
+	_ = restored.ExportJSON(&got, ExportOptions{IncludeProperties: true}, nil)
+	if got.String() != want.String() {
+		T.Fatalf("round trip changed the graph:\n%s\nvs\n%s", want.String(), got.String())
+	}
+	props, _ := restored.GetNodeProperties("a", nil)
+	if props["empty"] == nil || len(props["empty"]) != 0 || string(props["control"]) != "bell\x07" {
+		T.Fatalf("unexpected restored properties %q", props)
+	}
+	if weight, ok, _ := restored.GetEdgeWeight("b", "sink", nil); !ok || !math.IsInf(weight, 1) {
+		T.Fatal("infinite weight not restored: ", weight)
+	}
+}
+
+func TestExportImportGraphMLRoundTrip(T *testing.T) {
+	graph := newExportFixture(T)
+	defer graph.Close()
+
+	var buf bytes.Buffer
+	if err := graph.ExportGraphML(&buf, ExportOptions{IncludeProperties: true}, nil); err != nil {
+		T.Fatal(err)
+	}
+	exported := buf.String()
+	if !strings.Contains(exported, `attr.name="name"`) || !strings.Contains(exported, ">Alice&#xD;&#xA;<") ||
+		strings.Count(exported, `attr.name="weight"`) != 1 {
+		T.Fatalf("unexpected GraphML:\n%s", exported)
+	}
+
+	restored, _ := NewGraph("", true)
+	defer restored.Close()
+	stats, err := restored.ImportGraphML(&buf, ImportOptions{})
+	if err != nil {
+		T.Fatal(err)
+	}
+	if stats.Nodes != 4 || stats.Edges != 4 {
+		T.Fatalf("unexpected stats %+v", stats)
+	}
+	checkExportRoundTrip(T, graph, restored)
+
+	var again bytes.Buffer
+	_ = restored.ExportGraphML(&again, ExportOptions{IncludeProperties: true}, nil)
+	if again.String() != exported {
+		T.Fatalf("round trip changed the export:\n%s\nvs\n%s", exported, again.String())
+	}
+
+	// Documents of other tools: typed data is stored as text, with the key defaults.
+	other := `<?xml version="1.0"?>
+<graphml xmlns="http://graphml.graphdrawing.org/xmlns">
+  <key id="d0" for="node" attr.name="color" attr.type="string"><default>red</default></key>
+  <key id="d1" for="edge" attr.name="weight" attr.type="int"/>
+  <graph edgedefault="directed">
+    <node id="x"/>
+    <node id="y"><data key="d0">blue</data></node>
+    <edge source="x" target="y"><data key="d1">3</data></edge>
+  </graph>
+</graphml>`
+	imported, _ := NewGraph("", true)
+	defer imported.Close()
+	if _, err := imported.ImportGraphML(strings.NewReader(other), ImportOptions{}); err != nil {
+		T.Fatal(err)
+	}
+	x, _ := imported.GetNodeProperties("x", nil)
+	y, _ := imported.GetNodeProperties("y", nil)
+	if string(x["color"]) != "red" || string(y["color"]) != "blue" {
+		T.Fatalf("unexpected data %q %q", x, y)
+	}
+	if weight, ok, _ := imported.GetEdgeWeight("x", "y", nil); !ok || weight != 3 {
+		T.Fatal("weight not imported: ", weight)
+	}
+	undirected := strings.Replace(other, `edgedefault="directed"`, `edgedefault="undirected"`, 1)
+	if _, err := imported.ImportGraphML(strings.NewReader(undirected), ImportOptions{}); err == nil {
+		T.Fatal("undirected graph imported")
+	}
+}
+
+func TestExportImportSQLiteRoundTrip(T *testing.T) {
+	graph := newExportFixture(T)
+	defer graph.Close()
+	_ = graph.SetNodeProperties("b", map[string][]byte{"nul": []byte("a\x00b"), "quote": []byte("it's")}, nil)
+
+	var buf bytes.Buffer
+	if err := graph.ExportSQLite(&buf, ExportOptions{IncludeProperties: true}, nil); err != nil {
+		T.Fatal(err)
+	}
+	script := buf.String()
+	if !strings.Contains(script, "INSERT INTO edges VALUES('a','b',0.25);") {
+		T.Fatalf("unexpected script:\n%s", script)
+	}
+
+	restored, _ := NewGraph("", true)
+	defer restored.Close()
+	if _, err := restored.ImportSQLite(strings.NewReader(script), ImportOptions{}); err != nil {
+		T.Fatal(err)
+	}
+	checkExportRoundTrip(T, graph, restored)
+
+	// The script loads into SQLite, and its .dump imports back.
+	sqlite, err := exec.LookPath("sqlite3")
+	if err != nil {
+		T.Skip("no sqlite3 binary")
+	}
+	db := filepath.Join(T.TempDir(), "graph.db")
+	load := exec.Command(sqlite, db)
+	load.Stdin = strings.NewReader(script)
+	if out, err := load.CombinedOutput(); err != nil {
+		T.Fatalf("sqlite3 rejected the script: %v\n%s", err, out)
+	}
+	dump, err := exec.Command(sqlite, db, ".dump").Output()
+	if err != nil {
+		T.Fatal(err)
+	}
+	fromDump, _ := NewGraph("", true)
+	defer fromDump.Close()
+	if _, err := fromDump.ImportSQLite(bytes.NewReader(dump), ImportOptions{}); err != nil {
+		T.Fatalf("%v\n%s", err, dump)
+	}
+	checkExportRoundTrip(T, graph, fromDump)
+}
+
+func TestComputeLayoutForceDirected(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	for i := 0; i < 20; i++ {
+		_ = graph.AddEdge(fmt.Sprintf("n%02d", i), fmt.Sprintf("n%02d", (i+1)%20), nil)
+	}
+
+	first, err := graph.ComputeLayout(LayoutForceDirected, 50, LayoutOptions{Seed: 42}, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	second, _ := graph.ComputeLayout(LayoutForceDirected, 50, LayoutOptions{Seed: 42}, nil)
+	if len(first) != 20 || fmt.Sprint(first) != fmt.Sprint(second) {
+		T.Fatal("layout is not deterministic under a fixed seed")
+	}
+	for node, p := range first {
+		if p[0] < 0 || p[0] > 1 || p[1] < 0 || p[1] > 1 {
+			T.Fatalf("%s is outside the unit square: %v", node, p)
+		}
+	}
+
+	capped, _ := graph.ComputeLayout(LayoutForceDirected, 10, LayoutOptions{MaxNodes: 5, Start: "n10"}, nil)
+	if len(capped) != 5 {
+		T.Fatalf("expected 5 nodes, got %d", len(capped))
+	}
+	if _, ok := capped["n14"]; !ok {
+		T.Fatal("expected the nodes closest to the start node, got ", capped)
+	}
+}
+
+func TestComputeLayoutHierarchical(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	_ = graph.AddEdge("root", "a", nil)
+	_ = graph.AddEdge("root", "b", nil)
+	_ = graph.AddEdge("a", "leaf", nil)
+	_ = graph.AddEdge("b", "leaf", nil)
+	_ = graph.AddEdge("root", "leaf", nil)
+
+	layout, err := graph.ComputeLayout(LayoutHierarchical, 4, LayoutOptions{Persist: true}, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if layout["root"][1] != 0 || layout["a"][1] != 1 || layout["b"][1] != 1 || layout["leaf"][1] != 2 {
+		T.Fatal("unexpected layers ", layout)
+	}
+
+	var dot bytes.Buffer
+	_ = graph.ExportDOT(&dot, nil)
+	if !strings.Contains(dot.String(), `"leaf" [pos="0,2!"];`) || !strings.Contains(dot.String(), `"a" -> "leaf";`) {
+		T.Fatal("persisted layout not exported:\n", dot.String())
+	}
+
+	_ = graph.AddEdge("leaf", "root", nil)
+	if _, err = graph.ComputeLayout(LayoutHierarchical, 4, LayoutOptions{}, nil); err != ErrNotDAG {
+		T.Fatal("expected ErrNotDAG, got ", err)
+	}
+}
+
+func edgeSet(T *testing.T, graph *Graph) map[string]bool {
+	edges := make(map[string]bool)
+	err := graph.IterAllEdges(func(src string, dst string) error {
+		edges[src+"->"+dst] = true
+		return nil
+	}, 100, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	return edges
+}
+
+// flakySource fails every call to ChangesSince after delivering failAfter records.
+type flakySource struct {
+	ChangeSource
+	failAfter int
+}
+
+func (s *flakySource) ChangesSince(ctx context.Context, since uint64, fn func(record ChangeRecord) error) (uint64, error) {
+	n := 0
+	return s.ChangeSource.ChangesSince(ctx, since, func(record ChangeRecord) error {
+		if n == s.failAfter {
+			return errors.New("connection reset")
+		}
+		n++
+		return fn(record)
+	})
+}
+
+func TestReplicationFollowerRestart(T *testing.T) {
+	primary, _ := NewGraph("", true, WithChangelog())
+	defer primary.Close()
+	source, err := NewReplicationSource(primary)
+	if err != nil {
+		T.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		_ = primary.AddEdge(fmt.Sprintf("n%d", i%5), fmt.Sprintf("m%d", i), nil)
+	}
+
+	dir := T.TempDir()
+	followerGraph, _ := NewGraph(dir, false)
+	follower := NewFollower(followerGraph, &flakySource{ChangeSource: source, failAfter: 7}, FollowerOptions{})
+	if _, err = follower.Sync(context.Background()); err != nil {
+		T.Fatal(err)
+	}
+	if !reflect.DeepEqual(edgeSet(T, followerGraph), edgeSet(T, primary)) {
+		T.Fatal("full sync did not copy the primary")
+	}
+
+	for i := 0; i < 30; i++ {
+		_ = primary.AddEdge(fmt.Sprintf("n%d", i%5), fmt.Sprintf("x%d", i), nil)
+	}
+	_, _ = primary.RemoveEdge("n1", "m1", nil)
+	if _, err = follower.Sync(context.Background()); err == nil {
+		T.Fatal("expected the flaky source to fail mid-stream")
+	}
+	status := followerGraph.ReplicationStatus()
+	if status.Role != RoleFollower || status.LastError == nil {
+		T.Fatalf("unexpected status %+v", status)
+	}
+	// Kill the follower mid-stream and restart it from disk.
+	followerGraph.Close()
+
+	followerGraph, _ = NewGraph(dir, false)
+	defer followerGraph.Close()
+	follower = NewFollower(followerGraph, &flakySource{ChangeSource: source, failAfter: 7},
+		FollowerOptions{PollInterval: time.Millisecond, RetryInterval: time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- follower.Run(ctx) }()
+
+	head, _ := primary.CurrentVersion(nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for followerGraph.ReplicationStatus().Version < head && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if !reflect.DeepEqual(edgeSet(T, followerGraph), edgeSet(T, primary)) {
+		T.Fatal("follower did not converge to the primary")
+	}
+	status = followerGraph.ReplicationStatus()
+	if status.Version != head || status.LagRecords != 0 {
+		T.Fatalf("unexpected status after catching up %+v", status)
+	}
+	if primary.ReplicationStatus().Role != RolePrimary {
+		T.Fatal("primary does not report its role")
+	}
+}
+
+// replayedSource sends the given records whatever the follower asks for.
+type replayedSource struct {
+	ChangeSource
+	records []ChangeRecord
+	head    uint64
+}
+
+func (s *replayedSource) ChangesSince(ctx context.Context, since uint64, fn func(record ChangeRecord) error) (uint64, error) {
+	for _, record := range s.records {
+		if err := fn(record); err != nil {
+			return 0, err
+		}
+	}
+	return s.head, nil
+}
+
+func TestReplicationOutOfOrderCommits(T *testing.T) {
+	primary, _ := NewGraph("", true, WithChangelog())
+	defer primary.Close()
+	source, _ := NewReplicationSource(primary)
+	_ = primary.AddEdge("x", "y", nil)
+
+	followerGraph, _ := NewGraph("", true)
+	defer followerGraph.Close()
+	follower := NewFollower(followerGraph, source, FollowerOptions{})
+	if _, err := follower.Sync(context.Background()); err != nil {
+		T.Fatal(err)
+	}
+
+	// a allocates its record before b but commits after the follower synced b's.
+	a := primary.DB.NewTransaction(true)
+	defer a.Discard()
+	if err := primary.AddEdge("a", "b", a); err != nil {
+		T.Fatal(err)
+	}
+	if err := primary.AddEdge("c", "d", nil); err != nil {
+		T.Fatal(err)
+	}
+	if _, err := follower.Sync(context.Background()); err != nil {
+		T.Fatal(err)
+	}
+	if err := a.Commit(); err == nil {
+		T.Fatal("a committed below the version the follower applied")
+	}
+	if err := primary.AddEdge("a", "b", nil); err != nil {
+		T.Fatal(err)
+	}
+	caughtUp, err := follower.Sync(context.Background())
+	if err != nil || !caughtUp {
+		T.Fatal("follower didn't catch up: ", err)
+	}
+	if !reflect.DeepEqual(edgeSet(T, followerGraph), edgeSet(T, primary)) {
+		T.Fatal("follower dropped a change committed out of order")
+	}
+	head, _ := primary.CurrentVersion(nil)
+	if status := followerGraph.ReplicationStatus(); status.Version != head || head != 3 {
+		T.Fatalf("unexpected status %+v at head %d", status, head)
+	}
+
+	// A follower ahead of the primary's reported version doesn't wrap the lag around.
+	_, _ = source.ChangesSince(context.Background(), head+5, func(ChangeRecord) error { return nil })
+	if lag := primary.ReplicationStatus().LagRecords; lag != 0 {
+		T.Fatal("lag of a follower ahead of the primary: ", lag)
+	}
+
+	// A source sending a change the follower moved past, or past its head, is an error.
+	follower.source = &replayedSource{records: []ChangeRecord{{Seq: 2, Op: ChangeAddEdge, From: "p", To: "q"}}, head: 3}
+	if _, err := follower.Sync(context.Background()); !errors.Is(err, ErrChangesOutOfOrder) {
+		T.Fatal("expected ErrChangesOutOfOrder for a replayed change, got ", err)
+	}
+	follower.source = &replayedSource{records: []ChangeRecord{{Seq: 5, Op: ChangeAddEdge, From: "p", To: "q"}}, head: 3}
+	if _, err := follower.Sync(context.Background()); !errors.Is(err, ErrChangesOutOfOrder) {
+		T.Fatal("expected ErrChangesOutOfOrder for a change past the head, got ", err)
+	}
+}
+
+func TestReplicationRemoveNode(T *testing.T) {
+	primary, _ := NewGraph("", true, WithChangelog())
+	defer primary.Close()
+	source, _ := NewReplicationSource(primary)
+	_ = primary.AddEdge("a", "b", nil)
+	_ = primary.AddEdge("c", "a", nil)
+	_ = primary.SetNodeProperties("a", map[string][]byte{"name": []byte("A")}, nil)
+
+	followerGraph, _ := NewGraph("", true)
+	defer followerGraph.Close()
+	follower := NewFollower(followerGraph, source, FollowerOptions{})
+	if _, err := follower.Sync(context.Background()); err != nil {
+		T.Fatal(err)
+	}
+
+	if _, err := primary.RemoveNode("a", nil); err != nil {
+		T.Fatal(err)
+	}
+	if _, err := follower.Sync(context.Background()); err != nil {
+		T.Fatal(err)
+	}
+	nodes := func(g *Graph) []string {
+		var nodes []string
+		_ = g.ForEachNode(func(node string) error {
+			nodes = append(nodes, node)
+			return nil
+		}, nil)
+		return nodes
+	}
+	if !reflect.DeepEqual(nodes(followerGraph), nodes(primary)) || !reflect.DeepEqual(edgeSet(T, followerGraph), edgeSet(T, primary)) {
+		T.Fatal("follower kept the removed node: ", nodes(followerGraph), nodes(primary))
+	}
+	if props, _ := followerGraph.GetNodeProperties("a", nil); len(props) != 0 {
+		T.Fatal("follower kept the properties of the removed node ", props)
+	}
+}
+
+func TestConflictHotspots(T *testing.T) {
+	graph, _ := NewGraph("", true, WithConflictHotspotCapacity(8))
+	defer graph.Close()
+
+	txn := graph.DB.NewTransaction(true)
+	_ = graph.AddEdge("hot", "x", txn)
+	_ = graph.AddEdge("hot", "y", nil)
+	err := txn.Commit()
+	if err != badger.ErrConflict {
+		T.Fatal("expected a conflict, got ", err)
+	}
+	graph.recordConflict(err, "hot")
+	graph.recordConflict(errors.New("not a conflict"), "hot")
+
+	for i := 0; i < 100; i++ {
+		graph.recordConflict(badger.ErrConflict, "hot")
+		graph.recordConflict(badger.ErrConflict, fmt.Sprintf("cold%d", i))
+	}
+
+	top, err := graph.ConflictHotspots(3)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if len(top) != 3 || top[0].Key != "hot" || top[0].Count-top[0].Error > 101 || top[0].Count < 101 {
+		T.Fatalf("unexpected hotspots %+v", top)
+	}
+	if m := graph.Metrics(); m.Conflicts != 201 || m.ConflictHotspots[0].Key != "hot" {
+		T.Fatalf("unexpected metrics %+v", m)
+	}
+
+	graph.ResetConflictHotspots()
+	if top, _ = graph.ConflictHotspots(3); len(top) != 0 {
+		T.Fatal("hotspots survived a reset: ", top)
+	}
+	if m := graph.Metrics(); m.Conflicts != 0 {
+		T.Fatal("conflict count survived a reset: ", m.Conflicts)
+	}
+	if _, err = graph.ConflictHotspots(-1); err == nil {
+		T.Fatal("expected an error for a negative k")
+	}
+}
+
+func TestConflictAttribution(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	_ = graph.AddEdge("new", "x", nil)
+	_ = graph.AddEdge("src", "hub", nil)
+	_ = graph.AddEdge("hub", "y", nil)
+	_ = graph.Redirect("old", "new", nil)
+
+	// The policy commits an interfering write in a transaction of its own, so the operation
+	// it checks conflicts when it commits.
+	var interfere func()
+	graph.RegisterWritePolicy(func(op MutationOp, tx *Tx) error {
+		if f := interfere; f != nil {
+			interfere = nil
+			f()
+		}
+		return nil
+	})
+	hotspots := func() []string {
+		T.Helper()
+		if m := graph.Metrics(); m.Conflicts != 1 {
+			T.Fatal("expected one conflict, got ", m.Conflicts)
+		}
+		top, _ := graph.ConflictHotspots(10)
+		var keys []string
+		for _, e := range top {
+			keys = append(keys, e.Key)
+		}
+		graph.ResetConflictHotspots()
+		return keys
+	}
+
+	// A write through a redirected ID conflicts on the keys of the canonical node.
+	interfere = func() { _ = graph.AddEdge("new", "w", nil) }
+	if _, err := graph.RemoveEdges("old", []string{"x"}, nil); err != badger.ErrConflict {
+		T.Fatal("expected a conflict, got ", err)
+	}
+	if keys := hotspots(); !reflect.DeepEqual(keys, []string{"new"}) {
+		T.Fatal("expected the conflict on new, got ", keys)
+	}
+
+	// RemoveNode writes the edge lists of the nodes pointing at the node too.
+	interfere = func() { _ = graph.AddEdge("src", "z", nil) }
+	if _, err := graph.RemoveNode("hub", nil); err != badger.ErrConflict {
+		T.Fatal("expected a conflict, got ", err)
+	}
+	if keys := hotspots(); !reflect.DeepEqual(keys, []string{"hub", "src"}) {
+		T.Fatal("expected the conflict on hub and src, got ", keys)
+	}
+}
+
+func TestConflictKeyPrivacy(T *testing.T) {
+	for mode, want := range map[ConflictKeyMode]string{
+		ConflictKeyRaw:      "user:alice@example.com",
+		ConflictKeyTruncate: "user:ali",
+		ConflictKeyHash:     fmt.Sprintf("%016x", fnvHash("user:alice@example.com")),
+	} {
+		graph, _ := NewGraph("", true, WithConflictKeyPrivacy(mode))
+		graph.RecordConflict("user:alice@example.com")
+		top, _ := graph.ConflictHotspots(1)
+		graph.Close()
+		if top[0].Key != want {
+			T.Fatalf("mode %d: expected %q, got %q", mode, want, top[0].Key)
+		}
+	}
+
+	// Truncation doesn't cut a character in two.
+	graph, _ := NewGraph("", true, WithConflictKeyPrivacy(ConflictKeyTruncate))
+	defer graph.Close()
+	graph.RecordConflict("usér:zëd")
+	if top, _ := graph.ConflictHotspots(1); top[0].Key != "usér:z" {
+		T.Fatalf("expected the key cut before the last character, got %q", top[0].Key)
+	}
+}
+
+func fnvHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+func TestPropertySchema(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	_ = graph.AddEdge("a", "b", nil)
+
+	_ = graph.DefinePropertySchema("age", PropInt64, nil)
+	_ = graph.DefinePropertySchema("joined", PropTime, nil)
+	_ = graph.DefinePropertySchema("admin", PropBool, nil)
+	_ = graph.DefinePropertySchema(WeightProperty, PropFloat64, nil)
+	if err := graph.DefinePropertySchema("age", PropString, nil); err == nil {
+		T.Fatal("expected redefining age with another kind to fail")
+	}
+
+	err := graph.SetNodeProperties("a", map[string][]byte{"age": []byte("thirty"), "nick": []byte("al")}, nil)
+	var typeErr *ErrPropertyType
+	if !errors.As(err, &typeErr) || typeErr.Name != "age" || typeErr.Kind != PropInt64 {
+		T.Fatal("expected ErrPropertyType for age, got ", err)
+	}
+	if props, _ := graph.GetNodeProperties("a", nil); len(props) != 0 {
+		T.Fatal("rejected write left properties behind: ", props)
+	}
+	if err = graph.SetEdgeProperty("a", "b", "admin", []byte{2}, nil); !errors.As(err, &typeErr) {
+		T.Fatal("expected ErrPropertyType for an edge property, got ", err)
+	}
+
+	joined := time.Date(2021, 3, 4, 5, 6, 7, 8, time.UTC)
+	err = graph.SetNodeProperties("a", map[string][]byte{
+		"age":    EncodeInt64(-30),
+		"joined": EncodeTime(joined),
+		"admin":  EncodeBool(true),
+		"nick":   {0xff},
+	}, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if err = graph.SetEdgeWeight("a", "b", 1.5, nil); err != nil {
+		T.Fatal(err)
+	}
+
+	if age, err := graph.GetNodePropertyInt64("a", "age", nil); err != nil || age != -30 {
+		T.Fatal("age: ", age, err)
+	}
+	if t, err := graph.GetNodePropertyTime("a", "joined", nil); err != nil || !t.Equal(joined) {
+		T.Fatal("joined: ", t, err)
+	}
+	if admin, err := graph.GetNodePropertyBool("a", "admin", nil); err != nil || !admin {
+		T.Fatal("admin: ", admin, err)
+	}
+	if _, err = graph.GetNodePropertyInt64("a", "missing", nil); err != badger.ErrKeyNotFound {
+		T.Fatal("expected ErrKeyNotFound, got ", err)
+	}
+
+	schemas, _ := graph.PropertySchemas(nil)
+	if len(schemas) != 4 || schemas["joined"] != PropTime {
+		T.Fatal("unexpected schemas ", schemas)
+	}
+	_ = graph.RemovePropertySchema("age", nil)
+	if err = graph.SetNodeProperties("a", map[string][]byte{"age": []byte("thirty")}, nil); err != nil {
+		T.Fatal("unschema'd property rejected: ", err)
+	}
+}
+
+func TestPropertyIndex(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	_ = graph.DefinePropertySchema("age", PropInt64, nil)
+	_ = graph.DefinePropertySchema("score", PropFloat64, nil)
+	ages := map[string]int64{"a": 30, "b": -5, "c": 30, "d": 1 << 40, "e": 0}
+	for node, age := range ages {
+		_ = graph.SetNodeProperties(node, map[string][]byte{"age": EncodeInt64(age)}, nil)
+	}
+
+	if _, err := graph.NodesWhereEq("age", 30, 0, nil); err != ErrNoIndex {
+		T.Fatal("expected ErrNoIndex, got ", err)
+	}
+
+	// Backfill in small batches, as if IndexProperty had been interrupted after every batch.
+	_ = graph.DB.Update(func(txn *badger.Txn) error {
+		return writeIndexState(txn, "age", &indexState{})
+	})
+	if _, err := graph.NodesWhereEq("age", 30, 0, nil); err != ErrIndexNotReady {
+		T.Fatal("expected ErrIndexNotReady, got ", err)
+	}
+	for done := false; !done; {
+		var err error
+		done, err = graph.backfillIndexBatch("age", 2)
+		if err != nil {
+			T.Fatal(err)
+		}
+	}
+	if err := graph.IndexProperty("age"); err != nil {
+		T.Fatal(err)
+	}
+
+	nodes, err := graph.NodesWhereEq("age", 30, 0, nil)
+	if err != nil || fmt.Sprint(nodes) != "[a c]" {
+		T.Fatal("age = 30: ", nodes, err)
+	}
+	nodes, _ = graph.NodesWhereRange("age", -10, 30, 0, nil)
+	if fmt.Sprint(nodes) != "[b e a c]" {
+		T.Fatal("-10 <= age <= 30: ", nodes)
+	}
+	nodes, _ = graph.NodesWhereRange("age", 1, nil, 1, nil)
+	if fmt.Sprint(nodes) != "[a]" {
+		T.Fatal("age >= 1 limit 1: ", nodes)
+	}
+
+	// Writes maintain the index transactionally.
+	_ = graph.SetNodeProperties("a", map[string][]byte{"age": EncodeInt64(31)}, nil)
+	_ = graph.RemoveNodeProperty("c", "age", nil)
+	nodes, _ = graph.NodesWhereEq("age", 30, 0, nil)
+	if len(nodes) != 0 {
+		T.Fatal("stale index entries: ", nodes)
+	}
+	nodes, _ = graph.NodesWhereRange("age", nil, nil, 0, nil)
+	if fmt.Sprint(nodes) != "[b e a d]" {
+		T.Fatal("full range: ", nodes)
+	}
+
+	_ = graph.IndexProperty("score")
+	for node, score := range map[string]float64{"x": -1.5, "y": 2, "z": -0.25} {
+		_ = graph.SetNodeProperties(node, map[string][]byte{"score": EncodeFloat64(score)}, nil)
+	}
+	nodes, _ = graph.NodesWhereRange("score", -1.0, 10.0, 0, nil)
+	if fmt.Sprint(nodes) != "[z y]" {
+		T.Fatal("float range: ", nodes)
+	}
+
+	if err = graph.DropPropertyIndex("age"); err != nil {
+		T.Fatal(err)
+	}
+	if _, err = graph.NodesWhereEq("age", 30, 0, nil); err != ErrNoIndex {
+		T.Fatal("expected ErrNoIndex after dropping, got ", err)
+	}
+	_ = graph.DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = indexNamePrefix("age")
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			T.Fatalf("index key %q survived dropping the index", it.Item().Key())
+		}
+		return nil
+	})
+}
+
+func TestRemoveNodesWithPrefix(T *testing.T) {
+	graph, _ := NewGraph("", true, WithChangelog())
+	defer graph.Close()
+
+	txn := graph.DB.NewTransaction(true)
+	for i := 0; i < removeBatchSize+10; i++ {
+		node := fmt.Sprintf("job/2023/%04d", i)
+		_ = graph.AddEdge(node, "job/2024/keep", txn)
+		_ = graph.AddEdge(node, fmt.Sprintf("job/2023/%04d", (i+1)%100), txn)
+	}
+	if err := txn.Commit(); err != nil {
+		T.Fatal(err)
+	}
+	_ = graph.AddEdge("job/2024/keep", "job/2023/0001", nil)
+	_ = graph.AddEdge("job/2024/keep", "other", nil)
+	_ = graph.AddEdge("job/202", "job/2023/0002", nil)
+	_ = graph.SetNodeProperties("job/2023/0001", map[string][]byte{"owner": []byte("x")}, nil)
+	_ = graph.SetEdgeWeight("job/2024/keep", "job/2023/0001", 2, nil)
+	before, _ := graph.CurrentVersion(nil)
+
+	stats, err := graph.RemoveNodesWithPrefix("job/2023/")
+	if err != nil {
+		T.Fatal(err)
+	}
+	want := RemoveStats{Nodes: removeBatchSize + 10, Edges: 2 * (removeBatchSize + 10), InboundEdges: 2}
+	if stats != want {
+		T.Fatalf("expected %+v, got %+v", want, stats)
+	}
+
+	edges := edgeSet(T, graph)
+	if len(edges) != 1 || !edges["job/2024/keep->other"] {
+		T.Fatal("unexpected remaining edges ", edges)
+	}
+	if _, err = graph.GetEdges("job/202", nil); err != nil {
+		T.Fatal("node outside the prefix was removed: ", err)
+	}
+	if props, _ := graph.GetNodeProperties("job/2023/0001", nil); len(props) != 0 {
+		T.Fatal("properties of a removed node survived: ", props)
+	}
+	if _, ok, _ := graph.GetEdgeWeight("job/2024/keep", "job/2023/0001", nil); ok {
+		T.Fatal("weight of a repaired inbound edge survived")
+	}
+
+	removed := 0
+	_ = graph.Changes(before, func(record ChangeRecord) error {
+		if record.Op == ChangeRemoveEdge {
+			removed++
+		}
+		return nil
+	}, nil)
+	if removed != want.Edges+want.InboundEdges {
+		T.Fatalf("expected %d remove records, got %d", want.Edges+want.InboundEdges, removed)
+	}
+
+	if _, err = graph.RemoveNodesWithPrefix(""); err == nil {
+		T.Fatal("expected an empty prefix to be rejected")
+	}
+}
+
+func TestRemoveNodesWithPrefixWithoutEdgeList(T *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		graph, _ := NewGraph("", true)
+		if indexed {
+			if err := graph.IndexReverseEdges(); err != nil {
+				T.Fatal(err)
+			}
+		}
+		_ = graph.AddEdge("job/1", "kept", nil)
+		_ = graph.SetNodeProperties("job/2", map[string][]byte{"owner": []byte("x")}, nil)
+		_ = graph.AddEdge("kept", "job/3", nil)
+		_ = graph.AddAlias("j3", "job/3", nil)
+		// legacy is redirected into the prefix, and the edge to it is stored under legacy.
+		_ = graph.AddEdge("kept", "legacy", nil)
+		if err := graph.Redirect("legacy", "job/4", nil); err != nil {
+			T.Fatal(err)
+		}
+
+		stats, err := graph.RemoveNodesWithPrefix("job/")
+		if err != nil {
+			T.Fatal(err)
+		}
+		if stats.Nodes != 3 || stats.InboundEdges != 2 {
+			T.Fatalf("indexed %v: unexpected stats %+v", indexed, stats)
+		}
+		if props, _ := graph.GetNodeProperties("job/2", nil); len(props) != 0 {
+			T.Fatalf("indexed %v: properties of a removed node survived: %v", indexed, props)
+		}
+		if canonical, _ := graph.Resolve("j3", nil); canonical != "j3" {
+			T.Fatalf("indexed %v: alias of a removed node survived", indexed)
+		}
+		if edges := edgeSet(T, graph); len(edges) != 0 {
+			T.Fatalf("indexed %v: unexpected remaining edges %v", indexed, edges)
+		}
+		graph.Close()
+	}
+}
+
+func TestRemoveNodesWithPrefixResumes(T *testing.T) {
+	dir := T.TempDir()
+	graph, _ := NewGraph(dir, false)
+	txn := graph.DB.NewTransaction(true)
+	for i := 0; i < 2*removeBatchSize; i++ {
+		_ = graph.AddEdge(fmt.Sprintf("tmp/%04d", i), "kept", txn)
+	}
+	_ = graph.AddEdge("kept", "tmp/0000", txn)
+	if err := txn.Commit(); err != nil {
+		T.Fatal(err)
+	}
+
+	// Crash after the first batch.
+	entry, _, _ := graph.newJournalEntry(journalOpRemovePrefix, "tmp/")
+	if done, err := graph.removePrefixBatch(entry); err != nil || done {
+		T.Fatal("first batch: ", done, err)
+	}
+	graph.Close()
+
+	graph, err := NewGraph(dir, false, WithOpenCheck(CheckFull))
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer graph.Close()
+	if edges := edgeSet(T, graph); len(edges) != 0 {
+		T.Fatalf("recovery did not finish the removal, %d edges left", len(edges))
+	}
+}
+
+func TestPendingRecovery(T *testing.T) {
+	dir := T.TempDir()
+	calls := 0
+	graph, _ := NewGraph(dir, false, WithFaultPoints(func(point string) error {
+		if point == "RemoveNodesWithPrefix" {
+			if calls++; calls == 2 {
+				return ErrFault
+			}
+		}
+		return nil
+	}))
+	txn := graph.DB.NewTransaction(true)
+	for i := 0; i < 2*removeBatchSize; i++ {
+		_ = graph.AddEdge(fmt.Sprintf("tmp/%04d", i), "kept", txn)
+	}
+	if err := txn.Commit(); err != nil {
+		T.Fatal(err)
+	}
+
+	// A running operation is not waiting for recovery.
+	entry, release, _ := graph.newJournalEntry(journalOpRemovePrefix, "other/")
+	if pending, err := graph.PendingRecovery(); err != nil || pending != 0 {
+		T.Fatal("running operation counted as pending ", pending, err)
+	}
+	release()
+	_ = graph.DB.Update(func(txn *badger.Txn) error { return deleteJournalEntry(txn, entry) })
+
+	if _, err := graph.RemoveNodesWithPrefix("tmp/"); !errors.Is(err, ErrFault) {
+		T.Fatal("expected the removal to stop at the fault point, got ", err)
+	}
+	if pending, err := graph.PendingRecovery(); err != nil || pending != 1 {
+		T.Fatal("expected the interrupted removal to be pending ", pending, err)
+	}
+	graph.Close()
+
+	graph, _ = NewGraph(dir, false)
+	defer graph.Close()
+	if pending, err := graph.PendingRecovery(); err != nil || pending != 0 {
+		T.Fatal("expected NewGraph to recover the removal ", pending, err)
+	}
+}
+
+func TestJournalEntryIDs(T *testing.T) {
+	graph, _ := NewGraph("", true, WithUpdateRetries(100))
+	defer graph.Close()
+
+	// An entry written before the journal head existed was numbered by the time.
+	old := &journalEntry{ID: uint64(time.Now().UnixNano()), Op: "test"}
+	_ = graph.DB.Update(func(txn *badger.Txn) error { return writeJournalEntry(txn, old) })
+	first, release, err := graph.newJournalEntry("test", "")
+	if err != nil {
+		T.Fatal(err)
+	}
+	release()
+	if first.ID != old.ID+1 {
+		T.Fatal("expected the IDs to continue after the last entry, got ", first.ID, " after ", old.ID)
+	}
+
+	var wg sync.WaitGroup
+	ids := make([]uint64, 20)
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entry, release, err := graph.newJournalEntry("test", "")
+			if err != nil {
+				T.Error(err)
+				return
+			}
+			release()
+			ids[i] = entry.ID
+		}()
+	}
+	wg.Wait()
+	slices.Sort(ids)
+	for i, id := range ids {
+		if id != first.ID+uint64(i)+1 {
+			T.Fatal("expected consecutive IDs after ", first.ID, ", got ", ids)
+		}
+	}
+}
+
+func TestRemoveNodesWithPrefixReverseIndex(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	if err := graph.IndexReverseEdges(); err != nil {
+		T.Fatal(err)
+	}
+
+	// The removed nodes are mostly sinks, with more inbound edges than fit in a batch.
+	txn := graph.DB.NewTransaction(true)
+	for i := 0; i < 2*removeBatchSize+5; i++ {
+		_ = graph.AddEdge(fmt.Sprintf("src/%04d", i%50), fmt.Sprintf("tmp/%04d", i), txn)
+	}
+	_ = graph.AddEdge("src/0000", "other", txn)
+	_ = graph.AddEdge("tmp/0001", "other", txn)
+	_ = graph.AddEdge("tmp", "src/0001", txn)
+	if err := txn.Commit(); err != nil {
+		T.Fatal(err)
+	}
+
+	entry, _, _ := graph.newJournalEntry(journalOpRemovePrefix, "tmp/")
+	if done, err := graph.removePrefixBatch(entry); err != nil || done {
+		T.Fatal("nodes batch: ", done, err)
+	}
+	if entry.Phase != removePhaseInboundIndexed {
+		T.Fatal("inbound edges not looked up in the reverse index, phase ", entry.Phase)
+	}
+	for done := false; !done; {
+		var err error
+		if done, err = graph.removePrefixBatch(entry); err != nil {
+			T.Fatal(err)
+		}
+	}
+	if entry.Counts["nodes"] != 1 || entry.Counts["inbound"] != 2*removeBatchSize+5 {
+		T.Fatalf("unexpected counts %v", entry.Counts)
+	}
+
+	edges := edgeSet(T, graph)
+	if len(edges) != 2 || !edges["src/0000->other"] || !edges["tmp->src/0001"] {
+		T.Fatal("unexpected remaining edges ", edges)
+	}
+	if in, _ := graph.GetInEdges("tmp/0002", nil); len(in) != 0 {
+		T.Fatal("reverse index entries of removed edges survived: ", in)
+	}
+}
+
+func TestInMemoryPersistOnClose(T *testing.T) {
+	if _, err := NewGraph("/tmp/onyx-ignored", true); err != ErrInMemoryPath {
+		T.Fatal("expected ErrInMemoryPath, got ", err)
+	}
+	if _, err := NewGraph(T.TempDir(), false, WithPersistOnClose("x")); err == nil {
+		T.Fatal("expected WithPersistOnClose to be rejected for an on-disk graph")
+	}
+
+	file := filepath.Join(T.TempDir(), "graph.bak")
+	graph, err := NewGraph("", true, WithPersistOnClose(file))
+	if err != nil {
+		T.Fatal(err)
+	}
+	if !graph.IsInMemory() {
+		T.Fatal("IsInMemory is false for an in-memory graph")
+	}
+	_ = graph.AddEdge("a", "b", nil)
+	_ = graph.AddEdge("b", "c", nil)
+	_ = graph.SetNodeProperties("a", map[string][]byte{"name": []byte("Alice")}, nil)
+	if err = graph.Close(); err != nil {
+		T.Fatal(err)
+	}
+
+	if _, err = NewGraph("", true, WithRestoreFrom(file+".missing")); !errors.Is(err, os.ErrNotExist) {
+		T.Fatal("expected a missing restore file to fail, got ", err)
+	}
+
+	restored, err := NewGraph("", true, WithRestoreFrom(file), WithOpenCheck(CheckFull))
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer restored.Close()
+	if edges := edgeSet(T, restored); len(edges) != 2 || !edges["a->b"] || !edges["b->c"] {
+		T.Fatal("unexpected restored edges ", edges)
+	}
+	if name, _ := restored.GetNodePropertyString("a", "name", nil); name != "Alice" {
+		T.Fatal("property not restored: ", name)
+	}
+}
+
+func TestRedirect(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	_ = graph.AddEdge("old", "x", nil)
+	_ = graph.AddEdge("old", "y", nil)
+	_ = graph.AddEdge("new", "y", nil)
+	_ = graph.AddEdge("b", "old", nil)
+	_ = graph.SetEdgeWeight("old", "x", 3, nil)
+	_ = graph.SetNodeProperties("old", map[string][]byte{"name": []byte("Old"), "slug": []byte("old")}, nil)
+	_ = graph.SetNodeProperties("new", map[string][]byte{"name": []byte("New")}, nil)
+
+	if err := graph.Redirect("old", "new", nil); err != nil {
+		T.Fatal(err)
+	}
+	if edges, _ := graph.GetEdges("old", nil); !reflect.DeepEqual(edges, map[string]bool{"x": true, "y": true}) {
+		T.Fatal("unexpected edges of the redirected node ", edges)
+	}
+	if edges, _ := graph.GetEdges("b", nil); !reflect.DeepEqual(edges, map[string]bool{"new": true}) {
+		T.Fatal("inbound edge not resolved to the canonical id ", edges)
+	}
+	for _, from := range []string{"old", "new"} {
+		if ok, _ := graph.HasEdge("b", from, nil); !ok {
+			T.Fatalf("HasEdge(b, %s) is false", from)
+		}
+	}
+	if result, _ := graph.BFS("b", TraversalOptions{}, nil); !reflect.DeepEqual(result.Order, []string{"b", "new", "x", "y"}) {
+		T.Fatal("unexpected traversal order ", result.Order)
+	}
+	if w, ok, _ := graph.GetEdgeWeight("new", "x", nil); !ok || w != 3 {
+		T.Fatal("edge weight not moved ", w, ok)
+	}
+	props, _ := graph.GetNodeProperties("new", nil)
+	if string(props["name"]) != "New" || string(props["slug"]) != "old" {
+		T.Fatal("unexpected merged properties ", props)
+	}
+
+	_ = graph.AddEdge("old", "z", nil)
+	_ = graph.AddEdge("c", "old", nil)
+	if edges := edgeSet(T, graph); edges["old->z"] || edges["c->old"] || !edges["new->z"] || !edges["c->new"] {
+		T.Fatal("writes didn't resolve the redirect ", edges)
+	}
+	_, _ = graph.RemoveEdge("b", "new", nil)
+	if ok, _ := graph.HasEdge("b", "old", nil); ok {
+		T.Fatal("edge to the old id survived RemoveEdge of the canonical id")
+	}
+
+	if err := graph.Redirect("new", "old", nil); !errors.Is(err, ErrRedirectCycle) {
+		T.Fatal("expected a cycle error, got ", err)
+	}
+	if err := graph.Redirect("x", "x", nil); !errors.Is(err, ErrRedirectCycle) {
+		T.Fatal("expected a self redirect to be rejected, got ", err)
+	}
+}
+
+func TestRedirectDepth(T *testing.T) {
+	graph, _ := NewGraph("", true, WithRedirectDepth(1))
+	defer graph.Close()
+	_ = graph.AddEdge("c", "d", nil)
+	_ = graph.Redirect("a", "b", nil)
+	_ = graph.Redirect("b", "c", nil)
+
+	if _, err := graph.GetEdges("b", nil); err != nil {
+		T.Fatal(err)
+	}
+	if _, err := graph.GetEdges("a", nil); !errors.Is(err, ErrRedirectDepth) {
+		T.Fatal("expected the chain to exceed the redirect depth, got ", err)
+	}
+}
+
+func TestRedirectsAfterReopen(T *testing.T) {
+	dir := T.TempDir()
+	graph, _ := NewGraph(dir, false)
+	_ = graph.AddEdge("x", "old", nil)
+	_ = graph.AddEdge("new", "y", nil)
+	_ = graph.Redirect("old", "new", nil)
+	graph.Close()
+
+	// The graph has to know it has redirects without writing one.
+	graph, err := NewGraph(dir, false)
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer graph.Close()
+	if edges, _ := graph.GetEdges("x", nil); !reflect.DeepEqual(edges, map[string]bool{"new": true}) {
+		T.Fatal("redirect not followed after reopening: ", edges)
+	}
+}
+
+func TestAliases(T *testing.T) {
+	graph, _ := NewGraph("", true, WithAliasResolution())
+	defer graph.Close()
+	_ = graph.AddEdge("u1", "u2", nil)
+	_ = graph.AddEdge("u2", "u3", nil)
+
+	if err := graph.AddAlias("alice@example.com", "u1", nil); err != nil {
+		T.Fatal(err)
+	}
+	if err := graph.AddAlias("alice@example.com", "u1", nil); err != nil {
+		T.Fatal("adding an alias again: ", err)
+	}
+	var taken *ErrAliasTaken
+	if err := graph.AddAlias("alice@example.com", "u2", nil); !errors.As(err, &taken) || taken.Canonical != "u1" {
+		T.Fatal("expected the alias to be taken by u1, got ", err)
+	}
+	if err := graph.AddAlias("u2", "u3", nil); !errors.As(err, &taken) || taken.Canonical != "" {
+		T.Fatal("expected a node ID to be rejected as an alias, got ", err)
+	}
+	// Aliasing an alias aliases its node.
+	if err := graph.AddAlias("alice", "alice@example.com", nil); err != nil {
+		T.Fatal(err)
+	}
+
+	for _, id := range []string{"u1", "alice", "alice@example.com"} {
+		if canonical, err := graph.Resolve(id, nil); err != nil || canonical != "u1" {
+			T.Fatal("expected ", id, " to resolve to u1, got ", canonical, err)
+		}
+	}
+	if edges, err := graph.GetEdges("alice", nil); err != nil || !reflect.DeepEqual(edges, map[string]bool{"u2": true}) {
+		T.Fatal("unexpected edges of an alias ", edges, err)
+	}
+	if err := graph.AddEdge("u3", "alice", nil); err != nil {
+		T.Fatal(err)
+	}
+	if ok, _ := graph.HasEdge("u3", "u1", nil); !ok {
+		T.Fatal("write to an alias didn't write to its node")
+	}
+
+	// Merging u1 into u2 moves its aliases to u2.
+	if err := graph.MergeNodes("u2", []string{"u1"}, nil); err != nil {
+		T.Fatal(err)
+	}
+	if aliases, _ := graph.Aliases("u2", nil); !reflect.DeepEqual(aliases, []string{"alice", "alice@example.com"}) {
+		T.Fatal("unexpected aliases after merge ", aliases)
+	}
+	if aliases, _ := graph.Aliases("u1", nil); !reflect.DeepEqual(aliases, []string{"alice", "alice@example.com"}) {
+		T.Fatal("expected u1 to resolve to u2, got aliases ", aliases)
+	}
+	if canonical, _ := graph.Resolve("alice", nil); canonical != "u2" {
+		T.Fatal("expected the alias to point at the survivor, got ", canonical)
+	}
+
+	if _, err := graph.RemoveNode("u2", nil); err != nil {
+		T.Fatal(err)
+	}
+	if canonical, _ := graph.Resolve("alice", nil); canonical != "alice" {
+		T.Fatal("alias left after its node was removed ", canonical)
+	}
+	if err := graph.AddAlias("alice", "u3", nil); err != nil {
+		T.Fatal("reusing the alias of a removed node: ", err)
+	}
+	if err := graph.RemoveAlias("alice", nil); err != nil {
+		T.Fatal(err)
+	}
+	if aliases, _ := graph.Aliases("u3", nil); len(aliases) != 0 {
+		T.Fatal("alias left after RemoveAlias ", aliases)
+	}
+}
+
+func TestAliasesWithoutResolution(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	_ = graph.AddEdge("u1", "u2", nil)
+	_ = graph.AddAlias("alice", "u1", nil)
+
+	if canonical, _ := graph.Resolve("alice", nil); canonical != "u1" {
+		T.Fatal("expected alice to resolve to u1, got ", canonical)
+	}
+	if _, err := graph.GetEdges("alice", nil); err != badger.ErrKeyNotFound {
+		T.Fatal("expected reads not to resolve aliases, got ", err)
+	}
+	// Writes don't create a node the alias would hide.
+	var taken *ErrAliasTaken
+	if err := graph.AddEdge("alice", "u3", nil); !errors.As(err, &taken) || taken.Canonical != "u1" {
+		T.Fatal("expected AddEdge from an alias to be rejected, got ", err)
+	}
+	if err := graph.AddEdge("u3", "alice", nil); !errors.As(err, &taken) {
+		T.Fatal("expected AddEdge to an alias to be rejected, got ", err)
+	}
+	if err := graph.SetNodeProperties("alice", map[string][]byte{"name": []byte("A")}, nil); !errors.As(err, &taken) {
+		T.Fatal("expected SetNodeProperties on an alias to be rejected, got ", err)
+	}
+	if _, err := graph.GetEdges("alice", nil); err != badger.ErrKeyNotFound {
+		T.Fatal("rejected write created a node under the alias, got ", err)
+	}
+
+	// The alias operations run in the transaction of the caller.
+	txn := graph.DB.NewTransaction(true)
+	if err := graph.AddAlias("bob", "u2", txn); err != nil {
+		T.Fatal(err)
+	}
+	if canonical, _ := graph.Resolve("bob", txn); canonical != "u2" {
+		T.Fatal("expected bob to resolve to u2 in the transaction, got ", canonical)
+	}
+	if canonical, _ := graph.Resolve("bob", nil); canonical != "bob" {
+		T.Fatal("alias visible before the commit")
+	}
+	if err := txn.Commit(); err != nil {
+		T.Fatal(err)
+	}
+	if aliases, _ := graph.Aliases("u2", nil); !reflect.DeepEqual(aliases, []string{"bob"}) {
+		T.Fatal("unexpected aliases after the commit ", aliases)
+	}
+
+	if _, err := graph.RemoveNodesWithPrefix("u"); err != nil {
+		T.Fatal(err)
+	}
+	if canonical, _ := graph.Resolve("alice", nil); canonical != "alice" {
+		T.Fatal("alias left after its node was removed ", canonical)
+	}
+}
+
+func TestResolveRedirects(T *testing.T) {
+	graph, _ := NewGraph("", true, WithChangelog())
+	defer graph.Close()
+	for i := 0; i < resolveBatchSize+10; i++ {
+		_ = graph.AddEdge(fmt.Sprintf("n%04d", i), "a", nil)
+	}
+	_ = graph.AddEdge("n0000", "b", nil)
+	_ = graph.SetEdgeWeight("n0001", "a", 2, nil)
+	_ = graph.Redirect("a", "b", nil)
+	_ = graph.Redirect("b", "c", nil)
+
+	stats, err := graph.ResolveRedirects(context.Background())
+	if err != nil {
+		T.Fatal(err)
+	}
+	want := ResolveStats{EdgesRewritten: resolveBatchSize + 11, RedirectsRemoved: 2}
+	if stats != want {
+		T.Fatalf("expected %+v, got %+v", want, stats)
+	}
+
+	edges := edgeSet(T, graph)
+	if len(edges) != resolveBatchSize+10 || !edges["n0000->c"] || edges["n0000->a"] {
+		T.Fatal("unexpected edges after resolving ", len(edges))
+	}
+	if w, ok, _ := graph.GetEdgeWeight("n0001", "c", nil); !ok || w != 2 {
+		T.Fatal("edge weight not moved to the rewritten edge ", w, ok)
+	}
+	txn := graph.DB.NewTransaction(false)
+	defer txn.Discard()
+	if target, _ := readRedirect(txn, "a"); target != "" {
+		T.Fatal("redirect marker survived ", target)
+	}
+	if stats, _ = graph.ResolveRedirects(context.Background()); stats != (ResolveStats{}) {
+		T.Fatal("expected nothing left to resolve, got ", stats)
+	}
+}
+
+func TestMutationHistogram(T *testing.T) {
+	graph, _ := NewGraph("", true, WithMutationStats(time.Minute))
+	defer graph.Close()
+	_ = graph.AddEdge("a", "b", nil)
+	_ = graph.AddEdge("a", "c", nil)
+	_ = graph.AddEdge("a", "c", nil)
+	_, _ = graph.RemoveEdge("a", "b", nil)
+	_, _, _ = graph.SetEdges("a", []string{"d"}, nil)
+	_ = graph.WithoutMutationStats(nil, func(txn *badger.Txn) error {
+		return graph.AddEdge("a", "e", txn)
+	})
+	err := graph.ImportJSON(strings.NewReader(`{"edges": [{"from": "a", "to": "f"}]}`), ImportOptions{SkipMutationStats: true})
+	if err != nil {
+		T.Fatal(err)
+	}
+
+	now := time.Now()
+	buckets, err := graph.MutationHistogram("a", now.Add(-time.Hour), now.Add(time.Hour), nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	var added, removed uint64
+	for _, bucket := range buckets {
+		if bucket.Start.Truncate(time.Minute) != bucket.Start {
+			T.Fatal("bucket not aligned to the granularity ", bucket.Start)
+		}
+		added += bucket.Added
+		removed += bucket.Removed
+	}
+	if added != 3 || removed != 2 {
+		T.Fatalf("expected 3 added and 2 removed, got %d and %d", added, removed)
+	}
+	if buckets, _ = graph.MutationHistogram("a", now.Add(time.Hour), now.Add(2*time.Hour), nil); len(buckets) != 0 {
+		T.Fatal("unexpected buckets outside the range ", buckets)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	task := graph.MutationStatsRetentionTask(-time.Hour, time.Millisecond)
+	pruned := task.Run
+	task.Run = func(ctx context.Context) error {
+		defer cancel()
+		return pruned(ctx)
+	}
+	if err = graph.RunMaintenance(ctx, []MaintenanceTask{task}, func(_ string, err error) { T.Error(err) }); err != context.Canceled {
+		T.Fatal("expected RunMaintenance to stop with the context, got ", err)
+	}
+	if buckets, _ = graph.MutationHistogram("a", time.Time{}, now.Add(time.Hour), nil); len(buckets) != 0 {
+		T.Fatal("retention task didn't prune ", buckets)
+	}
+}
+
+func TestRemoveModes(T *testing.T) {
+	strict, _ := NewGraph("", true, WithChangelog())
+	defer strict.Close()
+	_ = strict.AddEdge("a", "b", nil)
+	_ = strict.AddEdge("a", "c", nil)
+
+	if _, err := strict.RemoveEdge("missing", "b", nil); !errors.Is(err, ErrNodeNotFound) || !errors.Is(err, badger.ErrKeyNotFound) {
+		T.Fatal("expected ErrNodeNotFound, got ", err)
+	}
+	if _, err := strict.RemoveEdge("a", "d", nil); !errors.Is(err, ErrEdgeNotFound) {
+		T.Fatal("expected ErrEdgeNotFound, got ", err)
+	}
+	if _, err := strict.RemoveEdges("a", []string{"b", "d"}, nil); !errors.Is(err, ErrEdgeNotFound) {
+		T.Fatal("expected ErrEdgeNotFound, got ", err)
+	}
+	if edges := edgeSet(T, strict); len(edges) != 2 {
+		T.Fatal("a failed strict removal removed edges ", edges)
+	}
+	if removed, err := strict.RemoveEdge("a", "b", nil); !removed || err != nil {
+		T.Fatal("expected the edge to be removed ", removed, err)
+	}
+
+	noop, _ := NewGraph("", true, WithChangelog(), WithMutationStats(time.Hour), WithRemoveMode(RemoveNoOp))
+	defer noop.Close()
+	_ = noop.AddEdge("a", "b", nil)
+	_ = noop.AddEdge("a", "c", nil)
+	before, _ := noop.CurrentVersion(nil)
+
+	if removed, err := noop.RemoveEdge("missing", "b", nil); removed || err != nil {
+		T.Fatal("expected a no-op for a missing node ", removed, err)
+	}
+	if removed, err := noop.RemoveEdge("a", "d", nil); removed || err != nil {
+		T.Fatal("expected a no-op for a missing edge ", removed, err)
+	}
+	if removed, err := noop.RemoveNode("missing", nil); removed || err != nil {
+		T.Fatal("expected a no-op for a missing node ", removed, err)
+	}
+	if after, _ := noop.CurrentVersion(nil); after != before {
+		T.Fatal("no-op removals were recorded in the changelog")
+	}
+	if n, err := noop.RemoveEdges("a", []string{"b", "c", "d"}, nil); n != 2 || err != nil {
+		T.Fatal("expected 2 edges to be removed ", n, err)
+	}
+	buckets, _ := noop.MutationHistogram("a", time.Time{}, time.Now().Add(time.Hour), nil)
+	if len(buckets) != 1 || buckets[0].Removed != 2 {
+		T.Fatal("unexpected mutation stats ", buckets)
+	}
+}
+
+func TestRemoveNode(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	_ = graph.AddEdge("a", "b", nil)
+	_ = graph.AddEdge("b", "c", nil)
+	_ = graph.AddEdge("b", "b", nil)
+	_ = graph.AddEdge("c", "b", nil)
+	_ = graph.AddEdge("c", "a", nil)
+	_ = graph.SetEdgeWeight("c", "b", 2, nil)
+	_ = graph.SetNodeProperties("b", map[string][]byte{"name": []byte("Bob")}, nil)
+	_ = graph.SetNodeProperties("p", map[string][]byte{"name": []byte("Props only")}, nil)
+
+	if removed, err := graph.RemoveNode("b", nil); !removed || err != nil {
+		T.Fatal("expected b to be removed ", removed, err)
+	}
+	if edges := edgeSet(T, graph); len(edges) != 1 || !edges["c->a"] {
+		T.Fatal("unexpected edges ", edges)
+	}
+	if props, _ := graph.GetNodeProperties("b", nil); len(props) != 0 {
+		T.Fatal("properties survived ", props)
+	}
+	if _, ok, _ := graph.GetEdgeWeight("c", "b", nil); ok {
+		T.Fatal("weight of an inbound edge survived")
+	}
+	if _, err := graph.RemoveNode("b", nil); !errors.Is(err, ErrNodeNotFound) {
+		T.Fatal("expected ErrNodeNotFound, got ", err)
+	}
+	if removed, _ := graph.RemoveNode("p", nil); !removed {
+		T.Fatal("node with only properties not removed")
+	}
+}
+
+func TestRemoveSinkOnlyNode(T *testing.T) {
+	for _, reverse := range []bool{false, true} {
+		graph, _ := NewGraph("", true)
+		if reverse {
+			if err := graph.IndexReverseEdges(); err != nil {
+				T.Fatal(err)
+			}
+		}
+		_ = graph.AddEdge("a", "b", nil)
+		_ = graph.AddEdge("c", "b", nil)
+		_ = graph.AddEdge("a", "c", nil)
+
+		if removed, err := graph.RemoveNode("b", nil); !removed || err != nil {
+			T.Fatal("expected the sink b to be removed ", removed, err)
+		}
+		if edges := edgeSet(T, graph); len(edges) != 1 || !edges["a->c"] {
+			T.Fatal("inbound edges of the sink survived ", edges, reverse)
+		}
+		if _, err := graph.RemoveNode("b", nil); !errors.Is(err, ErrNodeNotFound) {
+			T.Fatal("expected ErrNodeNotFound, got ", err)
+		}
+		graph.Close()
+	}
+}
+
+func TestRemoveNodeRedirectedInEdges(T *testing.T) {
+	for _, reverse := range []bool{false, true} {
+		graph, _ := NewGraph("", true)
+		if reverse {
+			if err := graph.IndexReverseEdges(); err != nil {
+				T.Fatal(err)
+			}
+		}
+		_ = graph.AddEdge("x", "old", nil)
+		_ = graph.AddEdge("y", "new", nil)
+		_ = graph.AddEdge("x", "z", nil)
+		if err := graph.Redirect("old", "new", nil); err != nil {
+			T.Fatal(err)
+		}
+
+		// x->old is still stored under old, and is an edge into new.
+		if removed, err := graph.RemoveNode("new", nil); !removed || err != nil {
+			T.Fatal("expected new to be removed ", removed, err)
+		}
+		if edges := edgeSet(T, graph); len(edges) != 1 || !edges["x->z"] {
+			T.Fatal("edges into the redirected ID survived ", edges, reverse)
+		}
+		if report, _ := graph.CheckIntegrity(nil); !report.OK() {
+			T.Fatal(report.Problems)
+		}
+		graph.Close()
+	}
+}
+
+func TestUpdateWithResult(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	_ = graph.AddEdge("a", "b", nil)
+
+	attempts := 0
+	result, err := graph.UpdateWithResult(func(tx *Tx) (any, error) {
+		attempts++
+		dstNodes, err := tx.GetEdges("a")
+		if err != nil {
+			return nil, err
+		}
+		if attempts == 1 {
+			// A concurrent writer changes what this attempt has read before it commits.
+			if err := graph.AddEdge("a", "c", nil); err != nil {
+				return nil, err
+			}
+		}
+		if err := tx.AddEdge("a", fmt.Sprintf("seen-%d", len(dstNodes))); err != nil {
+			return nil, err
+		}
+		return len(dstNodes), nil
+	})
+	if err != nil {
+		T.Fatal(err)
+	}
+	if attempts != 2 || result != 2 {
+		T.Fatalf("expected the second attempt to commit with 2 neighbors, got attempt %d with %v", attempts, result)
+	}
+	if edges := edgeSet(T, graph); edges["a->seen-1"] || !edges["a->seen-2"] {
+		T.Fatal("writes of the conflicting attempt were committed ", edges)
+	}
+	if hotspots, _ := graph.ConflictHotspots(1); len(hotspots) != 1 || hotspots[0].Key != "a" || graph.Metrics().Conflicts != 1 {
+		T.Fatal("conflict not recorded ", hotspots)
+	}
+
+	limited, _ := NewGraph("", true, WithUpdateRetries(2))
+	defer limited.Close()
+	attempts = 0
+	err = limited.Update(func(tx *Tx) error {
+		attempts++
+		if _, err := tx.GetEdges("x"); err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+		if err := limited.AddEdge("x", fmt.Sprint(attempts), nil); err != nil {
+			return err
+		}
+		return tx.AddEdge("x", "y")
+	})
+	if err != badger.ErrConflict || attempts != 3 {
+		T.Fatalf("expected a conflict after 3 attempts, got %v after %d", err, attempts)
+	}
+
+	wantErr := errors.New("stop")
+	if err = graph.Update(func(tx *Tx) error {
+		_ = tx.AddEdge("a", "never")
+		return wantErr
+	}); err != wantErr {
+		T.Fatal("expected the closure error, got ", err)
+	}
+	if ok, _ := graph.HasEdge("a", "never", nil); ok {
+		T.Fatal("write of a failed closure was committed")
+	}
+}
+
+func TestMultiSourceNeighborhood(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	for i := 0; i < 50; i++ {
+		_ = graph.AddEdge(fmt.Sprintf("s%d", i), "hub", nil)
+		_ = graph.AddEdge("hub", fmt.Sprintf("t%d", i%5), nil)
+	}
+	_ = graph.AddEdge("t0", "far", nil)
+
+	want, err := graph.Neighborhood("s0", 2, ExpansionLimits{}, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if len(want.Depth) != 7 || want.Depth["hub"] != 1 || want.Depth["t3"] != 2 || want.Truncated != nil {
+		T.Fatal("unexpected neighborhood ", want)
+	}
+
+	seeds := []string{"bad\x00seed"}
+	for i := 0; i < 50; i++ {
+		seeds = append(seeds, fmt.Sprintf("s%d", i))
+	}
+	var mu sync.Mutex
+	results := make(map[string]map[string]int)
+	err = graph.MultiSourceNeighborhood(seeds, 2, 4, MultiSourceOptions{}, func(seed string, result *NeighborhoodResult) error {
+		mu.Lock()
+		defer mu.Unlock()
+		results[seed] = result.Depth
+		if seed == "s7" {
+			return errors.New("rejected")
+		}
+		return nil
+	}, nil)
+	var multiErr *MultiSourceError
+	if !errors.As(err, &multiErr) || len(multiErr.Errors) != 2 || multiErr.Errors["s7"] == nil {
+		T.Fatal("expected the two failed seeds to be reported, got ", err)
+	}
+	if len(results) != 50 {
+		T.Fatal("expected every seed to be processed, got ", len(results))
+	}
+	for i := 0; i < 50; i++ {
+		seed := fmt.Sprintf("s%d", i)
+		if len(results[seed]) != 7 || results[seed][seed] != 0 || results[seed]["t1"] != 2 {
+			T.Fatal("unexpected neighborhood ", seed, results[seed])
+		}
+	}
+
+	calls := 0
+	err = graph.MultiSourceNeighborhood(seeds[1:], 1, 1, MultiSourceOptions{FailFast: true}, func(seed string, result *NeighborhoodResult) error {
+		calls++
+		return errors.New("stop")
+	}, nil)
+	if err == nil || calls != 1 {
+		T.Fatalf("expected FailFast to stop after the first seed, got %v after %d calls", err, calls)
+	}
+
+	// Workers can't share a read-write transaction.
+	txn := graph.DB.NewTransaction(true)
+	defer txn.Discard()
+	err = graph.MultiSourceNeighborhood(seeds[1:], 1, 2, MultiSourceOptions{}, func(string, *NeighborhoodResult) error { return nil }, txn)
+	if err == nil {
+		T.Fatal("expected an update transaction to be refused")
+	}
+	readOnly := graph.DB.NewTransaction(false)
+	defer readOnly.Discard()
+	err = graph.MultiSourceNeighborhood(seeds[1:], 1, 2, MultiSourceOptions{}, func(string, *NeighborhoodResult) error { return nil }, readOnly)
+	if err != nil {
+		T.Fatal(err)
+	}
+}
+
+func TestExpansionLimits(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	_ = graph.AddEdge("a", "hub", nil)
+	_ = graph.AddEdge("a", "b", nil)
+	_ = graph.AddEdge("b", "c", nil)
+	for i := 0; i < 100; i++ {
+		_ = graph.AddEdge("hub", fmt.Sprintf("leaf%02d", i), nil)
+	}
+	for _, leaf := range []string{"leaf07", "leaf42", "leaf99"} {
+		_ = graph.SetEdgeWeight("hub", leaf, 5, nil)
+	}
+
+	sampled := func(limits ExpansionLimits) []string {
+		T.Helper()
+		result, err := graph.BFS("a", TraversalOptions{ExpansionLimits: limits}, nil)
+		if err != nil {
+			T.Fatal(err)
+		}
+		if !reflect.DeepEqual(result.Truncated, map[string]bool{"hub": true}) {
+			T.Fatal("expected only hub to be truncated, got ", result.Truncated)
+		}
+		neighborhood, _ := graph.Neighborhood("a", 10, limits, nil)
+		if !reflect.DeepEqual(neighborhood.Depth, result.Depth) || !reflect.DeepEqual(neighborhood.Truncated, result.Truncated) {
+			T.Fatal("Neighborhood and BFS disagree ", neighborhood, result.Depth)
+		}
+		parallel, err := graph.ParallelBFS("a", 4, TraversalOptions{ExpansionLimits: limits}, nil)
+		if err != nil {
+			T.Fatal(err)
+		}
+		if !reflect.DeepEqual(parallel, result) {
+			T.Fatal("ParallelBFS and BFS disagree ", parallel.Order, result.Order)
+		}
+		var leaves []string
+		for _, node := range result.Order {
+			if strings.HasPrefix(node, "leaf") {
+				leaves = append(leaves, node)
+			}
+		}
+		return leaves
+	}
+
+	first := sampled(ExpansionLimits{MaxFanoutPerNode: 10, FanoutSeed: 1})
+	if len(first) != 10 || !reflect.DeepEqual(first, sampled(ExpansionLimits{MaxFanoutPerNode: 10, FanoutSeed: 1})) {
+		T.Fatal("sample is not deterministic ", first)
+	}
+	if reflect.DeepEqual(first, sampled(ExpansionLimits{MaxFanoutPerNode: 10, FanoutSeed: 2})) {
+		T.Fatal("sample doesn't depend on the seed ", first)
+	}
+	if heaviest := sampled(ExpansionLimits{MaxFanoutPerNode: 3, FanoutByWeight: true}); !reflect.DeepEqual(heaviest, []string{"leaf07", "leaf42", "leaf99"}) {
+		T.Fatal("expected the heaviest edges to be kept, got ", heaviest)
+	}
+	if leaves := sampled(ExpansionLimits{SkipNodesAboveDegree: 50}); len(leaves) != 0 {
+		T.Fatal("supernode was expanded ", leaves)
+	}
+
+	complete, _ := graph.BFS("a", TraversalOptions{ExpansionLimits: ExpansionLimits{MaxFanoutPerNode: 100}}, nil)
+	if complete.Truncated != nil || len(complete.Order) != 104 {
+		T.Fatal("expected a complete traversal ", complete.Truncated, len(complete.Order))
+	}
+}
+
+func TestApplyMutations(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+
+	err := graph.ApplyMutations([]Mutation{
+		{Kind: MutationAddNode, From: "lonely"},
+		{Kind: MutationAddEdge, From: "a", To: "b"},
+		{Kind: MutationAddEdge, From: "a", To: "c"},
+		{Kind: MutationRemoveEdge, From: "a", To: "c"},
+		{Kind: MutationSetProperty, From: "a", Name: "name", Value: []byte("Alice")},
+		{Kind: MutationSetProperty, From: "a", To: "b", Name: LabelProperty, Value: []byte("knows")},
+	})
+	if err != nil {
+		T.Fatal(err)
+	}
+	if edges := edgeSet(T, graph); len(edges) != 1 || !edges["a->b"] {
+		T.Fatal("unexpected edges ", edges)
+	}
+	if _, err = graph.GetEdges("lonely", nil); err != nil {
+		T.Fatal("add_node didn't create the node ", err)
+	}
+	if props, _ := graph.GetEdgeProperties("a", "b", nil); string(props[LabelProperty]) != "knows" {
+		T.Fatal("edge property not set ", props)
+	}
+	if err = graph.ApplyMutations([]Mutation{{Kind: MutationAddEdge, From: "x", To: "y"}, {Kind: "nope"}}); err == nil {
+		T.Fatal("expected an unknown mutation to fail")
+	}
+	if ok, _ := graph.HasEdge("x", "y", nil); ok {
+		T.Fatal("a failed batch was partially applied")
+	}
+
+	done := make(chan error, 1)
+	if err = graph.ApplyAsync([]Mutation{{Kind: MutationAddEdge, From: "a", To: "d"}}, func(err error) { done <- err }); err != nil {
+		T.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		T.Fatal(err)
+	}
+	if ok, _ := graph.HasEdge("a", "d", nil); !ok {
+		T.Fatal("async mutation not applied")
+	}
+}
+
+func TestDeadLetters(T *testing.T) {
+	dir := T.TempDir()
+	graph, _ := NewGraph(dir, false, WithUpdateRetries(0))
+
+	// Every mutation that loses its conflicts for good must end up in the queue.
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				err := graph.ApplyMutations([]Mutation{{Kind: MutationAddEdge, From: "hot", To: fmt.Sprintf("%d-%d", w, i)}})
+				if err != nil && err != badger.ErrConflict {
+					T.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	queued := 0
+	_ = graph.DeadLetters(func(dl DeadLetter) error {
+		queued += len(dl.Mutations)
+		return nil
+	}, nil)
+	degree, _ := graph.OutDegree("hot", nil)
+	if degree+queued != 160 || graph.Metrics().DeadLetters != int64(queued) {
+		T.Fatalf("expected %d applied and %d queued mutations to add up to 160", degree, queued)
+	}
+	if n, err := graph.RetryDeadLetters(); err != nil || n != queued {
+		T.Fatal("expected every dead letter to succeed on retry ", n, err)
+	}
+	if degree, _ = graph.OutDegree("hot", nil); degree != 160 {
+		T.Fatal("retried mutations not applied ", degree)
+	}
+
+	_ = graph.deadLetter([]Mutation{{Kind: MutationRemoveEdge, From: "hot", To: "missing"}}, badger.ErrConflict)
+	if n, _ := graph.RetryDeadLetters(); n != 0 {
+		T.Fatal("expected the retry to fail")
+	}
+	var letters []DeadLetter
+	_ = graph.DeadLetters(func(dl DeadLetter) error {
+		letters = append(letters, dl)
+		return nil
+	}, nil)
+	if len(letters) != 1 || letters[0].Attempts != 2 || !strings.Contains(letters[0].Error, "edge not found") {
+		T.Fatal("unexpected dead letters ", letters)
+	}
+	_ = graph.Close()
+
+	graph, _ = NewGraph(dir, false)
+	defer graph.Close()
+	if depth := graph.Metrics().DeadLetters; depth != 1 {
+		T.Fatal("dead letter depth not restored on open ", depth)
+	}
+	if n, _ := graph.PurgeDeadLetters(letters[0].Time); n != 0 {
+		T.Fatal("purged a dead letter that isn't older than the cutoff")
+	}
+	if n, _ := graph.PurgeDeadLetters(time.Now()); n != 1 || graph.Metrics().DeadLetters != 0 {
+		T.Fatal("expected the dead letter to be purged ", n)
+	}
+}
+
+// TestNodeEnumerationExcludesInternalKeys writes data with every optional feature that keeps
+// internal records enabled and checks that no scan over nodes reports them as nodes.
+// Features adding internal keyspaces should be enabled here too.
+func TestNodeEnumerationExcludesInternalKeys(T *testing.T) {
+	graph, _ := NewGraph("", true, WithChangelog(), WithMutationStats(time.Hour), WithMinHashSketches(16))
+	defer graph.Close()
+
+	_ = graph.DefinePropertySchema("age", PropInt64, nil)
+	_ = graph.IndexProperty("age")
+	_ = graph.IndexReverseEdges()
+	_ = graph.AddEdge("a", "b", nil)
+	_ = graph.AddEdge("b", "c", nil)
+	_ = graph.AddEdge("\x01low", "a", nil)
+	_ = graph.AddEdge("c", "a", nil)
+	_ = graph.AddEdge("old", "a", nil)
+	_ = graph.Redirect("old", "new", nil)
+	_ = graph.SetNodeProperties("a", map[string][]byte{"age": EncodeInt64(30)}, nil)
+	_ = graph.SetEdgeWeight("a", "b", 2, nil)
+	_ = graph.deadLetter([]Mutation{{Kind: MutationAddEdge, From: "x", To: "y"}}, badger.ErrConflict)
+	_, _, _ = graph.newJournalEntry("test", "")
+	want := map[string]bool{"\x01low": true, "a": true, "b": true, "c": true, "new": true}
+
+	nodes := make(map[string]bool)
+	_ = graph.ForEachNode(func(node string) error {
+		nodes[node] = true
+		return nil
+	}, nil)
+	if !reflect.DeepEqual(nodes, want) {
+		T.Fatal("ForEachNode: expected ", want, " got ", nodes)
+	}
+
+	sources := make(map[string]bool)
+	_ = graph.IterAllEdges(func(src string, dst string) error {
+		sources[src] = true
+		return nil
+	}, 10, nil)
+	if !reflect.DeepEqual(sources, want) {
+		T.Fatal("IterAllEdges: expected sources ", want, " got ", sources)
+	}
+
+	for i := 0; i < 20; i++ {
+		if node, err := graph.PickRandomVertex(nil); err != nil || !want[node] {
+			T.Fatalf("PickRandomVertex returned %q, %v", node, err)
+		}
+	}
+
+	ranks, _ := graph.PageRank(PageRankOptions{}, nil)
+	for node := range ranks {
+		if !want[node] {
+			T.Fatalf("PageRank ranked %q", node)
+		}
+	}
+	positions, _ := graph.ComputeLayout(LayoutForceDirected, 1, LayoutOptions{}, nil)
+	for node := range positions {
+		if !want[node] {
+			T.Fatalf("ComputeLayout placed %q", node)
+		}
+	}
+
+	var buf bytes.Buffer
+	_ = graph.ExportJSON(&buf, ExportOptions{IncludeProperties: true}, nil)
+	var doc exportedGraph
+	_ = json.Unmarshal(buf.Bytes(), &doc)
+	for _, node := range doc.Nodes {
+		if !want[node.ID] {
+			T.Fatalf("ExportJSON exported %q", node.ID)
+		}
+	}
+
+	report, _ := graph.CheckIntegrity(nil)
+	if len(report.Problems) != 1 || !strings.Contains(report.Problems[0].Reason, "journal") {
+		T.Fatal("expected only the unfinished journal entry to be reported ", report.Problems)
+	}
+}
+
+func TestReverseIndex(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	if _, err := graph.GetInEdges("b", nil); err != ErrNoReverseIndex {
+		T.Fatal("expected ErrNoReverseIndex, got ", err)
+	}
+
+	_ = graph.AddEdge("a", "b", nil)
+	_ = graph.AddEdge("b", "a", nil)
+	_ = graph.AddEdge("c", "b", nil)
+	if err := graph.IndexReverseEdges(); err != nil {
+		T.Fatal(err)
+	}
+	_ = graph.AddEdge("d", "b", nil)
+	_, _ = graph.RemoveEdge("c", "b", nil)
+	if in, _ := graph.GetInEdges("b", nil); !reflect.DeepEqual(in, map[string]bool{"a": true, "d": true}) {
+		T.Fatal("unexpected in-edges ", in)
+	}
+
+	_ = graph.AddEdge("e", "old", nil)
+	_ = graph.Redirect("old", "b", nil)
+	if in, _ := graph.GetInEdges("b", nil); !reflect.DeepEqual(in, map[string]bool{"a": true, "d": true, "e": true}) {
+		T.Fatal("edge to the redirected id missing from the in-edges ", in)
+	}
+
+	if _, err := graph.RemoveNode("b", nil); err != nil {
+		T.Fatal(err)
+	}
+	if edges := edgeSet(T, graph); len(edges) != 0 {
+		T.Fatal("inbound edges survived RemoveNode ", edges)
+	}
+	if in, _ := graph.GetInEdges("b", nil); len(in) != 0 {
+		T.Fatal("reverse entries survived RemoveNode ", in)
+	}
+}
+
+func TestReadRepair(T *testing.T) {
+	graph, _ := NewGraph("", true, WithReadRepair(true))
+	defer graph.Close()
+	_ = graph.IndexReverseEdges()
+	_ = graph.AddEdge("a", "b", nil)
+	_ = graph.AddEdge("c", "b", nil)
+
+	// Drop c->b from the edge list of c without going through writeEdgeMap.
+	err := graph.DB.Update(func(txn *badger.Txn) error {
+		val, _ := serializeEdgeMap(map[string]bool{})
+		return txn.Set([]byte("c"), val)
+	})
+	if err != nil {
+		T.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if in, _ := graph.GetInEdges("b", nil); !reflect.DeepEqual(in, map[string]bool{"a": true}) {
+			T.Fatal("stale reverse entry returned ", in)
+		}
+	}
+	if m := graph.Metrics(); m.ReverseIndexDrift != 1 || m.ReadRepairs != 1 {
+		T.Fatal("expected one repaired drift, got ", m.ReverseIndexDrift, m.ReadRepairs)
+	}
+	_ = graph.DB.View(func(txn *badger.Txn) error {
+		if _, err := txn.Get(reverseEdgeKey("b", "c")); err != badger.ErrKeyNotFound {
+			T.Fatal("stale reverse entry not deleted ", err)
+		}
+		return nil
+	})
+
+	limiter := newRepairLimiter(10, 5)
+	now := time.Now()
+	if n := limiter.take(8, now); n != 5 {
+		T.Fatal("expected the burst to be taken, got ", n)
+	}
+	if n := limiter.take(1, now); n != 0 {
+		T.Fatal("expected an empty bucket, got ", n)
+	}
+	if n := limiter.take(8, now.Add(200*time.Millisecond)); n != 2 {
+		T.Fatal("expected two refilled tokens, got ", n)
+	}
+}
+
+func TestGetEdgesPage(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	for i := 0; i < 10; i++ {
+		_ = graph.AddEdge("a", fmt.Sprintf("n%d", i), nil)
+	}
+
+	var seen []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		page, next, err := graph.GetEdgesPage("a", cursor, 3, nil)
+		if err != nil {
+			T.Fatal(err)
+		}
+		seen = append(seen, page...)
+		if pages == 1 {
+			// n0 sorts before the cursor and is missed, n9x after it and is returned.
+			// Removing the cursor itself must not restart or repeat the paging.
+			_ = graph.AddEdge("a", "n0a", nil)
+			_ = graph.AddEdge("a", "n9x", nil)
+			_, _ = graph.RemoveEdge("a", next, nil)
+			_, _ = graph.RemoveEdge("a", "n7", nil)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	want := []string{"n0", "n1", "n2", "n3", "n4", "n5", "n6", "n8", "n9", "n9x"}
+	if !reflect.DeepEqual(seen, want) {
+		T.Fatal("expected ", want, " got ", seen)
+	}
+
+	if _, _, err := graph.GetEdgesPage("a", "", 0, nil); err != ErrPageLimit {
+		T.Fatal("expected ErrPageLimit, got ", err)
+	}
+	if _, _, err := graph.GetEdgesPage("missing", "", 1, nil); err != badger.ErrKeyNotFound {
+		T.Fatal("expected ErrKeyNotFound, got ", err)
+	}
+}
+
+func TestMinHashSketches(T *testing.T) {
+	const k = 256
+	graph, _ := NewGraph("", true, WithMinHashSketches(k))
+	defer graph.Close()
+
+	// Nodes draw their neighbors from overlapping windows of a shared pool, so the pairs
+	// cover similarities from disjoint to nearly identical.
+	r := rand.New(rand.NewSource(7))
+	nodes := make([]string, 20)
+	for i := range nodes {
+		nodes[i] = fmt.Sprintf("n%d", i)
+		offset := r.Intn(200)
+		for j := 0; j < 50+r.Intn(100); j++ {
+			_ = graph.AddEdge(nodes[i], fmt.Sprintf("p%d", offset+r.Intn(150)), nil)
+		}
+	}
+
+	jaccard := func(a string, b string) float64 {
+		ea, _ := graph.GetEdges(a, nil)
+		eb, _ := graph.GetEdges(b, nil)
+		both := 0
+		for n := range ea {
+			if eb[n] {
+				both++
+			}
+		}
+		return float64(both) / float64(len(ea)+len(eb)-both)
+	}
+	var sumErr, maxErr float64
+	pairs := 0
+	for i := range nodes {
+		for j := i + 1; j < len(nodes); j++ {
+			approx, err := graph.ApproxJaccard(nodes[i], nodes[j])
+			if err != nil {
+				T.Fatal(err)
+			}
+			diff := math.Abs(approx - jaccard(nodes[i], nodes[j]))
+			sumErr += diff
+			maxErr = math.Max(maxErr, diff)
+			pairs++
+		}
+	}
+	// The standard error for k = 256 is at most 0.5/16 = 0.031.
+	if sumErr/float64(pairs) > 0.03 || maxErr > 0.15 {
+		T.Fatalf("estimates too far from the exact Jaccard: mean error %.3f, max error %.3f", sumErr/float64(pairs), maxErr)
+	}
+
+	// Removing edges marks the sketch stale, the rebuilt one must match a sketch built from scratch.
+	edges, _ := graph.GetEdges("n0", nil)
+	for to := range edges {
+		if r.Intn(2) == 0 {
+			_, _ = graph.RemoveEdge("n0", to, nil)
+		}
+	}
+	fresh, _ := NewGraph("", true, WithMinHashSketches(k))
+	defer fresh.Close()
+	for _, node := range []string{"n0", "n1"} {
+		edges, _ := graph.GetEdges(node, nil)
+		_, _, _ = fresh.SetEdges(node, sortedNeighbors(edges), nil)
+	}
+	got, _ := graph.ApproxJaccard("n0", "n1")
+	want, _ := fresh.ApproxJaccard("n0", "n1")
+	if got != want {
+		T.Fatal("stale sketch not rebuilt: ", got, " expected ", want)
+	}
+
+	similar, err := graph.SimilarNodes("n0", []string{"n0", "n1", "n2", "n1", "missing"}, 2)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if len(similar) != 2 || similar[0].Similarity < similar[1].Similarity || similar[0].Node == "n0" {
+		T.Fatal("unexpected ranking ", similar)
+	}
+	plain, _ := NewGraph("", true)
+	defer plain.Close()
+	if _, err := plain.ApproxJaccard("n0", "n1"); err != ErrNoSketches {
+		T.Fatal("expected ErrNoSketches, got ", err)
+	}
+}
+
+func TestApplyBatch(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+
+	batch := []Mutation{
+		{Kind: MutationAddEdge, From: "a", To: "b"},
+		{Kind: MutationRemoveEdge, From: "a", To: "missing"},
+		{Kind: MutationAddNode, From: "c"},
+	}
+	if _, err := graph.ApplyBatch(batch, true); !errors.Is(err, ErrEdgeNotFound) || !strings.Contains(err.Error(), "mutation 1") {
+		T.Fatal("expected the atomic batch to fail on mutation 1, got ", err)
+	}
+	if edges := edgeSet(T, graph); len(edges) != 0 {
+		T.Fatal("failed atomic batch was partially applied ", edges)
+	}
+
+	errs, err := graph.ApplyBatch(batch, false)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if errs[0] != nil || !errors.Is(errs[1], ErrEdgeNotFound) || errs[2] != nil {
+		T.Fatal("unexpected outcomes ", errs)
+	}
+	if ok, _ := graph.HasEdge("a", "b", nil); !ok {
+		T.Fatal("chunked batch not applied")
+	}
+
+	// The values are kept in the LSM tree, below the value threshold, and add up to about
+	// 1.5 times the transaction size limit of the default badger options.
+	var big []Mutation
+	for i := 0; i < 30; i++ {
+		big = append(big, Mutation{Kind: MutationSetProperty, From: fmt.Sprintf("n%d", i), Name: "blob", Value: make([]byte, 512<<10)})
+	}
+	if _, err := graph.ApplyBatch(big, true); !errors.Is(err, ErrBatchTooBig) {
+		T.Fatal("expected ErrBatchTooBig, got ", err)
+	}
+	if props, _ := graph.GetNodeProperties("n0", nil); len(props) != 0 {
+		T.Fatal("rejected batch was partially applied")
+	}
+	errs, _ = graph.ApplyBatch(big, false)
+	for i, err := range errs {
+		if err != nil {
+			T.Fatal("mutation ", i, " of the chunked batch failed: ", err)
+		}
+	}
+	if props, _ := graph.GetNodeProperties("n29", nil); len(props["blob"]) != 512<<10 {
+		T.Fatal("chunked batch not fully applied")
+	}
+}
+
+func TestApplyBatchReplaysHalfAppliedMutation(T *testing.T) {
+	graph, _ := NewGraph("", true, WithChangelog())
+	defer graph.Close()
+
+	// Adding an edge to hub writes a change record and then an edge list of about 900KB, so a
+	// full transaction fails with ErrTxnTooBig after the record is written.
+	var neighbors []string
+	for i := 0; i < 4500; i++ {
+		neighbors = append(neighbors, fmt.Sprintf("%0200d", i))
+	}
+	if _, _, err := graph.SetEdges("hub", neighbors, nil); err != nil {
+		T.Fatal(err)
+	}
+	since, _ := graph.CurrentVersion(nil)
+
+	var batch []Mutation
+	for i := 0; i < 17; i++ {
+		batch = append(batch, Mutation{Kind: MutationSetProperty, From: fmt.Sprintf("n%d", i), Name: "blob", Value: make([]byte, 512<<10)})
+	}
+	for i := 0; i < 6; i++ {
+		batch = append(batch, Mutation{Kind: MutationAddEdge, From: "hub", To: fmt.Sprint("late", i)})
+	}
+	errs, err := graph.ApplyBatch(batch, false)
+	if err != nil {
+		T.Fatal(err)
+	}
+	for i, err := range errs {
+		if err != nil {
+			T.Fatal("mutation ", i, " failed: ", err)
+		}
+	}
+	records := 0
+	_ = graph.Changes(since, func(record ChangeRecord) error {
+		records++
+		return nil
+	}, nil)
+	if records != 6 {
+		T.Fatal("expected a change record per added edge, got ", records)
+	}
+}
+
+func TestMigrations(T *testing.T) {
+	defer func(registered []Migration) { migrations = registered }(migrations)
+	dir := T.TempDir()
+	graph, err := NewGraph(dir, false)
+	if err != nil {
+		T.Fatal(err)
+	}
+	_ = graph.AddEdge("a", "b", nil)
+	graph.Close()
+
+	runs := map[int]int{}
+	failures := 1
+	migrations = append(migrations[:len(migrations):len(migrations)],
+		Migration{Version: latestFormatVersion() + 1, Name: "add-c", Up: func(ctx context.Context, g *Graph) error {
+			runs[1]++
+			return g.AddEdge("a", "c", nil)
+		}, Estimate: func(ctx context.Context, g *Graph) (int, error) {
+			return 1, nil
+		}},
+		Migration{Version: latestFormatVersion() + 2, Name: "flaky", Up: func(ctx context.Context, g *Graph) error {
+			runs[2]++
+			if failures > 0 {
+				failures--
+				return errors.New("interrupted")
+			}
+			return nil
+		}},
+	)
+	latest := latestFormatVersion()
+
+	graph, err = NewGraph(dir, false, WithManualMigrations())
+	if err != nil {
+		T.Fatal(err)
+	}
+	plan, _ := graph.PlanMigrations(context.Background())
+	if len(plan) != 2 || plan[0].EstimatedKeys != 1 || plan[1].EstimatedKeys != -1 || plan[1].Version != latest {
+		T.Fatal("unexpected plan ", plan)
+	}
+	if err := graph.Migrate(context.Background()); err == nil || !strings.Contains(err.Error(), "flaky") {
+		T.Fatal("expected the second migration to fail, got ", err)
+	}
+	if current, _, _ := graph.SchemaVersion(); current != latest-1 {
+		T.Fatal("expected the first migration to be committed, version ", current)
+	}
+	graph.Close()
+
+	// The journaled run is resumed on open, without repeating the first step.
+	graph, err = NewGraph(dir, false, WithManualMigrations(), WithOpenCheck(CheckFull))
+	if err != nil {
+		T.Fatal(err)
+	}
+	if current, _, _ := graph.SchemaVersion(); current != latest || runs[1] != 1 || runs[2] != 2 {
+		T.Fatal("migration not resumed: version ", current, " runs ", runs)
+	}
+	if ok, _ := graph.HasEdge("a", "c", nil); !ok {
+		T.Fatal("migration not applied")
+	}
+	graph.Close()
+
+	migrations = migrations[:len(migrations)-2]
+	var versionErr *ErrSchemaVersion
+	if _, err := NewGraph(dir, false); !errors.As(err, &versionErr) || versionErr.Found != latest || versionErr.Supported != latest-2 {
+		T.Fatal("expected ErrSchemaVersion, got ", err)
+	}
+}
+
+func TestConvertStorageMode(T *testing.T) {
+	dir := T.TempDir()
+	graph, _ := NewGraph(dir, false)
+	_ = graph.IndexReverseEdges()
+	for i := 0; i < 50; i++ {
+		_ = graph.AddEdge(fmt.Sprintf("n%02d", i), fmt.Sprintf("n%02d", (i+1)%50), nil)
+		_ = graph.AddEdge(fmt.Sprintf("n%02d", i), fmt.Sprintf("n%02d", i*7%50), nil)
+	}
+	edges := func() map[[2]string]bool {
+		T.Helper()
+		all := make(map[[2]string]bool)
+		err := graph.IterAllEdges(func(src string, dst string) error {
+			all[[2]string{src, dst}] = true
+			return nil
+		}, 10, nil)
+		if err != nil {
+			T.Fatal(err)
+		}
+		return all
+	}
+	want := edges()
+	nodeValues := func() (empty int, blobs int) {
+		_ = graph.DB.View(func(txn *badger.Txn) error {
+			it := newNodeIterator(txn, badger.DefaultIteratorOptions)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				if it.Item().ValueSize() == 0 {
+					empty++
+				} else {
+					blobs++
+				}
+			}
+			return nil
+		})
+		return empty, blobs
+	}
+
+	// An interrupted conversion leaves the nodes in both layouts, and reads see all edges.
+	ctx, cancel := context.WithCancel(context.Background())
+	batches := 0
+	err := graph.ConvertStorageMode(ctx, StoragePerEdge, ConvertOptions{BatchSize: 20, OnProgress: func(ConversionProgress) {
+		if batches++; batches == 2 {
+			cancel()
+		}
+	}})
+	if !errors.Is(err, context.Canceled) {
+		T.Fatal("expected the conversion to stop when cancelled, got ", err)
+	}
+	if empty, blobs := nodeValues(); empty == 0 || blobs == 0 {
+		T.Fatal("expected a partial conversion, got ", empty, blobs)
+	}
+	if progress, ok, _ := graph.StorageConversion(); !ok || progress.Target != StoragePerEdge || progress.Converted == 0 || progress.Remaining == 0 {
+		T.Fatalf("unexpected progress %+v", progress)
+	}
+	if !reflect.DeepEqual(edges(), want) {
+		T.Fatal("edges changed by a partial conversion")
+	}
+	if err := graph.ConvertStorageMode(context.Background(), StorageBlob, ConvertOptions{}); err == nil {
+		T.Fatal("expected a conversion to the other mode to fail while one is interrupted")
+	}
+	// Writes use the target layout from the start.
+	_ = graph.AddEdge("n49", "x", nil)
+	want[[2]string{"n49", "x"}] = true
+	graph.Close()
+
+	graph, err = NewGraph(dir, false, WithOpenCheck(CheckFull))
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer graph.Close()
+	if _, ok, _ := graph.StorageConversion(); ok || graph.StorageMode() != StoragePerEdge {
+		T.Fatal("conversion not resumed by NewGraph")
+	}
+	if _, blobs := nodeValues(); blobs != 0 {
+		T.Fatal("nodes left in the blob layout ", blobs)
+	}
+	if !reflect.DeepEqual(edges(), want) {
+		T.Fatal("edges changed by the conversion")
+	}
+	if in, _ := graph.GetInEdges("x", nil); !in["n49"] {
+		T.Fatal("reverse index not kept up to date")
+	}
+	if removed, err := graph.RemoveEdge("n49", "x", nil); !removed || err != nil {
+		T.Fatal("RemoveEdge failed: ", err)
+	}
+	delete(want, [2]string{"n49", "x"})
+	if report, _ := graph.CheckIntegrity(nil); !report.OK() {
+		T.Fatal(report.Problems)
+	}
+
+	var last ConversionProgress
+	err = graph.ConvertStorageMode(context.Background(), StorageBlob, ConvertOptions{OnProgress: func(p ConversionProgress) {
+		last = p
+	}})
+	if err != nil || !last.Done || !last.Verifying || last.Converted != 50 || last.Remaining != 0 {
+		T.Fatalf("unexpected progress %+v, %v", last, err)
+	}
+	if empty, _ := nodeValues(); empty != 0 {
+		T.Fatal("nodes left in the per-edge layout ", empty)
+	}
+	_ = graph.DB.View(func(txn *badger.Txn) error {
+		if hasKeyWithPrefix(txn, edgeKeyPrefix) {
+			T.Fatal("edge keys left after converting back")
+		}
+		return nil
+	})
+	if !reflect.DeepEqual(edges(), want) {
+		T.Fatal("edges changed by converting back")
+	}
+}
+
+func TestConvertStorageModeConcurrentWrites(T *testing.T) {
+	graph, _ := NewGraph(T.TempDir(), false, WithUpdateRetries(1000))
+	defer graph.Close()
+	for i := 0; i < 200; i++ {
+		_ = graph.AddEdge(fmt.Sprintf("n%03d", i), fmt.Sprintf("n%03d", (i+1)%200), nil)
+	}
+
+	// The writer keeps adding edges to the nodes being converted, so batches conflict with it.
+	stop := make(chan struct{})
+	written := make(chan []string)
+	go func() {
+		var added []string
+		for k := 0; ; k++ {
+			select {
+			case <-stop:
+				written <- added
+				return
+			default:
+			}
+			from := fmt.Sprintf("n%03d", k*13%200)
+			err := graph.Update(func(tx *Tx) error {
+				return tx.AddEdge(from, fmt.Sprintf("w%d", k))
+			})
+			if err == nil {
+				added = append(added, from, fmt.Sprintf("w%d", k))
+			}
+		}
+	}()
+	err := graph.ConvertStorageMode(context.Background(), StoragePerEdge, ConvertOptions{BatchSize: 5})
+	close(stop)
+	added := <-written
+	if err != nil {
+		T.Fatal("conversion failed next to a writer: ", err)
+	}
+
+	_ = graph.DB.View(func(txn *badger.Txn) error {
+		it := newNodeIterator(txn, badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if it.Item().ValueSize() != 0 {
+				T.Fatal("node left in the blob layout ", string(it.Item().Key()))
+			}
+		}
+		return nil
+	})
+	for i := 0; i < 200; i++ {
+		if ok, _ := graph.HasEdge(fmt.Sprintf("n%03d", i), fmt.Sprintf("n%03d", (i+1)%200), nil); !ok {
+			T.Fatal("edge lost by the conversion from ", i)
+		}
+	}
+	for i := 0; i < len(added); i += 2 {
+		if ok, _ := graph.HasEdge(added[i], added[i+1], nil); !ok {
+			T.Fatal("concurrent write lost: ", added[i], added[i+1])
+		}
+	}
+	if report, _ := graph.CheckIntegrity(nil); !report.OK() {
+		T.Fatal(report.Problems)
+	}
+}
+
+func TestReclaimSpace(T *testing.T) {
+	dir := T.TempDir()
+	graph, _ := NewGraph(dir, false)
+	for i := 0; i < 2000; i++ {
+		_ = graph.AddEdge(fmt.Sprintf("n%d", i%100), fmt.Sprintf("m%d", i), nil)
+	}
+	for i := 0; i < 100; i++ {
+		_, _ = graph.RemoveNode(fmt.Sprintf("n%d", i), nil)
+	}
+	// Closing flushes the memtable, so the writes show up in the table metadata.
+	graph.Close()
+	graph, err := NewGraph(dir, false)
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer graph.Close()
+
+	report, err := graph.CompactionReport()
+	if err != nil {
+		T.Fatal(err)
+	}
+	if report.Tables == 0 || report.LSMBytes == 0 || report.ReclaimableBytes() < report.StaleLSMBytes {
+		T.Fatal("unexpected report ", report)
+	}
+	result, err := graph.ReclaimSpaceWithResult(context.Background(), time.Minute)
+	if err != nil || result.MoreWork {
+		T.Fatal("unexpected result ", result, err)
+	}
+	if after, _ := graph.CompactionReport(); after.Levels > 1 || after.StaleLSMBytes > report.StaleLSMBytes {
+		T.Fatal("unexpected report after reclaiming ", after)
+	}
+	if edges := edgeSet(T, graph); len(edges) != 0 {
+		T.Fatal("removed edges came back ", edges)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if result, err := graph.ReclaimSpaceWithResult(ctx, time.Minute); err != nil || !result.MoreWork || result.Flattened {
+		T.Fatal("expected a cancelled ReclaimSpace to do nothing ", result, err)
+	}
+
+	memGraph, _ := NewGraph("", true)
+	defer memGraph.Close()
+	if err := memGraph.ReclaimSpace(context.Background(), time.Second); err != nil {
+		T.Fatal(err)
+	}
+}
+
+func TestBFSExplain(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	_ = graph.AddEdge("a", "hub", nil)
+	_ = graph.AddEdge("a", "b", nil)
+	_ = graph.AddEdge("b", "c", nil)
+	_ = graph.AddEdge("c", "d", nil)
+	for i := 0; i < 20; i++ {
+		_ = graph.AddEdge("hub", fmt.Sprintf("leaf%02d", i), nil)
+	}
+
+	plain, _ := graph.BFS("a", TraversalOptions{MaxDepth: 2}, nil)
+	if plain.Explain != nil {
+		T.Fatal("expected no report without Explain")
+	}
+
+	opts := TraversalOptions{MaxDepth: 2, Explain: true, ExpansionLimits: ExpansionLimits{MaxFanoutPerNode: 5, FanoutByWeight: true}}
+	result, err := graph.BFS("a", opts, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	report := result.Explain
+	want := []ExplainLevel{{Depth: 0, Expanded: 1, Discovered: 2}, {Depth: 1, Expanded: 2, Discovered: 6, Truncated: 1}}
+	if !reflect.DeepEqual(report.Levels, want) {
+		T.Fatal("unexpected levels ", report.Levels)
+	}
+	// 3 edge lists and the 20 weights ranked for hub.
+	if report.KeysRead != 23 || report.BytesDecoded <= 0 {
+		T.Fatal("unexpected reads ", report.KeysRead, report.BytesDecoded)
+	}
+	if !reflect.DeepEqual(report.LimitsTriggered, []string{LimitMaxFanoutPerNode, LimitMaxDepth}) {
+		T.Fatal("unexpected limits ", report.LimitsTriggered)
+	}
+	if len(report.Phases) == 0 || report.Total <= 0 {
+		T.Fatal("expected timings ", report.Phases, report.Total)
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil || !strings.Contains(string(data), `"limits_triggered":["max_fanout_per_node","max_depth"]`) {
+		T.Fatal("unexpected JSON ", string(data), err)
+	}
+	var text bytes.Buffer
+	if err := report.WriteText(&text); err != nil || !strings.Contains(text.String(), "keys read") {
+		T.Fatal("unexpected text ", text.String(), err)
+	}
+}
+
+func TestTxGuard(T *testing.T) {
+	graph, _ := NewGraph("", true, WithTxGuard(true))
+	defer graph.Close()
+
+	err := graph.Update(func(tx *Tx) error {
+		// Hold the guard as if another goroutine was in the middle of a Tx call.
+		release := tx.enter()
+		panicked := make(chan any)
+		go func() {
+			defer func() { panicked <- recover() }()
+			_ = tx.AddEdge("a", "b")
+		}()
+		if p := <-panicked; p != ErrConcurrentTx {
+			T.Fatal("expected the guard to panic, got ", p)
+		}
+		release()
+		return tx.AddEdge("a", "c")
+	})
+	if err != nil {
+		T.Fatal(err)
+	}
+	if edges, _ := graph.GetEdges("a", nil); !reflect.DeepEqual(edges, map[string]bool{"c": true}) {
+		T.Fatal("unexpected edges ", edges)
+	}
+
+	// Goroutines racing on one Tx: every call either runs alone or panics, so under the race
+	// detector the guard keeps the transaction itself from being raced on.
+	err = graph.Update(func(tx *Tx) error {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer func() {
+					if p := recover(); p != nil && p != ErrConcurrentTx {
+						panic(p)
+					}
+				}()
+				_ = tx.AddEdge(fmt.Sprint("racer", i), "x")
+			}(i)
+		}
+		wg.Wait()
+		return nil
+	})
+	if err != nil {
+		T.Fatal(err)
+	}
+
+	unguarded, _ := NewGraph("", true, WithTxGuard(false))
+	defer unguarded.Close()
+	err = unguarded.Update(func(tx *Tx) error {
+		release := tx.enter()
+		defer release()
+		return tx.AddEdge("a", "b")
+	})
+	if err != nil {
+		T.Fatal(err)
+	}
+
+	// The guard is on by default in test binaries.
+	defaulted, _ := NewGraph("", true)
+	defer defaulted.Close()
+	_ = defaulted.Update(func(tx *Tx) error {
+		if !tx.guard {
+			T.Fatal("expected the guard to be on under go test")
+		}
+		return nil
+	})
+}
+
+func TestCloseDrainsOperations(T *testing.T) {
+	graph, err := NewGraph(T.TempDir(), false, WithDrainTimeout(10*time.Second))
+	if err != nil {
+		T.Fatal(err)
+	}
+
+	var doc bytes.Buffer
+	doc.WriteString(`{"nodes": [], "edges": [`)
+	for i := 0; i < 200; i++ {
+		if i > 0 {
+			doc.WriteString(",")
+		}
+		fmt.Fprintf(&doc, `{"from": "n%d", "to": "n%d"}`, i, i+1)
+	}
+	doc.WriteString("]}")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	run := func(name string, fn func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(); err != ErrClosed {
+				errs <- fmt.Errorf("%s: expected ErrClosed, got %v", name, err)
+			}
+		}()
+	}
+	run("import", func() error {
+		for {
+			if err := graph.ImportJSON(bytes.NewReader(doc.Bytes()), ImportOptions{}); err != nil {
+				return err
+			}
+		}
+	})
+	run("watch", func() error {
+		var since uint64
+		for {
+			err := graph.Changes(since, func(record ChangeRecord) error {
+				since = record.Seq
+				return nil
+			}, nil)
+			if err != nil {
+				return err
+			}
+		}
+	})
+	run("maintenance", func() error {
+		gc := MaintenanceTask{Name: "gc", Interval: time.Millisecond, Run: func(ctx context.Context) error {
+			return graph.ReclaimSpace(ctx, time.Second)
+		}}
+		return graph.RunMaintenance(context.Background(), []MaintenanceTask{gc}, nil)
+	})
+	run("async", func() error {
+		for i := 0; ; i++ {
+			err := graph.ApplyAsync([]Mutation{{Kind: MutationAddEdge, From: "async", To: fmt.Sprint(i)}}, nil)
+			if err != nil {
+				return err
+			}
+		}
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	if err := graph.Close(); err != nil {
+		T.Fatal(err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		T.Error(err)
+	}
+	if _, err := graph.GetEdges("n0", nil); err != ErrClosed {
+		T.Fatal("expected ErrClosed after Close, got ", err)
+	}
+	if err := graph.Close(); err != ErrClosed {
+		T.Fatal("expected ErrClosed closing twice, got ", err)
+	}
+}
+
+func TestCloseDrainTimeout(T *testing.T) {
+	graph, _ := NewGraph("", true, WithDrainTimeout(10*time.Millisecond))
+	release := make(chan struct{})
+	stuck := MaintenanceTask{Name: "stuck", Interval: time.Millisecond, Run: func(ctx context.Context) error {
+		<-release
+		return nil
+	}}
+	done := make(chan error)
+	go func() {
+		done <- graph.RunMaintenance(context.Background(), []MaintenanceTask{stuck}, nil)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	err := graph.Close()
+	var timeout *ErrDrainTimeout
+	if !errors.As(err, &timeout) || !reflect.DeepEqual(timeout.Pending, map[string]int{"RunMaintenance": 1}) {
+		T.Fatal("expected a drain timeout listing RunMaintenance, got ", err)
+	}
+	close(release)
+	if err := <-done; err != ErrClosed {
+		T.Fatal("expected RunMaintenance to stop with ErrClosed, got ", err)
+	}
+}
+
+func TestEdgeProvenance(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+
+	_ = graph.AddSourcedEdge("a", "b", "feed1", nil)
+	_ = graph.AddSourcedEdge("a", "b", "feed2", nil)
+	_ = graph.AddSourcedEdge("a", "c", "feed1", nil)
+	_ = graph.AddEdge("a", "d", nil)
+	if err := graph.AddSourcedEdge("a", "e", "bad\x00source", nil); err != ErrInvalidSource {
+		T.Fatal("expected ErrInvalidSource, got ", err)
+	}
+
+	if sources, _ := graph.EdgeProvenance("a", "b", nil); !reflect.DeepEqual(sources, []string{"feed1", "feed2"}) {
+		T.Fatal("unexpected provenance ", sources)
+	}
+	removed, err := graph.RemoveSourcedEdge("a", "b", "feed1", nil)
+	if err != nil || removed {
+		T.Fatal("edge still asserted by feed2 was removed ", removed, err)
+	}
+	if _, err := graph.RemoveSourcedEdge("a", "b", "feed1", nil); !errors.Is(err, ErrEdgeNotFound) {
+		T.Fatal("expected ErrEdgeNotFound withdrawing twice, got ", err)
+	}
+	if ok, _ := graph.HasEdge("a", "b", nil); !ok {
+		T.Fatal("expected a->b to remain")
+	}
+
+	var doc bytes.Buffer
+	doc.WriteString(`{"nodes": [], "edges": [{"from": "a", "to": "c"}, {"from": "x", "to": "y"}]}`)
+	if err := graph.ImportJSON(&doc, ImportOptions{Source: "feed2"}); err != nil {
+		T.Fatal(err)
+	}
+	if sources, _ := graph.EdgeProvenance("a", "c", nil); !reflect.DeepEqual(sources, []string{"feed1", "feed2"}) {
+		T.Fatal("import didn't tag a->c ", sources)
+	}
+
+	stats, err := graph.RemoveSource("feed2")
+	if err != nil || stats != (RemoveSourceStats{Assertions: 3, Edges: 2}) {
+		T.Fatal("unexpected stats ", stats, err)
+	}
+	edges, _ := graph.GetEdges("a", nil)
+	if !reflect.DeepEqual(edges, map[string]bool{"c": true, "d": true}) {
+		T.Fatal("unexpected edges after removing feed2 ", edges)
+	}
+	if edges, _ := graph.GetEdges("x", nil); len(edges) != 0 {
+		T.Fatal("x->y only asserted by feed2 survived ", edges)
+	}
+
+	// Removing an edge drops its provenance.
+	_, _ = graph.RemoveEdge("a", "c", nil)
+	_ = graph.AddEdge("a", "c", nil)
+	if sources, _ := graph.EdgeProvenance("a", "c", nil); len(sources) != 0 {
+		T.Fatal("provenance survived RemoveEdge ", sources)
+	}
+	if stats, _ := graph.RemoveSource("feed1"); stats != (RemoveSourceStats{}) {
+		T.Fatal("feed1 assertions survived RemoveEdge ", stats)
+	}
+
+	// Redirects carry the assertions over to the canonical ID.
+	_ = graph.AddSourcedEdge("p", "old", "feed3", nil)
+	_ = graph.Redirect("old", "new", nil)
+	_, _ = graph.ResolveRedirects(context.Background())
+	if sources, _ := graph.EdgeProvenance("p", "new", nil); !reflect.DeepEqual(sources, []string{"feed3"}) {
+		T.Fatal("provenance lost by ResolveRedirects ", sources)
+	}
+}
+
+func TestNodeNormalizer(T *testing.T) {
+	dir := T.TempDir()
+	graph, err := NewGraph(dir, false)
+	if err != nil {
+		T.Fatal(err)
+	}
+	_ = graph.AddEdge("Alice", "x", nil)
+	_ = graph.AddEdge("b", "Alice", nil)
+	_ = graph.AddEdge("alice", "y", nil)
+	graph.Close()
+
+	normalizer := ChainNormalizers(NormalizeTrim, NormalizeLowercase)
+	graph, err = NewGraph(dir, false, WithNodeNormalizer(normalizer))
+	if err != nil {
+		T.Fatal(err)
+	}
+	groups, err := graph.FindDenormalizedDuplicates(nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if !reflect.DeepEqual(groups, []DenormalizedGroup{{Canonical: "alice", Variants: []string{"Alice"}}}) {
+		T.Fatal("unexpected duplicates ", groups)
+	}
+	for _, group := range groups {
+		if err := graph.MergeNodes(group.Canonical, group.Variants, nil); err != nil {
+			T.Fatal(err)
+		}
+	}
+	if groups, _ := graph.FindDenormalizedDuplicates(nil); len(groups) != 0 {
+		T.Fatal("duplicates left after merging ", groups)
+	}
+	if edges, _ := graph.GetEdges(" ALICE ", nil); !reflect.DeepEqual(edges, map[string]bool{"x": true, "y": true}) {
+		T.Fatal("unexpected edges of the merged node ", edges)
+	}
+	if edges, _ := graph.GetEdges("B", nil); !reflect.DeepEqual(edges, map[string]bool{"alice": true}) {
+		T.Fatal("inbound edge not resolved to the merged node ", edges)
+	}
+	_ = graph.AddEdge("Carol", "Alice", nil)
+	if edges := edgeSet(T, graph); !edges["carol->alice"] || edges["Carol->Alice"] {
+		T.Fatal("write wasn't normalized ", edges)
+	}
+	graph.Close()
+
+	_, err = NewGraph(dir, false)
+	var mismatch *ErrNormalizerMismatch
+	if !errors.As(err, &mismatch) || mismatch.Stored != "trim+lowercase" || mismatch.Configured != "" {
+		T.Fatal("expected a normalizer mismatch, got ", err)
+	}
+	_, err = NewGraph(dir, false, WithNodeNormalizer(NormalizeLowercase))
+	if !errors.As(err, &mismatch) {
+		T.Fatal("expected a normalizer mismatch, got ", err)
+	}
+}
+
+func TestNormalizeNFC(T *testing.T) {
+	graph, _ := NewGraph("", true, WithNodeNormalizer(ChainNormalizers(NormalizeNFC, NormalizeLowercase)))
+	defer graph.Close()
+	_ = graph.AddEdge("Ren\u00e9", "x", nil)
+	_ = graph.AddEdge("rene\u0301", "y", nil)
+	if edges := edgeSet(T, graph); len(edges) != 2 || !edges["ren\u00e9->x"] || !edges["ren\u00e9->y"] {
+		T.Fatal("composed and decomposed IDs are different nodes ", edges)
+	}
+}
+
+func TestExportWalkCorpus(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	for _, e := range [][2]string{{"a", "b"}, {"b", "c"}, {"b", "a"}, {"c", "a"}, {"c", "d"}, {"d", "b"}} {
+		_ = graph.AddEdge(e[0], e[1], nil)
+	}
+	_ = graph.SetNodeProperties("c", map[string][]byte{LabelProperty: []byte("start")}, nil)
+	edges := edgeSet(T, graph)
+
+	opts := WalkCorpusOptions{WalksPerNode: 3, WalkLength: 6, P: 0.5, Q: 2, Seed: 7}
+	var first, second bytes.Buffer
+	if err := graph.ExportWalkCorpus(&first, opts); err != nil {
+		T.Fatal(err)
+	}
+	_ = graph.ExportWalkCorpus(&second, opts)
+	if first.String() != second.String() {
+		T.Fatal("corpus is not deterministic under a fixed seed")
+	}
+	walks := strings.Split(strings.TrimSuffix(first.String(), "\n"), "\n")
+	if len(walks) != 12 {
+		T.Fatal("expected 3 walks per node, got ", len(walks))
+	}
+	for _, walk := range walks {
+		ids := strings.Fields(walk)
+		if len(ids) != 6 {
+			T.Fatal("unexpected walk length ", walk)
+		}
+		for i := 1; i < len(ids); i++ {
+			if !edges[ids[i-1]+"->"+ids[i]] {
+				T.Fatal("walk doesn't follow edges ", walk)
+			}
+		}
+	}
+
+	var labeled bytes.Buffer
+	opts.StartLabel = "start"
+	opts.Workers = 4
+	if err := graph.ExportWalkCorpus(&labeled, opts); err != nil {
+		T.Fatal(err)
+	}
+	walks = strings.Split(strings.TrimSuffix(labeled.String(), "\n"), "\n")
+	if len(walks) != 3 {
+		T.Fatal("expected 3 walks from the labeled node, got ", len(walks))
+	}
+	for _, walk := range walks {
+		if !strings.HasPrefix(walk, "c ") {
+			T.Fatal("walk doesn't start at the labeled node ", walk)
+		}
+	}
+}
+
+func TestSnapshotPool(T *testing.T) {
+	const staleness = 100 * time.Millisecond
+	graph, _ := NewGraph("", true, WithSnapshotPool(staleness))
+	defer graph.Close()
+	_ = graph.AddEdge("a", "b", nil)
+	if edges, _ := graph.GetEdges("a", nil); !reflect.DeepEqual(edges, map[string]bool{"b": true}) {
+		T.Fatal("unexpected edges ", edges)
+	}
+
+	_ = graph.AddEdge("a", "c", nil)
+	if edges, _ := graph.GetEdges("a", nil); len(edges) != 1 {
+		T.Fatal("expected the read to be served from the snapshot, got ", edges)
+	}
+	txn := graph.DB.NewTransaction(false)
+	if edges, _ := graph.GetEdges("a", txn); len(edges) != 2 {
+		T.Fatal("explicit transaction didn't bypass the pool ", edges)
+	}
+	txn.Discard()
+	if age := graph.Metrics().SnapshotAge; age <= 0 || age >= staleness {
+		T.Fatal("unexpected snapshot age ", age)
+	}
+
+	time.Sleep(staleness)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if edges, _ := graph.GetEdges("a", nil); len(edges) != 2 {
+				T.Error("read older than the staleness bound ", edges)
+			}
+			if result, _ := graph.BFS("a", TraversalOptions{}, nil); len(result.Order) != 3 {
+				T.Error("traversal older than the staleness bound ", result.Order)
+			}
+		}()
+	}
+	wg.Wait()
+	if age := graph.Metrics().SnapshotAge; age >= staleness {
+		T.Fatal("snapshot not refreshed ", age)
+	}
+}
+
+func TestStoreCrossEdges(T *testing.T) {
+	dir := T.TempDir()
+	store, err := OpenStore(dir, false)
+	if err != nil {
+		T.Fatal(err)
+	}
+	global, _ := store.CreateGraph("global")
+	tenant, _ := store.CreateGraph("tenant-1")
+	if _, err := store.CreateGraph("tenant-1"); err != ErrGraphExists {
+		T.Fatal("expected ErrGraphExists, got ", err)
+	}
+	_ = global.AddEdge("animals", "cats", nil)
+	_ = tenant.AddEdge("alice", "bob", nil)
+	if err := store.AddCrossEdge("tenant-1", "alice", "global", "animals"); err != nil {
+		T.Fatal(err)
+	}
+
+	edges, err := store.GetEdges("tenant-1", "alice")
+	if err != nil {
+		T.Fatal(err)
+	}
+	want := []QualifiedNode{{Graph: "global", Node: "animals"}, {Graph: "tenant-1", Node: "bob"}}
+	if !reflect.DeepEqual(edges, want) {
+		T.Fatal("unexpected edges ", edges)
+	}
+	if local, _ := tenant.GetEdges("alice", nil); !reflect.DeepEqual(local, map[string]bool{"bob": true}) {
+		T.Fatal("cross edge leaked into the edge list ", local)
+	}
+
+	result, err := store.BFS("tenant-1", "alice", StoreTraversalOptions{})
+	if err != nil {
+		T.Fatal(err)
+	}
+	if len(result.Order) != 2 {
+		T.Fatal("traversal left the graph without FollowCrossGraph ", result.Order)
+	}
+	result, _ = store.BFS("tenant-1", "alice", StoreTraversalOptions{FollowCrossGraph: true})
+	if cats := (QualifiedNode{Graph: "global", Node: "cats"}); result.Depth[cats] != 2 {
+		T.Fatal("cross edge not followed ", result.Order)
+	}
+
+	store.Close()
+	store, err = OpenStore(dir, false)
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer store.Close()
+	if names := store.Graphs(); !reflect.DeepEqual(names, []string{"global", "tenant-1"}) {
+		T.Fatal("unexpected graphs after reopening ", names)
+	}
+
+	var referenced *ErrGraphReferenced
+	refs, err := store.DropGraph("global", DropGraphOptions{})
+	if !errors.As(err, &referenced) || !reflect.DeepEqual(refs, map[string]int{"tenant-1": 1}) {
+		T.Fatal("expected the referenced graph to be kept, got ", refs, err)
+	}
+	if _, err := store.Graph("global"); err != nil {
+		T.Fatal(err)
+	}
+	if _, err := store.DropGraph("global", DropGraphOptions{Force: true}); err != nil {
+		T.Fatal(err)
+	}
+	if _, err := store.Graph("global"); !errors.Is(err, ErrGraphNotFound) {
+		T.Fatal("expected the graph to be dropped, got ", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "global")); !os.IsNotExist(err) {
+		T.Fatal("database of the dropped graph not deleted ", err)
+	}
+	result, _ = store.BFS("tenant-1", "alice", StoreTraversalOptions{FollowCrossGraph: true})
+	if len(result.Order) != 3 {
+		T.Fatal("unexpected traversal with a dangling cross edge ", result.Order)
+	}
+
+	_, _ = store.CreateGraph("global")
+	_ = store.AddCrossEdge("tenant-1", "alice", "global", "animals")
+	tenant, _ = store.Graph("tenant-1")
+	if _, err := tenant.RemoveNode("alice", nil); err != nil {
+		T.Fatal(err)
+	}
+	if refs, err := store.DropGraph("global", DropGraphOptions{}); err != nil || len(refs) != 0 {
+		T.Fatal("cross edges not removed with their node ", refs, err)
+	}
+}
+
+func TestDriftSnapshots(T *testing.T) {
+	var logs bytes.Buffer
+	graph, _ := NewGraph("", true, WithChangelog(), WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	defer graph.Close()
+	for i := 0; i < 10; i++ {
+		_ = graph.AddEdge(fmt.Sprint("n", i), "hub", nil)
+	}
+	if report, _ := graph.DriftReport(); report != nil {
+		T.Fatal("expected no report before the first snapshot ", report)
+	}
+	if _, err := graph.TakeDriftSnapshot(DriftOptions{}); err != nil {
+		T.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		_, _ = graph.RemoveEdge(fmt.Sprint("n", i), "hub", nil)
+	}
+	report, err := graph.TakeDriftSnapshot(DriftOptions{})
+	if err != nil {
+		T.Fatal(err)
+	}
+	if len(report.Alerts) != 0 || report.Previous.Edges != 10 || report.Current.Edges != 5 {
+		T.Fatal("removals in the changelog raised alerts ", report.Alerts)
+	}
+
+	empty, _ := serializeEdgeMap(map[string]bool{})
+	_ = graph.DB.Update(func(txn *badger.Txn) error {
+		for i := 5; i < 9; i++ {
+			_ = txn.Set([]byte(fmt.Sprint("n", i)), empty)
+		}
+		return nil
+	})
+	if _, err := graph.TakeDriftSnapshot(DriftOptions{}); err != nil {
+		T.Fatal(err)
+	}
+	report, _ = graph.DriftReport()
+	checks := make(map[string]bool)
+	for _, alert := range report.Alerts {
+		checks[alert.Check] = true
+	}
+	if !checks["edge-count"] || !checks["unrecorded-change"] {
+		T.Fatal("edges removed behind the graph's back not flagged ", report.Alerts)
+	}
+	if graph.Metrics().DriftAlerts != uint64(len(report.Alerts)) || !strings.Contains(logs.String(), "check=edge-count") {
+		T.Fatal("alerts not reported through metrics and logs ", logs.String())
+	}
+}
+
+func TestProjectBipartite(T *testing.T) {
+	schema := BipartiteSchema{
+		Classes: [2]NodeClass{"user", "item"},
+		ClassOf: func(node string) NodeClass {
+			class, _, _ := strings.Cut(node, ":")
+			return NodeClass(class)
+		},
+		MaxPivotDegree: 2,
+	}
+	graph, _ := NewGraph("", true, WithBipartite(schema))
+	defer graph.Close()
+	if err := graph.AddEdge("user:a", "user:b", nil); !errors.Is(err, ErrNotBipartite) {
+		T.Fatal("expected an edge within a class to be rejected, got ", err)
+	}
+	if _, _, err := graph.SetEdges("user:a", []string{"item:1", "tag:x"}, nil); !errors.Is(err, ErrNotBipartite) {
+		T.Fatal("expected an edge to an undeclared class to be rejected, got ", err)
+	}
+	_ = graph.IndexReverseEdges()
+	consumed := map[string][]string{
+		"user:a": {"item:1", "item:2", "item:3"},
+		"user:b": {"item:1", "item:2"},
+		"user:c": {"item:3", "item:4"},
+		"user:d": {"item:4"},
+		"user:e": {"item:4"},
+	}
+	for user, items := range consumed {
+		if _, _, err := graph.SetEdges(user, items, nil); err != nil {
+			T.Fatal(err)
+		}
+	}
+
+	items, _ := NewGraph("", true)
+	defer items.Close()
+	if err := graph.ProjectBipartite("item", items, 1, nil); err != nil {
+		T.Fatal(err)
+	}
+	// user:a consumed more items than the pivot degree cap, so it doesn't connect its items.
+	if edges := edgeSet(T, items); len(edges) != 4 || !edges["item:1->item:2"] || !edges["item:4->item:3"] {
+		T.Fatal("unexpected item projection ", edges)
+	}
+	if w, _, _ := items.GetEdgeWeight("item:2", "item:1", nil); w != 1 {
+		T.Fatal("expected item:1 and item:2 to share 1 user below the cap, got ", w)
+	}
+
+	users, _ := NewGraph("", true)
+	defer users.Close()
+	if err := graph.ProjectBipartite("user", users, 2, ProjectionJaccard); err != nil {
+		T.Fatal(err)
+	}
+	if edges := edgeSet(T, users); len(edges) != 2 || !edges["user:a->user:b"] || !edges["user:b->user:a"] {
+		T.Fatal("unexpected user projection ", edges)
+	}
+	if w, _, _ := users.GetEdgeWeight("user:a", "user:b", nil); w != 2.0/3 {
+		T.Fatal("unexpected jaccard weight ", w)
+	}
+}
+
+func TestTxStats(T *testing.T) {
+	graph, err := NewGraph("", true)
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer graph.Close()
+
+	err = graph.Update(func(tx *Tx) error {
+		if err := tx.AddEdge("a", "b"); err != nil {
+			return err
+		}
+		stats := tx.Stats()
+		if stats.PendingWrites == 0 || stats.PendingBytes == 0 || stats.ReadKeys == 0 || stats.Elapsed <= 0 {
+			T.Fatalf("unexpected stats %+v", stats)
+		}
+		return nil
+	})
+	if err != nil {
+		T.Fatal(err)
+	}
+
+	// Write until badger refuses, once with values big enough to hit the size limit and once
+	// with values small enough to hit the count limit.
+	for _, valueSize := range []int{256, 1} {
+		var predicted, failed int
+		err = graph.Update(func(tx *Tx) error {
+			value := make([]byte, valueSize)
+			for i := 0; ; i++ {
+				key := []byte(fmt.Sprintf("k%08d", i))
+				if predicted == 0 && tx.WillExceedLimits(1, int64(len(key)+len(value))) {
+					predicted = i
+				}
+				if err := tx.Txn().Set(key, value); err == badger.ErrTxnTooBig {
+					failed = i
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+		})
+		if err != nil {
+			T.Fatal(err)
+		}
+		if predicted == 0 || predicted > failed || float64(failed-predicted) > 0.01*float64(failed) {
+			T.Fatal("limit predicted at write ", predicted, ", hit at write ", failed, " with values of ", valueSize, " bytes")
+		}
+	}
+
+	// The calls write 256KB except one writing close to 1MB once the transaction is nearly
+	// full, which doesn't fit in the room left for the biggest call so far.
+	const n = 40
+	blob := func(i int) []byte {
+		if i == 35 {
+			return make([]byte, 1000<<10)
+		}
+		return make([]byte, 256<<10)
+	}
+	err = graph.Update(func(tx *Tx) error {
+		for i := 0; i < n; i++ {
+			if err := tx.SetNodeProperties(fmt.Sprintf("n%d", i), map[string][]byte{"blob": blob(i)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != badger.ErrTxnTooBig {
+		T.Fatal("expected ErrTxnTooBig, got ", err)
+	}
+	calls := 0
+	done, err := graph.ChunkedUpdate(n, func(tx *Tx, i int) error {
+		calls++
+		return tx.SetNodeProperties(fmt.Sprintf("n%d", i), map[string][]byte{"blob": blob(i)})
+	})
+	if err != nil || done != n {
+		T.Fatal("chunked update committed ", done, " calls: ", err)
+	}
+	if calls <= n {
+		T.Fatal("expected calls replayed after ErrTxnTooBig, got ", calls, " calls")
+	}
+	for i := 0; i < n; i++ {
+		props, err := graph.GetNodeProperties(fmt.Sprintf("n%d", i), nil)
+		if err != nil || len(props["blob"]) != len(blob(i)) {
+			T.Fatal("property of n", i, " not written: ", err)
+		}
+	}
+
+	done, err = graph.ChunkedUpdate(1, func(tx *Tx, i int) error {
+		props := make(map[string][]byte)
+		for j := 0; j < 20; j++ {
+			props[fmt.Sprint("blob", j)] = make([]byte, 512<<10)
+		}
+		return tx.SetNodeProperties("huge", props)
+	})
+	if err != badger.ErrTxnTooBig || done != 0 {
+		T.Fatal("expected ErrTxnTooBig for a call too big for a transaction, got ", done, err)
+	}
+}
+
+func TestStrength(T *testing.T) {
+	graph, err := NewGraph("", true)
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer graph.Close()
+	if err := graph.IndexReverseEdges(); err != nil {
+		T.Fatal(err)
+	}
+	for _, edge := range [][2]string{{"a", "b"}, {"a", "c"}, {"c", "b"}} {
+		_ = graph.AddEdge(edge[0], edge[1], nil)
+	}
+	_ = graph.SetEdgeWeight("a", "b", 2.5, nil)
+	_ = graph.SetEdgeWeight("c", "b", 0.5, nil)
+
+	if s, err := graph.OutStrength("a", nil); err != nil || s != 3.5 {
+		T.Fatal("unexpected out-strength ", s, err)
+	}
+	if s, err := graph.InStrength("b", nil); err != nil || s != 3 {
+		T.Fatal("unexpected in-strength ", s, err)
+	}
+	if _, err := graph.OutStrength("missing", nil); err != badger.ErrKeyNotFound {
+		T.Fatal("expected ErrKeyNotFound, got ", err)
+	}
+	top, err := graph.TopKByStrength(1, Outgoing, nil)
+	if err != nil || !reflect.DeepEqual(top, []NodeStrength{{Node: "a", Strength: 3.5}}) {
+		T.Fatal("unexpected top out-strength ", top, err)
+	}
+	top, err = graph.TopKByStrength(0, Incoming, nil)
+	if err != nil || !reflect.DeepEqual(top, []NodeStrength{{"b", 3}, {"c", 1}, {"a", 0}}) {
+		T.Fatal("unexpected in-strengths ", top, err)
+	}
+	stats, err := graph.DegreeStats(nil)
+	if err != nil || stats.TotalStrength != 4 || stats.MaxOutStrength != 3.5 || stats.MaxInStrength != 3 {
+		T.Fatalf("unexpected strengths in degree stats %+v %v", stats, err)
+	}
+	if !reflect.DeepEqual(stats.OutStrengths, map[int]int{3: 1, 0: 2}) || !reflect.DeepEqual(stats.InStrengths, map[int]int{3: 1, 1: 1, 0: 1}) {
+		T.Fatal("unexpected strength distribution ", stats.OutStrengths, stats.InStrengths)
+	}
+
+	_ = graph.SetEdgeWeight("c", "b", math.NaN(), nil)
+	var invalid *ErrInvalidStrength
+	if _, err := graph.OutStrength("c", nil); !errors.As(err, &invalid) || invalid.From != "c" || invalid.To != "b" || invalid.Overflow {
+		T.Fatal("expected an invalid strength error naming c->b, got ", err)
+	}
+	if _, err := graph.TopKByStrength(0, Incoming, nil); !errors.As(err, &invalid) {
+		T.Fatal("expected an invalid strength error, got ", err)
+	}
+	if _, err := graph.DegreeStats(nil); !errors.As(err, &invalid) {
+		T.Fatal("expected an invalid strength error, got ", err)
+	}
+	_ = graph.SetEdgeWeight("a", "b", math.MaxFloat64, nil)
+	_ = graph.SetEdgeWeight("a", "c", math.MaxFloat64, nil)
+	if _, err := graph.OutStrength("a", nil); !errors.As(err, &invalid) || !invalid.Overflow || invalid.To != "c" {
+		T.Fatal("expected an overflow naming a->c, got ", err)
+	}
+}
+
+func TestSavedQueries(T *testing.T) {
+	graph, err := NewGraph("", true)
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer graph.Close()
+	for _, edge := range [][2]string{{"alice", "bob"}, {"bob", "carol"}, {"carol", "dave"}} {
+		_ = graph.AddEdge(edge[0], edge[1], nil)
+	}
+
+	for _, text := range []string{"drop everything", "edges", "edges alice depth 1", "bfs alice depth", "bfs alice depth -1", "bfs alice depth 1 depth 2", "explain edges alice", "explain explain bfs alice", "bfs $1x", `bfs "alice`, "bfs alice\ndepth 1"} {
+		if err := graph.SaveQuery("bad", text); !errors.Is(err, ErrInvalidQuery) {
+			T.Fatalf("expected ErrInvalidQuery saving %q, got %v", text, err)
+		}
+	}
+	if err := graph.SaveQuery("my report", "edges alice"); !errors.Is(err, ErrInvalidQuery) {
+		T.Fatal("expected ErrInvalidQuery for an invalid name, got ", err)
+	}
+	if err := graph.SaveQuery("reach", "bfs $user depth 1"); err != nil {
+		T.Fatal(err)
+	}
+	if err := graph.SaveQuery("follows", `edges "bob"`); err != nil {
+		T.Fatal(err)
+	}
+	if err := graph.SaveQuery("deep", "bfs alice depth $depth"); err != nil {
+		T.Fatal(err)
+	}
+
+	result, err := graph.RunSavedQuery("reach", map[string]string{"user": "alice"})
+	if err != nil || !reflect.DeepEqual(result.Nodes, []string{"alice", "bob"}) || result.Query != `bfs "alice" depth "1"` {
+		T.Fatal("unexpected result ", result, err)
+	}
+	result, err = graph.RunSavedQuery("follows", nil)
+	if err != nil || !reflect.DeepEqual(result.Nodes, []string{"carol"}) {
+		T.Fatal("unexpected result ", result, err)
+	}
+
+	// Hostile values stay one node ID: the traversal of a node that doesn't exist.
+	for _, user := range []string{"alice depth 5", `alice" depth "5`, "alice\ndepth 5", `alice\" depth \"5`, "$user", "alice fanout 0", `"`} {
+		result, err := graph.RunSavedQuery("reach", map[string]string{"user": user})
+		if err != nil || !reflect.DeepEqual(result.Nodes, []string{user}) {
+			T.Fatalf("value %q changed the query: %v %v", user, result, err)
+		}
+		q, err := parseQuery(result.Query)
+		if err != nil || q.node.value != user || q.depth.value != "1" || q.fanout != nil {
+			T.Fatalf("query %q doesn't parse back to the value %q: %v", result.Query, user, err)
+		}
+	}
+	for _, depth := range []string{"1 fanout 0", "-1", "3; edges bob"} {
+		if _, err := graph.RunSavedQuery("deep", map[string]string{"depth": depth}); !errors.Is(err, ErrInvalidQuery) {
+			T.Fatalf("expected ErrInvalidQuery for depth %q, got %v", depth, err)
+		}
+	}
+	if result, err := graph.RunSavedQuery("deep", map[string]string{"depth": "2"}); err != nil || len(result.Nodes) != 3 {
+		T.Fatal("unexpected result ", result, err)
+	}
+	if _, err := graph.RunSavedQuery("reach", nil); !errors.Is(err, ErrInvalidQuery) {
+		T.Fatal("expected ErrInvalidQuery for a missing parameter, got ", err)
+	}
+	_ = graph.AddEdge("bob", "erin", nil)
+	if err := graph.SaveQuery("limited", "bfs alice fanout $fanout max-degree $degree"); err != nil {
+		T.Fatal(err)
+	}
+	result, err = graph.RunSavedQuery("limited", map[string]string{"fanout": "1", "degree": "5"})
+	if err != nil || len(result.Nodes) != 4 || !reflect.DeepEqual(result.Truncated, []string{"bob"}) ||
+		result.Query != `bfs "alice" fanout "1" max-degree "5"` {
+		T.Fatal("unexpected limited result ", result, err)
+	}
+	result, err = graph.RunSavedQuery("limited", map[string]string{"fanout": "0", "degree": "1"})
+	if err != nil || !reflect.DeepEqual(result.Nodes, []string{"alice", "bob"}) || !reflect.DeepEqual(result.Truncated, []string{"bob"}) {
+		T.Fatal("unexpected result skipping high degree nodes ", result, err)
+	}
+	if err := graph.SaveQuery("explained", "explain bfs $user fanout 1"); err != nil {
+		T.Fatal(err)
+	}
+	result, err = graph.RunSavedQuery("explained", map[string]string{"user": "alice"})
+	if err != nil || len(result.Nodes) != 4 || result.Explain == nil || result.Query != `explain bfs "alice" fanout "1"` {
+		T.Fatal("unexpected explained result ", result, err)
+	}
+	if !reflect.DeepEqual(result.Explain.LimitsTriggered, []string{LimitMaxFanoutPerNode}) || result.Explain.Levels[1].Truncated != 1 {
+		T.Fatal("unexpected explain report ", result.Explain)
+	}
+	if _, err := graph.RunSavedQuery("reach", map[string]string{"user": "alice", "depth": "9"}); !errors.Is(err, ErrInvalidQuery) {
+		T.Fatal("expected ErrInvalidQuery for an unknown parameter, got ", err)
+	}
+
+	queries, err := graph.ListQueries()
+	if err != nil || len(queries) != 5 || queries["reach"] != "bfs $user depth 1" {
+		T.Fatal("unexpected saved queries ", queries, err)
+	}
+	if err := graph.DeleteQuery("reach"); err != nil {
+		T.Fatal(err)
+	}
+	if _, err := graph.RunSavedQuery("reach", map[string]string{"user": "alice"}); !errors.Is(err, ErrQueryNotFound) {
+		T.Fatal("expected ErrQueryNotFound, got ", err)
+	}
+}
+
+func TestShadowCodec(T *testing.T) {
+	// The candidate loses the edges to nodes starting with x.
+	lossy := EdgeListCodec{
+		Name:   "lossy",
+		Encode: GobCodec.Encode,
+		Decode: func(data []byte) (map[string]bool, error) {
+			dstNodes, err := GobCodec.Decode(data)
+			for to := range dstNodes {
+				if strings.HasPrefix(to, "x") {
+					delete(dstNodes, to)
+				}
+			}
+			return dstNodes, err
+		},
+	}
+	logs := new(bytes.Buffer)
+	graph, err := NewGraph("", true, WithShadowCodec(lossy, ShadowOptions{}), WithLogger(slog.New(slog.NewTextHandler(logs, nil))))
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer graph.Close()
+
+	for _, edge := range [][2]string{{"a", "b"}, {"a", "x1"}, {"c", "x2"}, {"c", "d"}} {
+		if err := graph.AddEdge(edge[0], edge[1], nil); err != nil {
+			T.Fatal(err)
+		}
+	}
+	if ok, _ := graph.HasEdge("a", "x1", nil); !ok {
+		T.Fatal("mismatching write not stored")
+	}
+	if m := graph.Metrics().ShadowMismatches; m != 3 {
+		T.Fatal("expected 3 mismatches, got ", m)
+	}
+	if !strings.Contains(logs.String(), "node=a") || !strings.Contains(logs.String(), "node=c") {
+		T.Fatal("mismatching nodes not logged ", logs.String())
+	}
+	report, err := graph.ShadowReport()
+	if err != nil {
+		T.Fatal(err)
+	}
+	if report.Codec != "lossy" || report.Checked != 4 || report.Mismatches != 3 || len(report.Nodes) != 2 || report.Nodes[0].Node != "a" || report.Nodes[1].Count != 2 {
+		T.Fatal("unexpected report ", report)
+	}
+
+	report, err = graph.StopShadowCodec()
+	if err != nil || report.Mismatches != 3 {
+		T.Fatal("unexpected final report ", report, err)
+	}
+	_ = graph.AddEdge("e", "x3", nil)
+	report, err = graph.ShadowReport()
+	if err != nil || report.Codec != "" || report.Mismatches != 0 || report.Nodes != nil {
+		T.Fatal("shadow bookkeeping left after stopping ", report, err)
+	}
+	if m := graph.Metrics().ShadowMismatches; m != 3 {
+		T.Fatal("writes checked after stopping, ", m, " mismatches")
+	}
+
+	strict, err := NewGraph("", true, WithShadowCodec(lossy, ShadowOptions{Strict: true}))
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer strict.Close()
+	_ = strict.AddEdge("a", "b", nil)
+	var mismatch *ErrShadowMismatch
+	if err := strict.AddEdge("a", "x1", nil); !errors.As(err, &mismatch) || mismatch.Node != "a" {
+		T.Fatal("expected a shadow mismatch, got ", err)
+	}
+	if ok, _ := strict.HasEdge("a", "x1", nil); ok {
+		T.Fatal("strict mode stored a mismatching write")
+	}
+	if report, _ := strict.ShadowReport(); report.Mismatches != 1 {
+		T.Fatal("failed write not recorded ", report)
+	}
+}
+
+func TestDistanceOracle(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	if _, err := graph.ApproxDistance("a", "b"); err != ErrNoDistanceOracle {
+		T.Fatal("expected ErrNoDistanceOracle, got ", err)
+	}
+
+	// A path a->b->c->d and an island e->f.
+	for _, edge := range [][2]string{{"a", "b"}, {"b", "c"}, {"c", "d"}, {"e", "f"}} {
+		_ = graph.AddEdge(edge[0], edge[1], nil)
+	}
+	if err := graph.BuildDistanceOracle(10, 1); err != nil {
+		T.Fatal(err)
+	}
+	for _, tc := range []struct {
+		a, b string
+		want DistanceEstimate
+	}{
+		{"a", "d", DistanceEstimate{Upper: 3, Lower: 3, Exact: true}},
+		{"b", "b", DistanceEstimate{Exact: true}},
+		{"d", "a", DistanceEstimate{Upper: -1, Unreachable: true}},
+		{"a", "f", DistanceEstimate{Upper: -1, Unreachable: true}},
+	} {
+		if got, err := graph.ApproxDistance(tc.a, tc.b); err != nil || got != tc.want {
+			T.Fatalf("%s->%s: expected %+v, got %+v %v", tc.a, tc.b, tc.want, got, err)
+		}
+	}
+
+	status, err := graph.DistanceOracleStatus()
+	if err != nil {
+		T.Fatal(err)
+	}
+	if len(status.Landmarks) != 4 || status.ChangedNodes != 0 || status.Stale != nil {
+		T.Fatalf("unexpected status %+v", status)
+	}
+	_ = graph.AddEdge("a", "d", nil)
+	status, _ = graph.DistanceOracleStatus()
+	if status.ChangedNodes != 1 || len(status.Stale) != 4 {
+		T.Fatalf("expected every landmark to be stale, got %+v", status)
+	}
+	if err := graph.RebuildLandmark("a"); err != nil {
+		T.Fatal(err)
+	}
+	status, _ = graph.DistanceOracleStatus()
+	if !reflect.DeepEqual(status.Stale, []string{"b", "c", "e"}) {
+		T.Fatal("expected the rebuilt landmark to be fresh, got ", status.Stale)
+	}
+	if got, _ := graph.ApproxDistance("a", "d"); got.Upper != 1 {
+		T.Fatal("rebuilt landmark not used ", got)
+	}
+	if err := graph.RebuildLandmark("f"); err == nil {
+		T.Fatal("rebuilt a node that isn't a landmark")
+	}
+
+	if err := graph.DropDistanceOracle(); err != nil {
+		T.Fatal(err)
+	}
+	if _, err := graph.DistanceOracleStatus(); err != ErrNoDistanceOracle {
+		T.Fatal("expected the oracle to be dropped, got ", err)
+	}
+}
+
+// TestDistanceOracleAccuracy measures the bounds of the oracle against exact BFS distances on
+// a random undirected graph.
+func TestDistanceOracleAccuracy(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	const nodes = 500
+	rng := rand.New(rand.NewSource(7))
+	node := func(i int) string { return fmt.Sprintf("n%03d", i) }
+	for i := 0; i < nodes; i++ {
+		for j := 0; j < 2; j++ {
+			other := node(rng.Intn(nodes))
+			_ = graph.AddEdge(node(i), other, nil)
+			_ = graph.AddEdge(other, node(i), nil)
+		}
+	}
+
+	for _, landmarks := range []int{4, 16, 64} {
+		if err := graph.BuildDistanceOracle(landmarks, 1); err != nil {
+			T.Fatal(err)
+		}
+		pairs, exact, stretch := 0, 0, 0.0
+		for i := 0; i < 50; i++ {
+			a := node(rng.Intn(nodes))
+			bfs, err := graph.BFS(a, TraversalOptions{}, nil)
+			if err != nil {
+				T.Fatal(err)
+			}
+			for j := 0; j < 20; j++ {
+				b := node(rng.Intn(nodes))
+				got, err := graph.ApproxDistance(a, b)
+				if err != nil {
+					T.Fatal(err)
+				}
+				d, reachable := bfs.Depth[b]
+				if !reachable {
+					if got.Upper >= 0 {
+						T.Fatalf("%s->%s: path of %d through a landmark to an unreachable node", a, b, got.Upper)
+					}
+					continue
+				}
+				if got.Unreachable || got.Upper < d || got.Lower > d {
+					T.Fatalf("%s->%s: bounds %+v don't hold the distance %d", a, b, got, d)
+				}
+				if got.Upper == d {
+					exact++
+				}
+				if d > 0 {
+					stretch += float64(got.Upper) / float64(d)
+				} else {
+					stretch++
+				}
+				pairs++
+			}
+		}
+		T.Logf("%d landmarks: upper bound exact for %.0f%% of %d pairs, mean stretch %.3f",
+			landmarks, 100*float64(exact)/float64(pairs), pairs, stretch/float64(pairs))
+		if landmarks == 64 && stretch/float64(pairs) > 1.3 {
+			T.Fatalf("mean stretch %.3f with %d landmarks", stretch/float64(pairs), landmarks)
+		}
+	}
+}
+
+func TestWritePolicy(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	errQuarantined := errors.New("node is quarantined")
+	var calls []string
+	graph.RegisterWritePolicy(func(op MutationOp, tx *Tx) error {
+		calls = append(calls, "first "+op.String())
+		return nil
+	})
+	// No edges into quarantined nodes.
+	graph.RegisterWritePolicy(func(op MutationOp, tx *Tx) error {
+		calls = append(calls, "second "+op.String())
+		if op.Kind != MutationAddEdge {
+			return nil
+		}
+		props, err := tx.GetNodeProperties(op.To)
+		if err != nil {
+			return err
+		}
+		if props["quarantined"] != nil {
+			return errQuarantined
+		}
+		return nil
+	})
+
+	if err := graph.AddEdge("a", "b", nil); err != nil {
+		T.Fatal(err)
+	}
+	if !reflect.DeepEqual(calls, []string{"first add_edge a->b", "second add_edge a->b"}) {
+		T.Fatal("policies not run in registration order ", calls)
+	}
+
+	// The policy sees the property set earlier in the same transaction.
+	err := graph.Update(func(tx *Tx) error {
+		if err := tx.SetNodeProperties("q", map[string][]byte{"quarantined": {1}}); err != nil {
+			return err
+		}
+		return tx.AddEdge("a", "q")
+	})
+	var rejection *ErrPolicyRejected
+	if !errors.Is(err, errQuarantined) || !errors.As(err, &rejection) || rejection.Op.To != "q" {
+		T.Fatal("expected the edge to be rejected, got ", err)
+	}
+	if props, _ := graph.GetNodeProperties("q", nil); len(props) != 0 {
+		T.Fatal("rejected transaction was committed")
+	}
+
+	_ = graph.SetNodeProperties("q", map[string][]byte{"quarantined": {1}}, nil)
+	errs, err := graph.ApplyBatch([]Mutation{
+		{Kind: MutationAddEdge, From: "a", To: "c"},
+		{Kind: MutationAddEdge, From: "a", To: "q"},
+	}, false)
+	if err != nil || errs[0] != nil || !errors.Is(errs[1], errQuarantined) {
+		T.Fatal("unexpected batch outcome ", errs, err)
+	}
+	if _, _, err := graph.SetEdges("a", []string{"b", "q"}, nil); !errors.Is(err, errQuarantined) {
+		T.Fatal("SetEdges not checked, got ", err)
+	}
+
+	stats, err := graph.ImportJSONWithStats(strings.NewReader(`{"edges": [{"from": "d", "to": "q"}, {"from": "d", "to": "e"}]}`), ImportOptions{})
+	if err != nil {
+		T.Fatal(err)
+	}
+	if stats.Edges != 1 || len(stats.Rejected) != 1 || stats.Rejected[0].Op.From != "d" {
+		T.Fatalf("unexpected import stats %+v", stats)
+	}
+	if ok, _ := graph.HasEdge("d", "q", nil); ok {
+		T.Fatal("rejected edge imported")
+	}
+	if n := graph.Metrics().PolicyRejections; n != 4 {
+		T.Fatal("expected 4 policy rejections, got ", n)
+	}
+}
+
+func TestWritePolicyRemoveNode(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	for _, e := range [][2]string{{"a", "audit/1"}, {"audit/1", "b"}, {"job/1", "b"}, {"c", "job/1"}} {
+		graph.AddEdge(e[0], e[1], nil)
+	}
+	errProtected := errors.New("audit edges are append-only")
+	graph.RegisterWritePolicy(func(op MutationOp, tx *Tx) error {
+		if op.Kind == MutationRemoveEdge && op.To == "audit/1" {
+			return errProtected
+		}
+		return nil
+	})
+
+	var rejected *ErrPolicyRejected
+	for _, node := range []string{"audit/1", "a"} {
+		if _, err := graph.RemoveNode(node, nil); !errors.As(err, &rejected) || !errors.Is(err, errProtected) {
+			T.Fatalf("RemoveNode(%s) not rejected, got %v", node, err)
+		}
+	}
+	if _, err := graph.RemoveNodesWithPrefix("audit/"); !errors.Is(err, errProtected) {
+		T.Fatal("RemoveNodesWithPrefix not rejected, got ", err)
+	}
+	for _, e := range [][2]string{{"a", "audit/1"}, {"audit/1", "b"}} {
+		if ok, _ := graph.HasEdge(e[0], e[1], nil); !ok {
+			T.Fatalf("edge %s->%s removed by a rejected removal", e[0], e[1])
+		}
+	}
+	if pending, _ := graph.PendingRecovery(); pending != 0 {
+		T.Fatal("rejected RemoveNodesWithPrefix left a journal entry")
+	}
+
+	stats, err := graph.RemoveNodesWithPrefix("job/")
+	if err != nil || stats.Nodes != 1 || stats.InboundEdges != 1 {
+		T.Fatalf("unexpected stats %+v, %v", stats, err)
+	}
+	if ok, err := graph.RemoveNode("b", nil); !ok || err != nil {
+		T.Fatal("RemoveNode(b) failed: ", err)
+	}
+}
+
+func TestWritePolicyRedirect(T *testing.T) {
+	graph, _ := NewGraph("", true)
+	defer graph.Close()
+	for _, e := range [][2]string{{"old", "audit/1"}, {"old", "x"}, {"new", "x"}, {"dup", "y"}} {
+		graph.AddEdge(e[0], e[1], nil)
+	}
+	errProtected := errors.New("audit edges are append-only")
+	var ops []string
+	graph.RegisterWritePolicy(func(op MutationOp, tx *Tx) error {
+		ops = append(ops, op.String())
+		if op.Kind == MutationRemoveEdge && op.To == "audit/1" {
+			return errProtected
+		}
+		return nil
+	})
+
+	var rejected *ErrPolicyRejected
+	if err := graph.Redirect("old", "new", nil); !errors.As(err, &rejected) || !errors.Is(err, errProtected) {
+		T.Fatal("Redirect not rejected, got ", err)
+	}
+	if err := graph.MergeNodes("new", []string{"dup", "old"}, nil); !errors.Is(err, errProtected) {
+		T.Fatal("MergeNodes not rejected, got ", err)
+	}
+	for _, e := range [][2]string{{"old", "audit/1"}, {"old", "x"}, {"dup", "y"}} {
+		if ok, _ := graph.HasEdge(e[0], e[1], nil); !ok {
+			T.Fatalf("edge %s->%s moved by a rejected redirect", e[0], e[1])
+		}
+	}
+	if ok, _ := graph.HasEdge("new", "audit/1", nil); ok {
+		T.Fatal("edge added to the new ID by a rejected redirect")
+	}
+
+	// The edges new already has are only removed from old.
+	ops = nil
+	if err := graph.Redirect("dup", "new", nil); err != nil {
+		T.Fatal(err)
+	}
+	if fmt.Sprint(ops) != "[remove_edge dup->y add_edge new->y]" {
+		T.Fatal("unexpected ops submitted ", ops)
+	}
+	_ = graph.AddEdge("z", "x", nil)
+	ops = nil
+	if err := graph.Redirect("z", "new", nil); err != nil || fmt.Sprint(ops) != "[remove_edge z->x]" {
+		T.Fatal("unexpected ops submitted ", ops, err)
+	}
+}
+
+// BenchmarkWritePolicy measures the overhead of an empty write policy on AddEdge.
+func BenchmarkWritePolicy(b *testing.B) {
+	for _, policies := range []int{0, 1} {
+		b.Run(fmt.Sprintf("policies=%d", policies), func(b *testing.B) {
+			graph, _ := NewGraph("", true)
+			defer graph.Close()
+			for i := 0; i < policies; i++ {
+				graph.RegisterWritePolicy(func(op MutationOp, tx *Tx) error {
+					return nil
+				})
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := graph.AddEdge(fmt.Sprint("n", i%1000), fmt.Sprint("m", i), nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func analyticsTestGraph(T *testing.T) *Graph {
+	graph, err := NewGraph("", true)
+	if err != nil {
+		T.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(7))
+	for i := 0; i < 3000; i++ {
+		from, to := fmt.Sprint("n", rng.Intn(1500)), fmt.Sprint("n", rng.Intn(1500))
+		if err := graph.AddEdge(from, to, nil); err != nil {
+			T.Fatal(err)
+		}
+		if i%5 == 0 {
+			_ = graph.SetEdgeWeight(from, to, float64(1+rng.Intn(4)), nil)
+		}
+	}
+	_ = graph.AddEdge("x1", "x2", nil)
+	return graph
+}
+
+func TestAnalyticsPipeline(T *testing.T) {
+	graph := analyticsTestGraph(T)
+	defer graph.Close()
+
+	ranks, _ := graph.PageRank(PageRankOptions{Weighted: true}, nil)
+	top, _ := graph.TopKByStrength(10, Incoming, nil)
+	components, _ := graph.WeaklyConnectedComponents(nil)
+	degrees, _ := graph.DegreeStats(nil)
+
+	var out bytes.Buffer
+	var sets [][]string
+	setSink := NodeSetSink(func(stage string, s [][]string) error {
+		sets = append(sets, s...)
+		return nil
+	})
+	var results []any
+	collect := func(stage string, result any) error {
+		results = append(results, result)
+		return nil
+	}
+	passes := 0
+	p := graph.NewAnalyticsPipeline()
+	if err := p.AddAlgorithm("pagerank", map[string]string{"weighted": "true"}, PropertySink(graph, "rank")); err != nil {
+		T.Fatal(err)
+	}
+	_ = p.AddAlgorithm("topk-strength", map[string]string{"k": "10", "direction": "in"}, setSink)
+	_ = p.AddAlgorithm("components", nil, collect)
+	p.Add(AnalyticsStage{
+		Name: "edges-twice",
+		Run: func(ctx context.Context, g *Graph, txn *badger.Txn) (any, error) {
+			edges := 0
+			for i := 0; i < 2; i++ {
+				passes++
+				_ = g.IterAllEdges(func(src string, dst string) error {
+					edges++
+					return nil
+				}, 100, txn)
+			}
+			return edges / 2, nil
+		},
+	}, collect)
+	p.Add(DegreeStatsStage(), JSONSink(&out))
+
+	report, err := p.Run(context.Background())
+	if err != nil {
+		T.Fatal(err)
+	}
+	if len(report.Stages) != 5 || !report.Stages[0].Shared || report.Stages[3].Shared || report.Stages[3].Name != "edges-twice" {
+		T.Fatalf("stages %+v", report.Stages)
+	}
+	if report.EdgeLists == 0 || report.ReadTs == 0 || passes != 2 {
+		T.Fatalf("report %+v after %d passes", report, passes)
+	}
+
+	for node, rank := range ranks {
+		props, _ := graph.GetNodeProperties(node, nil)
+		if got, err := decodeFloat64(props["rank"]); err != nil || got != rank {
+			T.Fatalf("rank of %s: wrote %v, %v, standalone %v", node, got, err, rank)
+		}
+	}
+	if len(sets) != 1 || len(sets[0]) != len(top) || sets[0][0] != top[0].Node {
+		T.Fatalf("top nodes %v, standalone %v", sets, top)
+	}
+	if !reflect.DeepEqual(results[0], components) {
+		T.Fatalf("components differ from standalone")
+	}
+	if results[1] != degrees.Edges {
+		T.Fatalf("sequential stage counted %v edges, degree stats %d", results[1], degrees.Edges)
+	}
+	var line struct {
+		Stage  string
+		Result DegreeStats
+	}
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		T.Fatal(err)
+	}
+	if line.Stage != "degree-stats" || !reflect.DeepEqual(&line.Result, degrees) {
+		T.Fatalf("json %s, standalone %+v", out.String(), degrees)
+	}
+
+	isolated := false
+	for _, component := range components {
+		isolated = isolated || reflect.DeepEqual(component, []string{"x1", "x2"})
+	}
+	if !isolated {
+		T.Fatal("x1->x2 is not a component of its own")
+	}
+	_ = graph.IterAllEdges(func(src string, dst string) error {
+		for _, component := range components {
+			hasSrc, hasDst := false, false
+			for _, node := range component {
+				hasSrc = hasSrc || node == src
+				hasDst = hasDst || node == dst
+			}
+			if hasSrc != hasDst {
+				T.Fatalf("edge %s->%s spans two components", src, dst)
+			}
+		}
+		return nil
+	}, 100, nil)
+}
+
+func TestAnalyticsPipelineErrors(T *testing.T) {
+	graph := analyticsTestGraph(T)
+	defer graph.Close()
+
+	p := graph.NewAnalyticsPipeline()
+	if err := p.AddAlgorithm("betweenness", nil, nil); err == nil {
+		T.Fatal("expected an error for an unknown algorithm")
+	}
+	if err := p.AddAlgorithm("pagerank", map[string]string{"dampening": "0.5"}, nil); err == nil {
+		T.Fatal("expected an error for an unknown parameter")
+	}
+	if err := p.AddAlgorithm("topk-strength", map[string]string{"k": "3", "direction": "up"}, nil); err == nil {
+		T.Fatal("expected an error for a bad direction")
+	}
+	if _, err := graph.NewAnalyticsPipeline().Add(AnalyticsStage{Name: "empty"}, nil).Run(context.Background()); err == nil {
+		T.Fatal("expected an error for a stage without Pass or Run")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p = graph.NewAnalyticsPipeline().Add(ComponentsStage(), nil)
+	if _, err := p.Run(ctx); !errors.Is(err, context.Canceled) {
+		T.Fatal("cancelled before running: ", err)
+	}
+
+	// Cancelling mid-scan stops every stage and no sink is called.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	sinks := 0
+	sink := func(stage string, result any) error {
+		sinks++
+		return nil
+	}
+	canceller := AnalyticsStage{
+		Name: "canceller",
+		Pass: func(g *Graph, txn *badger.Txn) (func(string, map[string]bool) error, func() (any, error)) {
+			return func(string, map[string]bool) error {
+					cancel()
+					return nil
+				}, func() (any, error) {
+					return nil, nil
+				}
+		},
+	}
+	p = graph.NewAnalyticsPipeline().Add(PageRankStage(PageRankOptions{}), sink).Add(canceller, sink)
+	if _, err := p.Run(ctx); !errors.Is(err, context.Canceled) || sinks != 0 {
+		T.Fatalf("cancelled mid-scan: %v, %d sinks called", err, sinks)
+	}
+
+	// The error of a stage stops the others, and names the stage.
+	failure := errors.New("stage failed")
+	failing := AnalyticsStage{
+		Name: "failing",
+		Pass: func(g *Graph, txn *badger.Txn) (func(string, map[string]bool) error, func() (any, error)) {
+			seen := 0
+			return func(string, map[string]bool) error {
+					if seen++; seen == 300 {
+						return failure
+					}
+					return nil
+				}, func() (any, error) {
+					return nil, nil
+				}
+		},
+	}
+	p = graph.NewAnalyticsPipeline().Add(DegreeStatsStage(), sink).Add(failing, sink)
+	_, err := p.Run(context.Background())
+	if !errors.Is(err, failure) || !strings.Contains(err.Error(), "failing") || sinks != 0 {
+		T.Fatalf("failing stage: %v, %d sinks called", err, sinks)
+	}
+
+	if err := NodeSetSink(func(string, [][]string) error { return nil })("pagerank", map[string]float64{}); err == nil {
+		T.Fatal("expected an error for ranks in a node set sink")
+	}
+}
@@ -0,0 +1,59 @@
+package Onyx
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MaintenanceTask is background work that RunMaintenance runs every Interval.
+type MaintenanceTask struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+}
+
+// RunMaintenance runs every task on its interval until ctx is cancelled, or the graph is
+// closed, and returns ctx.Err(), or ErrClosed, once all of them have stopped. Errors of a run
+// are passed to onError, if set, and the task runs again on its next tick.
+func (g *Graph) RunMaintenance(ctx context.Context, tasks []MaintenanceTask, onError func(task string, err error)) error {
+	ctx, end, err := g.track(ctx, "RunMaintenance")
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		wg.Add(1)
+		go func(task MaintenanceTask) {
+			defer wg.Done()
+			ticker := time.NewTicker(task.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				if err := task.Run(ctx); err != nil && ctx.Err() == nil && onError != nil {
+					onError(task.Name, err)
+				}
+			}
+		}(task)
+	}
+	wg.Wait()
+	return context.Cause(ctx)
+}
+
+// MutationStatsRetentionTask returns a task that deletes mutation stats buckets older than retention.
+func (g *Graph) MutationStatsRetentionTask(retention time.Duration, interval time.Duration) MaintenanceTask {
+	return MaintenanceTask{
+		Name:     "mutation-stats-retention",
+		Interval: interval,
+		Run: func(ctx context.Context) error {
+			_, err := g.PruneMutationStats(time.Now().Add(-retention))
+			return err
+		},
+	}
+}
@@ -0,0 +1,61 @@
+package Onyx
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics is a point in time snapshot of the counters a Graph keeps about itself.
+type Metrics struct {
+	// Conflicts is the number of transaction conflicts recorded since the graph was opened,
+	// or since ResetConflictHotspots.
+	Conflicts uint64
+	// ConflictHotspots are the keys with the most recorded conflicts.
+	ConflictHotspots []HotspotEntry
+	// DeadLetters is the number of dead letters waiting to be retried or purged.
+	DeadLetters int64
+	// ReverseIndexDrift is the number of reverse edge index entries GetInEdges found without
+	// a matching edge, see WithReadRepair. ReadRepairs is how many of them were deleted.
+	ReverseIndexDrift uint64
+	ReadRepairs       uint64
+	// SnapshotAge is the age of the snapshot serving reads without a transaction, see
+	// WithSnapshotPool. It is 0 without a snapshot pool.
+	SnapshotAge time.Duration
+	// DriftAlerts is the number of alerts raised by drift snapshots, see TakeDriftSnapshot.
+	DriftAlerts uint64
+	// ShadowMismatches is the number of edge list writes the shadow codec didn't round-trip
+	// since the graph was opened, see WithShadowCodec.
+	ShadowMismatches uint64
+	// PolicyRejections is the number of writes rejected by write policies since the graph was
+	// opened, see RegisterWritePolicy.
+	PolicyRejections uint64
+}
+
+const metricsHotspots = 10
+
+type graphMetrics struct {
+	conflicts         atomic.Uint64
+	deadLetters       atomic.Int64
+	reverseIndexDrift atomic.Uint64
+	readRepairs       atomic.Uint64
+	driftAlerts       atomic.Uint64
+	shadowMismatches  atomic.Uint64
+	policyRejections  atomic.Uint64
+}
+
+func (g *Graph) Metrics() Metrics {
+	m := Metrics{
+		Conflicts:         g.metrics.conflicts.Load(),
+		ConflictHotspots:  g.hotspots.top(metricsHotspots),
+		DeadLetters:       g.metrics.deadLetters.Load(),
+		ReverseIndexDrift: g.metrics.reverseIndexDrift.Load(),
+		ReadRepairs:       g.metrics.readRepairs.Load(),
+		DriftAlerts:       g.metrics.driftAlerts.Load(),
+		ShadowMismatches:  g.metrics.shadowMismatches.Load(),
+		PolicyRejections:  g.metrics.policyRejections.Load(),
+	}
+	if g.snapshots != nil {
+		m.SnapshotAge = g.snapshots.age()
+	}
+	return m
+}
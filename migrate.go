@@ -0,0 +1,217 @@
+package Onyx
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// The schema version of a database is the format metadata key. A database created by this
+// version of the library is written at latestFormatVersion; older databases are upgraded by
+// running the migrations after their version in order. Every step commits the version it
+// reached, and a run is journaled, so an interrupted run is resumed by the next NewGraph
+// even when the graph is opened WithManualMigrations.
+
+const journalOpMigrate = "migrate"
+
+// baseFormatVersion is the version of databases that predate all migrations.
+const baseFormatVersion = 1
+
+// Migration is one step of the schema upgrade, from Version-1 to Version.
+type Migration struct {
+	Version int
+	Name    string
+	// Up performs the migration. A run interrupted part way repeats Up from the start, so
+	// it must be idempotent.
+	Up func(ctx context.Context, g *Graph) error
+	// Estimate returns how many keys Up would write, without writing anything. It may be nil.
+	Estimate func(ctx context.Context, g *Graph) (int, error)
+}
+
+// migrations is the ordered registry of migrations; migrations[i] upgrades to version
+// baseFormatVersion+i+1. A feature that changes the stored data appends a step here instead
+// of migrating on its own.
+var migrations = []Migration{
+	{Version: 2, Name: "storage-mode", Up: migrateStorageMode},
+}
+
+// ErrSchemaVersion is returned by NewGraph for a database written by a newer version of
+// the library, which this version can't read safely.
+type ErrSchemaVersion struct {
+	Found     int
+	Supported int
+}
+
+func (e *ErrSchemaVersion) Error() string {
+	return fmt.Sprintf("onyx: database schema version %d is newer than the supported version %d", e.Found, e.Supported)
+}
+
+func init() {
+	journalOps[journalOpMigrate] = func(g *Graph, entry *journalEntry) error {
+		return g.runMigrations(context.Background(), entry)
+	}
+}
+
+func latestFormatVersion() int {
+	return baseFormatVersion + len(migrations)
+}
+
+// WithManualMigrations makes NewGraph open a database with an older schema version without
+// upgrading it, so the upgrade can be planned with PlanMigrations and run with Migrate.
+func WithManualMigrations() Option {
+	return func(g *Graph) {
+		g.manualMigrations = true
+	}
+}
+
+func readFormatVersion(txn *badger.Txn) (int, error) {
+	item, err := txn.Get(metaKey(metaFormatKey))
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = item.Value(func(val []byte) error {
+		if len(val) != 1 {
+			return fmt.Errorf("onyx: invalid format version %v", val)
+		}
+		version = int(val[0])
+		return nil
+	})
+	return version, err
+}
+
+func writeFormatVersion(txn *badger.Txn, version int) error {
+	return txn.Set(metaKey(metaFormatKey), []byte{byte(version)})
+}
+
+// SchemaVersion returns the schema version of the database and the latest version this
+// library migrates to.
+func (g *Graph) SchemaVersion() (current int, latest int, err error) {
+	err = g.DB.View(func(txn *badger.Txn) error {
+		current, err = readFormatVersion(txn)
+		return err
+	})
+	return current, latestFormatVersion(), err
+}
+
+type PlannedMigration struct {
+	Version int
+	Name    string
+	// EstimatedKeys is the result of the Estimate of the migration, or -1 if it has none.
+	EstimatedKeys int
+}
+
+// PlanMigrations returns the migrations Migrate would run, with their estimates, as a dry run.
+func (g *Graph) PlanMigrations(ctx context.Context) ([]PlannedMigration, error) {
+	current, _, err := g.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	var plan []PlannedMigration
+	for _, m := range pendingMigrations(current) {
+		planned := PlannedMigration{Version: m.Version, Name: m.Name, EstimatedKeys: -1}
+		if m.Estimate != nil {
+			planned.EstimatedKeys, err = m.Estimate(ctx, g)
+			if err != nil {
+				return nil, fmt.Errorf("onyx: estimating migration %d (%s): %w", m.Version, m.Name, err)
+			}
+		}
+		plan = append(plan, planned)
+	}
+	return plan, nil
+}
+
+func pendingMigrations(current int) []Migration {
+	if current < baseFormatVersion || current >= latestFormatVersion() {
+		return nil
+	}
+	return migrations[current-baseFormatVersion:]
+}
+
+// Migrate upgrades the database to the latest schema version. NewGraph calls it unless the
+// graph is opened WithManualMigrations. Cancelling ctx stops before the next step; the steps
+// done so far are kept and the next call continues from there.
+func (g *Graph) Migrate(ctx context.Context) error {
+	g.migrateMu.Lock()
+	defer g.migrateMu.Unlock()
+
+	current, latest, err := g.SchemaVersion()
+	if err != nil || current >= latest {
+		return err
+	}
+	entry, err := g.migrationJournalEntry()
+	if err != nil {
+		return err
+	}
+	var release func()
+	if entry == nil {
+		entry, release, err = g.newJournalEntry(journalOpMigrate, strconv.Itoa(latest))
+		if err != nil {
+			return err
+		}
+	} else {
+		release = g.claimJournalEntry(entry.ID)
+	}
+	defer release()
+	return g.runMigrations(ctx, entry)
+}
+
+// migrationJournalEntry returns the journal entry of a run that was cancelled, if there is one.
+func (g *Graph) migrationJournalEntry() (*journalEntry, error) {
+	var found *journalEntry
+	err := g.DB.View(func(txn *badger.Txn) error {
+		entries, err := readJournal(txn)
+		for _, entry := range entries {
+			if entry.Op == journalOpMigrate {
+				found = entry
+			}
+		}
+		return err
+	})
+	return found, err
+}
+
+// runMigrations runs the pending migrations journaled by entry and deletes it when the
+// database is at the latest version.
+func (g *Graph) runMigrations(ctx context.Context, entry *journalEntry) error {
+	for {
+		current, latest, err := g.SchemaVersion()
+		if err != nil {
+			return err
+		}
+		if current > latest {
+			return &ErrSchemaVersion{Found: current, Supported: latest}
+		}
+		if current == latest {
+			return g.DB.Update(func(txn *badger.Txn) error {
+				return deleteJournalEntry(txn, entry)
+			})
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := g.faultPoint("Migrate"); err != nil {
+			return err
+		}
+
+		m := pendingMigrations(current)[0]
+		if m.Version != current+1 {
+			return fmt.Errorf("onyx: migration %q is registered for version %d, expected %d", m.Name, m.Version, current+1)
+		}
+		if err := m.Up(ctx, g); err != nil {
+			return fmt.Errorf("onyx: migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		err = g.DB.Update(func(txn *badger.Txn) error {
+			entry.Phase = m.Version
+			if err := writeJournalEntry(txn, entry); err != nil {
+				return err
+			}
+			return writeFormatVersion(txn, m.Version)
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
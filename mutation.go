@@ -0,0 +1,232 @@
+package Onyx
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// MutationKind is the operation of a Mutation.
+type MutationKind string
+
+const (
+	MutationAddEdge    MutationKind = "add_edge"
+	MutationRemoveEdge MutationKind = "remove_edge"
+	// MutationAddNode creates From with an empty edge list if it doesn't exist.
+	MutationAddNode MutationKind = "add_node"
+	// MutationSetProperty sets the property Name of node From, or of the edge From->To if To is set.
+	MutationSetProperty MutationKind = "set_property"
+)
+
+var ErrUnknownMutation = errors.New("onyx: unknown mutation")
+
+// ErrBatchTooBig is returned by ApplyBatch when an atomic batch doesn't fit in one transaction.
+var ErrBatchTooBig = errors.New("onyx: batch doesn't fit in one transaction")
+
+// Mutation is a graph write described as data, so it can be queued, sent over the
+// network or persisted, see ApplyMutations and DeadLetters.
+type Mutation struct {
+	Kind  MutationKind `json:"op"`
+	From  string       `json:"from"`
+	To    string       `json:"to,omitempty"`
+	Name  string       `json:"name,omitempty"`
+	Value []byte       `json:"value,omitempty"`
+}
+
+// Apply runs m in tx.
+func (tx *Tx) Apply(m Mutation) error {
+	defer tx.enter()()
+	tx.wrote(m.From)
+	switch m.Kind {
+	case MutationAddEdge:
+		return tx.g.AddEdge(m.From, m.To, tx.txn)
+	case MutationRemoveEdge:
+		_, err := tx.g.RemoveEdge(m.From, m.To, tx.txn)
+		return err
+	case MutationAddNode:
+		return tx.g.addNode(tx.txn, m.From)
+	case MutationSetProperty:
+		if m.To != "" {
+			return tx.g.SetEdgeProperty(m.From, m.To, m.Name, m.Value, tx.txn)
+		}
+		return tx.g.SetNodeProperties(m.From, map[string][]byte{m.Name: m.Value}, tx.txn)
+	default:
+		return fmt.Errorf("%w %q", ErrUnknownMutation, m.Kind)
+	}
+}
+
+// addNode writes an empty edge list for node unless it already has one.
+func (g *Graph) addNode(txn *badger.Txn, node string) error {
+	node = g.nodeID(node)
+	if err := validateNodeID(node); err != nil {
+		return err
+	}
+	node, err := g.resolveWriteID(txn, node)
+	if err != nil {
+		return err
+	}
+	_, exists, err := readEdgeMap(txn, node)
+	if err != nil || exists {
+		return err
+	}
+	if err := g.checkWritePolicies(txn, MutationOp{Kind: MutationAddNode, From: node}); err != nil {
+		return err
+	}
+	return g.writeEdgeMap(txn, node, map[string]bool{})
+}
+
+// ApplyMutations applies mutations atomically in one transaction, retrying on conflicts like
+// Update. If the retries are exhausted the mutations are persisted as a dead letter before
+// the error is returned, so they can be retried later with RetryDeadLetters.
+func (g *Graph) ApplyMutations(mutations []Mutation) error {
+	err := g.applyMutations(mutations)
+	if err == badger.ErrConflict {
+		return g.deadLetter(mutations, err)
+	}
+	return err
+}
+
+func (g *Graph) applyMutations(mutations []Mutation) error {
+	return g.Update(func(tx *Tx) error {
+		for _, m := range mutations {
+			if err := tx.Apply(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ApplyAsync applies mutations in one transaction that is committed in the background, and
+// calls done, if set, with the result of the commit. Errors applying the mutations are
+// returned right away. A failed commit is persisted as a dead letter, since the caller has
+// usually moved on by then.
+func (g *Graph) ApplyAsync(mutations []Mutation, done func(err error)) error {
+	// The operation ends with the callback of the commit, so Close waits for it.
+	end, err := g.begin("ApplyAsync")
+	if err != nil {
+		return err
+	}
+	tx := g.newTx()
+	for _, m := range mutations {
+		if err := tx.Apply(m); err != nil {
+			tx.txn.Discard()
+			end()
+			return err
+		}
+	}
+
+	tx.txn.CommitWith(func(err error) {
+		defer end()
+		if err != nil {
+			g.recordTxConflict(tx, err)
+			err = g.deadLetter(mutations, err)
+		}
+		if done != nil {
+			done(err)
+		}
+	})
+	// CommitWith doesn't discard the transaction if it fails before committing.
+	tx.txn.Discard()
+	return nil
+}
+
+// ApplyBatch applies a batch of mutations sent by a client. With atomic set, all of them are
+// applied in one transaction, retrying on conflicts like Update, or none are: the error of
+// the first failing mutation is returned with its index, and a batch that doesn't fit in a
+// transaction is rejected with ErrBatchTooBig.
+// Otherwise the batch is applied in as many transactions as it needs and the error of every
+// mutation is returned, nil for the applied ones. A mutation fails on its own, except that
+// when a transaction fails to commit every mutation in it fails with the commit error.
+// Unlike ApplyMutations, failed batches are not dead lettered, the client gets the errors.
+func (g *Graph) ApplyBatch(mutations []Mutation, atomic bool) ([]error, error) {
+	if !atomic {
+		end, err := g.begin("ApplyBatch")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		return g.applyChunked(mutations), nil
+	}
+
+	err := g.Update(func(tx *Tx) error {
+		for i, m := range mutations {
+			if err := tx.Apply(m); err != nil {
+				if err == badger.ErrTxnTooBig {
+					return err
+				}
+				return fmt.Errorf("onyx: mutation %d: %w", i, err)
+			}
+		}
+		return nil
+	})
+	if err == badger.ErrTxnTooBig {
+		return nil, fmt.Errorf("%w: %d mutations", ErrBatchTooBig, len(mutations))
+	}
+	return nil, err
+}
+
+func (g *Graph) applyChunked(mutations []Mutation) []error {
+	errs := make([]error, len(mutations))
+	var tx *Tx
+	var pending []int
+	commit := func() {
+		err := tx.txn.Commit()
+		if err != nil {
+			g.recordTxConflict(tx, err)
+			for _, i := range pending {
+				errs[i] = err
+			}
+		}
+		tx.txn.Discard()
+		tx, pending = nil, nil
+	}
+
+	// replay drops tx and applies the pending mutations again in a fresh transaction. Badger
+	// doesn't undo the writes a mutation made before failing, so a transaction a mutation
+	// failed in half written must not be committed.
+	replay := func() {
+		tx.txn.Discard()
+		tx = g.newTx()
+		for _, j := range pending {
+			if err := tx.Apply(mutations[j]); err != nil {
+				for _, j := range pending {
+					errs[j] = err
+				}
+				tx.txn.Discard()
+				tx, pending = nil, nil
+				return
+			}
+		}
+	}
+
+	for i, m := range mutations {
+		if tx == nil {
+			tx = g.newTx()
+		}
+		written := txnStats(tx.txn).PendingWrites
+		err := tx.Apply(m)
+		if err == badger.ErrTxnTooBig && len(pending) > 0 {
+			replay()
+			if tx != nil {
+				commit()
+			}
+			tx = g.newTx()
+			written = 0
+			err = tx.Apply(m)
+		}
+		if err != nil {
+			if txnStats(tx.txn).PendingWrites > written {
+				replay()
+			}
+			errs[i] = err
+			continue
+		}
+		pending = append(pending, i)
+	}
+	if tx != nil {
+		commit()
+	}
+	return errs
+}
@@ -0,0 +1,254 @@
+package Onyx
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+const defaultAdjacencyCacheSize = 10000
+
+type MultiSourceOptions struct {
+	// FailFast stops at the first failed seed and returns its error. By default every seed
+	// is processed and the failures are returned together as a *MultiSourceError.
+	FailFast bool
+	// CacheSize bounds how many decoded edge lists are shared between the workers. Defaults to 10000.
+	CacheSize int
+
+	ExpansionLimits
+}
+
+type NeighborhoodResult struct {
+	// Depth maps every node within the hop limit to its distance from the seed.
+	Depth map[string]int
+	// Truncated holds the nodes that were not fully expanded because of the ExpansionLimits.
+	// It is nil if the neighborhood is complete.
+	Truncated map[string]bool
+}
+
+// MultiSourceError holds the errors of the seeds MultiSourceNeighborhood failed on.
+type MultiSourceError struct {
+	Errors map[string]error
+}
+
+func (e *MultiSourceError) Error() string {
+	seeds := make([]string, 0, len(e.Errors))
+	for seed := range e.Errors {
+		seeds = append(seeds, seed)
+	}
+	sort.Strings(seeds)
+	return fmt.Sprintf("onyx: %d seed(s) failed, first %q: %v", len(seeds), seeds[0], e.Errors[seeds[0]])
+}
+
+// adjacencyCache holds decoded and redirect-resolved edge lists read from one transaction,
+// shared by concurrent readers. Once full, further edge lists are decoded but not cached.
+type adjacencyCache struct {
+	txn  *badger.Txn
+	size int
+
+	mu        sync.Mutex
+	resolver  *redirectResolver
+	neighbors map[string][]string
+}
+
+func (g *Graph) newAdjacencyCache(txn *badger.Txn, size int) *adjacencyCache {
+	if size <= 0 {
+		size = defaultAdjacencyCacheSize
+	}
+	return &adjacencyCache{
+		txn:       txn,
+		size:      size,
+		resolver:  g.newRedirectResolver(txn),
+		neighbors: make(map[string][]string),
+	}
+}
+
+func (c *adjacencyCache) resolve(id string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resolver.resolve(id)
+}
+
+// get returns the sorted neighbors of node.
+func (c *adjacencyCache) get(node string) ([]string, error) {
+	c.mu.Lock()
+	neighbors, ok := c.neighbors[node]
+	c.mu.Unlock()
+	if ok {
+		return neighbors, nil
+	}
+
+	dstNodes, _, err := readEdgeMap(c.txn, node)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dstNodes, err = c.resolver.resolveNeighbors(dstNodes)
+	if err != nil {
+		return nil, err
+	}
+	neighbors = sortedNeighbors(dstNodes)
+	if len(c.neighbors) < c.size {
+		c.neighbors[node] = neighbors
+	}
+	return neighbors, nil
+}
+
+// neighborhood returns the nodes at most hops away from seed with their distance.
+func (c *adjacencyCache) neighborhood(seed string, hops int, limits ExpansionLimits) (*NeighborhoodResult, error) {
+	if err := validateNodeID(seed); err != nil {
+		return nil, err
+	}
+	seed, err := c.resolve(seed)
+	if err != nil {
+		return nil, err
+	}
+	result := &NeighborhoodResult{Depth: map[string]int{seed: 0}}
+	frontier := []string{seed}
+	for depth := 1; depth <= hops && len(frontier) > 0; depth++ {
+		var next []string
+		for _, node := range frontier {
+			neighbors, err := c.get(node)
+			if err != nil {
+				return nil, err
+			}
+			neighbors, truncated, err := limits.limit(c.txn, node, neighbors)
+			if err != nil {
+				return nil, err
+			}
+			if truncated {
+				if result.Truncated == nil {
+					result.Truncated = make(map[string]bool)
+				}
+				result.Truncated[node] = true
+			}
+			for _, neighbor := range neighbors {
+				if _, seen := result.Depth[neighbor]; !seen {
+					result.Depth[neighbor] = depth
+					next = append(next, neighbor)
+				}
+			}
+		}
+		frontier = next
+	}
+	return result, nil
+}
+
+// Neighborhood returns every node at most hops away from seed with its distance in hops.
+func (g *Graph) Neighborhood(seed string, hops int, limits ExpansionLimits, txn *badger.Txn) (*NeighborhoodResult, error) {
+	seed = g.nodeID(seed)
+	if hops < 0 {
+		return nil, fmt.Errorf("onyx: invalid hop count %d", hops)
+	}
+
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("Neighborhood")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	result, err := g.newAdjacencyCache(txn, 0).neighborhood(seed, hops, limits)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// MultiSourceNeighborhood computes the Neighborhood of every seed with a pool of workers and
+// calls fn with each result. fn is called concurrently from the workers, in no particular order.
+// All workers read from txn, so every neighborhood sees the same snapshot, and edge lists
+// decoded for one seed are reused for the others. Badger only supports concurrent reads in a
+// read-only transaction, so txn must be one, or nil.
+// An error computing a seed's neighborhood or returned by fn fails that seed; see
+// MultiSourceOptions.FailFast for how failures are reported.
+func (g *Graph) MultiSourceNeighborhood(seeds []string, hops int, workers int, opts MultiSourceOptions, fn func(seed string, result *NeighborhoodResult) error, txn *badger.Txn) error {
+	seeds = g.nodeIDs(seeds)
+	if hops < 0 {
+		return fmt.Errorf("onyx: invalid hop count %d", hops)
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+
+	if txn != nil && txnIsUpdate(txn) {
+		return errors.New("onyx: MultiSourceNeighborhood needs a read-only transaction")
+	}
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("MultiSourceNeighborhood")
+		if err != nil {
+			return err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	cache := g.newAdjacencyCache(txn, opts.CacheSize)
+	work := make(chan string)
+	stop := make(chan struct{})
+	var mu sync.Mutex
+	var firstErr error
+	failed := make(map[string]error)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seed := range work {
+				select {
+				case <-stop:
+					continue
+				default:
+				}
+				result, err := cache.neighborhood(seed, hops, opts.ExpansionLimits)
+				if err == nil {
+					err = fn(seed, result)
+				}
+				if err == nil {
+					continue
+				}
+				mu.Lock()
+				failed[seed] = err
+				if opts.FailFast && firstErr == nil {
+					firstErr = fmt.Errorf("onyx: seed %q: %w", seed, err)
+					close(stop)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, seed := range seeds {
+		select {
+		case work <- seed:
+		case <-stop:
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if len(failed) > 0 {
+		return &MultiSourceError{Errors: failed}
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package Onyx
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+	"golang.org/x/text/unicode/norm"
+)
+
+const metaNormalizerKey = "node-normalizer"
+
+// NodeNormalizer canonicalizes the node IDs passed to the graph API, so IDs that only differ
+// in, say, case or surrounding whitespace name the same node. Normalize must be idempotent and
+// must not return IDs containing a NUL byte. Name identifies the normalization: it is stored
+// in the database, and opening it with a normalizer of another name fails.
+type NodeNormalizer struct {
+	Name      string
+	Normalize func(id string) string
+}
+
+var (
+	NormalizeLowercase = NodeNormalizer{Name: "lowercase", Normalize: strings.ToLower}
+	NormalizeTrim      = NodeNormalizer{Name: "trim", Normalize: strings.TrimSpace}
+	// NormalizeNFC converts IDs to Unicode normalization form C, so precomposed and
+	// combining character sequences, like "é" and "e\u0301", are the same ID.
+	NormalizeNFC = NodeNormalizer{Name: "nfc", Normalize: norm.NFC.String}
+)
+
+// ChainNormalizers applies normalizers in order. Its name joins their names with "+".
+func ChainNormalizers(normalizers ...NodeNormalizer) NodeNormalizer {
+	names := make([]string, len(normalizers))
+	for i, n := range normalizers {
+		names[i] = n.Name
+	}
+	return NodeNormalizer{
+		Name: strings.Join(names, "+"),
+		Normalize: func(id string) string {
+			for _, n := range normalizers {
+				id = n.Normalize(id)
+			}
+			return id
+		},
+	}
+}
+
+// WithNodeNormalizer normalizes every node ID passed to the graph: to mutations, reads,
+// traversals, imports and the Tx methods. IDs already stored are not rewritten, see
+// FindDenormalizedDuplicates for databases that were written without the normalizer.
+func WithNodeNormalizer(normalizer NodeNormalizer) Option {
+	return func(g *Graph) {
+		g.normalizer = normalizer
+	}
+}
+
+// ErrNormalizerMismatch is returned by NewGraph when the database was written with another
+// node normalizer than the graph is opened with. An empty name means no normalizer.
+type ErrNormalizerMismatch struct {
+	Stored     string
+	Configured string
+}
+
+func (e *ErrNormalizerMismatch) Error() string {
+	return fmt.Sprintf("onyx: database uses node normalizer %q, opened with %q", e.Stored, e.Configured)
+}
+
+// openNormalizer checks the normalizer stored in the database against the configured one.
+// A database without a normalizer adopts the configured one.
+func (g *Graph) openNormalizer() error {
+	return g.DB.Update(func(txn *badger.Txn) error {
+		stored := ""
+		item, err := txn.Get(metaKey(metaNormalizerKey))
+		if err == nil {
+			var val []byte
+			val, err = item.ValueCopy(nil)
+			stored = string(val)
+		}
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		configured := g.normalizer.Name
+		if stored == configured {
+			return nil
+		}
+		if stored != "" {
+			return &ErrNormalizerMismatch{Stored: stored, Configured: configured}
+		}
+		return txn.Set(metaKey(metaNormalizerKey), []byte(configured))
+	})
+}
+
+// nodeID returns the normalized form of a node ID passed to the API.
+func (g *Graph) nodeID(id string) string {
+	if g.normalizer.Normalize == nil {
+		return id
+	}
+	return g.normalizer.Normalize(id)
+}
+
+func (g *Graph) nodeIDs(ids []string) []string {
+	if g.normalizer.Normalize == nil {
+		return ids
+	}
+	normalized := make([]string, len(ids))
+	for i, id := range ids {
+		normalized[i] = g.normalizer.Normalize(id)
+	}
+	return normalized
+}
+
+// DenormalizedGroup is a set of stored node IDs that the normalizer maps to the same ID.
+type DenormalizedGroup struct {
+	// Canonical is the normalized ID, which may or may not be stored itself.
+	Canonical string
+	// Variants are the stored IDs that differ from Canonical, sorted.
+	Variants []string
+}
+
+// FindDenormalizedDuplicates scans the stored node IDs for the ones the node normalizer would
+// change, grouped by their normalized ID and sorted by it. Such nodes are left over from
+// before the normalizer was enabled and can't be reached through the API anymore; merging
+// every group with MergeNodes(group.Canonical, group.Variants, nil) makes them reachable again.
+func (g *Graph) FindDenormalizedDuplicates(txn *badger.Txn) ([]DenormalizedGroup, error) {
+	if g.normalizer.Normalize == nil {
+		return nil, nil
+	}
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("FindDenormalizedDuplicates")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	variants := make(map[string][]string)
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := newNodeIterator(txn, opts)
+	for it.Rewind(); it.Valid(); it.Next() {
+		id := string(it.Item().Key())
+		if canonical := g.normalizer.Normalize(id); canonical != id {
+			variants[canonical] = append(variants[canonical], id)
+		}
+	}
+	it.Close()
+
+	groups := make([]DenormalizedGroup, 0, len(variants))
+	for canonical, ids := range variants {
+		groups = append(groups, DenormalizedGroup{Canonical: canonical, Variants: ids})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Canonical < groups[j].Canonical
+	})
+
+	return groups, nil
+}
+
+// MergeNodes merges the nodes others into into, like Redirect(other, into) for each of them:
+// their out-edges and properties move to into, keeping the values into already has, and
+// redirect markers make reads of them and of edges pointing at them resolve to into,
+// until ResolveRedirects rewrites those edges. into is normalized; others are taken as
+// stored, so the IDs found by FindDenormalizedDuplicates can be merged. The edges moved are
+// checked by the write policies like in Redirect, and a rejection fails the whole merge.
+func (g *Graph) MergeNodes(into string, others []string, txn *badger.Txn) error {
+	into = g.nodeID(into)
+	if err := validateNodeID(into); err != nil {
+		return err
+	}
+	for _, other := range others {
+		if err := validateNodeID(other); err != nil {
+			return err
+		}
+	}
+
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("MergeNodes")
+		if err != nil {
+			return err
+		}
+		defer end()
+		txn = g.DB.NewTransaction(true)
+		defer txn.Discard()
+	}
+
+	// written are the nodes the merge writes to, for the conflict hotspots: others, and the
+	// canonical ID of into they now redirect to.
+	written := []string{into}
+	for _, other := range others {
+		if other == into {
+			continue
+		}
+		canonical, err := g.redirect(txn, other, into)
+		if err != nil {
+			return err
+		}
+		written[0] = canonical
+		written = append(written, other)
+	}
+
+	if localTxn {
+		err := txn.Commit()
+		if err != nil {
+			g.recordConflict(err, written...)
+			return err
+		}
+	}
+	return nil
+}
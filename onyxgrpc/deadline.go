@@ -0,0 +1,49 @@
+package onyxgrpc
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// MaxCallDuration returns the server options capping how long a call may run, whatever
+// deadline the client set. Every call of the server runs with a context that is done at the
+// earlier of the call deadline and d, and the services of this package pass it to the
+// context-aware graph APIs: traversals past it stop with DeadlineExceeded, and streams end.
+// 0 only applies the call deadline. The options add to the interceptors of the server:
+//
+//	server := grpc.NewServer(onyxgrpc.MaxCallDuration(10 * time.Second)...)
+func MaxCallDuration(d time.Duration) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			ctx, cancel := withMaxDuration(ctx, d)
+			defer cancel()
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, cancel := withMaxDuration(stream.Context(), d)
+			defer cancel()
+			return handler(srv, &deadlineStream{ServerStream: stream, ctx: ctx})
+		}),
+	}
+}
+
+// withMaxDuration returns ctx, which has the deadline of the call if the client set one,
+// limited to d from now.
+func withMaxDuration(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// deadlineStream is a server stream with the context of MaxCallDuration.
+type deadlineStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *deadlineStream) Context() context.Context {
+	return s.ctx
+}
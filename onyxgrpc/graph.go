@@ -0,0 +1,323 @@
+package onyxgrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/Dynaclo/Onyx"
+	"github.com/dgraph-io/badger/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const graphService = "onyx.Graph"
+
+// BatchRequest is the message of ApplyBatch, and every client message of ApplyBatchStream.
+// A batch is applied atomically unless Chunked is set, see Onyx.Graph.ApplyBatch.
+type BatchRequest struct {
+	Mutations []Onyx.Mutation `json:"mutations"`
+	Chunked   bool            `json:"chunked,omitempty"`
+}
+
+// BatchResponse reports how many mutations of a batch were applied, and how many were
+// rejected by write policies. Results has the outcome of every mutation, in order, and is only
+// set for chunked batches.
+//
+// On ApplyBatchStream, a batch that failed as a whole is answered with its Code and Error
+// instead of failing the stream; ApplyBatch returns them as the status of the call.
+type BatchResponse struct {
+	Applied  int              `json:"applied"`
+	Rejected int              `json:"rejected,omitempty"`
+	Results  []MutationResult `json:"results,omitempty"`
+	Code     codes.Code       `json:"code,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// MutationResult is the outcome of one mutation of a chunked batch.
+type MutationResult struct {
+	OK    bool       `json:"ok"`
+	Code  codes.Code `json:"code"`
+	Error string     `json:"error,omitempty"`
+}
+
+// TraversalRequest is the message of BFS: a breadth first traversal from Start with the
+// Onyx.TraversalOptions of the same names. IncludeProperties returns the properties of the
+// visited nodes, restricted to PropertyAllowlist unless it is empty.
+type TraversalRequest struct {
+	Start                string   `json:"start"`
+	MaxDepth             int      `json:"max_depth,omitempty"`
+	MaxFanoutPerNode     int      `json:"max_fanout_per_node,omitempty"`
+	SkipNodesAboveDegree int      `json:"skip_nodes_above_degree,omitempty"`
+	IncludeProperties    bool     `json:"include_properties,omitempty"`
+	PropertyAllowlist    []string `json:"property_allowlist,omitempty"`
+}
+
+// TraversalResponse is an Onyx.TraversalResult, with the Truncated nodes sorted: the
+// traversal is partial unless it is empty. Properties has an entry for every visited node when
+// the request set IncludeProperties.
+type TraversalResponse struct {
+	Order      []string                     `json:"order"`
+	Depth      map[string]int               `json:"depth"`
+	Truncated  []string                     `json:"truncated"`
+	Properties map[string]map[string][]byte `json:"properties,omitempty"`
+}
+
+// graphServer is the HandlerType of the service, which grpc checks the implementation
+// against.
+type graphServer interface {
+	applyBatch(ctx context.Context, req *BatchRequest) (*BatchResponse, error)
+	applyBatchStream(stream grpc.ServerStream) error
+	bfs(ctx context.Context, req *TraversalRequest) (*TraversalResponse, error)
+}
+
+// unaryHandler returns the grpc handler of a unary method running fn, through the
+// interceptors of the server.
+func unaryHandler[Req any, Resp any](method string, fn func(s graphServer, ctx context.Context, req *Req) (*Resp, error)) func(any, context.Context, func(any) error, grpc.UnaryServerInterceptor) (any, error) {
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		req := new(Req)
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return fn(srv.(graphServer), ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + graphService + "/" + method}
+		return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+			return fn(srv.(graphServer), ctx, req.(*Req))
+		})
+	}
+}
+
+var graphServiceDesc = grpc.ServiceDesc{
+	ServiceName: graphService,
+	HandlerType: (*graphServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ApplyBatch",
+			Handler:    unaryHandler("ApplyBatch", graphServer.applyBatch),
+		},
+		{
+			MethodName: "BFS",
+			Handler:    unaryHandler("BFS", graphServer.bfs),
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ApplyBatchStream",
+			ClientStreams: true,
+			ServerStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				return srv.(graphServer).applyBatchStream(stream)
+			},
+		},
+	},
+	Metadata: "onyxgrpc/graph.go",
+}
+
+// RegisterGraph registers the graph service of g on s.
+func RegisterGraph(s grpc.ServiceRegistrar, g *Onyx.Graph) {
+	s.RegisterService(&graphServiceDesc, &graphHandler{g: g})
+}
+
+type graphHandler struct {
+	g *Onyx.Graph
+	// onExpand is the TraversalOptions.OnExpand of traversals, for tests.
+	onExpand func(node string, depth int)
+}
+
+func (h *graphHandler) applyBatch(ctx context.Context, req *BatchRequest) (*BatchResponse, error) {
+	// ApplyBatch can't be stopped midway, so a client that gave up before it started doesn't
+	// get it applied at least.
+	if err := ctx.Err(); err != nil {
+		return nil, statusError(err)
+	}
+	errs, err := h.g.ApplyBatch(req.Mutations, !req.Chunked)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	if !req.Chunked {
+		return &BatchResponse{Applied: len(req.Mutations)}, nil
+	}
+	resp := &BatchResponse{Results: make([]MutationResult, len(errs))}
+	for i, err := range errs {
+		if err != nil {
+			if errors.As(err, new(*Onyx.ErrPolicyRejected)) {
+				resp.Rejected++
+			}
+			resp.Results[i] = MutationResult{Code: codeOf(err), Error: err.Error()}
+			continue
+		}
+		resp.Results[i] = MutationResult{OK: true, Code: codes.OK}
+		resp.Applied++
+	}
+	return resp, nil
+}
+
+// applyBatchStream applies the batches of the stream in order, answering each before the
+// next one is read. It ends when the context of the stream is done, even while waiting for a
+// batch: RecvMsg only returns once the call itself ends, not at the deadline of
+// MaxCallDuration.
+func (h *graphHandler) applyBatchStream(stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	type received struct {
+		req *BatchRequest
+		err error
+	}
+	next := make(chan received)
+	go func() {
+		for {
+			req := new(BatchRequest)
+			err := stream.RecvMsg(req)
+			select {
+			case next <- received{req, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		var msg received
+		select {
+		case msg = <-next:
+		case <-ctx.Done():
+			return statusError(ctx.Err())
+		}
+		if msg.err == io.EOF {
+			return nil
+		} else if msg.err != nil {
+			return msg.err
+		}
+		resp, err := h.applyBatch(ctx, msg.req)
+		if err != nil {
+			s := status.Convert(err)
+			resp = &BatchResponse{Code: s.Code(), Error: s.Message()}
+		}
+		if err := stream.SendMsg(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (h *graphHandler) bfs(ctx context.Context, req *TraversalRequest) (*TraversalResponse, error) {
+	opts := Onyx.TraversalOptions{
+		MaxDepth:          req.MaxDepth,
+		IncludeProperties: req.IncludeProperties,
+		PropertyAllowlist: req.PropertyAllowlist,
+		OnExpand:          h.onExpand,
+		ExpansionLimits: Onyx.ExpansionLimits{
+			MaxFanoutPerNode:     req.MaxFanoutPerNode,
+			SkipNodesAboveDegree: req.SkipNodesAboveDegree,
+		},
+	}
+	result, err := h.g.BFSContext(ctx, req.Start, opts, nil)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	truncated := make([]string, 0, len(result.Truncated))
+	for node := range result.Truncated {
+		truncated = append(truncated, node)
+	}
+	sort.Strings(truncated)
+	return &TraversalResponse{Order: result.Order, Depth: result.Depth, Truncated: truncated, Properties: result.Properties}, nil
+}
+
+// codeOf maps errors of the graph API to gRPC status codes.
+func codeOf(err error) codes.Code {
+	switch {
+	case errors.Is(err, Onyx.ErrNodeNotFound), errors.Is(err, Onyx.ErrEdgeNotFound), errors.Is(err, badger.ErrKeyNotFound), errors.Is(err, Onyx.ErrQueryNotFound):
+		return codes.NotFound
+	case errors.Is(err, Onyx.ErrInvalidNodeID), errors.Is(err, Onyx.ErrUnknownMutation), errors.Is(err, Onyx.ErrInvalidQuery):
+		return codes.InvalidArgument
+	case errors.Is(err, Onyx.ErrBatchTooBig):
+		return codes.ResourceExhausted
+	case errors.Is(err, badger.ErrConflict):
+		return codes.Aborted
+	case errors.As(err, new(*Onyx.ErrPolicyRejected)):
+		return codes.PermissionDenied
+	case errors.Is(err, Onyx.ErrNoReverseIndex), errors.Is(err, Onyx.ErrReverseIndexNotReady):
+		return codes.FailedPrecondition
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	case errors.Is(err, Onyx.ErrClosed):
+		return codes.Unavailable
+	default:
+		return codes.Unknown
+	}
+}
+
+func statusError(err error) error {
+	return status.Error(codeOf(err), err.Error())
+}
+
+// GraphClient calls the graph service served on a connection.
+type GraphClient struct {
+	conn grpc.ClientConnInterface
+}
+
+func NewGraphClient(conn grpc.ClientConnInterface) *GraphClient {
+	return &GraphClient{conn: conn}
+}
+
+// ApplyBatch applies req and returns its response. A failed atomic batch is returned as an
+// error with its status.
+func (c *GraphClient) ApplyBatch(ctx context.Context, req *BatchRequest) (*BatchResponse, error) {
+	resp := new(BatchResponse)
+	err := c.conn.Invoke(ctx, "/"+graphService+"/ApplyBatch", req, resp, grpc.CallContentSubtype(codecName))
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// BFS runs the traversal of req.
+func (c *GraphClient) BFS(ctx context.Context, req *TraversalRequest) (*TraversalResponse, error) {
+	resp := new(TraversalResponse)
+	err := c.conn.Invoke(ctx, "/"+graphService+"/BFS", req, resp, grpc.CallContentSubtype(codecName))
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// BatchStream is an ApplyBatchStream call: every batch sent is answered with one response,
+// in order.
+type BatchStream struct {
+	stream grpc.ClientStream
+}
+
+// ApplyBatchStream opens a stream of batches, which ends when ctx is done or after CloseSend.
+func (c *GraphClient) ApplyBatchStream(ctx context.Context) (*BatchStream, error) {
+	desc := &graphServiceDesc.Streams[0]
+	stream, err := c.conn.NewStream(ctx, desc, "/"+graphService+"/"+desc.StreamName, grpc.CallContentSubtype(codecName))
+	if err != nil {
+		return nil, err
+	}
+	return &BatchStream{stream: stream}, nil
+}
+
+func (s *BatchStream) Send(req *BatchRequest) error {
+	return s.stream.SendMsg(req)
+}
+
+// Recv returns the response to the next batch sent, and io.EOF once the stream ended.
+func (s *BatchStream) Recv() (*BatchResponse, error) {
+	resp := new(BatchResponse)
+	if err := s.stream.RecvMsg(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// CloseSend tells the server no more batches follow.
+func (s *BatchStream) CloseSend() error {
+	return s.stream.CloseSend()
+}
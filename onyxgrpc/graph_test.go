@@ -0,0 +1,240 @@
+package onyxgrpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Dynaclo/Onyx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// serveGraph serves the graph service of h and returns a client of it.
+func serveGraph(T *testing.T, h *graphHandler, opts ...grpc.ServerOption) *GraphClient {
+	T.Helper()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		T.Fatal(err)
+	}
+	server := grpc.NewServer(opts...)
+	server.RegisterService(&graphServiceDesc, h)
+	go server.Serve(tcp)
+	T.Cleanup(server.Stop)
+	conn, err := grpc.NewClient(tcp.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		T.Fatal(err)
+	}
+	T.Cleanup(func() { conn.Close() })
+	return NewGraphClient(conn)
+}
+
+func TestApplyBatch(T *testing.T) {
+	graph, _ := Onyx.NewGraph("", true)
+	defer graph.Close()
+	graph.RegisterWritePolicy(func(op Onyx.MutationOp, tx *Onyx.Tx) error {
+		if op.To == "blocked" {
+			return errors.New("blocked")
+		}
+		return nil
+	})
+	client := serveGraph(T, &graphHandler{g: graph})
+	ctx := context.Background()
+
+	resp, err := client.ApplyBatch(ctx, &BatchRequest{Mutations: []Onyx.Mutation{
+		{Kind: Onyx.MutationAddEdge, From: "a", To: "b"},
+		{Kind: Onyx.MutationAddEdge, From: "b", To: "c"},
+	}})
+	if err != nil || resp.Applied != 2 || resp.Results != nil {
+		T.Fatalf("unexpected atomic outcome %+v, %v", resp, err)
+	}
+	_, err = client.ApplyBatch(ctx, &BatchRequest{Mutations: []Onyx.Mutation{
+		{Kind: Onyx.MutationAddEdge, From: "a", To: "x"},
+		{Kind: "rename", From: "a"},
+	}})
+	if status.Code(err) != codes.InvalidArgument {
+		T.Fatal("expected InvalidArgument for an unknown mutation, got ", err)
+	}
+	if ok, _ := graph.HasEdge("a", "x", nil); ok {
+		T.Fatal("failed atomic batch was partly applied")
+	}
+
+	resp, err = client.ApplyBatch(ctx, &BatchRequest{Chunked: true, Mutations: []Onyx.Mutation{
+		{Kind: Onyx.MutationAddEdge, From: "a", To: "x"},
+		{Kind: Onyx.MutationAddEdge, From: "a", To: "blocked"},
+		{Kind: "rename", From: "a"},
+	}})
+	if err != nil || resp.Applied != 1 || resp.Rejected != 1 || len(resp.Results) != 3 {
+		T.Fatalf("unexpected chunked outcome %+v, %v", resp, err)
+	}
+	results := resp.Results
+	if !results[0].OK || results[1].Code != codes.PermissionDenied || results[2].Code != codes.InvalidArgument || results[1].Error == "" {
+		T.Fatalf("unexpected results %+v", resp.Results)
+	}
+	if ok, _ := graph.HasEdge("a", "x", nil); !ok {
+		T.Fatal("chunked batch not applied")
+	}
+}
+
+func TestApplyBatchStream(T *testing.T) {
+	graph, _ := Onyx.NewGraph("", true)
+	defer graph.Close()
+	client := serveGraph(T, &graphHandler{g: graph})
+
+	stream, err := client.ApplyBatchStream(context.Background())
+	if err != nil {
+		T.Fatal(err)
+	}
+	batches := []*BatchRequest{
+		{Mutations: []Onyx.Mutation{{Kind: Onyx.MutationAddEdge, From: "a", To: "b"}}},
+		{Mutations: []Onyx.Mutation{{Kind: "rename", From: "a"}}},
+		{Chunked: true, Mutations: []Onyx.Mutation{
+			{Kind: Onyx.MutationAddEdge, From: "b", To: "c"},
+			{Kind: "rename", From: "b"},
+		}},
+	}
+	for _, batch := range batches {
+		if err := stream.Send(batch); err != nil {
+			T.Fatal(err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		T.Fatal(err)
+	}
+
+	var responses []*BatchResponse
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			T.Fatal(err)
+		}
+		responses = append(responses, resp)
+	}
+	if len(responses) != 3 {
+		T.Fatal("expected a response per batch, got ", len(responses))
+	}
+	if responses[0].Applied != 1 || responses[0].Code != codes.OK {
+		T.Fatalf("unexpected first response %+v", responses[0])
+	}
+	// A failed batch is answered without ending the stream.
+	if responses[1].Code != codes.InvalidArgument || responses[1].Error == "" || responses[1].Applied != 0 {
+		T.Fatalf("unexpected response to the failed batch %+v", responses[1])
+	}
+	results := responses[2].Results
+	if responses[2].Applied != 1 || len(results) != 2 || !results[0].OK || results[1].Code != codes.InvalidArgument {
+		T.Fatalf("unexpected chunked response %+v", responses[2])
+	}
+	if ok, _ := graph.HasEdge("b", "c", nil); !ok {
+		T.Fatal("streamed batch not applied")
+	}
+}
+
+func TestBFSIncludeProperties(T *testing.T) {
+	graph, _ := Onyx.NewGraph("", true)
+	defer graph.Close()
+	_ = graph.AddEdge("a", "b", nil)
+	_ = graph.AddEdge("a", "c", nil)
+	_ = graph.AddEdge("b", "d", nil)
+	_ = graph.SetNodeProperties("b", map[string][]byte{"name": []byte("B"), "blob": {0xff, 0}}, nil)
+	_ = graph.SetNodeProperties("d", map[string][]byte{"name": []byte("D")}, nil)
+	client := serveGraph(T, &graphHandler{g: graph})
+
+	resp, err := client.BFS(context.Background(), &TraversalRequest{Start: "a", MaxDepth: 1})
+	if err != nil {
+		T.Fatal(err)
+	}
+	if fmt.Sprint(resp.Order) != "[a b c]" || resp.Depth["c"] != 1 || resp.Properties != nil {
+		T.Fatalf("unexpected traversal %+v", resp)
+	}
+
+	resp, err = client.BFS(context.Background(), &TraversalRequest{Start: "a", IncludeProperties: true})
+	if err != nil {
+		T.Fatal(err)
+	}
+	if len(resp.Properties) != 4 || !bytes.Equal(resp.Properties["b"]["blob"], []byte{0xff, 0}) || string(resp.Properties["d"]["name"]) != "D" {
+		T.Fatalf("unexpected properties %q", resp.Properties)
+	}
+	if props, ok := resp.Properties["c"]; !ok || len(props) != 0 {
+		T.Fatal("expected an empty property map for c")
+	}
+
+	resp, err = client.BFS(context.Background(), &TraversalRequest{Start: "a", IncludeProperties: true, PropertyAllowlist: []string{"name"}})
+	if err != nil {
+		T.Fatal(err)
+	}
+	if _, ok := resp.Properties["b"]["blob"]; ok || string(resp.Properties["b"]["name"]) != "B" {
+		T.Fatalf("allowlist not applied %q", resp.Properties["b"])
+	}
+}
+
+func TestCallDeadlines(T *testing.T) {
+	graph, _ := Onyx.NewGraph("", true)
+	defer graph.Close()
+	const n = 1000
+	err := graph.Update(func(tx *Onyx.Tx) error {
+		for i := 0; i < n-1; i++ {
+			if err := tx.AddEdge(fmt.Sprint("n", i), fmt.Sprint("n", i+1)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		T.Fatal(err)
+	}
+
+	// Every expansion is slow, so a traversal that isn't stopped runs for a second.
+	var expanded atomic.Int64
+	h := &graphHandler{g: graph, onExpand: func(node string, depth int) {
+		expanded.Add(1)
+		time.Sleep(time.Millisecond)
+	}}
+	client := serveGraph(T, h, MaxCallDuration(50*time.Millisecond)...)
+	stopsMidway := func(ctx context.Context) {
+		T.Helper()
+		expanded.Store(0)
+		start := time.Now()
+		_, err := client.BFS(ctx, &TraversalRequest{Start: "n0"})
+		if status.Code(err) != codes.DeadlineExceeded || time.Since(start) > time.Second/2 {
+			T.Fatal("expected DeadlineExceeded within the deadline, got ", err, " after ", time.Since(start))
+		}
+		stopped := expanded.Load()
+		time.Sleep(20 * time.Millisecond)
+		if count := expanded.Load(); count != stopped || count == 0 || count >= n {
+			T.Fatal("traversal not stopped mid-way, expanded ", stopped, " then ", count)
+		}
+	}
+
+	// The server caps the deadline the client asks for, and applies the call deadline below it.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	stopsMidway(ctx)
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	stopsMidway(ctx)
+
+	resp, err := client.BFS(context.Background(), &TraversalRequest{Start: "n0", MaxDepth: 3})
+	if err != nil || len(resp.Order) != 4 {
+		T.Fatal("expected a short traversal to complete, got ", resp, err)
+	}
+
+	// Streams end at the maximum duration too.
+	stream, err := client.ApplyBatchStream(context.Background())
+	if err != nil {
+		T.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := stream.Recv(); status.Code(err) != codes.DeadlineExceeded {
+		T.Fatal("expected the stream to end with DeadlineExceeded, got ", err)
+	}
+}
@@ -0,0 +1,115 @@
+package onyxgrpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/Dynaclo/Onyx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// Services of the health checking service registered by RegisterHealth, for the service
+// field of a probe. The empty service is the liveness service too.
+const (
+	LivenessService  = "liveness"
+	ReadinessService = "readiness"
+)
+
+// watchInterval is how often Watch runs the checks of its service.
+const watchInterval = time.Second
+
+// HealthOption configures RegisterHealth.
+type HealthOption func(*healthServer)
+
+// WithReadinessCheck adds a check named name to the readiness service. It returns nil when
+// the check passes, and runs on every probe, so it must be cheap and must not write.
+func WithReadinessCheck(name string, check func(ctx context.Context) error) HealthOption {
+	return func(s *healthServer) {
+		s.checks = append(s.checks, Onyx.HealthCheck{Name: name, Check: check})
+	}
+}
+
+// WithMaxReplicationLag sets the replication lag above which a follower isn't ready,
+// Onyx.DefaultMaxReplicationLag by default.
+func WithMaxReplicationLag(lag time.Duration) HealthOption {
+	return func(s *healthServer) {
+		s.maxReplicationLag = lag
+	}
+}
+
+// RegisterHealth registers the standard gRPC health checking service on s, reporting the
+// health of g like the /healthz and /readyz endpoints of onyxhttp: LivenessService is
+// serving while g is open, ReadinessService while the checks of g.ReadinessChecks and
+// those added WithReadinessCheck pass.
+func RegisterHealth(s grpc.ServiceRegistrar, g *Onyx.Graph, opts ...HealthOption) {
+	server := &healthServer{g: g, maxReplicationLag: Onyx.DefaultMaxReplicationLag}
+	for _, opt := range opts {
+		opt(server)
+	}
+	healthpb.RegisterHealthServer(s, server)
+}
+
+type healthServer struct {
+	healthpb.UnimplementedHealthServer
+	g                 *Onyx.Graph
+	checks            []Onyx.HealthCheck
+	maxReplicationLag time.Duration
+}
+
+// status runs the checks of service.
+func (s *healthServer) status(ctx context.Context, service string) (healthpb.HealthCheckResponse_ServingStatus, error) {
+	var checks []Onyx.HealthCheck
+	switch service {
+	case "", LivenessService:
+		checks = s.g.LivenessChecks()
+	case ReadinessService:
+		checks = append(s.g.ReadinessChecks(s.maxReplicationLag), s.checks...)
+	default:
+		return 0, status.Errorf(codes.NotFound, "unknown service %q", service)
+	}
+	for _, c := range checks {
+		if c.Check(ctx) != nil {
+			return healthpb.HealthCheckResponse_NOT_SERVING, nil
+		}
+	}
+	return healthpb.HealthCheckResponse_SERVING, nil
+}
+
+func (s *healthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	serving, err := s.status(ctx, req.GetService())
+	if err != nil {
+		return nil, err
+	}
+	return &healthpb.HealthCheckResponse{Status: serving}, nil
+}
+
+// Watch sends the status of the service, then every change of it, checking every
+// watchInterval. An unknown service is reported as SERVICE_UNKNOWN.
+func (s *healthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	ctx := stream.Context()
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	last := healthpb.HealthCheckResponse_ServingStatus(-1)
+	for {
+		serving, err := s.status(ctx, req.GetService())
+		if status.Code(err) == codes.NotFound {
+			serving = healthpb.HealthCheckResponse_SERVICE_UNKNOWN
+		} else if err != nil {
+			return err
+		}
+		if serving != last {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: serving}); err != nil {
+				return err
+			}
+			last = serving
+		}
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-ticker.C:
+		}
+	}
+}
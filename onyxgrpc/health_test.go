@@ -0,0 +1,54 @@
+package onyxgrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/Dynaclo/Onyx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestHealth(T *testing.T) {
+	graph, _ := Onyx.NewGraph("", true)
+	warm := errors.New("cache is still warming up")
+	tcp, _ := net.Listen("tcp", "127.0.0.1:0")
+	server := grpc.NewServer()
+	RegisterHealth(server, graph, WithReadinessCheck("cache", func(ctx context.Context) error {
+		return warm
+	}))
+	go server.Serve(tcp)
+	defer server.Stop()
+	conn, _ := grpc.NewClient(tcp.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	check := func(service string, want healthpb.HealthCheckResponse_ServingStatus) {
+		T.Helper()
+		resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			T.Fatal(err)
+		}
+		if resp.Status != want {
+			T.Fatalf("service %q: expected %v, got %v", service, want, resp.Status)
+		}
+	}
+
+	check("", healthpb.HealthCheckResponse_SERVING)
+	check(LivenessService, healthpb.HealthCheckResponse_SERVING)
+	check(ReadinessService, healthpb.HealthCheckResponse_NOT_SERVING)
+	warm = nil
+	check(ReadinessService, healthpb.HealthCheckResponse_SERVING)
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "other"}); status.Code(err) != codes.NotFound {
+		T.Fatal("expected NotFound for an unknown service, got ", err)
+	}
+
+	graph.Close()
+	check(LivenessService, healthpb.HealthCheckResponse_NOT_SERVING)
+	check(ReadinessService, healthpb.HealthCheckResponse_NOT_SERVING)
+}
@@ -0,0 +1,203 @@
+// Package onyxgrpc serves an Onyx graph over gRPC: its health, see RegisterHealth, its
+// writes and traversals, see RegisterGraph and GraphClient, and its replication changelog,
+// so a Follower can run in another process:
+//
+//	onyx.Graph/ApplyBatch        apply a batch of mutations, atomically or chunked
+//	onyx.Graph/ApplyBatchStream  bidirectional stream of batches, each answered in order
+//	onyx.Graph/BFS               breadth first traversal, with the properties of the visited
+//	                             nodes if asked for
+//	onyx.Replication/Snapshot    server stream of the chunks of a full backup of the primary
+//	onyx.Replication/Changes     server stream of the change records after a version, ending
+//	                             with the version of the primary
+//
+// Messages are JSON with the "onyxjson" content subtype. A broken stream fails the Sync of
+// the follower, and the next one resumes after the last record it applied; the
+// grpc.ClientConn reconnects in between.
+package onyxgrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/Dynaclo/Onyx"
+	"google.golang.org/grpc"
+)
+
+const replicationService = "onyx.Replication"
+
+// snapshotChunkSize is the largest chunk of a backup sent in one message.
+const snapshotChunkSize = 64 << 10
+
+type snapshotRequest struct{}
+
+type snapshotChunk struct {
+	Data []byte `json:"data"`
+}
+
+type changesRequest struct {
+	Since uint64 `json:"since"`
+}
+
+// changesMessage is one message of a Changes stream: a record, or the last message with
+// the version of the primary or the Onyx.ErrVersionUnavailable the primary answered with.
+type changesMessage struct {
+	Record      *Onyx.ChangeRecord          `json:"record,omitempty"`
+	Head        uint64                      `json:"head,omitempty"`
+	Unavailable *Onyx.ErrVersionUnavailable `json:"unavailable,omitempty"`
+}
+
+// replicationServer is the HandlerType of the service, which grpc checks the
+// implementation against.
+type replicationServer interface {
+	snapshot(stream grpc.ServerStream) error
+	changes(stream grpc.ServerStream) error
+}
+
+var replicationServiceDesc = grpc.ServiceDesc{
+	ServiceName: replicationService,
+	HandlerType: (*replicationServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Snapshot",
+			ServerStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				return srv.(replicationServer).snapshot(stream)
+			},
+		},
+		{
+			StreamName:    "Changes",
+			ServerStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				return srv.(replicationServer).changes(stream)
+			},
+		},
+	},
+	Metadata: "onyxgrpc/replication.go",
+}
+
+// RegisterReplication registers the replication service of source on s.
+func RegisterReplication(s grpc.ServiceRegistrar, source *Onyx.ReplicationSource) {
+	s.RegisterService(&replicationServiceDesc, &sourceServer{source: source})
+}
+
+type sourceServer struct {
+	source *Onyx.ReplicationSource
+}
+
+func (s *sourceServer) snapshot(stream grpc.ServerStream) error {
+	if err := stream.RecvMsg(&snapshotRequest{}); err != nil {
+		return err
+	}
+	return s.source.Snapshot(stream.Context(), &chunkWriter{stream: stream})
+}
+
+// chunkWriter sends what is written to it as snapshot chunks of at most snapshotChunkSize.
+type chunkWriter struct {
+	stream grpc.ServerStream
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), snapshotChunkSize)]
+		if err := w.stream.SendMsg(&snapshotChunk{Data: chunk}); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (s *sourceServer) changes(stream grpc.ServerStream) error {
+	var req changesRequest
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	head, err := s.source.ChangesSince(stream.Context(), req.Since, func(record Onyx.ChangeRecord) error {
+		return stream.SendMsg(&changesMessage{Record: &record})
+	})
+	var unavailable *Onyx.ErrVersionUnavailable
+	if errors.As(err, &unavailable) {
+		return stream.SendMsg(&changesMessage{Unavailable: unavailable})
+	} else if err != nil {
+		return err
+	}
+	return stream.SendMsg(&changesMessage{Head: head})
+}
+
+// ErrTruncatedStream is returned when a Changes stream ends before the primary sent its version.
+var ErrTruncatedStream = errors.New("onyxgrpc: changes stream ended before the version of the primary")
+
+// NewChangeSource returns the Onyx.ChangeSource of the primary served on conn, for
+// Onyx.NewFollower.
+func NewChangeSource(conn grpc.ClientConnInterface) Onyx.ChangeSource {
+	return &remoteSource{conn: conn}
+}
+
+type remoteSource struct {
+	conn grpc.ClientConnInterface
+}
+
+func (s *remoteSource) open(ctx context.Context, method int, req any) (grpc.ClientStream, error) {
+	desc := &replicationServiceDesc.Streams[method]
+	stream, err := s.conn.NewStream(ctx, desc, "/"+replicationService+"/"+desc.StreamName, grpc.CallContentSubtype(codecName))
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return nil, err
+	}
+	return stream, stream.CloseSend()
+}
+
+func (s *remoteSource) Snapshot(ctx context.Context, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := s.open(ctx, 0, &snapshotRequest{})
+	if err != nil {
+		return err
+	}
+	for {
+		var chunk snapshotChunk
+		err := stream.RecvMsg(&chunk)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *remoteSource) ChangesSince(ctx context.Context, since uint64, fn func(record Onyx.ChangeRecord) error) (uint64, error) {
+	// Cancelling stops the stream when fn fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := s.open(ctx, 1, &changesRequest{Since: since})
+	if err != nil {
+		return 0, err
+	}
+	for {
+		var msg changesMessage
+		err := stream.RecvMsg(&msg)
+		if err == io.EOF {
+			return 0, ErrTruncatedStream
+		} else if err != nil {
+			return 0, err
+		}
+		switch {
+		case msg.Record != nil:
+			if err := fn(*msg.Record); err != nil {
+				return 0, err
+			}
+		case msg.Unavailable != nil:
+			return 0, msg.Unavailable
+		default:
+			return msg.Head, nil
+		}
+	}
+}
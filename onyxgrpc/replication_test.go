@@ -0,0 +1,184 @@
+package onyxgrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Dynaclo/Onyx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// breakingListener accepts connections that can be made to drop after writing some bytes.
+type breakingListener struct {
+	net.Listener
+	mu       sync.Mutex
+	conns    []*breakingConn
+	accepted atomic.Int32
+}
+
+func (l *breakingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.accepted.Add(1)
+	c := &breakingConn{Conn: conn}
+	l.mu.Lock()
+	l.conns = append(l.conns, c)
+	l.mu.Unlock()
+	return c, nil
+}
+
+// breakAfter makes every open connection close once it wrote n more bytes.
+func (l *breakingListener) breakAfter(n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range l.conns {
+		c.budget.Store(n)
+	}
+	l.conns = nil
+}
+
+type breakingConn struct {
+	net.Conn
+	// budget is how many bytes may still be written, or 0 for no limit. It is only set on
+	// idle connections, so a single writer uses it.
+	budget atomic.Int64
+}
+
+func (c *breakingConn) Write(p []byte) (int, error) {
+	budget := c.budget.Load()
+	if budget == 0 {
+		return c.Conn.Write(p)
+	}
+	if int64(len(p)) < budget {
+		c.budget.Add(-int64(len(p)))
+		return c.Conn.Write(p)
+	}
+	n, _ := c.Conn.Write(p[:budget])
+	c.Conn.Close()
+	return n, net.ErrClosed
+}
+
+func edgeSet(T *testing.T, g *Onyx.Graph) map[string]bool {
+	T.Helper()
+	edges := make(map[string]bool)
+	err := g.IterAllEdges(func(src string, dst string) error {
+		edges[src+"->"+dst] = true
+		return nil
+	}, 100, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	return edges
+}
+
+func TestReplicationResumesAfterBrokenConnection(T *testing.T) {
+	primary, _ := Onyx.NewGraph("", true, Onyx.WithChangelog())
+	defer primary.Close()
+	source, err := Onyx.NewReplicationSource(primary)
+	if err != nil {
+		T.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		_ = primary.AddEdge(fmt.Sprintf("n%d", i%5), fmt.Sprintf("m%d", i), nil)
+	}
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		T.Fatal(err)
+	}
+	lis := &breakingListener{Listener: tcp}
+	server := grpc.NewServer()
+	RegisterReplication(server, source)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient(tcp.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer conn.Close()
+
+	followerGraph, _ := Onyx.NewGraph(T.TempDir(), false)
+	defer followerGraph.Close()
+	follower := Onyx.NewFollower(followerGraph, NewChangeSource(conn), Onyx.FollowerOptions{RetryInterval: 10 * time.Millisecond})
+	if _, err := follower.Sync(context.Background()); err != nil {
+		T.Fatal(err)
+	}
+	if !reflect.DeepEqual(edgeSet(T, followerGraph), edgeSet(T, primary)) {
+		T.Fatal("full sync did not copy the primary")
+	}
+	synced := followerGraph.ReplicationStatus().Version
+
+	for i := 0; i < 200; i++ {
+		_ = primary.AddEdge(fmt.Sprintf("n%d", i%5), fmt.Sprintf("x%d", i), nil)
+	}
+	_, _ = primary.RemoveEdge("n1", "m1", nil)
+	_, _ = primary.RemoveNode("n2", nil)
+	head, _ := primary.CurrentVersion(nil)
+
+	// The connection drops after a few records were sent.
+	lis.breakAfter(20 << 10)
+	if _, err := follower.Sync(context.Background()); err == nil {
+		T.Fatal("expected the broken connection to fail the sync")
+	}
+	applied := followerGraph.ReplicationStatus().Version
+	if applied <= synced || applied >= head {
+		T.Fatalf("expected the stream to break mid-way, applied %d of %d..%d", applied, synced, head)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- follower.Run(ctx) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for followerGraph.ReplicationStatus().Version < head && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if lis.accepted.Load() < 2 {
+		T.Fatal("the follower did not reconnect")
+	}
+	if !reflect.DeepEqual(edgeSet(T, followerGraph), edgeSet(T, primary)) {
+		T.Fatal("follower did not converge to the primary")
+	}
+	if status := followerGraph.ReplicationStatus(); status.Version != head || status.LastError != nil {
+		T.Fatalf("unexpected status after resuming %+v", status)
+	}
+}
+
+func TestReplicationVersionUnavailable(T *testing.T) {
+	primary, _ := Onyx.NewGraph("", true, Onyx.WithChangelog())
+	defer primary.Close()
+	source, _ := Onyx.NewReplicationSource(primary)
+	_ = primary.AddEdge("a", "b", nil)
+	time.Sleep(time.Millisecond)
+	_ = primary.AddEdge("a", "c", nil)
+	if _, err := primary.PruneChangelog(time.Now()); err != nil {
+		T.Fatal(err)
+	}
+
+	tcp, _ := net.Listen("tcp", "127.0.0.1:0")
+	server := grpc.NewServer()
+	RegisterReplication(server, source)
+	go server.Serve(tcp)
+	defer server.Stop()
+	conn, _ := grpc.NewClient(tcp.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer conn.Close()
+
+	_, err := NewChangeSource(conn).ChangesSince(context.Background(), 0, func(Onyx.ChangeRecord) error { return nil })
+	var unavailable *Onyx.ErrVersionUnavailable
+	if !errors.As(err, &unavailable) || unavailable.Earliest == 0 {
+		T.Fatal("expected ErrVersionUnavailable from the primary, got ", err)
+	}
+}
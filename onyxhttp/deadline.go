@@ -0,0 +1,43 @@
+package onyxhttp
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// StatusClientClosedRequest is the status of the requests whose client went away before the
+// response was ready. No one reads it, but it shows in access logs and metrics.
+const StatusClientClosedRequest = 499
+
+// WithMaxRequestDuration caps how long a request may run, whatever timeout the client asks
+// for with the timeout query parameter. Traversals past it stop with 504. 0, the default,
+// only applies the client's timeout.
+func WithMaxRequestDuration(d time.Duration) Option {
+	return func(h *Handler) {
+		h.maxRequestDuration = d
+	}
+}
+
+// withDeadline runs next with the context of r limited by the timeout query parameter, a Go
+// duration such as 500ms, and by WithMaxRequestDuration. The context of r is already cancelled
+// when the client disconnects.
+func (h *Handler) withDeadline(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	timeout := h.maxRequestDuration
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "timeout must be a positive duration"})
+			return
+		}
+		if timeout == 0 || d < timeout {
+			timeout = d
+		}
+	}
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	next.ServeHTTP(w, r)
+}
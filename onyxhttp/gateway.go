@@ -0,0 +1,188 @@
+package onyxhttp
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Dynaclo/Onyx"
+)
+
+// DefaultCacheEntries is the number of responses a Gateway caches.
+const DefaultCacheEntries = 1024
+
+// WithCacheEntries sets how many rendered responses a Gateway caches, DefaultCacheEntries by
+// default. The least recently used responses are evicted first.
+func WithCacheEntries(entries int) Option {
+	return func(h *Handler) {
+		h.cacheEntries = entries
+	}
+}
+
+// Gateway is a read-only http.Handler for dashboard traffic. It serves the GET endpoints of
+// Handler, /nodes/{id}/edges, /nodes/{id}/in-edges, /nodes/{id}/properties, /nodes/{id}/bfs,
+// /stats and the probes, answering other methods on them with 405; the write routes of Handler
+// don't exist in a Gateway.
+//
+// Successful responses carry an ETag made of the graph's generation, see Onyx.Graph.Generation,
+// and are cached by path, query and generation, so repeated reads between two commits are
+// rendered once and conditional requests with a matching If-None-Match get a 304. Every commit,
+// including the graph's own bookkeeping writes, moves to a new generation and so misses the
+// cache. With a snapshot pool the responses may be behind the latest commits, by at most the
+// number of seconds in the Onyx-Max-Staleness header, see Onyx.WithSnapshotPool.
+type Gateway struct {
+	h     *Handler
+	mux   *http.ServeMux
+	cache *responseCache
+}
+
+func NewGateway(g *Onyx.Graph, opts ...Option) *Gateway {
+	h := NewHandler(g, opts...)
+	if h.cacheEntries <= 0 {
+		h.cacheEntries = DefaultCacheEntries
+	}
+	gw := &Gateway{h: h, mux: http.NewServeMux(), cache: newResponseCache(h.cacheEntries)}
+	gw.mux.HandleFunc("GET /nodes/{id}/edges", gw.cached(h.getEdges))
+	gw.mux.HandleFunc("GET /nodes/{id}/in-edges", gw.cached(h.getInEdges))
+	gw.mux.HandleFunc("GET /nodes/{id}/properties", gw.cached(h.getProperties))
+	gw.mux.HandleFunc("GET /nodes/{id}/bfs", gw.cached(h.bfs))
+	gw.mux.HandleFunc("GET /stats", gw.cached(h.stats))
+	gw.mux.HandleFunc("GET /healthz", h.healthz)
+	gw.mux.HandleFunc("GET /readyz", h.readyz)
+	return gw
+}
+
+func (gw *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	gw.h.withDeadline(w, r, gw.mux)
+}
+
+// cached serves the responses of handler from the cache, rendering and caching the ones
+// that aren't in it.
+func (gw *Gateway) cached(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The generation is read before rendering, so a response is never older than its
+		// generation. It may be newer if the data changed in between, which only costs a
+		// cache miss at the next generation.
+		generation, err := gw.h.g.Generation()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		etag := `"` + strconv.FormatUint(generation, 10) + `"`
+		w.Header().Set("Cache-Control", "no-cache")
+		if staleness := gw.h.g.MaxStaleness(); staleness > 0 {
+			w.Header().Set("Onyx-Max-Staleness", strconv.FormatFloat(staleness.Seconds(), 'f', -1, 64))
+		}
+
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		// The timeout doesn't change the response, only whether there is one.
+		query := r.URL.Query()
+		query.Del("timeout")
+		key := cacheKey{uri: r.URL.Path + "?" + query.Encode(), generation: generation}
+		body, ok := gw.cache.get(key)
+		if !ok {
+			rec := &responseRecorder{header: make(http.Header), status: http.StatusOK}
+			handler(rec, r)
+			if rec.status != http.StatusOK {
+				for name, values := range rec.header {
+					w.Header()[name] = values
+				}
+				w.WriteHeader(rec.status)
+				w.Write(rec.body.Bytes())
+				return
+			}
+			body = rec.body.Bytes()
+			gw.cache.add(key, body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag)
+		w.Write(body)
+	}
+}
+
+// etagMatches reports whether the If-None-Match header value header lists etag.
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// responseRecorder buffers a response so it can be cached before it is written.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+type cacheKey struct {
+	uri        string
+	generation uint64
+}
+
+// responseCache is a bounded LRU of rendered response bodies. Entries of past generations are
+// never hit again and age out.
+type responseCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[cacheKey]*list.Element
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	body []byte
+}
+
+func newResponseCache(capacity int) *responseCache {
+	return &responseCache{capacity: capacity, order: list.New(), entries: make(map[cacheKey]*list.Element)}
+}
+
+func (c *responseCache) get(key cacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).body, true
+}
+
+func (c *responseCache) add(key cacheKey, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		e.Value.(*cacheEntry).body = body
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, body: body})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
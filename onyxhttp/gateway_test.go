@@ -0,0 +1,143 @@
+package onyxhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Dynaclo/Onyx"
+)
+
+func TestGateway(T *testing.T) {
+	graph, err := Onyx.NewGraph("", true)
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer graph.Close()
+	_ = graph.AddEdge("a", "b", nil)
+	gateway := NewGateway(graph)
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	get := func(path string, etag string, wantStatus int, v any) string {
+		T.Helper()
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			T.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			T.Fatalf("GET %s: expected status %d, got %d", path, wantStatus, resp.StatusCode)
+		}
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				T.Fatal(err)
+			}
+		}
+		return resp.Header.Get("ETag")
+	}
+
+	var edges edgesResponse
+	etag := get("/nodes/a/edges", "", http.StatusOK, &edges)
+	if etag == "" || !reflect.DeepEqual(edges.Edges, []string{"b"}) {
+		T.Fatal("unexpected response ", etag, edges)
+	}
+	if get("/nodes/a/edges", etag, http.StatusNotModified, nil) != etag {
+		T.Fatal("304 without the ETag")
+	}
+	if get("/nodes/a/edges", "", http.StatusOK, nil) != etag {
+		T.Fatal("ETag changed without a mutation")
+	}
+	if len(gateway.cache.entries) != 1 {
+		T.Fatal("expected one cached response, got ", len(gateway.cache.entries))
+	}
+
+	if err := graph.AddEdge("a", "c", nil); err != nil {
+		T.Fatal(err)
+	}
+	edges = edgesResponse{}
+	newEtag := get("/nodes/a/edges", etag, http.StatusOK, &edges)
+	if newEtag == etag || !reflect.DeepEqual(edges.Edges, []string{"b", "c"}) {
+		T.Fatal("stale response after a mutation ", newEtag, edges)
+	}
+	get("/nodes/a/edges", newEtag, http.StatusNotModified, nil)
+
+	// Errors are neither cached nor tagged, and writes aren't served.
+	if get("/nodes/missing/edges", "", http.StatusNotFound, nil) != "" {
+		T.Fatal("error response with an ETag")
+	}
+	for path, want := range map[string]int{"/edges/a/d": http.StatusNotFound, "/nodes/a/edges": http.StatusMethodNotAllowed} {
+		req, _ := http.NewRequest("PUT", server.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			T.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			T.Fatal("PUT ", path, ": expected status ", want, ", got ", resp.StatusCode)
+		}
+	}
+	if ok, _ := graph.HasEdge("a", "d", nil); ok {
+		T.Fatal("gateway applied a write")
+	}
+
+	var stats statsResponse
+	get("/stats", "", http.StatusOK, &stats)
+	if stats.Generation == 0 || stats.Nodes != nil {
+		T.Fatal("unexpected stats before a drift snapshot ", stats)
+	}
+	if _, err := graph.TakeDriftSnapshot(Onyx.DriftOptions{}); err != nil {
+		T.Fatal(err)
+	}
+	get("/stats", "", http.StatusOK, &stats)
+	if stats.Nodes == nil || *stats.Nodes != 1 || *stats.Edges != 2 {
+		T.Fatal("unexpected stats ", stats)
+	}
+}
+
+func TestGatewayStaleness(T *testing.T) {
+	graph, err := Onyx.NewGraph("", true, Onyx.WithSnapshotPool(time.Hour))
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer graph.Close()
+	_ = graph.AddEdge("a", "b", nil)
+	server := httptest.NewServer(NewGateway(graph))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/nodes/a/edges")
+	if err != nil {
+		T.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Onyx-Max-Staleness") != "3600" {
+		T.Fatal("unexpected staleness bound ", resp.Header.Get("Onyx-Max-Staleness"))
+	}
+}
+
+func TestResponseCache(T *testing.T) {
+	cache := newResponseCache(2)
+	for i := 0; i < 3; i++ {
+		cache.add(cacheKey{uri: fmt.Sprint("/", i)}, []byte{byte(i)})
+		if i == 1 {
+			cache.get(cacheKey{uri: "/0"})
+		}
+	}
+	if _, ok := cache.get(cacheKey{uri: "/1"}); ok {
+		T.Fatal("least recently used entry not evicted")
+	}
+	if body, ok := cache.get(cacheKey{uri: "/0"}); !ok || body[0] != 0 {
+		T.Fatal("recently used entry evicted")
+	}
+	if _, ok := cache.get(cacheKey{uri: "/2", generation: 1}); ok {
+		T.Fatal("entry of another generation hit")
+	}
+}
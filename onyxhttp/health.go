@@ -0,0 +1,68 @@
+package onyxhttp
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/Dynaclo/Onyx"
+)
+
+// DefaultMaxReplicationLag is the replication lag above which a follower isn't ready.
+const DefaultMaxReplicationLag = Onyx.DefaultMaxReplicationLag
+
+// Option configures a Handler.
+type Option func(*Handler)
+
+// ReadinessCheck is a check /readyz runs in addition to the built-in ones, see
+// Onyx.Graph.ReadinessChecks. It returns nil when the check passes. Checks run on every
+// probe, so they must be cheap and must not write.
+type ReadinessCheck func(ctx context.Context) error
+
+// WithReadinessCheck adds a check named name to /readyz.
+func WithReadinessCheck(name string, check ReadinessCheck) Option {
+	return func(h *Handler) {
+		h.checks = append(h.checks, Onyx.HealthCheck{Name: name, Check: check})
+	}
+}
+
+// WithMaxReplicationLag sets the replication lag above which a follower isn't ready,
+// DefaultMaxReplicationLag by default.
+func WithMaxReplicationLag(lag time.Duration) Option {
+	return func(h *Handler) {
+		h.maxReplicationLag = lag
+	}
+}
+
+type healthResponse struct {
+	Status string `json:"status"`
+	// Checks maps every check to "ok" or the reason it failed.
+	Checks map[string]string `json:"checks"`
+}
+
+// healthz reports whether the process is serving and the graph is open.
+func (h *Handler) healthz(w http.ResponseWriter, r *http.Request) {
+	h.writeHealth(w, h.g.LivenessChecks(), r.Context())
+}
+
+// readyz reports whether the graph is open, recovered, migrated and, for followers, caught up,
+// and whether the checks added WithReadinessCheck pass.
+func (h *Handler) readyz(w http.ResponseWriter, r *http.Request) {
+	h.writeHealth(w, append(h.g.ReadinessChecks(h.maxReplicationLag), h.checks...), r.Context())
+}
+
+func (h *Handler) writeHealth(w http.ResponseWriter, checks []Onyx.HealthCheck, ctx context.Context) {
+	resp := healthResponse{Status: "ok", Checks: make(map[string]string, len(checks))}
+	status := http.StatusOK
+	for _, c := range checks {
+		if err := c.Check(ctx); err != nil {
+			resp.Checks[c.Name] = err.Error()
+			resp.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		resp.Checks[c.Name] = "ok"
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, resp)
+}
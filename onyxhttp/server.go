@@ -0,0 +1,374 @@
+// Package onyxhttp serves an Onyx graph over HTTP with a small JSON API:
+//
+//	GET    /nodes/{id}/edges       out-neighbors of a node, ?limit= and ?after= page through them
+//	GET    /nodes/{id}/in-edges    in-neighbors of a node, needs a reverse edge index
+//	GET    /nodes/{id}/properties  node properties, with the type hints of ExportJSON
+//	GET    /nodes/{id}/bfs         breadth first traversal, ?depth= limits the hops, ?fanout= and
+//	                               ?max-degree= the expansion of high degree nodes,
+//	                               ?include_properties=true adds the properties of the visited
+//	                               nodes, restricted to a comma separated ?properties= list
+//	GET    /stats                  generation and the node and edge counts of the latest drift snapshot
+//	PUT    /edges/{from}/{to}      add an edge
+//	DELETE /edges/{from}/{to}      remove an edge
+//	POST   /batch                  apply a JSON array of Onyx.Mutation, ?atomic=false to chunk it
+//	POST   /queries/{name}/run     run a saved query, the body is a JSON object of its parameters
+//	GET    /healthz                liveness: the graph is open
+//	GET    /readyz                 readiness: open, recovered, migrated and caught up, see WithReadinessCheck
+//
+// Every route takes a ?timeout= duration capped by WithMaxRequestDuration. Traversals stop
+// when it passes, with 504, or when the client disconnects, with StatusClientClosedRequest.
+//
+// The Handler has no routes outside of these, so it can be mounted in an existing mux
+// with http.StripPrefix. Gateway serves the GET routes alone, with caching and ETags.
+package onyxhttp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Dynaclo/Onyx"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Handler is an http.Handler serving one graph.
+type Handler struct {
+	g   *Onyx.Graph
+	mux *http.ServeMux
+
+	checks             []Onyx.HealthCheck
+	maxReplicationLag  time.Duration
+	cacheEntries       int
+	maxRequestDuration time.Duration
+	// onExpand is the TraversalOptions.OnExpand of traversals, for tests.
+	onExpand func(node string, depth int)
+}
+
+func NewHandler(g *Onyx.Graph, opts ...Option) *Handler {
+	h := &Handler{g: g, mux: http.NewServeMux(), maxReplicationLag: DefaultMaxReplicationLag}
+	for _, opt := range opts {
+		opt(h)
+	}
+	h.mux.HandleFunc("GET /nodes/{id}/edges", h.getEdges)
+	h.mux.HandleFunc("GET /nodes/{id}/in-edges", h.getInEdges)
+	h.mux.HandleFunc("GET /nodes/{id}/properties", h.getProperties)
+	h.mux.HandleFunc("GET /nodes/{id}/bfs", h.bfs)
+	h.mux.HandleFunc("GET /stats", h.stats)
+	h.mux.HandleFunc("PUT /edges/{from}/{to}", h.addEdge)
+	h.mux.HandleFunc("DELETE /edges/{from}/{to}", h.removeEdge)
+	h.mux.HandleFunc("POST /batch", h.batch)
+	h.mux.HandleFunc("POST /queries/{name}/run", h.runQuery)
+	h.mux.HandleFunc("GET /healthz", h.healthz)
+	h.mux.HandleFunc("GET /readyz", h.readyz)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.withDeadline(w, r, h.mux)
+}
+
+type edgesResponse struct {
+	Node  string   `json:"node"`
+	Edges []string `json:"edges"`
+	// Next is the after parameter of the next page, empty on the last page.
+	Next string `json:"next,omitempty"`
+}
+
+type statsResponse struct {
+	Generation uint64 `json:"generation"`
+	// Nodes and Edges are counted by the latest drift snapshot, taken at CountedAt, and are
+	// omitted if no snapshot was taken, see Onyx.Graph.TakeDriftSnapshot.
+	Nodes     *int       `json:"nodes,omitempty"`
+	Edges     *int       `json:"edges,omitempty"`
+	CountedAt *time.Time `json:"counted_at,omitempty"`
+}
+
+type property struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// bfsResponse is a traversal. Truncated are the nodes the expansion limits didn't fully
+// expand, sorted: the traversal is partial unless it is empty. Properties is only set with
+// ?include_properties=true, and has an entry for every visited node.
+type bfsResponse struct {
+	Order      []string                       `json:"order"`
+	Depth      map[string]int                 `json:"depth"`
+	Truncated  []string                       `json:"truncated"`
+	Properties map[string]map[string]property `json:"properties,omitempty"`
+}
+
+// batchResponse reports how many mutations of a batch were applied, and how many were
+// rejected by write policies. Results has the outcome of every mutation, in order, and is only
+// set for chunked batches.
+type batchResponse struct {
+	Applied  int           `json:"applied"`
+	Rejected int           `json:"rejected,omitempty"`
+	Results  []batchResult `json:"results,omitempty"`
+}
+
+type batchResult struct {
+	OK     bool   `json:"ok"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (h *Handler) getEdges(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "limit must be a positive integer"})
+			return
+		}
+		page, next, err := h.g.GetEdgesPage(id, r.URL.Query().Get("after"), n, nil)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, edgesResponse{Node: id, Edges: page, Next: next})
+		return
+	}
+	dstNodes, err := h.g.GetEdges(id, nil)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := edgesResponse{Node: id, Edges: make([]string, 0, len(dstNodes))}
+	for to := range dstNodes {
+		resp.Edges = append(resp.Edges, to)
+	}
+	sort.Strings(resp.Edges)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) getInEdges(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	srcNodes, err := h.g.GetInEdges(id, nil)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := edgesResponse{Node: id, Edges: make([]string, 0, len(srcNodes))}
+	for from := range srcNodes {
+		resp.Edges = append(resp.Edges, from)
+	}
+	sort.Strings(resp.Edges)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) stats(w http.ResponseWriter, r *http.Request) {
+	generation, err := h.g.Generation()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	report, err := h.g.DriftReport()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := statsResponse{Generation: generation}
+	if report != nil {
+		resp.Nodes, resp.Edges, resp.CountedAt = &report.Current.Nodes, &report.Current.Edges, &report.Current.Time
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) getProperties(w http.ResponseWriter, r *http.Request) {
+	props, err := h.g.GetNodeProperties(r.PathValue("id"), nil)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, encodeProperties(props))
+}
+
+// encodeProperties gives every property value the type hint of ExportJSON.
+func encodeProperties(props map[string][]byte) map[string]property {
+	encoded := make(map[string]property, len(props))
+	for name, value := range props {
+		if utf8.Valid(value) {
+			encoded[name] = property{Type: "string", Value: string(value)}
+		} else {
+			encoded[name] = property{Type: "base64", Value: base64.StdEncoding.EncodeToString(value)}
+		}
+	}
+	return encoded
+}
+
+func (h *Handler) bfs(w http.ResponseWriter, r *http.Request) {
+	var opts Onyx.TraversalOptions
+	for _, param := range []struct {
+		name   string
+		option *int
+	}{
+		{"depth", &opts.MaxDepth},
+		{"fanout", &opts.MaxFanoutPerNode},
+		{"max-degree", &opts.SkipNodesAboveDegree},
+	} {
+		if value := r.URL.Query().Get(param.name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: param.name + " must be a non-negative integer"})
+				return
+			}
+			*param.option = n
+		}
+	}
+	if include := r.URL.Query().Get("include_properties"); include != "" {
+		b, err := strconv.ParseBool(include)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "include_properties must be a boolean"})
+			return
+		}
+		opts.IncludeProperties = b
+	}
+	if names := r.URL.Query().Get("properties"); names != "" {
+		opts.PropertyAllowlist = strings.Split(names, ",")
+	}
+	opts.OnExpand = h.onExpand
+	result, err := h.g.BFSContext(r.Context(), r.PathValue("id"), opts, nil)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	truncated := make([]string, 0, len(result.Truncated))
+	for node := range result.Truncated {
+		truncated = append(truncated, node)
+	}
+	sort.Strings(truncated)
+	resp := bfsResponse{Order: result.Order, Depth: result.Depth, Truncated: truncated}
+	if result.Properties != nil {
+		resp.Properties = make(map[string]map[string]property, len(result.Properties))
+		for node, props := range result.Properties {
+			resp.Properties[node] = encodeProperties(props)
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) addEdge(w http.ResponseWriter, r *http.Request) {
+	if err := h.g.AddEdge(r.PathValue("from"), r.PathValue("to"), nil); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) removeEdge(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.g.RemoveEdge(r.PathValue("from"), r.PathValue("to"), nil); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) batch(w http.ResponseWriter, r *http.Request) {
+	atomic := true
+	if v := r.URL.Query().Get("atomic"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "atomic must be a boolean"})
+			return
+		}
+		atomic = b
+	}
+	var mutations []Onyx.Mutation
+	if err := json.NewDecoder(r.Body).Decode(&mutations); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "body must be a JSON array of mutations: " + err.Error()})
+		return
+	}
+
+	// ApplyBatch can't be stopped midway, so a client that gave up while sending the body
+	// doesn't get it applied at least.
+	if err := r.Context().Err(); err != nil {
+		writeError(w, err)
+		return
+	}
+	errs, err := h.g.ApplyBatch(mutations, atomic)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if atomic {
+		writeJSON(w, http.StatusOK, batchResponse{Applied: len(mutations)})
+		return
+	}
+	resp := batchResponse{Results: make([]batchResult, len(errs))}
+	for i, err := range errs {
+		if err != nil {
+			var rejection *Onyx.ErrPolicyRejected
+			if errors.As(err, &rejection) {
+				resp.Rejected++
+			}
+			resp.Results[i] = batchResult{Status: statusOf(err), Error: err.Error()}
+			continue
+		}
+		resp.Results[i] = batchResult{OK: true, Status: http.StatusOK}
+		resp.Applied++
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) runQuery(w http.ResponseWriter, r *http.Request) {
+	var params map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "body must be a JSON object of string parameters: " + err.Error()})
+		return
+	}
+	result, err := h.g.RunSavedQueryContext(r.Context(), r.PathValue("name"), params)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// statusOf maps errors of the graph API to HTTP status codes.
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, Onyx.ErrNodeNotFound), errors.Is(err, Onyx.ErrEdgeNotFound), errors.Is(err, badger.ErrKeyNotFound), errors.Is(err, Onyx.ErrQueryNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, Onyx.ErrInvalidNodeID), errors.Is(err, Onyx.ErrUnknownMutation), errors.Is(err, Onyx.ErrInvalidQuery):
+		return http.StatusBadRequest
+	case errors.Is(err, Onyx.ErrBatchTooBig):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, badger.ErrConflict):
+		return http.StatusConflict
+	case errors.As(err, new(*Onyx.ErrPolicyRejected)):
+		return http.StatusForbidden
+	case errors.Is(err, Onyx.ErrNoReverseIndex), errors.Is(err, Onyx.ErrReverseIndexNotReady):
+		return http.StatusNotImplemented
+	case errors.Is(err, context.Canceled):
+		return StatusClientClosedRequest
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, Onyx.ErrClosed):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, statusOf(err), errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,356 @@
+package onyxhttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Dynaclo/Onyx"
+)
+
+func TestHandler(T *testing.T) {
+	graph, err := Onyx.NewGraph("", true)
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer graph.Close()
+	_ = graph.SetNodeProperties("a", map[string][]byte{"name": []byte("Alice"), "raw": {0xff}}, nil)
+	server := httptest.NewServer(NewHandler(graph))
+	defer server.Close()
+
+	do := func(method string, path string, wantStatus int, v any) {
+		T.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			T.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			T.Fatalf("%s %s: expected status %d, got %d", method, path, wantStatus, resp.StatusCode)
+		}
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				T.Fatal(err)
+			}
+		}
+	}
+
+	do("PUT", "/edges/a/b", http.StatusNoContent, nil)
+	do("PUT", "/edges/a/c", http.StatusNoContent, nil)
+	do("PUT", "/edges/b/d", http.StatusNoContent, nil)
+	do("DELETE", "/edges/a/c", http.StatusNoContent, nil)
+
+	var edges edgesResponse
+	do("GET", "/nodes/a/edges", http.StatusOK, &edges)
+	if !reflect.DeepEqual(edges.Edges, []string{"b"}) {
+		T.Fatal("unexpected edges ", edges)
+	}
+	do("GET", "/nodes/missing/edges", http.StatusNotFound, nil)
+
+	do("PUT", "/edges/p/x", http.StatusNoContent, nil)
+	do("PUT", "/edges/p/y", http.StatusNoContent, nil)
+	var page edgesResponse
+	do("GET", "/nodes/p/edges?limit=1", http.StatusOK, &page)
+	if !reflect.DeepEqual(page.Edges, []string{"x"}) || page.Next == "" {
+		T.Fatal("unexpected first page ", page)
+	}
+	var last edgesResponse
+	do("GET", "/nodes/p/edges?limit=1&after="+page.Next, http.StatusOK, &last)
+	if !reflect.DeepEqual(last.Edges, []string{"y"}) || last.Next != "" {
+		T.Fatal("unexpected last page ", last)
+	}
+	do("GET", "/nodes/p/edges?limit=0", http.StatusBadRequest, nil)
+
+	var props map[string]property
+	do("GET", "/nodes/a/properties", http.StatusOK, &props)
+	if props["name"] != (property{Type: "string", Value: "Alice"}) || props["raw"] != (property{Type: "base64", Value: "/w=="}) {
+		T.Fatal("unexpected properties ", props)
+	}
+
+	var result bfsResponse
+	do("GET", "/nodes/a/bfs?depth=1", http.StatusOK, &result)
+	if !reflect.DeepEqual(result.Order, []string{"a", "b"}) {
+		T.Fatal("unexpected traversal ", result)
+	}
+	do("GET", "/nodes/a/bfs?depth=x", http.StatusBadRequest, nil)
+	if result.Truncated == nil || len(result.Truncated) != 0 {
+		T.Fatal("expected an empty truncated list ", result.Truncated)
+	}
+
+	do("PUT", "/edges/b/e", http.StatusNoContent, nil)
+	var limited bfsResponse
+	do("GET", "/nodes/a/bfs?fanout=1", http.StatusOK, &limited)
+	if len(limited.Order) != 3 || !reflect.DeepEqual(limited.Truncated, []string{"b"}) {
+		T.Fatal("unexpected traversal with a fanout limit ", limited)
+	}
+	do("GET", "/nodes/a/bfs?max-degree=1", http.StatusOK, &limited)
+	if !reflect.DeepEqual(limited.Order, []string{"a", "b"}) || !reflect.DeepEqual(limited.Truncated, []string{"b"}) {
+		T.Fatal("unexpected traversal skipping high degree nodes ", limited)
+	}
+	do("GET", "/nodes/a/bfs?fanout=-1", http.StatusBadRequest, nil)
+
+	var withProps bfsResponse
+	do("GET", "/nodes/a/bfs?depth=1&include_properties=true", http.StatusOK, &withProps)
+	if len(withProps.Properties) != 2 || withProps.Properties["a"]["raw"] != (property{Type: "base64", Value: "/w=="}) ||
+		withProps.Properties["b"] == nil || len(withProps.Properties["b"]) != 0 {
+		T.Fatal("unexpected traversal properties ", withProps.Properties)
+	}
+	withProps = bfsResponse{}
+	do("GET", "/nodes/a/bfs?depth=1&include_properties=true&properties=name", http.StatusOK, &withProps)
+	if !reflect.DeepEqual(withProps.Properties["a"], map[string]property{"name": {Type: "string", Value: "Alice"}}) {
+		T.Fatal("expected only the allowed properties ", withProps.Properties)
+	}
+	if result.Properties != nil {
+		T.Fatal("expected no properties without include_properties ", result.Properties)
+	}
+	do("GET", "/nodes/a/bfs?include_properties=maybe", http.StatusBadRequest, nil)
+}
+
+func TestBatch(T *testing.T) {
+	graph, err := Onyx.NewGraph("", true)
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer graph.Close()
+	server := httptest.NewServer(NewHandler(graph))
+	defer server.Close()
+
+	post := func(query string, body string, wantStatus int) batchResponse {
+		T.Helper()
+		resp, err := http.Post(server.URL+"/batch"+query, "application/json", strings.NewReader(body))
+		if err != nil {
+			T.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			T.Fatalf("POST /batch%s: expected status %d, got %d", query, wantStatus, resp.StatusCode)
+		}
+		var batch batchResponse
+		_ = json.NewDecoder(resp.Body).Decode(&batch)
+		return batch
+	}
+
+	body := `[{"op": "add_edge", "from": "a", "to": "b"}, {"op": "rename", "from": "a"}, {"op": "set_property", "from": "a", "name": "name", "value": "QWxpY2U="}]`
+	post("", body, http.StatusBadRequest)
+	if ok, _ := graph.HasEdge("a", "b", nil); ok {
+		T.Fatal("rejected atomic batch was applied")
+	}
+
+	batch := post("?atomic=false", body, http.StatusOK)
+	if batch.Applied != 2 || len(batch.Results) != 3 || !batch.Results[0].OK || batch.Results[1].Status != http.StatusBadRequest {
+		T.Fatal("unexpected chunked outcome ", batch)
+	}
+	if name, _ := graph.GetNodePropertyString("a", "name", nil); name != "Alice" {
+		T.Fatal("property not set ", name)
+	}
+
+	batch = post("", `[{"op": "remove_edge", "from": "a", "to": "b"}, {"op": "add_edge", "from": "b", "to": "c"}]`, http.StatusOK)
+	if batch.Applied != 2 || batch.Results != nil {
+		T.Fatal("unexpected atomic outcome ", batch)
+	}
+	post("", `{"op": "add_edge"}`, http.StatusBadRequest)
+}
+
+func TestBatchPolicyRejections(T *testing.T) {
+	graph, err := Onyx.NewGraph("", true)
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer graph.Close()
+	graph.RegisterWritePolicy(func(op Onyx.MutationOp, tx *Onyx.Tx) error {
+		if op.To == "blocked" {
+			return errors.New("blocked")
+		}
+		return nil
+	})
+	server := httptest.NewServer(NewHandler(graph))
+	defer server.Close()
+
+	body := `[{"op": "add_edge", "from": "a", "to": "b"}, {"op": "add_edge", "from": "a", "to": "blocked"}]`
+	resp, err := http.Post(server.URL+"/batch?atomic=false", "application/json", strings.NewReader(body))
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var batch batchResponse
+	_ = json.NewDecoder(resp.Body).Decode(&batch)
+	if batch.Applied != 1 || batch.Rejected != 1 || batch.Results[1].Status != http.StatusForbidden {
+		T.Fatal("unexpected outcome ", batch)
+	}
+}
+
+func TestProbes(T *testing.T) {
+	graph, err := Onyx.NewGraph("", true)
+	if err != nil {
+		T.Fatal(err)
+	}
+	warm := errors.New("cache is still warming up")
+	server := httptest.NewServer(NewHandler(graph, WithReadinessCheck("cache", func(ctx context.Context) error {
+		return warm
+	})))
+	defer server.Close()
+
+	probe := func(path string, wantStatus int) healthResponse {
+		T.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			T.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			T.Fatalf("GET %s: expected status %d, got %d", path, wantStatus, resp.StatusCode)
+		}
+		var health healthResponse
+		if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+			T.Fatal(err)
+		}
+		return health
+	}
+
+	probe("/healthz", http.StatusOK)
+	ready := probe("/readyz", http.StatusServiceUnavailable)
+	want := map[string]string{"db": "ok", "journal": "ok", "migrations": "ok", "replication": "ok", "cache": warm.Error()}
+	if ready.Status != "unavailable" || !reflect.DeepEqual(ready.Checks, want) {
+		T.Fatal("unexpected readiness ", ready)
+	}
+	warm = nil
+	probe("/readyz", http.StatusOK)
+
+	graph.Close()
+	if health := probe("/healthz", http.StatusServiceUnavailable); health.Checks["db"] != Onyx.ErrClosed.Error() {
+		T.Fatal("unexpected liveness of a closed graph ", health)
+	}
+}
+
+func TestRequestDeadlines(T *testing.T) {
+	graph, err := Onyx.NewGraph("", true)
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer graph.Close()
+	const n = 1000
+	err = graph.Update(func(tx *Onyx.Tx) error {
+		for i := 0; i < n-1; i++ {
+			if err := tx.AddEdge(fmt.Sprint("n", i), fmt.Sprint("n", i+1)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		T.Fatal(err)
+	}
+
+	// The client disconnects after 100 expansions, and every expansion after that is slow, so
+	// a traversal that isn't stopped runs for seconds.
+	h := NewHandler(graph)
+	ctx, disconnect := context.WithCancel(context.Background())
+	var expanded atomic.Int64
+	h.onExpand = func(node string, depth int) {
+		if count := expanded.Add(1); count == 100 {
+			disconnect()
+		} else if count > 100 {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		h.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/nodes/n0/bfs", nil)
+	if _, err := http.DefaultClient.Do(req); err == nil {
+		T.Fatal("expected the request to be cancelled")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		T.Fatal("traversal still running after the client disconnected")
+	}
+	if count := expanded.Load(); count > 150 {
+		T.Fatal("traversal expanded ", count, " nodes, 100 before the client disconnected")
+	}
+
+	rec := httptest.NewRecorder()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/nodes/n0/bfs", nil).WithContext(ctx))
+	if rec.Code != StatusClientClosedRequest {
+		T.Fatal("expected status 499 for a cancelled request, got ", rec.Code)
+	}
+
+	// The server caps the timeout the client asks for.
+	h = NewHandler(graph, WithMaxRequestDuration(50*time.Millisecond))
+	h.onExpand = func(node string, depth int) {
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/nodes/n0/bfs?timeout=1h", nil))
+	if rec.Code != http.StatusGatewayTimeout || time.Since(start) > time.Second/2 {
+		T.Fatal("expected a 504 within the maximum duration, got ", rec.Code, " after ", time.Since(start))
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/nodes/n0/bfs?timeout=soon", nil))
+	if rec.Code != http.StatusBadRequest {
+		T.Fatal("expected 400 for an invalid timeout, got ", rec.Code)
+	}
+	h.onExpand = nil
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/nodes/n0/bfs?depth=3&timeout=10s", nil))
+	if rec.Code != http.StatusOK {
+		T.Fatal("expected 200 within the timeout, got ", rec.Code)
+	}
+}
+
+func TestRunQuery(T *testing.T) {
+	graph, err := Onyx.NewGraph("", true)
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer graph.Close()
+	_ = graph.AddEdge("alice", "bob", nil)
+	_ = graph.AddEdge("bob", "carol", nil)
+	if err := graph.SaveQuery("reach", "bfs $user depth 1"); err != nil {
+		T.Fatal(err)
+	}
+	server := httptest.NewServer(NewHandler(graph))
+	defer server.Close()
+
+	post := func(path string, body string, wantStatus int) Onyx.QueryResult {
+		T.Helper()
+		resp, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			T.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			T.Fatalf("POST %s: expected status %d, got %d", path, wantStatus, resp.StatusCode)
+		}
+		var result Onyx.QueryResult
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		return result
+	}
+
+	result := post("/queries/reach/run", `{"user": "alice"}`, http.StatusOK)
+	if !reflect.DeepEqual(result.Nodes, []string{"alice", "bob"}) {
+		T.Fatal("unexpected result ", result)
+	}
+	result = post("/queries/reach/run", `{"user": "alice depth 5"}`, http.StatusOK)
+	if !reflect.DeepEqual(result.Nodes, []string{"alice depth 5"}) {
+		T.Fatal("parameter changed the query ", result)
+	}
+	post("/queries/reach/run", ``, http.StatusBadRequest)
+	post("/queries/reach/run", `["alice"]`, http.StatusBadRequest)
+	post("/queries/missing/run", `{}`, http.StatusNotFound)
+}
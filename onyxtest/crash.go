@@ -0,0 +1,158 @@
+// Package onyxtest helps testing code built on Onyx. RunCrashTest checks that an operation
+// survives a crash at any of its fault points: it crashes the operation at each of them in
+// turn, reopens the database so NewGraph recovers it, and checks an invariant.
+package onyxtest
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/Dynaclo/Onyx"
+)
+
+// Crash is where a run was crashed: the Hit-th time the operation reached the fault point
+// Point, from 1. The zero Crash is the run that wasn't crashed.
+type Crash struct {
+	Point string
+	Hit   int
+}
+
+func (c Crash) String() string {
+	if c.Point == "" {
+		return "no crash"
+	}
+	return fmt.Sprintf("%s #%d", c.Point, c.Hit)
+}
+
+// CrashTest describes the operation to crash.
+type CrashTest struct {
+	// Options are passed to every NewGraph. The graphs are always opened on disk.
+	Options []Onyx.Option
+	// Setup fills the graph before every run. It is never crashed.
+	Setup func(g *Onyx.Graph) error
+	// Run runs the operation. It must return the error it stopped with.
+	Run func(g *Onyx.Graph) error
+	// Check asserts the invariant on the graph reopened after crash, once NewGraph has
+	// recovered the journal.
+	Check func(g *Onyx.Graph, crash Crash) error
+}
+
+// faults crashes the run at one fault point. After the crash every fault point fails, so
+// nothing runs past it.
+type faults struct {
+	armed   bool
+	crashAt Crash
+	hits    map[string]int
+	order   []Crash
+	crashed bool
+}
+
+func (f *faults) fault(point string) error {
+	if !f.armed {
+		return nil
+	}
+	if f.crashed {
+		return fmt.Errorf("%w: %s, after the crash", Onyx.ErrFault, point)
+	}
+	f.hits[point]++
+	hit := Crash{Point: point, Hit: f.hits[point]}
+	f.order = append(f.order, hit)
+	if hit == f.crashAt {
+		f.crashed = true
+		return fmt.Errorf("%w: %s", Onyx.ErrFault, hit)
+	}
+	return nil
+}
+
+// RunCrashTest runs test once to completion to find the fault points its operation reaches,
+// and then once for each of them, crashing the operation there. Every run starts from a new
+// database filled by Setup, and is checked with Check after the database is reopened. The
+// failures are reported to t. It returns the crashes, in the order their points are reached.
+//
+// The crash closes the graph right after the operation returns. Committed transactions are
+// durable whether the process crashes or closes, so this is what a crash at the fault point
+// leaves on disk.
+func RunCrashTest(t testing.TB, test CrashTest) []Crash {
+	t.Helper()
+	dir := t.TempDir()
+
+	baseline := &faults{}
+	if err := runOnce(filepath.Join(dir, "baseline"), test, baseline); err != nil {
+		t.Fatalf("run without a crash: %v", err)
+		return nil
+	}
+	if len(baseline.order) == 0 {
+		t.Errorf("the operation reached no fault point")
+	}
+	for i, crash := range baseline.order {
+		f := &faults{crashAt: crash}
+		if err := runOnce(filepath.Join(dir, fmt.Sprint("crash", i)), test, f); err != nil {
+			t.Errorf("crash at %s: %v", crash, err)
+		}
+	}
+	return baseline.order
+}
+
+// runOnce runs test once on a new database in dir, crashing as f says.
+func runOnce(dir string, test CrashTest, f *faults) error {
+	f.hits = make(map[string]int)
+	opts := append([]Onyx.Option{Onyx.WithFaultPoints(f.fault)}, test.Options...)
+	g, err := Onyx.NewGraph(dir, false, opts...)
+	if err != nil {
+		return fmt.Errorf("opening: %w", err)
+	}
+	if test.Setup != nil {
+		if err := test.Setup(g); err != nil {
+			g.Close()
+			return fmt.Errorf("setup: %w", err)
+		}
+	}
+
+	f.armed = true
+	err = test.Run(g)
+	f.armed = false
+	crash := Crash{}
+	if f.crashAt.Point != "" {
+		if !f.crashed {
+			g.Close()
+			return fmt.Errorf("the fault point wasn't reached again, the fault points reached must not depend on timing")
+		}
+		if !errors.Is(err, Onyx.ErrFault) {
+			g.Close()
+			return fmt.Errorf("the operation didn't return the fault, got %v", err)
+		}
+		crash = f.crashAt
+	} else if err != nil {
+		g.Close()
+		return err
+	}
+	if err := g.Close(); err != nil && crash.Point == "" {
+		return fmt.Errorf("closing: %w", err)
+	}
+
+	g, err = Onyx.NewGraph(dir, false, test.Options...)
+	if err != nil {
+		return fmt.Errorf("reopening: %w", err)
+	}
+	defer g.Close()
+	if test.Check == nil {
+		return nil
+	}
+	return test.Check(g, crash)
+}
+
+// Intact returns an error describing the problems CheckIntegrity finds in g, such as journal
+// entries recovery didn't finish, or nil if there are none.
+func Intact(g *Onyx.Graph) error {
+	report, err := g.CheckIntegrity(nil)
+	if err != nil {
+		return err
+	}
+	if report.OK() {
+		return nil
+	}
+	first := report.Problems[0]
+	return fmt.Errorf("integrity check found %d problem(s), the first %q: %s", len(report.Problems), first.Key, first.Reason)
+}
@@ -0,0 +1,80 @@
+package onyxtest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/Dynaclo/Onyx"
+)
+
+func TestCrashRemoveNodesWithPrefix(T *testing.T) {
+	crashes := RunCrashTest(T, CrashTest{
+		Setup: func(g *Onyx.Graph) error {
+			for i := 0; i < 1200; i++ {
+				if err := g.AddEdge(fmt.Sprintf("p%04d", i), fmt.Sprintf("q%04d", i), nil); err != nil {
+					return err
+				}
+				if err := g.AddEdge(fmt.Sprintf("q%04d", i), fmt.Sprintf("p%04d", i), nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Run: func(g *Onyx.Graph) error {
+			_, err := g.RemoveNodesWithPrefix("p")
+			return err
+		},
+		Check: func(g *Onyx.Graph, crash Crash) error {
+			if err := Intact(g); err != nil {
+				return err
+			}
+			// The journal finishes the removal, so it is always fully applied.
+			for i := 0; i < 1200; i++ {
+				if edges, err := g.GetEdges(fmt.Sprintf("q%04d", i), nil); err != nil || len(edges) != 0 {
+					return fmt.Errorf("q%04d: edges %v, error %v", i, edges, err)
+				}
+				if _, err := g.GetEdges(fmt.Sprintf("p%04d", i), nil); err == nil {
+					return fmt.Errorf("p%04d wasn't removed", i)
+				}
+			}
+			return nil
+		},
+	})
+	// One point per batch: three of the nodes, three of the inbound edges.
+	if len(crashes) != 6 || crashes[5] != (Crash{Point: "RemoveNodesWithPrefix", Hit: 6}) {
+		T.Fatal("unexpected fault points ", crashes)
+	}
+}
+
+func TestCrashResolveRedirects(T *testing.T) {
+	crashes := RunCrashTest(T, CrashTest{
+		Setup: func(g *Onyx.Graph) error {
+			for i := 0; i < 600; i++ {
+				if err := g.AddEdge(fmt.Sprintf("n%04d", i), "a", nil); err != nil {
+					return err
+				}
+			}
+			return g.Redirect("a", "b", nil)
+		},
+		Run: func(g *Onyx.Graph) error {
+			_, err := g.ResolveRedirects(context.Background())
+			return err
+		},
+		Check: func(g *Onyx.Graph, crash Crash) error {
+			if err := Intact(g); err != nil {
+				return err
+			}
+			// Resolving isn't journaled, but edges read the same whether it ran or not.
+			for i := 0; i < 600; i++ {
+				if ok, err := g.HasEdge(fmt.Sprintf("n%04d", i), "b", nil); !ok || err != nil {
+					return fmt.Errorf("n%04d lost its edge to b: %v", i, err)
+				}
+			}
+			return nil
+		},
+	})
+	if len(crashes) != 3 || crashes[2].Point != "ResolveRedirects:markers" {
+		T.Fatal("unexpected fault points ", crashes)
+	}
+}
@@ -0,0 +1,28 @@
+package Onyx
+
+import "log/slog"
+
+// Option configures optional Graph behaviour and is passed as a trailing argument to NewGraph.
+type Option func(*Graph)
+
+// WithOpenCheck makes NewGraph verify the database before returning it. See CheckLevel.
+func WithOpenCheck(level CheckLevel) Option {
+	return func(g *Graph) {
+		g.openCheck = level
+	}
+}
+
+// WithLogger sets the logger the graph reports problems found in the background to, such as
+// drift alerts. Defaults to slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(g *Graph) {
+		g.logger = logger
+	}
+}
+
+func (g *Graph) log() *slog.Logger {
+	if g.logger == nil {
+		return slog.Default()
+	}
+	return g.logger
+}
@@ -0,0 +1,476 @@
+package Onyx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// The distance oracle estimates shortest path lengths without traversing the graph. It stores
+// the BFS distances from and to a sample of landmark nodes, and bounds the distance from a to
+// b with the triangle inequality through every landmark L:
+//
+//	d(a, L) + d(L, b) >= d(a, b) >= max(d(L, b) - d(L, a), d(a, L) - d(b, L))
+//
+// A landmark stores two distances per node it reaches or is reached from, so the oracle takes
+// about 2 * landmarks keys per node.
+
+// ErrNoDistanceOracle is returned when no distance oracle has been built, see
+// BuildDistanceOracle.
+var ErrNoDistanceOracle = errors.New("onyx: no distance oracle has been built")
+
+const metaOracleKey = "distance-oracle"
+
+// oracleState is the metadata of the distance oracle. A landmark is only listed once all its
+// distances are stored.
+type oracleState struct {
+	Seed int64
+	// Landmarks holds the generation every landmark was built at.
+	Landmarks map[string]uint64
+	BuiltAt   time.Time
+}
+
+// DistanceEstimate bounds the length of the shortest path between two nodes.
+type DistanceEstimate struct {
+	// Upper is the length of the shortest path through a landmark, -1 if no landmark is on
+	// a path from the first node to the second.
+	Upper int
+	// Lower is a lower bound of the distance, 0 if the landmarks give none.
+	Lower int
+	// Exact is set when Lower == Upper.
+	Exact bool
+	// Unreachable is set when the landmarks show there is no path at all.
+	Unreachable bool
+}
+
+type DistanceOracleStatus struct {
+	Seed    int64
+	BuiltAt time.Time
+	// Landmarks holds the generation every landmark was built at, see Generation.
+	Landmarks map[string]uint64
+	// Generation is the current generation.
+	Generation uint64
+	// ChangedNodes counts the edge lists written or removed since the oldest landmark was
+	// built, and Stale lists the landmarks built before the latest of those writes, sorted.
+	// RebuildLandmark brings a stale landmark up to date.
+	ChangedNodes int
+	Stale        []string
+}
+
+func oracleLandmarkPrefix(landmark string) []byte {
+	return []byte(oraclePrefix + landmark + keySep)
+}
+
+// oracleKey returns the key of the distance from landmark to node along out-edges, or from
+// node to landmark when direction is Incoming.
+func oracleKey(landmark string, direction EdgeDirection, node string) []byte {
+	dir := byte('o')
+	if direction == Incoming {
+		dir = 'i'
+	}
+	return append(append(oracleLandmarkPrefix(landmark), dir), node...)
+}
+
+func readOracleState(txn *badger.Txn) (*oracleState, error) {
+	item, err := txn.Get(metaKey(metaOracleKey))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state := &oracleState{}
+	err = item.Value(func(val []byte) error {
+		return gob.NewDecoder(bytes.NewReader(val)).Decode(state)
+	})
+	return state, err
+}
+
+// writeOracleState stores state as it is now: the state is encoded before the write, so the
+// chunked writer replays it unchanged.
+func writeOracleState(w *chunkedWriter, state *oracleState) error {
+	b := new(bytes.Buffer)
+	if err := gob.NewEncoder(b).Encode(state); err != nil {
+		return err
+	}
+	return w.do(func(txn *badger.Txn) error {
+		return txn.Set(metaKey(metaOracleKey), b.Bytes())
+	})
+}
+
+// readOracleDistance returns the distance stored for node under landmark, or -1.
+func readOracleDistance(txn *badger.Txn, landmark string, direction EdgeDirection, node string) (int, error) {
+	item, err := txn.Get(oracleKey(landmark, direction, node))
+	if err == badger.ErrKeyNotFound {
+		return -1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var d uint64
+	err = item.Value(func(val []byte) error {
+		var n int
+		if d, n = binary.Uvarint(val); n <= 0 {
+			return fmt.Errorf("onyx: invalid distance oracle value %v", val)
+		}
+		return nil
+	})
+	return int(d), err
+}
+
+// oracleGraph is the adjacency of the graph in both directions, with redirects resolved.
+type oracleGraph struct {
+	out   map[string][]string
+	in    map[string][]string
+	nodes []string
+}
+
+func (g *Graph) loadOracleGraph(txn *badger.Txn) (*oracleGraph, error) {
+	og := &oracleGraph{out: make(map[string][]string), in: make(map[string][]string)}
+	resolver := g.newRedirectResolver(txn)
+	err := forEachEdgeList(txn, func(from string, dstNodes map[string]bool) error {
+		og.nodes = append(og.nodes, from)
+		dstNodes, err := resolver.resolveNeighbors(dstNodes)
+		if err != nil {
+			return err
+		}
+		for _, to := range sortedNeighbors(dstNodes) {
+			og.out[from] = append(og.out[from], to)
+			og.in[to] = append(og.in[to], from)
+		}
+		return nil
+	})
+	return og, err
+}
+
+// distances returns the BFS distances from landmark along out-edges, or along in-edges when
+// direction is Incoming.
+func (og *oracleGraph) distances(landmark string, direction EdgeDirection) map[string]int {
+	adjacency := og.out
+	if direction == Incoming {
+		adjacency = og.in
+	}
+	dist := map[string]int{landmark: 0}
+	queue := []string{landmark}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, neighbor := range adjacency[node] {
+			if _, ok := dist[neighbor]; !ok {
+				dist[neighbor] = dist[node] + 1
+				queue = append(queue, neighbor)
+			}
+		}
+	}
+	return dist
+}
+
+// writeLandmark stores the distances of landmark and then lists it in state at generation.
+func writeLandmark(w *chunkedWriter, og *oracleGraph, state *oracleState, landmark string, generation uint64) error {
+	for _, direction := range []EdgeDirection{Outgoing, Incoming} {
+		dist := og.distances(landmark, direction)
+		nodes := make([]string, 0, len(dist))
+		for node := range dist {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		for _, node := range nodes {
+			err := w.do(func(txn *badger.Txn) error {
+				return txn.Set(oracleKey(landmark, direction, node), binary.AppendUvarint(nil, uint64(dist[node])))
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	state.Landmarks[landmark] = generation
+	return writeOracleState(w, state)
+}
+
+// deleteOracleKeys deletes the committed oracle keys starting with prefix.
+func deleteOracleKeys(w *chunkedWriter, prefix []byte) error {
+	var keys [][]byte
+	err := w.g.DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err := w.do(func(txn *badger.Txn) error {
+			return txn.Delete(key)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BuildDistanceOracle replaces the distance oracle with one of landmarks landmarks, sampled
+// uniformly among the nodes with an edge list using seed, so the same graph and seed give
+// the same landmarks. It loads the adjacency of the whole graph from one snapshot, whose
+// generation the landmarks are built at, runs a BFS from every landmark in both directions
+// and stores the distances in chunks of transactions. A landmark is only used once all its
+// distances are stored, so an interrupted build leaves a smaller oracle.
+func (g *Graph) BuildDistanceOracle(landmarks int, seed int64) error {
+	if landmarks <= 0 {
+		return errors.New("onyx: the distance oracle needs at least one landmark")
+	}
+	end, err := g.begin("BuildDistanceOracle")
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	txn := g.DB.NewTransaction(false)
+	og, err := g.loadOracleGraph(txn)
+	generation := txn.ReadTs()
+	txn.Discard()
+	if err != nil {
+		return err
+	}
+
+	// Reservoir sampling over the nodes in key order.
+	rng := rand.New(rand.NewSource(seed))
+	sample := make([]string, 0, landmarks)
+	for i, node := range og.nodes {
+		if len(sample) < landmarks {
+			sample = append(sample, node)
+		} else if j := rng.Intn(i + 1); j < landmarks {
+			sample[j] = node
+		}
+	}
+	sort.Strings(sample)
+
+	w := &chunkedWriter{g: g, point: "BuildDistanceOracle"}
+	defer w.discard()
+	err = w.do(func(txn *badger.Txn) error {
+		return txn.Delete(metaKey(metaOracleKey))
+	})
+	if err != nil {
+		return err
+	}
+	if err := deleteOracleKeys(w, []byte(oraclePrefix)); err != nil {
+		return err
+	}
+	state := &oracleState{Seed: seed, Landmarks: make(map[string]uint64), BuiltAt: time.Now()}
+	for _, landmark := range sample {
+		if err := writeLandmark(w, og, state, landmark, generation); err != nil {
+			return err
+		}
+	}
+	return w.commit()
+}
+
+// RebuildLandmark recomputes the distances of one landmark of the distance oracle on the
+// current graph, see DistanceOracleStatus.Stale. The other landmarks are left as they are.
+func (g *Graph) RebuildLandmark(landmark string) error {
+	landmark = g.nodeID(landmark)
+	end, err := g.begin("RebuildLandmark")
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	txn := g.DB.NewTransaction(false)
+	state, err := readOracleState(txn)
+	if err != nil || state == nil {
+		txn.Discard()
+		if err == nil {
+			err = ErrNoDistanceOracle
+		}
+		return err
+	}
+	if _, ok := state.Landmarks[landmark]; !ok {
+		txn.Discard()
+		return fmt.Errorf("onyx: %s is not a landmark of the distance oracle", landmark)
+	}
+	og, err := g.loadOracleGraph(txn)
+	generation := txn.ReadTs()
+	txn.Discard()
+	if err != nil {
+		return err
+	}
+
+	w := &chunkedWriter{g: g, point: "RebuildLandmark"}
+	defer w.discard()
+	delete(state.Landmarks, landmark)
+	err = writeOracleState(w, state)
+	if err != nil {
+		return err
+	}
+	if err := deleteOracleKeys(w, oracleLandmarkPrefix(landmark)); err != nil {
+		return err
+	}
+	if err := writeLandmark(w, og, state, landmark, generation); err != nil {
+		return err
+	}
+	return w.commit()
+}
+
+// DropDistanceOracle deletes the distance oracle.
+func (g *Graph) DropDistanceOracle() error {
+	end, err := g.begin("DropDistanceOracle")
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	w := &chunkedWriter{g: g, point: "DropDistanceOracle"}
+	defer w.discard()
+	err = w.do(func(txn *badger.Txn) error {
+		return txn.Delete(metaKey(metaOracleKey))
+	})
+	if err != nil {
+		return err
+	}
+	if err := deleteOracleKeys(w, []byte(oraclePrefix)); err != nil {
+		return err
+	}
+	return w.commit()
+}
+
+// ApproxDistance bounds the length of the shortest path from a to b with the distance
+// oracle, in four lookups per landmark. The bounds are exact when a or b is a landmark, or
+// lies on a shortest path through one. They are as old as the landmarks, see
+// DistanceOracleStatus: edges written since may make the real distance shorter or longer.
+func (g *Graph) ApproxDistance(a string, b string) (DistanceEstimate, error) {
+	a, b = g.nodeID(a), g.nodeID(b)
+	end, err := g.begin("ApproxDistance")
+	if err != nil {
+		return DistanceEstimate{}, err
+	}
+	defer end()
+	txn, release := g.readTxn()
+	defer release()
+
+	if a, err = g.resolveID(txn, a); err != nil {
+		return DistanceEstimate{}, err
+	}
+	if b, err = g.resolveID(txn, b); err != nil {
+		return DistanceEstimate{}, err
+	}
+	state, err := readOracleState(txn)
+	if err != nil {
+		return DistanceEstimate{}, err
+	}
+	if state == nil {
+		return DistanceEstimate{}, ErrNoDistanceOracle
+	}
+	if a == b {
+		return DistanceEstimate{Exact: true}, nil
+	}
+
+	estimate := DistanceEstimate{Upper: -1}
+	for landmark := range state.Landmarks {
+		var d [4]int // d(L, a), d(L, b), d(a, L), d(b, L)
+		lookups := []struct {
+			direction EdgeDirection
+			node      string
+		}{{Outgoing, a}, {Outgoing, b}, {Incoming, a}, {Incoming, b}}
+		for i, lookup := range lookups {
+			if d[i], err = readOracleDistance(txn, landmark, lookup.direction, lookup.node); err != nil {
+				return DistanceEstimate{}, err
+			}
+		}
+		fromA, toB, aTo, bTo := d[0], d[1], d[2], d[3]
+
+		if aTo >= 0 && toB >= 0 && (estimate.Upper < 0 || aTo+toB < estimate.Upper) {
+			estimate.Upper = aTo + toB
+		}
+		if fromA >= 0 && toB >= 0 {
+			estimate.Lower = max(estimate.Lower, toB-fromA)
+		} else if fromA >= 0 {
+			// b can't be reached from a, or it could be from L.
+			estimate.Unreachable = true
+		}
+		if aTo >= 0 && bTo >= 0 {
+			estimate.Lower = max(estimate.Lower, aTo-bTo)
+		} else if bTo >= 0 {
+			// a can't reach b, or it could reach L through b.
+			estimate.Unreachable = true
+		}
+	}
+	if estimate.Unreachable {
+		estimate.Upper, estimate.Lower = -1, 0
+	}
+	estimate.Exact = estimate.Upper >= 0 && estimate.Lower == estimate.Upper
+	return estimate, nil
+}
+
+// DistanceOracleStatus describes the distance oracle and how stale its landmarks are. It
+// scans the keys of every edge list, including those removed, without reading the values.
+func (g *Graph) DistanceOracleStatus() (*DistanceOracleStatus, error) {
+	end, err := g.begin("DistanceOracleStatus")
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	txn := g.DB.NewTransaction(false)
+	defer txn.Discard()
+
+	state, err := readOracleState(txn)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, ErrNoDistanceOracle
+	}
+	status := &DistanceOracleStatus{
+		Seed:       state.Seed,
+		BuiltAt:    state.BuiltAt,
+		Landmarks:  state.Landmarks,
+		Generation: txn.ReadTs(),
+	}
+	if len(state.Landmarks) == 0 {
+		return status, nil
+	}
+	oldest := uint64(0)
+	for _, generation := range state.Landmarks {
+		if oldest == 0 || generation < oldest {
+			oldest = generation
+		}
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.AllVersions = true
+	it := newNodeIterator(txn, opts)
+	defer it.Close()
+	var last []byte
+	latest := uint64(0)
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		// Versions of a key come newest first.
+		if bytes.Equal(item.Key(), last) {
+			continue
+		}
+		last = item.KeyCopy(last[:0])
+		if item.Version() > oldest {
+			status.ChangedNodes++
+			latest = max(latest, item.Version())
+		}
+	}
+	for landmark, generation := range state.Landmarks {
+		if generation < latest {
+			status.Stale = append(status.Stale, landmark)
+		}
+	}
+	sort.Strings(status.Stale)
+	return status, nil
+}
@@ -0,0 +1,201 @@
+package Onyx
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+type PageRankOptions struct {
+	// Damping is the probability of following an out-edge instead of teleporting. Defaults to 0.85.
+	Damping float64
+	// MaxIterations defaults to 100.
+	MaxIterations int
+	// Tolerance stops the iteration once the L1 change between iterations drops below it. Defaults to 1e-9.
+	Tolerance float64
+	// Weighted distributes the rank of a node along its out-edges in proportion to their weight.
+	// Edges without a weight count as 1.0 and nodes whose out-edges weigh 0 in total are treated as dangling.
+	Weighted bool
+	// TeleportLabel restricts random jumps (and the mass of dangling nodes) to nodes whose
+	// LabelProperty equals it. Empty means every node receives teleportation mass.
+	TeleportLabel string
+}
+
+var ErrNoTeleportNodes = errors.New("onyx: no node carries the pagerank teleport label")
+
+// PageRank computes the PageRank of every node in the graph. The ranks sum to 1.
+func (g *Graph) PageRank(opts PageRankOptions, txn *badger.Txn) (map[string]float64, error) {
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("PageRank")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	pr := newPageRankPass(txn, opts)
+	if err := forEachEdgeList(txn, pr.consume); err != nil {
+		return nil, err
+	}
+	return pr.finish()
+}
+
+// PageRankStage is PageRank as a stage of an AnalyticsPipeline. Its result is the
+// map[string]float64 of the ranks.
+func PageRankStage(opts PageRankOptions) AnalyticsStage {
+	return AnalyticsStage{
+		Name: "pagerank",
+		Pass: func(g *Graph, txn *badger.Txn) (func(string, map[string]bool) error, func() (any, error)) {
+			pr := newPageRankPass(txn, opts)
+			return pr.consume, func() (any, error) {
+				return pr.finish()
+			}
+		},
+	}
+}
+
+type pageRankEdge struct {
+	dst    int
+	weight float64
+}
+
+// pageRankPass collects the edge lists of one scan and iterates PageRank on them.
+type pageRankPass struct {
+	txn    *badger.Txn
+	opts   PageRankOptions
+	index  map[string]int
+	nodes  []string
+	out    [][]pageRankEdge
+	totals []float64
+}
+
+func newPageRankPass(txn *badger.Txn, opts PageRankOptions) *pageRankPass {
+	if opts.Damping == 0 {
+		opts.Damping = 0.85
+	}
+	if opts.MaxIterations == 0 {
+		opts.MaxIterations = 100
+	}
+	if opts.Tolerance == 0 {
+		opts.Tolerance = 1e-9
+	}
+	return &pageRankPass{txn: txn, opts: opts, index: make(map[string]int)}
+}
+
+func (pr *pageRankPass) nodeIndex(node string) int {
+	i, ok := pr.index[node]
+	if !ok {
+		i = len(pr.nodes)
+		pr.index[node] = i
+		pr.nodes = append(pr.nodes, node)
+	}
+	return i
+}
+
+func (pr *pageRankPass) consume(from string, dstNodes map[string]bool) error {
+	src := pr.nodeIndex(from)
+	var edges []pageRankEdge
+	total := 0.0
+	for _, to := range sortedNeighbors(dstNodes) {
+		weight := 1.0
+		if pr.opts.Weighted {
+			w, ok, err := readEdgeWeight(pr.txn, from, to)
+			if err != nil {
+				return err
+			}
+			if ok {
+				if w < 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+					return fmt.Errorf("onyx: edge %s->%s has invalid pagerank weight %v", from, to, w)
+				}
+				weight = w
+			}
+		}
+		edges = append(edges, pageRankEdge{dst: pr.nodeIndex(to), weight: weight})
+		total += weight
+	}
+	for len(pr.out) <= src {
+		pr.out = append(pr.out, nil)
+		pr.totals = append(pr.totals, 0)
+	}
+	pr.out[src] = edges
+	pr.totals[src] = total
+	return nil
+}
+
+func (pr *pageRankPass) finish() (map[string]float64, error) {
+	opts, nodes, out, totals := pr.opts, pr.nodes, pr.out, pr.totals
+	for len(out) < len(nodes) {
+		out = append(out, nil)
+		totals = append(totals, 0)
+	}
+
+	ranks := make(map[string]float64, len(nodes))
+	if len(nodes) == 0 {
+		return ranks, nil
+	}
+
+	teleport := make([]float64, len(nodes))
+	if opts.TeleportLabel == "" {
+		for i := range teleport {
+			teleport[i] = 1 / float64(len(nodes))
+		}
+	} else {
+		var labeled []int
+		for i, node := range nodes {
+			props, err := readNodeProperties(pr.txn, node, []string{LabelProperty})
+			if err != nil {
+				return nil, err
+			}
+			if string(props[LabelProperty]) == opts.TeleportLabel {
+				labeled = append(labeled, i)
+			}
+		}
+		if len(labeled) == 0 {
+			return nil, ErrNoTeleportNodes
+		}
+		for _, i := range labeled {
+			teleport[i] = 1 / float64(len(labeled))
+		}
+	}
+
+	rank := make([]float64, len(nodes))
+	copy(rank, teleport)
+	next := make([]float64, len(nodes))
+	for iter := 0; iter < opts.MaxIterations; iter++ {
+		dangling := 0.0
+		for i := range next {
+			next[i] = 0
+		}
+		for src, edges := range out {
+			if totals[src] == 0 {
+				dangling += rank[src]
+				continue
+			}
+			for _, e := range edges {
+				next[e.dst] += rank[src] * e.weight / totals[src]
+			}
+		}
+
+		delta := 0.0
+		for i := range next {
+			next[i] = opts.Damping*(next[i]+dangling*teleport[i]) + (1-opts.Damping)*teleport[i]
+			delta += math.Abs(next[i] - rank[i])
+		}
+		rank, next = next, rank
+		if delta < opts.Tolerance {
+			break
+		}
+	}
+
+	for i, node := range nodes {
+		ranks[node] = rank[i]
+	}
+
+	return ranks, nil
+}
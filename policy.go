@@ -0,0 +1,87 @@
+package Onyx
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// MutationOp is a write submitted to the write policies, see RegisterWritePolicy. Its IDs are
+// canonical: normalized, with redirects resolved.
+type MutationOp struct {
+	Kind MutationKind
+	From string
+	// To is the target of edge writes and edge properties, empty for node writes.
+	To string
+	// Name and Value are the property of MutationSetProperty.
+	Name  string
+	Value []byte
+}
+
+func (op MutationOp) String() string {
+	switch {
+	case op.Kind == MutationSetProperty && op.To != "":
+		return fmt.Sprintf("%s %s of %s->%s", op.Kind, op.Name, op.From, op.To)
+	case op.Kind == MutationSetProperty:
+		return fmt.Sprintf("%s %s of %s", op.Kind, op.Name, op.From)
+	case op.To != "":
+		return fmt.Sprintf("%s %s->%s", op.Kind, op.From, op.To)
+	default:
+		return fmt.Sprintf("%s %s", op.Kind, op.From)
+	}
+}
+
+// ErrPolicyRejected is returned by writes a write policy rejected. Err is the error the
+// policy returned, so errors.Is and errors.As see through it.
+type ErrPolicyRejected struct {
+	Op  MutationOp
+	Err error
+}
+
+func (e *ErrPolicyRejected) Error() string {
+	return fmt.Sprintf("onyx: write policy rejected %s: %v", e.Op, e.Err)
+}
+
+func (e *ErrPolicyRejected) Unwrap() error {
+	return e.Err
+}
+
+// RegisterWritePolicy adds fn to the policies that every write must pass. fn is called in the
+// transaction of the write, before it is applied to it: an error aborts the write with an
+// *ErrPolicyRejected wrapping it, and the transaction is not committed unless the caller of a
+// shared transaction ignores the error. tx reads through the transaction of the write, so
+// fn sees the writes made before in it, and must not write itself. Policies run in
+// registration order and the first error stops the others. Policies aren't persisted and
+// can't be unregistered.
+//
+// The writes checked are the edges added and removed by AddEdge, SetEdges, RemoveEdge(s) and
+// AddSourcedEdge, the edges removed with a node by RemoveNode and RemoveNodesWithPrefix, the
+// edges moved by Redirect and MergeNodes, the nodes created by MutationAddNode and ImportJSON,
+// and node and edge properties, including weights. ProjectBipartite and maintenance like
+// ResolveRedirects aren't.
+func (g *Graph) RegisterWritePolicy(fn func(op MutationOp, tx *Tx) error) {
+	g.policyMu.Lock()
+	defer g.policyMu.Unlock()
+	var policies []func(op MutationOp, tx *Tx) error
+	if current := g.policies.Load(); current != nil {
+		policies = append(policies, *current...)
+	}
+	policies = append(policies, fn)
+	g.policies.Store(&policies)
+}
+
+// checkWritePolicies runs the write policies on op in txn.
+func (g *Graph) checkWritePolicies(txn *badger.Txn, op MutationOp) error {
+	policies := g.policies.Load()
+	if policies == nil {
+		return nil
+	}
+	tx := &Tx{g: g, txn: txn, written: make(map[string]bool)}
+	for _, policy := range *policies {
+		if err := policy(op, tx); err != nil {
+			g.metrics.policyRejections.Add(1)
+			return &ErrPolicyRejected{Op: op, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+package Onyx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Node properties are stored one key per property so that single properties can be read
+// without loading every other (possibly large) property of the node.
+
+// SetNodeProperties sets the given properties of node, leaving its other properties untouched.
+func (g *Graph) SetNodeProperties(node string, props map[string][]byte, txn *badger.Txn) error {
+	node = g.nodeID(node)
+	if err := validateNodeID(node); err != nil {
+		return err
+	}
+
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("SetNodeProperties")
+		if err != nil {
+			return err
+		}
+		defer end()
+		txn = g.DB.NewTransaction(true)
+		defer txn.Discard()
+	}
+
+	if err := g.checkNotAlias(txn, node); err != nil {
+		return err
+	}
+	// Validate everything first so a rejected property doesn't leave the others half written in txn.
+	for name, value := range props {
+		err := validateProperty(txn, name, value)
+		if err != nil {
+			return err
+		}
+		err = g.checkWritePolicies(txn, MutationOp{Kind: MutationSetProperty, From: node, Name: name, Value: value})
+		if err != nil {
+			return err
+		}
+	}
+	for name, value := range props {
+		if value == nil {
+			value = []byte{}
+		}
+		err := updatePropertyIndex(txn, node, name, value)
+		if err != nil {
+			return err
+		}
+		err = txn.Set(nodePropKey(node, name), value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if localTxn {
+		err := txn.Commit()
+		if err != nil {
+			g.recordConflict(err, node)
+			return err
+		}
+	}
+	return nil
+}
+
+// GetNodeProperties returns all properties of node. A node without properties yields an empty map.
+func (g *Graph) GetNodeProperties(node string, txn *badger.Txn) (map[string][]byte, error) {
+	node = g.nodeID(node)
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("GetNodeProperties")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	props, err := readNodeProperties(txn, node, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return props, nil
+}
+
+func (g *Graph) RemoveNodeProperty(node string, name string, txn *badger.Txn) error {
+	node = g.nodeID(node)
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("RemoveNodeProperty")
+		if err != nil {
+			return err
+		}
+		defer end()
+		txn = g.DB.NewTransaction(true)
+		defer txn.Discard()
+	}
+
+	err := updatePropertyIndex(txn, node, name, nil)
+	if err != nil {
+		return err
+	}
+	err = txn.Delete(nodePropKey(node, name))
+	if err != nil {
+		return err
+	}
+
+	if localTxn {
+		err = txn.Commit()
+		if err != nil {
+			g.recordConflict(err, node)
+			return err
+		}
+	}
+	return nil
+}
+
+// readNodeProperties reads the properties of node. If names is non-empty only those
+// properties are read, with point lookups instead of a prefix scan.
+func readNodeProperties(txn *badger.Txn, node string, names []string) (map[string][]byte, error) {
+	props := make(map[string][]byte)
+
+	if len(names) > 0 {
+		for _, name := range names {
+			item, err := txn.Get(nodePropKey(node, name))
+			if err == badger.ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			value, err := copyPropertyValue(item)
+			if err != nil {
+				return nil, err
+			}
+			props[name] = value
+		}
+		return props, nil
+	}
+
+	prefix := nodePropKey(node, "")
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		value, err := copyPropertyValue(item)
+		if err != nil {
+			return nil, err
+		}
+		props[string(item.Key()[len(prefix):])] = value
+	}
+	return props, nil
+}
+
+// copyPropertyValue is item.ValueCopy, except that empty values are returned as a
+// non-nil empty slice so callers can tell them apart from missing properties.
+func copyPropertyValue(item *badger.Item) ([]byte, error) {
+	value, err := item.ValueCopy(nil)
+	if value == nil && err == nil {
+		value = []byte{}
+	}
+	return value, err
+}
+
+// multiGetNodeProperties reads the properties of every node in nodes within txn, like
+// readNodeProperties. The nodes are read in key order with a single iterator, seeking from one
+// to the next, so a traversal reads the properties of a whole frontier level in one pass.
+// Nodes without properties get an empty map.
+func multiGetNodeProperties(txn *badger.Txn, nodes []string, names []string) (map[string]map[string][]byte, error) {
+	nodes = slices.Clone(nodes)
+	slices.Sort(nodes)
+	names = slices.Clone(names)
+	slices.Sort(names)
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(nodePropPrefix)
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	result := make(map[string]map[string][]byte, len(nodes))
+	for _, node := range nodes {
+		props := make(map[string][]byte)
+		result[node] = props
+		if len(names) > 0 {
+			for _, name := range names {
+				key := nodePropKey(node, name)
+				if it.Seek(key); !it.Valid() || !bytes.Equal(it.Item().Key(), key) {
+					continue
+				}
+				value, err := copyPropertyValue(it.Item())
+				if err != nil {
+					return nil, err
+				}
+				props[name] = value
+			}
+			continue
+		}
+		prefix := nodePropKey(node, "")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			value, err := copyPropertyValue(item)
+			if err != nil {
+				return nil, err
+			}
+			props[string(item.Key()[len(prefix):])] = value
+		}
+	}
+	return result, nil
+}
+
+// Edge properties live in their own keyspace, so setting one doesn't touch the edge list of from.
+// They are removed together with the edge.
+
+// SetEdgeProperty sets the property name of the edge from->to, and fails with ErrEdgeNotFound
+// if the edge doesn't exist.
+func (g *Graph) SetEdgeProperty(from string, to string, name string, value []byte, txn *badger.Txn) error {
+	from, to = g.nodeID(from), g.nodeID(to)
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("SetEdgeProperty")
+		if err != nil {
+			return err
+		}
+		defer end()
+		txn = g.DB.NewTransaction(true)
+		defer txn.Discard()
+	}
+
+	dstNodes, _, err := readEdgeMap(txn, from)
+	if err != nil {
+		return err
+	}
+	if !dstNodes[to] {
+		return fmt.Errorf("%w: %s->%s", ErrEdgeNotFound, from, to)
+	}
+
+	if value == nil {
+		value = []byte{}
+	}
+	err = validateProperty(txn, name, value)
+	if err != nil {
+		return err
+	}
+	err = g.checkWritePolicies(txn, MutationOp{Kind: MutationSetProperty, From: from, To: to, Name: name, Value: value})
+	if err != nil {
+		return err
+	}
+	err = txn.Set(edgePropKey(from, to, name), value)
+	if err != nil {
+		return err
+	}
+
+	if localTxn {
+		err = txn.Commit()
+		if err != nil {
+			g.recordConflict(err, from)
+			return err
+		}
+	}
+	return nil
+}
+
+// GetEdgeProperties returns all properties of the edge from->to. An edge without properties yields an empty map.
+func (g *Graph) GetEdgeProperties(from string, to string, txn *badger.Txn) (map[string][]byte, error) {
+	from, to = g.nodeID(from), g.nodeID(to)
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("GetEdgeProperties")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	props := make(map[string][]byte)
+	prefix := edgePropKey(from, to, "")
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		value, err := copyPropertyValue(item)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		props[string(item.Key()[len(prefix):])] = value
+	}
+	it.Close()
+
+	return props, nil
+}
+
+// deleteEdgeProperties deletes the properties and the provenance of the edge from->to, which
+// every removal of an edge goes through.
+func deleteEdgeProperties(txn *badger.Txn, from string, to string) error {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = edgePropKey(from, to, "")
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	var keys [][]byte
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+	it.Close()
+
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return deleteEdgeProvenance(txn, from, to)
+}
+
+const (
+	// WeightProperty is the edge property holding the weight set by SetEdgeWeight.
+	WeightProperty = "weight"
+	// LabelProperty is the node property holding the label of a node.
+	LabelProperty = "label"
+)
+
+func (g *Graph) SetEdgeWeight(from string, to string, weight float64, txn *badger.Txn) error {
+	return g.SetEdgeProperty(from, to, WeightProperty, encodeFloat64(weight), txn)
+}
+
+// GetEdgeWeight returns the weight of the edge from->to, and false if the edge has no weight.
+func (g *Graph) GetEdgeWeight(from string, to string, txn *badger.Txn) (float64, bool, error) {
+	from, to = g.nodeID(from), g.nodeID(to)
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("GetEdgeWeight")
+		if err != nil {
+			return 0, false, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	weight, ok, err := readEdgeWeight(txn, from, to)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return weight, ok, nil
+}
+
+func readEdgeWeight(txn *badger.Txn, from string, to string) (float64, bool, error) {
+	item, err := txn.Get(edgePropKey(from, to, WeightProperty))
+	if err == badger.ErrKeyNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return 0, false, err
+	}
+	weight, err := decodeFloat64(value)
+	if err != nil {
+		return 0, false, fmt.Errorf("onyx: weight of edge %s->%s: %w", from, to, err)
+	}
+	return weight, true, nil
+}
+
+// Float properties such as weights and layout coordinates are stored as 8 big endian bytes.
+
+func encodeFloat64(f float64) []byte {
+	return binary.BigEndian.AppendUint64(nil, math.Float64bits(f))
+}
+
+func decodeFloat64(value []byte) (float64, error) {
+	if len(value) != 8 {
+		return 0, fmt.Errorf("float value is %d bytes, expected 8", len(value))
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(value)), nil
+}
+
+// deleteNodeProperties deletes every property of node, keeping property indexes up to date.
+func deleteNodeProperties(txn *badger.Txn, node string) error {
+	props, err := readNodeProperties(txn, node, nil)
+	if err != nil {
+		return err
+	}
+	for name := range props {
+		if err := updatePropertyIndex(txn, node, name, nil); err != nil {
+			return err
+		}
+		if err := txn.Delete(nodePropKey(node, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
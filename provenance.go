@@ -0,0 +1,356 @@
+package Onyx
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Provenance records which sources, like the feeds data is imported from, asserted an edge.
+// Every assertion is a provenance key under provenancePrefix + from + to + source, mirrored
+// under sourcePrefix + source + from + to so RemoveSource can find the assertions of a source
+// without scanning the graph. Edges added without a source have no provenance and are only
+// removed by the plain removal operations, which also delete the provenance of the edges
+// they remove.
+
+const (
+	journalOpRemoveSource = "remove-source"
+	removeSourceBatchSize = 500
+)
+
+var ErrInvalidSource = errors.New("onyx: source must be non-empty and must not contain a NUL byte")
+
+func init() {
+	journalOps[journalOpRemoveSource] = func(g *Graph, entry *journalEntry) error {
+		_, err := g.runRemoveSource(entry)
+		return err
+	}
+}
+
+// provenanceKey returns the key of the assertion of from->to by source. With an empty source
+// it is the prefix of all assertions of that edge.
+func provenanceKey(from string, to string, source string) []byte {
+	return []byte(provenancePrefix + from + keySep + to + keySep + source)
+}
+
+// sourceKey returns the key mirroring the assertion of from->to by source. With empty from
+// and to it is the prefix of all assertions of source.
+func sourceKey(source string, from string, to string) []byte {
+	if from == "" {
+		return []byte(sourcePrefix + source + keySep)
+	}
+	return []byte(sourcePrefix + source + keySep + from + keySep + to)
+}
+
+func validateSource(source string) error {
+	if source == "" || strings.Contains(source, keySep) {
+		return ErrInvalidSource
+	}
+	return nil
+}
+
+// readEdgeProvenance returns the sources asserting from->to, sorted.
+func readEdgeProvenance(txn *badger.Txn, from string, to string) ([]string, error) {
+	prefix := provenanceKey(from, to, "")
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	var sources []string
+	for it.Rewind(); it.Valid(); it.Next() {
+		sources = append(sources, string(it.Item().Key()[len(prefix):]))
+	}
+	return sources, nil
+}
+
+func setAssertion(txn *badger.Txn, from string, to string, source string) error {
+	if err := txn.Set(provenanceKey(from, to, source), nil); err != nil {
+		return err
+	}
+	return txn.Set(sourceKey(source, from, to), nil)
+}
+
+func deleteAssertion(txn *badger.Txn, from string, to string, source string) error {
+	if err := txn.Delete(provenanceKey(from, to, source)); err != nil {
+		return err
+	}
+	return txn.Delete(sourceKey(source, from, to))
+}
+
+// deleteEdgeProvenance deletes every assertion of from->to.
+func deleteEdgeProvenance(txn *badger.Txn, from string, to string) error {
+	sources, err := readEdgeProvenance(txn, from, to)
+	if err != nil {
+		return err
+	}
+	for _, source := range sources {
+		if err := deleteAssertion(txn, from, to, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyEdgeProvenance adds the assertions of from->to to newFrom->newTo.
+func copyEdgeProvenance(txn *badger.Txn, from string, to string, newFrom string, newTo string) error {
+	sources, err := readEdgeProvenance(txn, from, to)
+	if err != nil {
+		return err
+	}
+	for _, source := range sources {
+		if err := setAssertion(txn, newFrom, newTo, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddSourcedEdge adds the edge from->to like AddEdge and records that source asserts it.
+// Adding an edge that already exists only adds the assertion.
+func (g *Graph) AddSourcedEdge(from string, to string, source string, txn *badger.Txn) error {
+	from, to = g.nodeID(from), g.nodeID(to)
+	if err := validateSource(source); err != nil {
+		return err
+	}
+	if err := validateNodeID(from); err != nil {
+		return err
+	}
+	if err := validateNodeID(to); err != nil {
+		return err
+	}
+
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("AddSourcedEdge")
+		if err != nil {
+			return err
+		}
+		defer end()
+		txn = g.DB.NewTransaction(true)
+		defer txn.Discard()
+	}
+
+	from, err := g.resolveWriteID(txn, from)
+	if err != nil {
+		return err
+	}
+	to, err = g.resolveWriteID(txn, to)
+	if err != nil {
+		return err
+	}
+	if err := g.AddEdge(from, to, txn); err != nil {
+		return err
+	}
+	if err := setAssertion(txn, from, to, source); err != nil {
+		return err
+	}
+
+	if localTxn {
+		err = txn.Commit()
+		if err != nil {
+			g.recordConflict(err, from)
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveSourcedEdge withdraws the assertion of from->to by source and removes the edge once
+// no source asserts it anymore. It reports whether the edge was removed. A missing assertion
+// is handled like a missing edge by RemoveEdge, see WithRemoveMode.
+func (g *Graph) RemoveSourcedEdge(from string, to string, source string, txn *badger.Txn) (bool, error) {
+	from, to = g.nodeID(from), g.nodeID(to)
+	if err := validateSource(source); err != nil {
+		return false, err
+	}
+
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("RemoveSourcedEdge")
+		if err != nil {
+			return false, err
+		}
+		defer end()
+		txn = g.DB.NewTransaction(true)
+		defer txn.Discard()
+	}
+
+	from, err := g.resolveID(txn, from)
+	if err != nil {
+		return false, err
+	}
+	to, err = g.resolveID(txn, to)
+	if err != nil {
+		return false, err
+	}
+	removed, found, err := g.withdrawAssertion(txn, from, to, source)
+	if err != nil {
+		return false, err
+	}
+	if !found && g.removeMode == RemoveStrict {
+		return false, fmt.Errorf("%w: %s->%s from %s", ErrEdgeNotFound, from, to, source)
+	}
+
+	if localTxn {
+		err = txn.Commit()
+		if err != nil {
+			g.recordConflict(err, from)
+			return false, err
+		}
+	}
+	return removed, nil
+}
+
+// withdrawAssertion deletes the assertion of from->to by source, if found, and removes the
+// edge if it was the last one.
+func (g *Graph) withdrawAssertion(txn *badger.Txn, from string, to string, source string) (removed bool, found bool, err error) {
+	_, err = txn.Get(provenanceKey(from, to, source))
+	if err == badger.ErrKeyNotFound {
+		return false, false, nil
+	} else if err != nil {
+		return false, false, err
+	}
+	if err := deleteAssertion(txn, from, to, source); err != nil {
+		return false, true, err
+	}
+	remaining, err := readEdgeProvenance(txn, from, to)
+	if err != nil || len(remaining) > 0 {
+		return false, true, err
+	}
+
+	dstNodes, _, err := readEdgeMap(txn, from)
+	if err != nil || !dstNodes[to] {
+		return false, true, err
+	}
+	if err := g.removeEdgeData(txn, from, to); err != nil {
+		return false, true, err
+	}
+	delete(dstNodes, to)
+	return true, true, g.writeEdgeMap(txn, from, dstNodes)
+}
+
+// EdgeProvenance returns the sources asserting the edge from->to, sorted. Edges added without
+// a source and missing edges have none.
+func (g *Graph) EdgeProvenance(from string, to string, txn *badger.Txn) ([]string, error) {
+	from, to = g.nodeID(from), g.nodeID(to)
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("EdgeProvenance")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	from, err := g.resolveID(txn, from)
+	if err != nil {
+		return nil, err
+	}
+	to, err = g.resolveID(txn, to)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := readEdgeProvenance(txn, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return sources, nil
+}
+
+type RemoveSourceStats struct {
+	// Assertions is the number of assertions of the source withdrawn.
+	Assertions int
+	// Edges is the number of edges removed because no other source asserted them.
+	Edges int
+}
+
+// RemoveSource withdraws every assertion of source, removing the edges no other source
+// asserts. Like RemoveNodesWithPrefix, the work is done in batches of separate transactions
+// and journaled, so an interrupted call is finished by the next NewGraph.
+func (g *Graph) RemoveSource(source string) (RemoveSourceStats, error) {
+	if err := validateSource(source); err != nil {
+		return RemoveSourceStats{}, err
+	}
+	end, err := g.begin("RemoveSource")
+	if err != nil {
+		return RemoveSourceStats{}, err
+	}
+	defer end()
+
+	entry, release, err := g.newJournalEntry(journalOpRemoveSource, source)
+	if err != nil {
+		return RemoveSourceStats{}, err
+	}
+	defer release()
+	return g.runRemoveSource(entry)
+}
+
+func (g *Graph) runRemoveSource(entry *journalEntry) (RemoveSourceStats, error) {
+	for {
+		if err := g.faultPoint("RemoveSource"); err != nil {
+			return RemoveSourceStats{}, err
+		}
+		done, err := g.removeSourceBatch(entry)
+		if err == nil && !done && g.closing() {
+			err = ErrClosed
+		}
+		if err != nil || done {
+			stats := RemoveSourceStats{
+				Assertions: entry.Counts["assertions"],
+				Edges:      entry.Counts["edges"],
+			}
+			return stats, err
+		}
+	}
+}
+
+// removeSourceBatch withdraws one batch of the assertions of entry and reports whether the
+// whole operation is done. Withdrawn assertions are deleted, so every batch starts over from
+// the beginning of the source.
+func (g *Graph) removeSourceBatch(entry *journalEntry) (bool, error) {
+	txn := g.DB.NewTransaction(true)
+	defer txn.Discard()
+	source := entry.Arg
+
+	prefix := sourceKey(source, "", "")
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	var edges [][2]string
+	for it.Rewind(); it.Valid() && len(edges) < removeSourceBatchSize; it.Next() {
+		from, to, _ := strings.Cut(string(it.Item().Key()[len(prefix):]), keySep)
+		edges = append(edges, [2]string{from, to})
+	}
+	it.Close()
+
+	for _, edge := range edges {
+		removed, _, err := g.withdrawAssertion(txn, edge[0], edge[1], source)
+		if err != nil {
+			return false, err
+		}
+		entry.Counts["assertions"]++
+		if removed {
+			entry.Counts["edges"]++
+		}
+	}
+
+	done := len(edges) < removeSourceBatchSize
+	var err error
+	if done {
+		err = deleteJournalEntry(txn, entry)
+	} else {
+		err = writeJournalEntry(txn, entry)
+	}
+	if err != nil {
+		return false, err
+	}
+	return done, txn.Commit()
+}
@@ -0,0 +1,403 @@
+package Onyx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// A saved query is one line of a small query language:
+//
+//	edges <node>     out-neighbors of node, see GetEdges
+//	in-edges <node>  in-neighbors of node, see GetInEdges
+//	bfs <node> [depth <n>] [fanout <n>] [max-degree <n>]
+//	                 breadth first traversal, see BFS; fanout and max-degree set the
+//	                 MaxFanoutPerNode and SkipNodesAboveDegree ExpansionLimits
+//	explain bfs ...  the bfs query, with an ExplainReport of how it ran, see
+//	                 TraversalOptions.Explain
+//
+// Arguments are bare words, double quoted strings with Go escapes, or $name parameters given
+// to RunSavedQuery. A query is parsed when it is saved and parameters are substituted into
+// the parsed arguments, so a parameter always stands for exactly one argument whatever its
+// value: a value can't add clauses or options to the query.
+
+var (
+	ErrQueryNotFound = errors.New("onyx: saved query not found")
+	ErrInvalidQuery  = errors.New("onyx: invalid query")
+)
+
+const metaQueryPrefix = "query:"
+
+type QueryResult struct {
+	// Query is the query that ran, with its parameters substituted and quoted.
+	Query string `json:"query"`
+	// Nodes are the neighbors, or the visited nodes in the order they were reached.
+	Nodes []string `json:"nodes"`
+	// Depth is only set by bfs queries, see TraversalResult.
+	Depth map[string]int `json:"depth,omitempty"`
+	// Truncated are the nodes a bfs query didn't fully expand, sorted, see ExpansionLimits.
+	Truncated []string `json:"truncated,omitempty"`
+	// Explain is only set by explain queries.
+	Explain *ExplainReport `json:"explain,omitempty"`
+}
+
+// queryArg is one argument of a query: a literal value, or the name of a parameter.
+type queryArg struct {
+	value string
+	param string
+}
+
+type parsedQuery struct {
+	explain   bool
+	op        string
+	node      queryArg
+	depth     *queryArg
+	fanout    *queryArg
+	maxDegree *queryArg
+}
+
+// lexQuery splits text into arguments.
+func lexQuery(text string) ([]queryArg, error) {
+	var args []queryArg
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(text) && text[end] != '"'; end++ {
+				if text[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(text) {
+				return nil, fmt.Errorf("%w: unterminated string at offset %d", ErrInvalidQuery, i)
+			}
+			value, err := strconv.Unquote(text[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("%w: string at offset %d: %v", ErrInvalidQuery, i, err)
+			}
+			args = append(args, queryArg{value: value})
+			i = end + 1
+		default:
+			end := i
+			for end < len(text) && text[end] != ' ' && text[end] != '\t' && text[end] != '"' {
+				end++
+			}
+			word := text[i:end]
+			if strings.ContainsAny(word, "\n\r") {
+				return nil, fmt.Errorf("%w: a query is a single line", ErrInvalidQuery)
+			}
+			if name, ok := strings.CutPrefix(word, "$"); ok {
+				if !validParamName(name) {
+					return nil, fmt.Errorf("%w: invalid parameter name %q", ErrInvalidQuery, word)
+				}
+				args = append(args, queryArg{param: name})
+			} else {
+				args = append(args, queryArg{value: word})
+			}
+			i = end
+		}
+	}
+	return args, nil
+}
+
+func validParamName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseQuery parses the text of a query. Keywords are the literal arguments in keyword
+// positions; parameters are only allowed where values are.
+func parseQuery(text string) (*parsedQuery, error) {
+	args, err := lexQuery(text)
+	if err != nil {
+		return nil, err
+	}
+	keyword := func(arg queryArg) string {
+		if arg.param != "" {
+			return ""
+		}
+		return arg.value
+	}
+	explain := len(args) > 0 && keyword(args[0]) == "explain"
+	if explain {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return nil, fmt.Errorf("%w: expected a command and a node", ErrInvalidQuery)
+	}
+	q := &parsedQuery{explain: explain, op: keyword(args[0]), node: args[1]}
+	if q.explain && q.op != "bfs" {
+		return nil, fmt.Errorf("%w: only bfs queries can be explained", ErrInvalidQuery)
+	}
+	switch q.op {
+	case "edges", "in-edges":
+		if len(args) > 2 {
+			return nil, fmt.Errorf("%w: %s takes no options", ErrInvalidQuery, q.op)
+		}
+	case "bfs":
+		for rest := args[2:]; len(rest) > 0; rest = rest[2:] {
+			if len(rest) < 2 {
+				return nil, fmt.Errorf("%w: option %q has no value", ErrInvalidQuery, keyword(rest[0]))
+			}
+			value := rest[1]
+			var option **queryArg
+			switch keyword(rest[0]) {
+			case "depth":
+				option = &q.depth
+			case "fanout":
+				option = &q.fanout
+			case "max-degree":
+				option = &q.maxDegree
+			default:
+				return nil, fmt.Errorf("%w: unknown bfs option %q", ErrInvalidQuery, keyword(rest[0]))
+			}
+			if *option != nil {
+				return nil, fmt.Errorf("%w: option %q given twice", ErrInvalidQuery, keyword(rest[0]))
+			}
+			if value.param == "" {
+				if _, err := parseQueryInt(value.value); err != nil {
+					return nil, err
+				}
+			}
+			*option = &value
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown command %q", ErrInvalidQuery, keyword(args[0]))
+	}
+	return q, nil
+}
+
+func parseQueryInt(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: %q is not a non-negative integer", ErrInvalidQuery, value)
+	}
+	return n, nil
+}
+
+// bind returns q with its parameters substituted from params. Every parameter must be given
+// and every given parameter must be used.
+func (q *parsedQuery) bind(params map[string]string) (*parsedQuery, error) {
+	used := make(map[string]bool)
+	bindArg := func(arg *queryArg) (*queryArg, error) {
+		if arg == nil || arg.param == "" {
+			return arg, nil
+		}
+		value, ok := params[arg.param]
+		if !ok {
+			return nil, fmt.Errorf("%w: parameter $%s is not set", ErrInvalidQuery, arg.param)
+		}
+		used[arg.param] = true
+		return &queryArg{value: value}, nil
+	}
+	bound := &parsedQuery{explain: q.explain, op: q.op}
+	node, err := bindArg(&q.node)
+	if err != nil {
+		return nil, err
+	}
+	bound.node = *node
+	if bound.depth, err = bindArg(q.depth); err != nil {
+		return nil, err
+	}
+	if bound.fanout, err = bindArg(q.fanout); err != nil {
+		return nil, err
+	}
+	if bound.maxDegree, err = bindArg(q.maxDegree); err != nil {
+		return nil, err
+	}
+	for name := range params {
+		if !used[name] {
+			return nil, fmt.Errorf("%w: the query has no parameter $%s", ErrInvalidQuery, name)
+		}
+	}
+	return bound, nil
+}
+
+// String renders q as query text, quoting every value, so parsing it gives q back.
+func (q *parsedQuery) String() string {
+	quote := func(arg *queryArg) string {
+		if arg.param != "" {
+			return "$" + arg.param
+		}
+		return strconv.Quote(arg.value)
+	}
+	var parts []string
+	if q.explain {
+		parts = append(parts, "explain")
+	}
+	parts = append(parts, q.op, quote(&q.node))
+	if q.depth != nil {
+		parts = append(parts, "depth", quote(q.depth))
+	}
+	if q.fanout != nil {
+		parts = append(parts, "fanout", quote(q.fanout))
+	}
+	if q.maxDegree != nil {
+		parts = append(parts, "max-degree", quote(q.maxDegree))
+	}
+	return strings.Join(parts, " ")
+}
+
+func validQueryName(name string) error {
+	if name == "" || strings.ContainsFunc(name, func(r rune) bool {
+		return r != '-' && r != '_' && r != '.' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		return fmt.Errorf("%w: query name %q must be letters, digits, '-', '_' and '.'", ErrInvalidQuery, name)
+	}
+	return nil
+}
+
+// SaveQuery parses queryText and saves it as name, replacing the query saved as name if any.
+func (g *Graph) SaveQuery(name string, queryText string) error {
+	if err := validQueryName(name); err != nil {
+		return err
+	}
+	if _, err := parseQuery(queryText); err != nil {
+		return err
+	}
+	end, err := g.begin("SaveQuery")
+	if err != nil {
+		return err
+	}
+	defer end()
+	return g.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set(metaKey(metaQueryPrefix+name), []byte(queryText))
+	})
+}
+
+// DeleteQuery deletes the query saved as name. Deleting a query that doesn't exist is not an
+// error.
+func (g *Graph) DeleteQuery(name string) error {
+	end, err := g.begin("DeleteQuery")
+	if err != nil {
+		return err
+	}
+	defer end()
+	return g.DB.Update(func(txn *badger.Txn) error {
+		return txn.Delete(metaKey(metaQueryPrefix + name))
+	})
+}
+
+// ListQueries returns the text of every saved query by name.
+func (g *Graph) ListQueries() (map[string]string, error) {
+	end, err := g.begin("ListQueries")
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	txn, release := g.readTxn()
+	defer release()
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = metaKey(metaQueryPrefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	queries := make(map[string]string)
+	for it.Rewind(); it.Valid(); it.Next() {
+		text, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		queries[string(it.Item().Key()[len(opts.Prefix):])] = string(text)
+	}
+	return queries, nil
+}
+
+// RunSavedQuery runs the query saved as name with its $parameters set from params. See
+// RunSavedQueryContext.
+func (g *Graph) RunSavedQuery(name string, params map[string]string) (*QueryResult, error) {
+	return g.RunSavedQueryContext(context.Background(), name, params)
+}
+
+// RunSavedQueryContext runs the query saved as name with its $parameters set from params.
+// Every parameter of the query must be set, and params must not have others. Traversals stop
+// with the error of ctx once it is done, like BFSContext.
+func (g *Graph) RunSavedQueryContext(ctx context.Context, name string, params map[string]string) (*QueryResult, error) {
+	text, err := g.savedQuery(name)
+	if err != nil {
+		return nil, err
+	}
+	q, err := parseQuery(text)
+	if err != nil {
+		return nil, err
+	}
+	q, err = q.bind(params)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &QueryResult{Query: q.String()}
+	switch q.op {
+	case "edges", "in-edges":
+		var neighbors map[string]bool
+		if q.op == "edges" {
+			neighbors, err = g.GetEdges(q.node.value, nil)
+		} else {
+			neighbors, err = g.GetInEdges(q.node.value, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		result.Nodes = sortedNeighbors(neighbors)
+	case "bfs":
+		opts := TraversalOptions{Explain: q.explain}
+		if q.depth != nil {
+			if opts.MaxDepth, err = parseQueryInt(q.depth.value); err != nil {
+				return nil, err
+			}
+		}
+		if q.fanout != nil {
+			if opts.MaxFanoutPerNode, err = parseQueryInt(q.fanout.value); err != nil {
+				return nil, err
+			}
+		}
+		if q.maxDegree != nil {
+			if opts.SkipNodesAboveDegree, err = parseQueryInt(q.maxDegree.value); err != nil {
+				return nil, err
+			}
+		}
+		traversal, err := g.BFSContext(ctx, q.node.value, opts, nil)
+		if err != nil {
+			return nil, err
+		}
+		result.Nodes, result.Depth, result.Explain = traversal.Order, traversal.Depth, traversal.Explain
+		if traversal.Truncated != nil {
+			result.Truncated = sortedNeighbors(traversal.Truncated)
+		}
+	}
+	return result, nil
+}
+
+func (g *Graph) savedQuery(name string) (string, error) {
+	end, err := g.begin("RunSavedQuery")
+	if err != nil {
+		return "", err
+	}
+	defer end()
+	txn, release := g.readTxn()
+	defer release()
+
+	item, err := txn.Get(metaKey(metaQueryPrefix + name))
+	if err == badger.ErrKeyNotFound {
+		return "", fmt.Errorf("%w: %q", ErrQueryNotFound, name)
+	} else if err != nil {
+		return "", err
+	}
+	text, err := item.ValueCopy(nil)
+	return string(text), err
+}
@@ -0,0 +1,553 @@
+package Onyx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// defaultRedirectDepth is the longest redirect chain followed unless WithRedirectDepth is used.
+const defaultRedirectDepth = 8
+
+const resolveBatchSize = 500
+
+var ErrRedirectCycle = errors.New("onyx: redirect would create a cycle")
+
+// ErrRedirectDepth is returned when a redirect chain is longer than the configured depth.
+var ErrRedirectDepth = errors.New("onyx: redirect chain is too long")
+
+// WithRedirectDepth sets how many redirects are followed when resolving a node ID.
+func WithRedirectDepth(depth int) Option {
+	return func(g *Graph) {
+		g.redirectDepth = depth
+	}
+}
+
+func redirectKey(id string) []byte {
+	return []byte(redirectPrefix + id)
+}
+
+// readRedirect returns the ID oldID redirects to, or "" if it isn't redirected.
+func readRedirect(txn *badger.Txn, oldID string) (string, error) {
+	item, err := txn.Get(redirectKey(oldID))
+	if err == badger.ErrKeyNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	target, err := item.ValueCopy(nil)
+	return string(target), err
+}
+
+// resolveID follows the redirects of id and returns its canonical ID. With
+// WithAliasResolution an alias is resolved to its node first.
+func (g *Graph) resolveID(txn *badger.Txn, id string) (string, error) {
+	if g.aliasResolution {
+		return g.resolveAlias(txn, id)
+	}
+	return g.followRedirects(txn, id)
+}
+
+func (g *Graph) followRedirects(txn *badger.Txn, id string) (string, error) {
+	for i := 0; ; i++ {
+		target, err := readRedirect(txn, id)
+		if err != nil || target == "" {
+			return id, err
+		}
+		if i == g.redirectDepth {
+			return "", fmt.Errorf("%w: following %q", ErrRedirectDepth, id)
+		}
+		id = target
+	}
+}
+
+// redirectResolver resolves node IDs for reads. Most graphs have no redirects, so unless
+// the graph has one it returns IDs unchanged without lookups. With WithAliasResolution
+// aliases count as redirects.
+type redirectResolver struct {
+	g     *Graph
+	txn   *badger.Txn
+	any   bool
+	cache map[string]string
+	// hits and misses count the lookups of resolve in cache, for ExplainReport.
+	hits   int
+	misses int
+}
+
+func (g *Graph) newRedirectResolver(txn *badger.Txn) *redirectResolver {
+	any := g.hasRedirects.Load() || g.aliasResolution && g.hasAliases.Load()
+	return &redirectResolver{g: g, txn: txn, any: any, cache: make(map[string]string)}
+}
+
+// detectRedirects sets hasRedirects and hasAliases from the keys of the graph, when it is
+// opened or restored. Redirect and AddAlias set them as they write.
+func (g *Graph) detectRedirects() error {
+	return g.DB.View(func(txn *badger.Txn) error {
+		g.hasRedirects.Store(hasKeyWithPrefix(txn, redirectPrefix))
+		g.hasAliases.Store(hasKeyWithPrefix(txn, aliasPrefix))
+		return nil
+	})
+}
+
+func hasKeyWithPrefix(txn *badger.Txn, prefix string) bool {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(prefix)
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	it.Rewind()
+	return it.Valid()
+}
+
+func (r *redirectResolver) resolve(id string) (string, error) {
+	if !r.any {
+		return id, nil
+	}
+	if canonical, ok := r.cache[id]; ok {
+		r.hits++
+		return canonical, nil
+	}
+	r.misses++
+	canonical, err := r.g.resolveID(r.txn, id)
+	if err != nil {
+		return "", err
+	}
+	r.cache[id] = canonical
+	return canonical, nil
+}
+
+// resolveNeighbors returns dstNodes with every neighbor replaced by its canonical ID.
+func (r *redirectResolver) resolveNeighbors(dstNodes map[string]bool) (map[string]bool, error) {
+	if !r.any {
+		return dstNodes, nil
+	}
+	resolved := make(map[string]bool, len(dstNodes))
+	for neighbor := range dstNodes {
+		canonical, err := r.resolve(neighbor)
+		if err != nil {
+			return nil, err
+		}
+		resolved[canonical] = true
+	}
+	return resolved, nil
+}
+
+// aliasesOf returns the IDs redirected to the canonical ID id, directly or through a chain.
+func (r *redirectResolver) aliasesOf(id string) ([]string, error) {
+	if !r.any {
+		return nil, nil
+	}
+	var aliases []string
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(redirectPrefix)
+	opts.PrefetchValues = false
+	it := r.txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		oldID := string(it.Item().Key()[len(redirectPrefix):])
+		canonical, err := r.resolve(oldID)
+		if err != nil {
+			return nil, err
+		}
+		if canonical == id {
+			aliases = append(aliases, oldID)
+		}
+	}
+	return aliases, nil
+}
+
+// Redirect makes newID the identity of oldID. The out-edges and properties of oldID are
+// moved to newID (keeping the values newID already has), and a redirect marker is left
+// under oldID so reads of oldID, and of edges pointing at it, resolve to newID.
+// Writes resolve redirects too, so no new references to oldID are created. Edges that
+// already point at oldID are rewritten by ResolveRedirects.
+// The out-edges moved are submitted to the write policies, as removed from oldID and, unless
+// newID already has them, added to newID, before any is moved.
+// A redirect that would close a cycle returns ErrRedirectCycle.
+func (g *Graph) Redirect(oldID string, newID string, txn *badger.Txn) error {
+	oldID, newID = g.nodeID(oldID), g.nodeID(newID)
+	if err := validateNodeID(oldID); err != nil {
+		return err
+	}
+	if err := validateNodeID(newID); err != nil {
+		return err
+	}
+
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("Redirect")
+		if err != nil {
+			return err
+		}
+		defer end()
+		txn = g.DB.NewTransaction(true)
+		defer txn.Discard()
+	}
+
+	target, err := g.redirect(txn, oldID, newID)
+	if err != nil {
+		return err
+	}
+
+	if localTxn {
+		err = txn.Commit()
+		if err != nil {
+			g.recordConflict(err, oldID, target)
+			return err
+		}
+	}
+	return nil
+}
+
+// redirect is Redirect on IDs that are already normalized. It returns the canonical ID of
+// newID, which oldID now redirects to.
+func (g *Graph) redirect(txn *badger.Txn, oldID string, newID string) (string, error) {
+	id := newID
+	for i := 0; id != oldID; i++ {
+		target, err := readRedirect(txn, id)
+		if err != nil {
+			return "", err
+		}
+		if target == "" {
+			break
+		}
+		if i == g.redirectDepth {
+			return "", fmt.Errorf("%w: following %q", ErrRedirectDepth, newID)
+		}
+		id = target
+	}
+	if id == oldID {
+		return "", ErrRedirectCycle
+	}
+
+	err := g.moveNode(txn, oldID, id)
+	if err != nil {
+		return "", err
+	}
+	if err := moveAliases(txn, oldID, id); err != nil {
+		return "", err
+	}
+	// Set before the commit, so reads that see the redirect resolve it.
+	g.hasRedirects.Store(true)
+	return id, txn.Set(redirectKey(oldID), []byte(id))
+}
+
+// moveNode merges the edge list, edge properties, cross edges and node properties of from
+// into to and removes from. Values already present on to are kept.
+func (g *Graph) moveNode(txn *badger.Txn, from string, to string) error {
+	err := g.moveEdges(txn, from, to)
+	if err != nil {
+		return err
+	}
+	err = moveCrossEdges(txn, from, to)
+	if err != nil {
+		return err
+	}
+
+	props, err := readNodeProperties(txn, from, nil)
+	if err != nil {
+		return err
+	}
+	existing, err := readNodeProperties(txn, to, nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range props {
+		if _, ok := existing[name]; ok {
+			continue
+		}
+		if err := updatePropertyIndex(txn, to, name, value); err != nil {
+			return err
+		}
+		if err := txn.Set(nodePropKey(to, name), value); err != nil {
+			return err
+		}
+	}
+	return deleteNodeProperties(txn, from)
+}
+
+// moveEdges merges the edge list of from into the one of to and deletes from. Every edge it
+// removes from from and adds to to is submitted to the write policies before any is.
+func (g *Graph) moveEdges(txn *badger.Txn, from string, to string) error {
+	srcEdges, exists, err := readEdgeMap(txn, from)
+	if err != nil || !exists {
+		return err
+	}
+	dstEdges, _, err := readEdgeMap(txn, to)
+	if err != nil {
+		return err
+	}
+	if err := g.checkMoveEdgesPolicies(txn, from, to, srcEdges, dstEdges); err != nil {
+		return err
+	}
+
+	for _, neighbor := range sortedNeighbors(srcEdges) {
+		if !dstEdges[neighbor] {
+			dstEdges[neighbor] = true
+			if err := g.recordChange(txn, ChangeAddEdge, to, neighbor); err != nil {
+				return err
+			}
+			if err := copyEdgeProperties(txn, from, neighbor, to, neighbor); err != nil {
+				return err
+			}
+		}
+		if err := copyEdgeProvenance(txn, from, neighbor, to, neighbor); err != nil {
+			return err
+		}
+		if err := g.removeEdgeData(txn, from, neighbor); err != nil {
+			return err
+		}
+	}
+	if err := g.writeEdgeMap(txn, to, dstEdges); err != nil {
+		return err
+	}
+	if err := g.recordChange(txn, ChangeRemoveNode, from, ""); err != nil {
+		return err
+	}
+	return deleteEdgeMap(txn, from)
+}
+
+// checkMoveEdgesPolicies runs the write policies on the edges moveEdges moves: the removal of
+// every out-edge of from, and the addition of the ones to doesn't have yet.
+func (g *Graph) checkMoveEdgesPolicies(txn *badger.Txn, from string, to string, srcEdges map[string]bool, dstEdges map[string]bool) error {
+	if g.policies.Load() == nil {
+		return nil
+	}
+	resolver := g.newRedirectResolver(txn)
+	for _, neighbor := range sortedNeighbors(srcEdges) {
+		canonical, err := resolver.resolve(neighbor)
+		if err != nil {
+			return err
+		}
+		if err := g.checkWritePolicies(txn, MutationOp{Kind: MutationRemoveEdge, From: from, To: canonical}); err != nil {
+			return err
+		}
+		if dstEdges[neighbor] {
+			continue
+		}
+		if err := g.checkWritePolicies(txn, MutationOp{Kind: MutationAddEdge, From: to, To: canonical}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyEdgeProperties copies the properties of the edge from->to onto newFrom->newTo.
+func copyEdgeProperties(txn *badger.Txn, from string, to string, newFrom string, newTo string) error {
+	prefix := edgePropKey(from, to, "")
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	props := make(map[string][]byte)
+	for it.Rewind(); it.Valid(); it.Next() {
+		value, err := copyPropertyValue(it.Item())
+		if err != nil {
+			it.Close()
+			return err
+		}
+		props[string(it.Item().Key()[len(prefix):])] = value
+	}
+	it.Close()
+
+	for name, value := range props {
+		if err := txn.Set(edgePropKey(newFrom, newTo, name), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type ResolveStats struct {
+	// EdgesRewritten is the number of edges pointing at a redirected ID that were rewritten.
+	EdgesRewritten int
+	// RedirectsRemoved is the number of redirect markers deleted.
+	RedirectsRemoved int
+}
+
+// ResolveRedirects rewrites every edge pointing at a redirected ID to point at its canonical
+// ID, in batches of separate transactions, and then deletes the redirect markers that existed
+// when it started. It is meant to run in the background: cancelling ctx stops it between
+// batches, and since the work is idempotent a later call picks up where this one stopped.
+func (g *Graph) ResolveRedirects(ctx context.Context) (ResolveStats, error) {
+	var stats ResolveStats
+	ctx, end, err := g.track(ctx, "ResolveRedirects")
+	if err != nil {
+		return stats, err
+	}
+	defer end()
+
+	redirects := make(map[string]string)
+	err = g.DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(redirectPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			target, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			redirects[string(it.Item().Key()[len(redirectPrefix):])] = string(target)
+		}
+		for oldID := range redirects {
+			canonical, err := g.resolveID(txn, oldID)
+			if err != nil {
+				return err
+			}
+			redirects[oldID] = canonical
+		}
+		return nil
+	})
+	if err != nil || len(redirects) == 0 {
+		return stats, err
+	}
+
+	var cursor []byte
+	for {
+		if ctx.Err() != nil {
+			return stats, context.Cause(ctx)
+		}
+		if err := g.faultPoint("ResolveRedirects"); err != nil {
+			return stats, err
+		}
+		next, rewritten, err := g.resolveRedirectsBatch(cursor, redirects)
+		if err != nil {
+			return stats, err
+		}
+		stats.EdgesRewritten += rewritten
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+
+	if err := g.faultPoint("ResolveRedirects:markers"); err != nil {
+		return stats, err
+	}
+	err = g.DB.Update(func(txn *badger.Txn) error {
+		removable := make(map[string]string)
+		for oldID, canonical := range redirects {
+			// A marker changed since the scan started may still be referenced.
+			current, err := g.resolveID(txn, oldID)
+			if err != nil {
+				return err
+			}
+			if current == canonical {
+				removable[oldID] = canonical
+			}
+		}
+
+		// Markers added since the scan started may point at a marker that is about to go.
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(redirectPrefix)
+		it := txn.NewIterator(opts)
+		repoint := make(map[string]string)
+		for it.Rewind(); it.Valid(); it.Next() {
+			oldID := string(it.Item().Key()[len(redirectPrefix):])
+			target, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				it.Close()
+				return err
+			}
+			if _, ok := removable[oldID]; ok {
+				continue
+			}
+			if canonical, ok := removable[string(target)]; ok {
+				repoint[oldID] = canonical
+			}
+		}
+		it.Close()
+		for oldID, canonical := range repoint {
+			if err := txn.Set(redirectKey(oldID), []byte(canonical)); err != nil {
+				return err
+			}
+		}
+
+		for oldID, canonical := range removable {
+			// The graph may have been changed through oldID by a write that raced with Redirect.
+			if err := g.moveNode(txn, oldID, canonical); err != nil {
+				return err
+			}
+			if err := txn.Delete(redirectKey(oldID)); err != nil {
+				return err
+			}
+			stats.RedirectsRemoved++
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// resolveRedirectsBatch rewrites the edge lists of up to resolveBatchSize nodes after cursor.
+// It returns the cursor of the next batch, or nil once every node has been visited.
+func (g *Graph) resolveRedirectsBatch(cursor []byte, redirects map[string]string) ([]byte, int, error) {
+	txn := g.DB.NewTransaction(true)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := newNodeIterator(txn, opts)
+	var nodes []string
+	if cursor != nil {
+		it.Seek(cursor)
+	} else {
+		it.Rewind()
+	}
+	for ; it.Valid() && len(nodes) < resolveBatchSize; it.Next() {
+		node := it.Item().KeyCopy(nil)
+		if bytes.Equal(node, cursor) {
+			continue
+		}
+		nodes = append(nodes, string(node))
+	}
+	it.Close()
+
+	rewritten := 0
+	for _, node := range nodes {
+		dstNodes, _, err := readEdgeMap(txn, node)
+		if err != nil {
+			return nil, 0, err
+		}
+		changed := false
+		for _, to := range sortedNeighbors(dstNodes) {
+			canonical, ok := redirects[to]
+			if !ok {
+				continue
+			}
+			if !dstNodes[canonical] {
+				dstNodes[canonical] = true
+				if err := g.recordChange(txn, ChangeAddEdge, node, canonical); err != nil {
+					return nil, 0, err
+				}
+				if err := copyEdgeProperties(txn, node, to, node, canonical); err != nil {
+					return nil, 0, err
+				}
+			}
+			if err := copyEdgeProvenance(txn, node, to, node, canonical); err != nil {
+				return nil, 0, err
+			}
+			if err := g.removeEdgeData(txn, node, to); err != nil {
+				return nil, 0, err
+			}
+			delete(dstNodes, to)
+			rewritten++
+			changed = true
+		}
+		if changed {
+			if err := g.writeEdgeMap(txn, node, dstNodes); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	if err := txn.Commit(); err != nil {
+		return nil, 0, err
+	}
+	if len(nodes) < resolveBatchSize {
+		return nil, rewritten, nil
+	}
+	return []byte(nodes[len(nodes)-1]), rewritten, nil
+}
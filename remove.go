@@ -0,0 +1,424 @@
+package Onyx
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+const (
+	journalOpRemovePrefix = "remove-prefix"
+	removeBatchSize       = 500
+)
+
+func init() {
+	journalOps[journalOpRemovePrefix] = func(g *Graph, entry *journalEntry) error {
+		_, err := g.runRemovePrefix(entry)
+		return err
+	}
+}
+
+type RemoveStats struct {
+	// Nodes is the number of nodes removed.
+	Nodes int
+	// Edges is the number of out-edges of the removed nodes.
+	Edges int
+	// InboundEdges is the number of edges from other nodes into the removed nodes.
+	InboundEdges int
+}
+
+// Phases of a RemoveNodesWithPrefix journal entry. The inbound edges are found in the reverse
+// edge index if it is ready when the nodes are removed, and by scanning every edge list otherwise.
+// The index is keyed by the ID an edge is stored under, so the edges pointing at IDs
+// redirected into the prefix are looked up in a phase of their own.
+const (
+	removePhaseNodes = iota
+	removePhaseInbound
+	removePhaseInboundIndexed
+	removePhaseInboundRedirected
+)
+
+// RemoveNodesWithPrefix removes every node whose ID starts with prefix, together with its
+// properties, aliases and out-edges and every edge pointing at it or at an ID redirected to
+// it, like RemoveNode. Nodes without an edge list are removed too. Work is done in batches of
+// separate transactions and journaled, so an interrupted call is finished by the next NewGraph.
+// Removed edges are recorded in the changelog batch by batch. The edges pointing at removed
+// nodes are read from the reverse edge index if it is ready, see IndexReverseEdges; without
+// it every edge list of the graph is scanned.
+//
+// With write policies registered every edge to remove is checked before the first batch, in
+// one more scan of the edge lists, and a rejection removes nothing. Edges added to the
+// prefix while the batches run are removed unchecked.
+//
+// Unlike most graph operations it takes no txn: a prefix can cover more nodes than one badger
+// transaction can write, and the journal resumes an interrupted call from the last batch that
+// committed, which a batch of the caller's transaction could not be.
+func (g *Graph) RemoveNodesWithPrefix(prefix string) (RemoveStats, error) {
+	if prefix == "" || strings.Contains(prefix, keySep) {
+		return RemoveStats{}, errors.New("onyx: node prefix must be non-empty and must not contain a NUL byte")
+	}
+	end, err := g.begin("RemoveNodesWithPrefix")
+	if err != nil {
+		return RemoveStats{}, err
+	}
+	defer end()
+
+	if err := g.checkRemovePrefixPolicies(prefix); err != nil {
+		return RemoveStats{}, err
+	}
+	entry, release, err := g.newJournalEntry(journalOpRemovePrefix, prefix)
+	if err != nil {
+		return RemoveStats{}, err
+	}
+	defer release()
+	return g.runRemovePrefix(entry)
+}
+
+// checkRemovePrefixPolicies runs the write policies on every edge from or to a node starting
+// with prefix, in a read transaction of its own.
+func (g *Graph) checkRemovePrefixPolicies(prefix string) error {
+	if g.policies.Load() == nil {
+		return nil
+	}
+	txn := g.DB.NewTransaction(false)
+	defer txn.Discard()
+	resolver := g.newRedirectResolver(txn)
+	return forEachEdgeList(txn, func(from string, dstNodes map[string]bool) error {
+		for _, to := range sortedNeighbors(dstNodes) {
+			canonical, err := resolver.resolve(to)
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(from, prefix) && !strings.HasPrefix(canonical, prefix) {
+				continue
+			}
+			if err := g.checkWritePolicies(txn, MutationOp{Kind: MutationRemoveEdge, From: from, To: canonical}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (g *Graph) runRemovePrefix(entry *journalEntry) (RemoveStats, error) {
+	for {
+		if err := g.faultPoint("RemoveNodesWithPrefix"); err != nil {
+			return RemoveStats{}, err
+		}
+		done, err := g.removePrefixBatch(entry)
+		if err == nil && !done && g.closing() {
+			// The journal entry resumes the removal when the graph is opened again.
+			err = ErrClosed
+		}
+		if err != nil || done {
+			stats := RemoveStats{
+				Nodes:        entry.Counts["nodes"],
+				Edges:        entry.Counts["edges"],
+				InboundEdges: entry.Counts["inbound"],
+			}
+			return stats, err
+		}
+	}
+}
+
+// removePrefixBatch does one batch of entry and reports whether the whole operation is done.
+func (g *Graph) removePrefixBatch(entry *journalEntry) (bool, error) {
+	txn := g.DB.NewTransaction(true)
+	defer txn.Discard()
+	prefix := entry.Arg
+
+	reverse, err := readIndexStateAt(txn, reverseIndexMetaKey())
+	if err != nil {
+		return false, err
+	}
+	indexed := reverse != nil && reverse.Ready
+	if entry.Phase == removePhaseInboundIndexed || entry.Phase == removePhaseInboundRedirected {
+		if indexed && entry.Phase == removePhaseInboundIndexed {
+			return g.removeIndexedInboundBatch(txn, entry)
+		} else if indexed {
+			return g.removeRedirectedInboundBatch(txn, entry)
+		}
+		// The index was dropped since the nodes were removed.
+		entry.Phase = removePhaseInbound
+		entry.Cursor = nil
+	}
+
+	var nodes []string
+	if entry.Phase == removePhaseNodes {
+		nodes = prefixNodes(txn, prefix, string(entry.Cursor), removeBatchSize)
+	} else {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := newNodeIterator(txn, opts)
+		if len(entry.Cursor) > 0 {
+			it.Seek(entry.Cursor)
+		} else {
+			it.Rewind()
+		}
+		for ; it.Valid() && len(nodes) < removeBatchSize; it.Next() {
+			node := it.Item().KeyCopy(nil)
+			if bytes.Equal(node, entry.Cursor) {
+				continue
+			}
+			nodes = append(nodes, string(node))
+		}
+		it.Close()
+	}
+
+	resolver := g.newRedirectResolver(txn)
+	for _, node := range nodes {
+		dstNodes, _, err := readEdgeMap(txn, node)
+		if err != nil {
+			return false, err
+		}
+
+		if entry.Phase == removePhaseNodes {
+			for _, to := range sortedNeighbors(dstNodes) {
+				if err := g.removeEdgeData(txn, node, to); err != nil {
+					return false, err
+				}
+			}
+			if err := g.deleteNode(txn, node); err != nil {
+				return false, err
+			}
+			entry.Counts["nodes"]++
+			entry.Counts["edges"] += len(dstNodes)
+			continue
+		}
+
+		changed := false
+		for _, to := range sortedNeighbors(dstNodes) {
+			canonical, err := resolver.resolve(to)
+			if err != nil {
+				return false, err
+			}
+			if strings.HasPrefix(canonical, prefix) {
+				if err := g.removeEdgeData(txn, node, to); err != nil {
+					return false, err
+				}
+				delete(dstNodes, to)
+				entry.Counts["inbound"]++
+				changed = true
+			}
+		}
+		if changed {
+			if err := g.writeEdgeMap(txn, node, dstNodes); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	done := false
+	if len(nodes) < removeBatchSize {
+		if entry.Phase == removePhaseNodes {
+			entry.Phase = removePhaseInbound
+			if indexed {
+				entry.Phase = removePhaseInboundIndexed
+			}
+			entry.Cursor = nil
+		} else {
+			done = true
+		}
+	} else {
+		entry.Cursor = []byte(nodes[len(nodes)-1])
+	}
+
+	return done, g.commitRemoveBatch(txn, entry, done)
+}
+
+// removeIndexedInboundBatch removes the next batch of edges pointing at the removed nodes. The
+// reverse index entries are keyed by destination, so those of the removed nodes share the
+// prefix and the batch only reads the edges it removes.
+func (g *Graph) removeIndexedInboundBatch(txn *badger.Txn, entry *journalEntry) (bool, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = []byte(reverseEdgePrefix + entry.Arg)
+	it := txn.NewIterator(opts)
+	inbound := make(map[string][]string)
+	sources := make(map[string]bool)
+	n := 0
+	if len(entry.Cursor) > 0 {
+		it.Seek(entry.Cursor)
+	} else {
+		it.Rewind()
+	}
+	for ; it.Valid() && n < removeBatchSize; it.Next() {
+		key := it.Item().KeyCopy(nil)
+		if bytes.Equal(key, entry.Cursor) {
+			continue
+		}
+		rest := string(key[len(reverseEdgePrefix):])
+		sep := strings.Index(rest, keySep)
+		to, from := rest[:sep], rest[sep+len(keySep):]
+		inbound[from] = append(inbound[from], to)
+		sources[from] = true
+		entry.Cursor = key
+		n++
+	}
+	it.Close()
+
+	for _, from := range sortedNeighbors(sources) {
+		dstNodes, exists, err := readEdgeMap(txn, from)
+		if err != nil {
+			return false, err
+		}
+		changed := false
+		for _, to := range inbound[from] {
+			// Entries the edge list doesn't confirm are stale, see WithReadRepair.
+			if !dstNodes[to] {
+				continue
+			}
+			if err := g.removeEdgeData(txn, from, to); err != nil {
+				return false, err
+			}
+			delete(dstNodes, to)
+			entry.Counts["inbound"]++
+			changed = true
+		}
+		if changed && exists {
+			if err := g.writeEdgeMap(txn, from, dstNodes); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if n < removeBatchSize {
+		entry.Phase = removePhaseInboundRedirected
+		entry.Cursor = nil
+	}
+	return false, g.commitRemoveBatch(txn, entry, false)
+}
+
+// removeRedirectedInboundBatch removes the edges pointing at the next batch of IDs redirected
+// into the prefix from outside of it, which the reverse index has under the old IDs.
+func (g *Graph) removeRedirectedInboundBatch(txn *badger.Txn, entry *journalEntry) (bool, error) {
+	prefix := entry.Arg
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = []byte(redirectPrefix)
+	it := txn.NewIterator(opts)
+	var oldIDs []string
+	if len(entry.Cursor) > 0 {
+		it.Seek(entry.Cursor)
+	} else {
+		it.Rewind()
+	}
+	for ; it.Valid() && len(oldIDs) < removeBatchSize; it.Next() {
+		key := it.Item().KeyCopy(nil)
+		if bytes.Equal(key, entry.Cursor) {
+			continue
+		}
+		oldIDs = append(oldIDs, string(key[len(redirectPrefix):]))
+		entry.Cursor = key
+	}
+	it.Close()
+
+	resolver := g.newRedirectResolver(txn)
+	for _, oldID := range oldIDs {
+		if strings.HasPrefix(oldID, prefix) {
+			// Found by removeIndexedInboundBatch.
+			continue
+		}
+		canonical, err := resolver.resolve(oldID)
+		if err != nil {
+			return false, err
+		}
+		if !strings.HasPrefix(canonical, prefix) {
+			continue
+		}
+		var sources []string
+		opts.Prefix = reverseEdgePrefixOf(oldID)
+		it := txn.NewIterator(opts)
+		for it.Rewind(); it.Valid(); it.Next() {
+			sources = append(sources, string(it.Item().Key()[len(opts.Prefix):]))
+		}
+		it.Close()
+		for _, from := range sources {
+			dstNodes, exists, err := readEdgeMap(txn, from)
+			if err != nil {
+				return false, err
+			}
+			if !exists || !dstNodes[oldID] {
+				continue
+			}
+			if err := g.removeEdgeData(txn, from, oldID); err != nil {
+				return false, err
+			}
+			delete(dstNodes, oldID)
+			entry.Counts["inbound"]++
+			if err := g.writeEdgeMap(txn, from, dstNodes); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	done := len(oldIDs) < removeBatchSize
+	return done, g.commitRemoveBatch(txn, entry, done)
+}
+
+// prefixNodes returns, in order, the first count nodes after cursor whose ID starts with
+// prefix. Besides the nodes with an edge list these are the nodes with only properties,
+// aliases or cross edges.
+func prefixNodes(txn *badger.Txn, prefix string, cursor string, count int) []string {
+	found := make(map[string]bool)
+	for _, keyspace := range []string{"", nodePropPrefix, aliasOfPrefix, crossEdgePrefix} {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(keyspace + prefix)
+		it := txn.NewIterator(opts)
+		if cursor != "" {
+			it.Seek([]byte(keyspace + cursor))
+		} else {
+			it.Rewind()
+		}
+		// Every keyspace holds the count first nodes it has, so together they hold the
+		// count first nodes.
+		n := 0
+		last := cursor
+		for ; it.Valid() && n < count; it.Next() {
+			node := string(it.Item().Key()[len(keyspace):])
+			if i := strings.Index(node, keySep); i >= 0 {
+				node = node[:i]
+			}
+			if node <= last {
+				continue
+			}
+			found[node] = true
+			last = node
+			n++
+		}
+		it.Close()
+	}
+	nodes := sortedNeighbors(found)
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+// commitRemoveBatch saves the progress of entry with the batch in txn, or deletes it once the
+// removal is done.
+func (g *Graph) commitRemoveBatch(txn *badger.Txn, entry *journalEntry, done bool) error {
+	var err error
+	if done {
+		err = deleteJournalEntry(txn, entry)
+	} else {
+		err = writeJournalEntry(txn, entry)
+	}
+	if err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// removeEdgeData records the removal of from->to in the changelog and deletes its properties.
+// The caller updates the edge list of from.
+func (g *Graph) removeEdgeData(txn *badger.Txn, from string, to string) error {
+	err := g.recordChange(txn, ChangeRemoveEdge, from, to)
+	if err != nil {
+		return err
+	}
+	return deleteEdgeProperties(txn, from, to)
+}
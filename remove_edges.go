@@ -0,0 +1,310 @@
+package Onyx
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// RemoveMode selects how removals treat nodes and edges that don't exist.
+type RemoveMode int
+
+const (
+	// RemoveStrict returns ErrNodeNotFound or ErrEdgeNotFound and removes nothing.
+	RemoveStrict RemoveMode = iota
+	// RemoveNoOp silently skips what doesn't exist, which suits idempotent cleanup jobs.
+	RemoveNoOp
+)
+
+// notFoundError is a typed not found error that still matches badger.ErrKeyNotFound, which
+// removals used to return, for callers checking with errors.Is.
+type notFoundError struct {
+	msg string
+}
+
+func (e *notFoundError) Error() string {
+	return e.msg
+}
+
+func (e *notFoundError) Is(target error) bool {
+	return target == badger.ErrKeyNotFound
+}
+
+var (
+	ErrNodeNotFound error = &notFoundError{"onyx: node not found"}
+	ErrEdgeNotFound error = &notFoundError{"onyx: edge not found"}
+)
+
+// WithRemoveMode sets the RemoveMode of RemoveEdge, RemoveEdges and RemoveNode. The default is RemoveStrict.
+func WithRemoveMode(mode RemoveMode) Option {
+	return func(g *Graph) {
+		g.removeMode = mode
+	}
+}
+
+// RemoveEdges removes the edges from from to every node in tos and returns how many were
+// removed. In RemoveStrict mode nothing is removed unless from and all the edges exist.
+func (g *Graph) RemoveEdges(from string, tos []string, txn *badger.Txn) (int, error) {
+	from = g.nodeID(from)
+	tos = g.nodeIDs(tos)
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("RemoveEdges")
+		if err != nil {
+			return 0, err
+		}
+		defer end()
+		txn = g.DB.NewTransaction(true)
+		defer txn.Discard()
+	}
+
+	from, err := g.resolveID(txn, from)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := g.removeEdges(txn, from, tos)
+	if err != nil {
+		return 0, err
+	}
+
+	if localTxn {
+		err = txn.Commit()
+		if err != nil {
+			g.recordConflict(err, from)
+			return 0, err
+		}
+	}
+	return removed, nil
+}
+
+// removeEdges removes the edges from->to for every to in tos, resolving redirects of the
+// neighbors. from is canonical. The edge list is only rewritten if an edge was removed.
+func (g *Graph) removeEdges(txn *badger.Txn, from string, tos []string) (int, error) {
+	dstNodes, exists, err := readEdgeMap(txn, from)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		if g.removeMode == RemoveStrict {
+			return 0, fmt.Errorf("%w: %s", ErrNodeNotFound, from)
+		}
+		return 0, nil
+	}
+
+	resolver := g.newRedirectResolver(txn)
+	targets := make(map[string]string, len(tos))
+	for _, to := range tos {
+		canonical, err := resolver.resolve(to)
+		if err != nil {
+			return 0, err
+		}
+		targets[canonical] = to
+	}
+
+	var remove []string
+	found := make(map[string]bool, len(targets))
+	for _, neighbor := range sortedNeighbors(dstNodes) {
+		canonical, err := resolver.resolve(neighbor)
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := targets[canonical]; ok {
+			remove = append(remove, neighbor)
+			found[canonical] = true
+		}
+	}
+	if g.removeMode == RemoveStrict && len(found) < len(targets) {
+		for canonical, to := range targets {
+			if !found[canonical] {
+				return 0, fmt.Errorf("%w: %s->%s", ErrEdgeNotFound, from, to)
+			}
+		}
+	}
+	if len(remove) == 0 {
+		return 0, nil
+	}
+	for _, neighbor := range remove {
+		if err := g.checkWritePolicies(txn, MutationOp{Kind: MutationRemoveEdge, From: from, To: neighbor}); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, neighbor := range remove {
+		if err := g.removeEdgeData(txn, from, neighbor); err != nil {
+			return 0, err
+		}
+		delete(dstNodes, neighbor)
+	}
+	return len(remove), g.writeEdgeMap(txn, from, dstNodes)
+}
+
+// RemoveNode removes node with its properties, its out-edges and every edge pointing at it,
+// and reports whether it existed: had an edge list, properties or inbound edges. Without a
+// reverse edge index (see IndexReverseEdges) finding the inbound edges scans every edge list
+// in txn, so use RemoveNodesWithPrefix for removals that don't fit in one transaction.
+func (g *Graph) RemoveNode(node string, txn *badger.Txn) (bool, error) {
+	node = g.nodeID(node)
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("RemoveNode")
+		if err != nil {
+			return false, err
+		}
+		defer end()
+		txn = g.DB.NewTransaction(true)
+		defer txn.Discard()
+	}
+
+	node, err := g.resolveID(txn, node)
+	if err != nil {
+		return false, err
+	}
+	dstNodes, exists, err := readEdgeMap(txn, node)
+	if err != nil {
+		return false, err
+	}
+	props, err := readNodeProperties(txn, node, nil)
+	if err != nil {
+		return false, err
+	}
+	// A node that is only the target of edges has neither an edge list nor properties.
+	resolver := g.newRedirectResolver(txn)
+	inbound, err := g.inboundEdgeLists(txn, resolver, node)
+	if err != nil {
+		return false, err
+	}
+	if !exists && len(props) == 0 && len(inbound) == 0 {
+		if g.removeMode == RemoveStrict {
+			return false, fmt.Errorf("%w: %s", ErrNodeNotFound, node)
+		}
+		return false, nil
+	}
+	if err := g.checkRemoveNodePolicies(txn, resolver, node, dstNodes, inbound); err != nil {
+		return false, err
+	}
+
+	for _, to := range sortedNeighbors(dstNodes) {
+		if err := g.removeEdgeData(txn, node, to); err != nil {
+			return false, err
+		}
+	}
+	if err := g.deleteNode(txn, node); err != nil {
+		return false, err
+	}
+
+	written := []string{node}
+	for from, dstNodes := range inbound {
+		written = append(written, from)
+		for _, to := range sortedNeighbors(dstNodes) {
+			if canonical, _ := resolver.resolve(to); canonical != node {
+				continue
+			}
+			if err := g.removeEdgeData(txn, from, to); err != nil {
+				return false, err
+			}
+			delete(dstNodes, to)
+		}
+		if err := g.writeEdgeMap(txn, from, dstNodes); err != nil {
+			return false, err
+		}
+	}
+
+	if localTxn {
+		err = txn.Commit()
+		if err != nil {
+			g.recordConflict(err, written...)
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// deleteNode records the removal of node in the changelog and deletes its edge list,
+// properties, cross edges and aliases. The caller removes the edges of node first.
+func (g *Graph) deleteNode(txn *badger.Txn, node string) error {
+	if err := g.recordChange(txn, ChangeRemoveNode, node, ""); err != nil {
+		return err
+	}
+	return deleteNodeData(txn, node)
+}
+
+// deleteNodeData is deleteNode without the changelog record, for followers applying one.
+func deleteNodeData(txn *badger.Txn, node string) error {
+	if err := deleteEdgeMap(txn, node); err != nil {
+		return err
+	}
+	if err := deleteNodeProperties(txn, node); err != nil {
+		return err
+	}
+	if err := deleteCrossEdges(txn, node); err != nil {
+		return err
+	}
+	return deleteAliases(txn, node)
+}
+
+// checkRemoveNodePolicies runs the write policies on every edge RemoveNode removes with
+// node, its out-edges dstNodes and the edges of inbound pointing at it, before any is.
+func (g *Graph) checkRemoveNodePolicies(txn *badger.Txn, resolver *redirectResolver, node string, dstNodes map[string]bool, inbound map[string]map[string]bool) error {
+	if g.policies.Load() == nil {
+		return nil
+	}
+	for _, to := range sortedNeighbors(dstNodes) {
+		canonical, err := resolver.resolve(to)
+		if err != nil {
+			return err
+		}
+		if err := g.checkWritePolicies(txn, MutationOp{Kind: MutationRemoveEdge, From: node, To: canonical}); err != nil {
+			return err
+		}
+	}
+	sources := make([]string, 0, len(inbound))
+	for from := range inbound {
+		sources = append(sources, from)
+	}
+	sort.Strings(sources)
+	for _, from := range sources {
+		if err := g.checkWritePolicies(txn, MutationOp{Kind: MutationRemoveEdge, From: from, To: node}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inboundEdgeLists returns the edge lists of the nodes other than node with an edge pointing
+// at node or at an ID redirected to it, keyed by their source. The reverse edge index is used
+// if it is ready: inEdges reads the entries of node and of every ID redirected to it, since
+// an edge stays stored under the ID it was added with until ResolveRedirects.
+func (g *Graph) inboundEdgeLists(txn *badger.Txn, resolver *redirectResolver, node string) (map[string]map[string]bool, error) {
+	inbound := make(map[string]map[string]bool)
+	srcNodes, _, err := g.inEdges(txn, node)
+	if err == nil {
+		for from := range srcNodes {
+			if from == node {
+				continue
+			}
+			dstNodes, _, err := readEdgeMap(txn, from)
+			if err != nil {
+				return nil, err
+			}
+			inbound[from] = dstNodes
+		}
+		return inbound, nil
+	} else if err != ErrNoReverseIndex && err != ErrReverseIndexNotReady {
+		return nil, err
+	}
+
+	err = forEachEdgeList(txn, func(from string, dstNodes map[string]bool) error {
+		for to := range dstNodes {
+			canonical, err := resolver.resolve(to)
+			if err != nil {
+				return err
+			}
+			if canonical == node && from != node {
+				inbound[from] = dstNodes
+			}
+		}
+		return nil
+	})
+	return inbound, err
+}
@@ -0,0 +1,356 @@
+package Onyx
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Replication ships the changelog of a primary graph to a follower graph. The follower
+// starts with a full sync built on Backup and Restore and then applies change records in
+// order, storing the last applied sequence number in the same transaction as the change,
+// so it can resume exactly where it stopped after a crash or a broken connection.
+//
+// Only edge changes and node removals are recorded in the changelog, so properties set on
+// the primary after the full sync are not replicated. Package onyxgrpc serves a
+// ReplicationSource over gRPC for followers in other processes.
+
+const metaReplicationAppliedKey = "replication-applied"
+
+// ErrChangesOutOfOrder is returned by a follower whose source sends a change at or below the
+// version the follower already applied, or above the version the source reports.
+var ErrChangesOutOfOrder = errors.New("onyx: change source sent changes out of sequence order")
+
+// ChangeSource is the primary side of replication as seen by a Follower. ReplicationSource
+// implements it for a Graph in the same process, and onyxgrpc.NewChangeSource for a primary
+// served by onyxgrpc.RegisterReplication.
+type ChangeSource interface {
+	// Snapshot writes a full backup of the primary to w.
+	Snapshot(ctx context.Context, w io.Writer) error
+	// ChangesSince calls fn with every change after since, in order, and returns the
+	// current version of the primary. It must not skip a change below one it sends, nor send
+	// one above the version it returns: the follower moves past every version it applied.
+	ChangesSince(ctx context.Context, since uint64, fn func(record ChangeRecord) error) (uint64, error)
+}
+
+type ReplicationRole int
+
+const (
+	RoleNone ReplicationRole = iota
+	RolePrimary
+	RoleFollower
+)
+
+type ReplicationStatus struct {
+	Role ReplicationRole
+	// Version is the current version of a primary or the last applied version of a follower.
+	Version uint64
+	// LagRecords is how many versions the follower is behind the primary, as last reported by
+	// the other side. Sequence numbers may have gaps, so it is an upper bound on the records.
+	LagRecords uint64
+	// LagTime is roughly the age of the oldest change the follower has not applied yet.
+	LagTime time.Duration
+	// LastContact is when the two sides last talked.
+	LastContact time.Time
+	// LastError is the last error the follower ran into, cleared by the next successful sync.
+	LastError error
+}
+
+type replicationState struct {
+	mu     sync.Mutex
+	status ReplicationStatus
+}
+
+// ReplicationStatus returns the replication status of the graph, with RoleNone if the graph
+// is neither a primary nor a follower.
+func (g *Graph) ReplicationStatus() ReplicationStatus {
+	if g.replication == nil {
+		return ReplicationStatus{}
+	}
+	g.replication.mu.Lock()
+	defer g.replication.mu.Unlock()
+	return g.replication.status
+}
+
+// ReplicationSource serves the changelog of a primary graph, which must be opened with WithChangelog.
+type ReplicationSource struct {
+	g *Graph
+}
+
+func NewReplicationSource(g *Graph) (*ReplicationSource, error) {
+	if !g.changelog {
+		return nil, errors.New("onyx: replication requires the primary to be opened WithChangelog")
+	}
+	g.replication = &replicationState{status: ReplicationStatus{Role: RolePrimary}}
+	return &ReplicationSource{g: g}, nil
+}
+
+func (s *ReplicationSource) Snapshot(ctx context.Context, w io.Writer) error {
+	return s.g.Backup(w)
+}
+
+// ChangesSince treats since as an acknowledgement that the follower applied every change up to it.
+// The changes and the version are read from one snapshot. Change records commit in sequence
+// order, so the snapshot has every change up to its version and none above.
+func (s *ReplicationSource) ChangesSince(ctx context.Context, since uint64, fn func(record ChangeRecord) error) (uint64, error) {
+	txn := s.g.DB.NewTransaction(false)
+	defer txn.Discard()
+
+	head, err := s.g.CurrentVersion(txn)
+	if err != nil {
+		return 0, err
+	}
+
+	var oldestPending time.Time
+	err = s.g.Changes(since, func(record ChangeRecord) error {
+		if oldestPending.IsZero() {
+			oldestPending = record.Time
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(record)
+	}, txn)
+
+	state := s.g.replication
+	state.mu.Lock()
+	state.status.Version = head
+	state.status.LagRecords = 0
+	if head > since {
+		state.status.LagRecords = head - since
+	}
+	state.status.LagTime = 0
+	if !oldestPending.IsZero() {
+		state.status.LagTime = time.Since(oldestPending)
+	}
+	state.status.LastContact = time.Now()
+	state.mu.Unlock()
+
+	return head, err
+}
+
+type FollowerOptions struct {
+	// PollInterval is how long the follower waits for new changes once caught up. Defaults to 100ms.
+	PollInterval time.Duration
+	// RetryInterval is how long the follower waits after an error before reconnecting. Defaults to 1s.
+	RetryInterval time.Duration
+}
+
+// Follower applies the changes of a primary to a second graph. See ChangeSource.
+type Follower struct {
+	g      *Graph
+	source ChangeSource
+	opts   FollowerOptions
+}
+
+func NewFollower(g *Graph, source ChangeSource, opts FollowerOptions) *Follower {
+	if opts.PollInterval == 0 {
+		opts.PollInterval = 100 * time.Millisecond
+	}
+	if opts.RetryInterval == 0 {
+		opts.RetryInterval = time.Second
+	}
+	g.replication = &replicationState{status: ReplicationStatus{Role: RoleFollower}}
+	return &Follower{g: g, source: source, opts: opts}
+}
+
+// Run replicates until ctx is cancelled, or the graph is closed, reconnecting after errors.
+// It returns ctx.Err(), or ErrClosed.
+func (f *Follower) Run(ctx context.Context) error {
+	ctx, end, err := f.g.track(ctx, "Follower.Run")
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	for {
+		caughtUp, err := f.Sync(ctx)
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+
+		wait := f.opts.PollInterval
+		if err != nil {
+			wait = f.opts.RetryInterval
+		} else if !caughtUp {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Sync does one round of replication: a full sync if the follower has never synced or fell
+// behind the retained changelog of the primary, followed by every change the primary has.
+// It reports whether the follower has caught up with the version the primary reported.
+func (f *Follower) Sync(ctx context.Context) (bool, error) {
+	caughtUp, err := f.sync(ctx)
+
+	state := f.g.replication
+	state.mu.Lock()
+	state.status.LastError = err
+	state.mu.Unlock()
+	return caughtUp, err
+}
+
+func (f *Follower) sync(ctx context.Context) (bool, error) {
+	applied, synced, err := f.applied()
+	if err != nil {
+		return false, err
+	}
+	if !synced {
+		applied, err = f.fullSync(ctx)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	head, err := f.source.ChangesSince(ctx, applied, func(record ChangeRecord) error {
+		if record.Seq <= applied {
+			return ErrChangesOutOfOrder
+		}
+		err := f.apply(record)
+		if err == nil {
+			applied = record.Seq
+			f.updateStatus(applied, 0, record.Time)
+		}
+		return err
+	})
+	var unavailable *ErrVersionUnavailable
+	if errors.As(err, &unavailable) {
+		// The primary pruned changes we haven't applied yet, start over from a full sync.
+		err = f.g.DB.Update(func(txn *badger.Txn) error {
+			return txn.Delete(metaKey(metaReplicationAppliedKey))
+		})
+		if err != nil {
+			return false, err
+		}
+		return false, unavailable
+	} else if err != nil {
+		return false, err
+	}
+	if applied > head {
+		return false, ErrChangesOutOfOrder
+	}
+
+	f.updateStatus(applied, head, time.Time{})
+	return applied >= head, nil
+}
+
+func (f *Follower) updateStatus(applied uint64, head uint64, appliedTime time.Time) {
+	state := f.g.replication
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.status.Version = applied
+	state.status.LastContact = time.Now()
+	if head != 0 {
+		state.status.LagRecords = 0
+		if head > applied {
+			state.status.LagRecords = head - applied
+		}
+	}
+	if !appliedTime.IsZero() {
+		state.status.LagTime = time.Since(appliedTime)
+	} else if state.status.LagRecords == 0 {
+		state.status.LagTime = 0
+	}
+}
+
+func (f *Follower) applied() (uint64, bool, error) {
+	var applied uint64
+	err := f.g.DB.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(metaKey(metaReplicationAppliedKey))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			applied = binary.BigEndian.Uint64(val)
+			return nil
+		})
+	})
+	if err == badger.ErrKeyNotFound {
+		return 0, false, nil
+	}
+	return applied, err == nil, err
+}
+
+func (f *Follower) fullSync(ctx context.Context) (uint64, error) {
+	err := f.g.DB.DropAll()
+	if err != nil {
+		return 0, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(f.source.Snapshot(ctx, pw))
+	}()
+	err = f.g.Restore(pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return 0, err
+	}
+
+	// The backup is one snapshot of the primary and contains its changelog, so the head of the
+	// changelog is the version the snapshot was taken at. Changes still in flight on the
+	// primary commit above it and are sent by ChangesSince.
+	applied, err := f.g.CurrentVersion(nil)
+	if err != nil {
+		return 0, err
+	}
+	err = f.g.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set(metaKey(metaReplicationAppliedKey), binary.BigEndian.AppendUint64(nil, applied))
+	})
+	return applied, err
+}
+
+// apply applies one change record, copies it into the changelog of the follower and
+// advances the applied version, all in one transaction. The change is applied with the
+// helpers the primary made it with, minus recording it, since the record is copied.
+func (f *Follower) apply(record ChangeRecord) error {
+	return f.g.DB.Update(func(txn *badger.Txn) error {
+		var err error
+		switch record.Op {
+		case ChangeAddEdge, ChangeRemoveEdge:
+			err = f.applyEdge(txn, record)
+		case ChangeRemoveNode:
+			err = deleteNodeData(txn, record.From)
+		default:
+			err = fmt.Errorf("onyx: change %d has unknown operation %v", record.Seq, record.Op)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = writeChangeRecord(txn, record)
+		if err != nil {
+			return err
+		}
+		return txn.Set(metaKey(metaReplicationAppliedKey), binary.BigEndian.AppendUint64(nil, record.Seq))
+	})
+}
+
+func (f *Follower) applyEdge(txn *badger.Txn, record ChangeRecord) error {
+	dstNodes, _, err := readEdgeMap(txn, record.From)
+	if err != nil {
+		return err
+	}
+	if record.Op == ChangeAddEdge {
+		dstNodes[record.To] = true
+	} else {
+		delete(dstNodes, record.To)
+		// Like removeEdgeData, this also deletes the provenance of the edge.
+		if err := deleteEdgeProperties(txn, record.From, record.To); err != nil {
+			return err
+		}
+	}
+	return f.g.writeEdgeMap(txn, record.From, dstNodes)
+}
@@ -0,0 +1,357 @@
+package Onyx
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// The reverse edge index has one empty entry per edge, keyed by its destination:
+//
+//	reverseEdgePrefix + to + keySep + from
+//
+// to is the destination as it is stored in the edge list of from, so edges pointing at a
+// redirected ID are indexed under that ID. Like property indexes, entries are maintained in
+// the transaction of every edge list write (see updateEdgeListIndexes) once IndexReverseEdges
+// has been called, and existing edges are backfilled in batches that record their progress.
+
+const metaReverseIndexKey = "reverse-index"
+
+// Read repairs over the rate limit are skipped. The stale entries are still filtered out of
+// the results and are repaired by a later read.
+const (
+	readRepairRate  = 100
+	readRepairBurst = 100
+)
+
+var (
+	ErrNoReverseIndex       = errors.New("onyx: reverse edge index has not been built, see IndexReverseEdges")
+	ErrReverseIndexNotReady = errors.New("onyx: reverse edge index is still being backfilled")
+)
+
+// WithReadRepair makes GetInEdges verify every predecessor it reads from the reverse edge
+// index against the predecessor's edge list. Entries the edge list doesn't confirm are left
+// out of the result, counted in Metrics.ReverseIndexDrift and deleted in a follow-up write,
+// at most readRepairRate per second.
+func WithReadRepair(on bool) Option {
+	return func(g *Graph) {
+		g.readRepair = on
+	}
+}
+
+func reverseIndexMetaKey() []byte {
+	return metaKey(metaReverseIndexKey)
+}
+
+// reverseEdgePrefixOf returns the prefix of the reverse index entries of the edges pointing at to.
+func reverseEdgePrefixOf(to string) []byte {
+	return []byte(reverseEdgePrefix + to + keySep)
+}
+
+func reverseEdgeKey(to string, from string) []byte {
+	return append(reverseEdgePrefixOf(to), from...)
+}
+
+// updateReverseIndex replaces the reverse index entries of the edges in old, the current edge
+// list of from, with the ones of dstNodes. A nil dstNodes removes them all.
+func updateReverseIndex(txn *badger.Txn, from string, old map[string]bool, dstNodes map[string]bool) error {
+	for to := range old {
+		if !dstNodes[to] {
+			if err := txn.Delete(reverseEdgeKey(to, from)); err != nil {
+				return err
+			}
+		}
+	}
+	for to := range dstNodes {
+		if !old[to] {
+			if err := txn.Set(reverseEdgeKey(to, from), nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// IndexReverseEdges creates the reverse edge index used by GetInEdges, or finishes building
+// it if a previous call was interrupted, and returns once every existing edge has been indexed.
+func (g *Graph) IndexReverseEdges() error {
+	end, err := g.begin("IndexReverseEdges")
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	err = g.DB.Update(func(txn *badger.Txn) error {
+		state, err := readIndexStateAt(txn, reverseIndexMetaKey())
+		if err != nil || state != nil {
+			return err
+		}
+		return writeIndexStateAt(txn, reverseIndexMetaKey(), &indexState{})
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		if g.closing() {
+			return ErrClosed
+		}
+		if err := g.faultPoint("IndexReverseEdges"); err != nil {
+			return err
+		}
+		done, err := g.backfillReverseIndexBatch(indexBackfillBatch)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// backfillReverseIndexBatch indexes the edges of the next nodes after the cursor, stopping
+// after the node that brings the batch to batchSize edges.
+func (g *Graph) backfillReverseIndexBatch(batchSize int) (bool, error) {
+	txn := g.DB.NewTransaction(true)
+	defer txn.Discard()
+
+	state, err := readIndexStateAt(txn, reverseIndexMetaKey())
+	if err != nil {
+		return false, err
+	}
+	if state == nil {
+		return false, ErrNoReverseIndex
+	}
+	if state.Ready {
+		return true, nil
+	}
+
+	it := newNodeIterator(txn, badger.DefaultIteratorOptions)
+	n := 0
+	it.Seek(state.Cursor)
+	if it.Valid() && bytes.Equal(it.Item().Key(), state.Cursor) {
+		it.Next()
+	}
+	done := true
+	for ; it.Valid(); it.Next() {
+		if n >= batchSize {
+			done = false
+			break
+		}
+		item := it.Item()
+		from := string(item.Key())
+		state.Cursor = item.KeyCopy(state.Cursor[:0])
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			it.Close()
+			return false, err
+		}
+		dstNodes, _, err := decodeEdgeList(txn, from, val)
+		if err != nil {
+			it.Close()
+			return false, err
+		}
+		for to := range dstNodes {
+			if err := txn.Set(reverseEdgeKey(to, from), nil); err != nil {
+				it.Close()
+				return false, err
+			}
+		}
+		n += len(dstNodes) + 1
+	}
+	it.Close()
+
+	state.Ready = done
+	err = writeIndexStateAt(txn, reverseIndexMetaKey(), state)
+	if err != nil {
+		return false, err
+	}
+	return done, txn.Commit()
+}
+
+// DropReverseEdgeIndex deletes the reverse edge index and all its entries, in batches of separate transactions.
+func (g *Graph) DropReverseEdgeIndex() error {
+	end, err := g.begin("DropReverseEdgeIndex")
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	err = g.DB.Update(func(txn *badger.Txn) error {
+		return txn.Delete(reverseIndexMetaKey())
+	})
+	if err != nil {
+		return err
+	}
+	return g.deletePrefix([]byte(reverseEdgePrefix))
+}
+
+// staleReverseEdge is a reverse index entry whose edge isn't in the edge list of From.
+type staleReverseEdge struct {
+	From string
+	To   string
+}
+
+// GetInEdges returns the in-neighbors of to, ie the nodes with an edge pointing at to or at
+// an ID redirected to it. It reads the reverse edge index, see IndexReverseEdges and WithReadRepair.
+func (g *Graph) GetInEdges(to string, txn *badger.Txn) (map[string]bool, error) {
+	to = g.nodeID(to)
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("GetInEdges")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	srcNodes, stale, err := g.inEdges(txn, to)
+	if err != nil {
+		return nil, err
+	}
+
+	g.repairReverseIndex(stale)
+	return srcNodes, nil
+}
+
+// inEdges reads the in-neighbors of to from the reverse edge index. With read repair on,
+// entries not confirmed by the edge list of their source are returned separately.
+func (g *Graph) inEdges(txn *badger.Txn, to string) (map[string]bool, []staleReverseEdge, error) {
+	srcNodes := make(map[string]bool)
+	stale, err := g.scanInEdges(txn, to, func(from string, target string) error {
+		srcNodes[from] = true
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return srcNodes, stale, nil
+}
+
+// scanInEdges calls fn with every edge from->target of the reverse edge index, where target is
+// to or an ID redirected to it, the ID the edge and its properties are stored under. With read
+// repair on, entries not confirmed by the edge list of their source are returned instead.
+func (g *Graph) scanInEdges(txn *badger.Txn, to string, fn func(from string, target string) error) ([]staleReverseEdge, error) {
+	state, err := readIndexStateAt(txn, reverseIndexMetaKey())
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, ErrNoReverseIndex
+	}
+	if !state.Ready {
+		return nil, ErrReverseIndexNotReady
+	}
+
+	resolver := g.newRedirectResolver(txn)
+	to, err = resolver.resolve(to)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := resolver.aliasesOf(to)
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []staleReverseEdge
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	for _, target := range append(targets, to) {
+		opts.Prefix = reverseEdgePrefixOf(target)
+		it := txn.NewIterator(opts)
+		for it.Rewind(); it.Valid(); it.Next() {
+			from := string(it.Item().Key()[len(opts.Prefix):])
+			if g.readRepair {
+				dstNodes, _, err := readEdgeMap(txn, from)
+				if err != nil {
+					it.Close()
+					return nil, err
+				}
+				if !dstNodes[target] {
+					stale = append(stale, staleReverseEdge{From: from, To: target})
+					continue
+				}
+			}
+			if err := fn(from, target); err != nil {
+				it.Close()
+				return nil, err
+			}
+		}
+		it.Close()
+	}
+	return stale, nil
+}
+
+// repairReverseIndex deletes the stale entries read by GetInEdges in a new transaction, as
+// far as the repair rate limit allows. Every entry is checked again before it is deleted, as
+// the edge may have been added back since it was read. Failed repairs are left to later reads.
+func (g *Graph) repairReverseIndex(stale []staleReverseEdge) {
+	if len(stale) == 0 {
+		return
+	}
+	g.metrics.reverseIndexDrift.Add(uint64(len(stale)))
+	stale = stale[:g.repairLimiter.take(len(stale), time.Now())]
+	if len(stale) == 0 {
+		return
+	}
+
+	repaired := 0
+	err := g.DB.Update(func(txn *badger.Txn) error {
+		repaired = 0
+		state, err := readIndexStateAt(txn, reverseIndexMetaKey())
+		if err != nil || state == nil {
+			return err
+		}
+		for _, edge := range stale {
+			dstNodes, _, err := readEdgeMap(txn, edge.From)
+			if err != nil {
+				return err
+			}
+			if dstNodes[edge.To] {
+				continue
+			}
+			if err := txn.Delete(reverseEdgeKey(edge.To, edge.From)); err != nil {
+				return err
+			}
+			repaired++
+		}
+		return nil
+	})
+	if err == nil {
+		g.metrics.readRepairs.Add(uint64(repaired))
+	}
+}
+
+// repairLimiter is a token bucket limiting the rate of read repairs.
+type repairLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRepairLimiter(rate float64, burst float64) *repairLimiter {
+	return &repairLimiter{rate: rate, burst: burst, tokens: burst}
+}
+
+// take removes up to n tokens from the bucket and returns how many it removed.
+func (l *repairLimiter) take(n int, now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	if float64(n) > l.tokens {
+		n = int(l.tokens)
+	}
+	l.tokens -= float64(n)
+	return n
+}
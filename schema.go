@@ -0,0 +1,322 @@
+package Onyx
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// A property schema fixes the encoding of every node and edge property with a given name.
+// Schemas are optional: properties without one accept any value. The schema of a property
+// is read in the same transaction as the write it validates, so changing a schema conflicts
+// with concurrent writes of that property instead of racing them.
+//
+// Encodings: String is UTF-8, Int64 and Time (Unix nanoseconds) are 8 big endian bytes,
+// Float64 is the same 8 byte encoding as edge weights, Bool is a single 0 or 1 byte and
+// Bytes is anything.
+
+type PropKind byte
+
+const (
+	PropBytes PropKind = iota + 1
+	PropString
+	PropInt64
+	PropFloat64
+	PropBool
+	PropTime
+)
+
+func (k PropKind) String() string {
+	switch k {
+	case PropBytes:
+		return "bytes"
+	case PropString:
+		return "string"
+	case PropInt64:
+		return "int64"
+	case PropFloat64:
+		return "float64"
+	case PropBool:
+		return "bool"
+	case PropTime:
+		return "time"
+	}
+	return fmt.Sprintf("PropKind(%d)", byte(k))
+}
+
+// ErrPropertyType is returned when a property value doesn't match the kind in its schema.
+type ErrPropertyType struct {
+	Name   string
+	Kind   PropKind
+	Reason string
+}
+
+func (e *ErrPropertyType) Error() string {
+	return fmt.Sprintf("onyx: property %q must be %s: %s", e.Name, e.Kind, e.Reason)
+}
+
+const metaPropSchemaPrefix = "propschema:"
+
+// DefinePropertySchema declares the kind of the property name. Redefining a property
+// with a different kind fails; use RemovePropertySchema first. Existing values are not checked.
+func (g *Graph) DefinePropertySchema(name string, kind PropKind, txn *badger.Txn) error {
+	if kind < PropBytes || kind > PropTime {
+		return fmt.Errorf("onyx: unknown property kind %d", kind)
+	}
+
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("DefinePropertySchema")
+		if err != nil {
+			return err
+		}
+		defer end()
+		txn = g.DB.NewTransaction(true)
+		defer txn.Discard()
+	}
+
+	current, ok, err := readPropertySchema(txn, name)
+	if err != nil {
+		return err
+	}
+	if ok && current != kind {
+		return fmt.Errorf("onyx: property %q is already defined as %s", name, current)
+	}
+	err = txn.Set(metaKey(metaPropSchemaPrefix+name), []byte{byte(kind)})
+	if err != nil {
+		return err
+	}
+
+	if localTxn {
+		err = txn.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *Graph) RemovePropertySchema(name string, txn *badger.Txn) error {
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("RemovePropertySchema")
+		if err != nil {
+			return err
+		}
+		defer end()
+		txn = g.DB.NewTransaction(true)
+		defer txn.Discard()
+	}
+
+	err := txn.Delete(metaKey(metaPropSchemaPrefix + name))
+	if err != nil {
+		return err
+	}
+
+	if localTxn {
+		err = txn.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PropertySchemas returns every defined property schema.
+func (g *Graph) PropertySchemas(txn *badger.Txn) (map[string]PropKind, error) {
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("PropertySchemas")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	schemas := make(map[string]PropKind)
+	prefix := metaKey(metaPropSchemaPrefix)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		err := item.Value(func(val []byte) error {
+			schemas[string(item.Key()[len(prefix):])] = PropKind(val[0])
+			return nil
+		})
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+	}
+	it.Close()
+
+	return schemas, nil
+}
+
+func readPropertySchema(txn *badger.Txn, name string) (PropKind, bool, error) {
+	item, err := txn.Get(metaKey(metaPropSchemaPrefix + name))
+	if err == badger.ErrKeyNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	var kind PropKind
+	err = item.Value(func(val []byte) error {
+		kind = PropKind(val[0])
+		return nil
+	})
+	return kind, true, err
+}
+
+// validateProperty checks value against the schema of name, if it has one.
+func validateProperty(txn *badger.Txn, name string, value []byte) error {
+	kind, ok, err := readPropertySchema(txn, name)
+	if err != nil || !ok {
+		return err
+	}
+	if reason := checkPropKind(kind, value); reason != "" {
+		return &ErrPropertyType{Name: name, Kind: kind, Reason: reason}
+	}
+	return nil
+}
+
+func checkPropKind(kind PropKind, value []byte) string {
+	switch kind {
+	case PropString:
+		if !utf8.Valid(value) {
+			return "value is not valid UTF-8"
+		}
+	case PropInt64, PropFloat64, PropTime:
+		if len(value) != 8 {
+			return fmt.Sprintf("value is %d bytes, expected 8", len(value))
+		}
+	case PropBool:
+		if len(value) != 1 || value[0] > 1 {
+			return "value is not a single 0 or 1 byte"
+		}
+	}
+	return ""
+}
+
+func EncodeString(v string) []byte {
+	return []byte(v)
+}
+
+func EncodeInt64(v int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(v))
+}
+
+func EncodeFloat64(v float64) []byte {
+	return encodeFloat64(v)
+}
+
+func EncodeBool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// EncodeTime encodes v with nanosecond precision. The location is not kept; DecodeTime returns UTC.
+func EncodeTime(v time.Time) []byte {
+	return EncodeInt64(v.UnixNano())
+}
+
+func DecodeInt64(value []byte) (int64, error) {
+	if reason := checkPropKind(PropInt64, value); reason != "" {
+		return 0, fmt.Errorf("onyx: %s", reason)
+	}
+	return int64(binary.BigEndian.Uint64(value)), nil
+}
+
+func DecodeFloat64(value []byte) (float64, error) {
+	return decodeFloat64(value)
+}
+
+func DecodeBool(value []byte) (bool, error) {
+	if reason := checkPropKind(PropBool, value); reason != "" {
+		return false, fmt.Errorf("onyx: %s", reason)
+	}
+	return value[0] == 1, nil
+}
+
+func DecodeTime(value []byte) (time.Time, error) {
+	nanos, err := DecodeInt64(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos).UTC(), nil
+}
+
+// getNodeProperty returns the value of one node property, or badger.ErrKeyNotFound.
+func (g *Graph) getNodeProperty(node string, name string, txn *badger.Txn) ([]byte, error) {
+	node = g.nodeID(node)
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("GetNodeProperty")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	props, err := readNodeProperties(txn, node, []string{name})
+	if err != nil {
+		return nil, err
+	}
+	value, ok := props[name]
+	if !ok {
+		return nil, badger.ErrKeyNotFound
+	}
+
+	return value, nil
+}
+
+// The typed getters return badger.ErrKeyNotFound if node doesn't have the property.
+
+func (g *Graph) GetNodePropertyString(node string, name string, txn *badger.Txn) (string, error) {
+	value, err := g.getNodeProperty(node, name, txn)
+	return string(value), err
+}
+
+func (g *Graph) GetNodePropertyInt64(node string, name string, txn *badger.Txn) (int64, error) {
+	value, err := g.getNodeProperty(node, name, txn)
+	if err != nil {
+		return 0, err
+	}
+	return DecodeInt64(value)
+}
+
+func (g *Graph) GetNodePropertyFloat64(node string, name string, txn *badger.Txn) (float64, error) {
+	value, err := g.getNodeProperty(node, name, txn)
+	if err != nil {
+		return 0, err
+	}
+	return DecodeFloat64(value)
+}
+
+func (g *Graph) GetNodePropertyBool(node string, name string, txn *badger.Txn) (bool, error) {
+	value, err := g.getNodeProperty(node, name, txn)
+	if err != nil {
+		return false, err
+	}
+	return DecodeBool(value)
+}
+
+func (g *Graph) GetNodePropertyTime(node string, name string, txn *badger.Txn) (time.Time, error) {
+	value, err := g.getNodeProperty(node, name, txn)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return DecodeTime(value)
+}
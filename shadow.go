@@ -0,0 +1,215 @@
+package Onyx
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"maps"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// EdgeListCodec encodes edge lists. Edge lists are stored with GobCodec; another codec can be
+// checked against the live writes with WithShadowCodec before it is trusted with data.
+type EdgeListCodec struct {
+	Name   string
+	Encode func(dstNodes map[string]bool) ([]byte, error)
+	Decode func(data []byte) (map[string]bool, error)
+}
+
+var GobCodec = EdgeListCodec{Name: "gob", Encode: serializeEdgeMap, Decode: deserializeEdgeMap}
+
+type ShadowOptions struct {
+	// Strict fails the writes whose edge list the candidate codec doesn't round-trip with an
+	// *ErrShadowMismatch, instead of only recording the mismatch.
+	Strict bool
+}
+
+// WithShadowCodec turns on shadow mode: every edge list write is also encoded with candidate
+// and decoded back, and an edge list that doesn't come back the same is a mismatch. The edge
+// list is still stored with GobCodec. Mismatches are logged as warnings with the node ID, see
+// WithLogger, counted in Metrics.ShadowMismatches and recorded per node for ShadowReport, in a
+// transaction of their own so they are kept even if the write fails. StopShadowCodec turns
+// the mode off.
+func WithShadowCodec(candidate EdgeListCodec, opts ShadowOptions) Option {
+	return func(g *Graph) {
+		g.shadow = &shadowMode{codec: candidate, strict: opts.Strict}
+		g.shadow.on.Store(true)
+	}
+}
+
+type shadowMode struct {
+	codec   EdgeListCodec
+	strict  bool
+	on      atomic.Bool
+	checked atomic.Uint64
+}
+
+// ErrShadowMismatch is returned by writes in strict shadow mode when the candidate codec
+// doesn't round-trip the edge list of Node.
+type ErrShadowMismatch struct {
+	Node   string
+	Codec  string
+	Reason string
+}
+
+func (e *ErrShadowMismatch) Error() string {
+	return fmt.Sprintf("onyx: codec %q doesn't round-trip the edge list of %s: %s", e.Codec, e.Node, e.Reason)
+}
+
+// ShadowMismatch is the record of the mismatches of one node.
+type ShadowMismatch struct {
+	Node      string
+	Codec     string
+	Count     int
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Reason is why the last mismatch happened.
+	Reason string
+}
+
+type ShadowReport struct {
+	// Codec is the candidate codec, empty if shadow mode is off.
+	Codec string
+	// Checked is the number of edge list writes checked since the graph was opened.
+	Checked uint64
+	// Mismatches is the number of mismatches recorded, and Nodes their records by node, in
+	// node order. Records are kept across restarts until StopShadowCodec.
+	Mismatches int
+	Nodes      []ShadowMismatch
+}
+
+func shadowKey(node string) []byte {
+	return []byte(shadowPrefix + node)
+}
+
+// checkShadow round-trips the edge list of from through the candidate codec, if shadow mode
+// is on.
+func (g *Graph) checkShadow(from string, dstNodes map[string]bool) error {
+	s := g.shadow
+	if s == nil || !s.on.Load() {
+		return nil
+	}
+	s.checked.Add(1)
+	reason := ""
+	encoded, err := s.codec.Encode(dstNodes)
+	if err != nil {
+		reason = "encode: " + err.Error()
+	} else if decoded, err := s.codec.Decode(encoded); err != nil {
+		reason = "decode: " + err.Error()
+	} else if !maps.Equal(decoded, dstNodes) {
+		reason = fmt.Sprintf("decoded %d edges, wrote %d", len(decoded), len(dstNodes))
+	}
+	if reason == "" {
+		return nil
+	}
+
+	g.metrics.shadowMismatches.Add(1)
+	g.log().Warn("onyx: shadow codec mismatch", "codec", s.codec.Name, "node", from, "reason", reason)
+	if err := g.recordShadowMismatch(from, reason); err != nil {
+		g.log().Warn("onyx: recording shadow codec mismatch", "node", from, "err", err)
+	}
+	if s.strict {
+		return &ErrShadowMismatch{Node: from, Codec: s.codec.Name, Reason: reason}
+	}
+	return nil
+}
+
+func (g *Graph) recordShadowMismatch(node string, reason string) error {
+	return g.DB.Update(func(txn *badger.Txn) error {
+		now := time.Now()
+		record := ShadowMismatch{Node: node, Codec: g.shadow.codec.Name, FirstSeen: now}
+		item, err := txn.Get(shadowKey(node))
+		if err == nil {
+			err = item.Value(func(val []byte) error {
+				return gob.NewDecoder(bytes.NewReader(val)).Decode(&record)
+			})
+		} else if err == badger.ErrKeyNotFound {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		record.Count++
+		record.LastSeen, record.Reason = now, reason
+
+		b := new(bytes.Buffer)
+		if err := gob.NewEncoder(b).Encode(record); err != nil {
+			return err
+		}
+		return txn.Set(shadowKey(node), b.Bytes())
+	})
+}
+
+// ShadowReport summarizes the mismatches recorded in shadow mode, see WithShadowCodec.
+func (g *Graph) ShadowReport() (*ShadowReport, error) {
+	end, err := g.begin("ShadowReport")
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	txn, release := g.readTxn()
+	defer release()
+
+	report := &ShadowReport{}
+	if g.shadow != nil && g.shadow.on.Load() {
+		report.Codec = g.shadow.codec.Name
+		report.Checked = g.shadow.checked.Load()
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(shadowPrefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		var record ShadowMismatch
+		err := it.Item().Value(func(val []byte) error {
+			return gob.NewDecoder(bytes.NewReader(val)).Decode(&record)
+		})
+		if err != nil {
+			return nil, err
+		}
+		report.Mismatches += record.Count
+		report.Nodes = append(report.Nodes, record)
+	}
+	sort.Slice(report.Nodes, func(i, j int) bool {
+		return report.Nodes[i].Node < report.Nodes[j].Node
+	})
+	return report, nil
+}
+
+// StopShadowCodec turns shadow mode off and deletes the mismatch records, returning the last
+// report. It also deletes the records left by an earlier run when the graph was opened
+// without WithShadowCodec.
+func (g *Graph) StopShadowCodec() (*ShadowReport, error) {
+	if g.shadow != nil {
+		g.shadow.on.Store(false)
+	}
+	report, err := g.ShadowReport()
+	if err != nil {
+		return nil, err
+	}
+	if g.shadow != nil {
+		report.Codec = g.shadow.codec.Name
+		report.Checked = g.shadow.checked.Load()
+	}
+
+	end, err := g.begin("StopShadowCodec")
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	w := &chunkedWriter{g: g, point: "StopShadowCodec"}
+	defer w.discard()
+	for _, record := range report.Nodes {
+		err := w.do(func(txn *badger.Txn) error {
+			return txn.Delete(shadowKey(record.Node))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, w.commit()
+}
@@ -0,0 +1,145 @@
+package Onyx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultDrainTimeout = 30 * time.Second
+
+// ErrClosed is returned by operations started after Close was called.
+var ErrClosed = errors.New("onyx: graph is closed")
+
+// ErrDrainTimeout is returned by Close when operations were still running after the drain
+// timeout. Badger is closed anyway, so they fail with badger errors.
+type ErrDrainTimeout struct {
+	// Pending counts the unfinished operations by name.
+	Pending map[string]int
+}
+
+func (e *ErrDrainTimeout) Error() string {
+	names := make([]string, 0, len(e.Pending))
+	for name, n := range e.Pending {
+		names = append(names, fmt.Sprintf("%s (%d)", name, n))
+	}
+	sort.Strings(names)
+	return "onyx: closed with operations still running: " + strings.Join(names, ", ")
+}
+
+// WithDrainTimeout sets how long Close waits for running operations to finish, 30s by default.
+func WithDrainTimeout(timeout time.Duration) Option {
+	return func(g *Graph) {
+		g.drainTimeout = timeout
+	}
+}
+
+// lifecycle tracks the operations running on a graph, so Close can wait for them.
+type lifecycle struct {
+	mu      sync.Mutex
+	closed  bool
+	running map[string]int
+	// drained is closed by the last operation to finish once the graph is closing.
+	drained chan struct{}
+
+	// ctx is cancelled with ErrClosed when the graph starts closing, which stops the
+	// operations that take a context.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &lifecycle{running: make(map[string]int), drained: make(chan struct{}), ctx: ctx, cancel: cancel}
+}
+
+// begin registers a running operation until the returned function is called, or returns
+// ErrClosed if the graph is closing.
+func (g *Graph) begin(name string) (func(), error) {
+	l := g.life
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
+	l.running[name]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.running[name]--; l.running[name] == 0 {
+				delete(l.running, name)
+			}
+			if l.closed && len(l.running) == 0 {
+				close(l.drained)
+			}
+		})
+	}, nil
+}
+
+// track is begin for operations taking a context: the returned context is also cancelled,
+// with ErrClosed as its cause, when the graph starts closing.
+func (g *Graph) track(ctx context.Context, name string) (context.Context, func(), error) {
+	end, err := g.begin(name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := context.AfterFunc(g.life.ctx, func() {
+		cancel(ErrClosed)
+	})
+	return ctx, func() {
+		stop()
+		cancel(nil)
+		end()
+	}, nil
+}
+
+// Closed reports whether Close was called. Operations fail with ErrClosed from then on.
+func (g *Graph) Closed() bool {
+	return g.closing()
+}
+
+// closing reports whether Close was called, for loops that stop between steps.
+func (g *Graph) closing() bool {
+	return g.life.ctx.Err() != nil
+}
+
+// drain stops new operations, cancels the running ones that take a context and waits for all
+// of them to finish, at most drainTimeout.
+func (g *Graph) drain() error {
+	l := g.life
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return ErrClosed
+	}
+	l.closed = true
+	if len(l.running) == 0 {
+		close(l.drained)
+	}
+	l.mu.Unlock()
+	l.cancel(ErrClosed)
+
+	timer := time.NewTimer(g.drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-l.drained:
+		return nil
+	case <-timer.C:
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pending := make(map[string]int, len(l.running))
+	for name, n := range l.running {
+		pending[name] = n
+	}
+	return &ErrDrainTimeout{Pending: pending}
+}
@@ -0,0 +1,357 @@
+package Onyx
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"sort"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// A MinHash sketch of a node is the minimum of k hash functions over the neighbors in its
+// edge list. The fraction of positions at which the sketches of two nodes agree is an
+// unbiased estimate of the Jaccard similarity of their neighborhoods, with a standard error
+// of about sqrt(J(1-J)/k).
+//
+// Sketches are stored under sketchPrefix + node as a stale flag followed by the k minimums.
+// Adding edges folds the new neighbors into the sketch in the writing transaction. Removing
+// edges can't be undone on a minimum, so it only marks the sketch stale, and the next read
+// rebuilds it from the edge list. Nodes without a sketch, like the ones written before
+// sketches were enabled, are rebuilt the same way.
+
+const metaSketchSizeKey = "minhash-k"
+
+const sketchStale = 1
+
+var ErrNoSketches = errors.New("onyx: MinHash sketches are not enabled, see WithMinHashSketches")
+
+// WithMinHashSketches makes the graph keep a MinHash sketch of k hashes for every edge list,
+// used by ApproxJaccard and SimilarNodes. The sketches are persisted; opening the graph with
+// a different k rebuilds them lazily, and opening it without the option deletes them.
+func WithMinHashSketches(k int) Option {
+	return func(g *Graph) {
+		g.sketchSize = k
+	}
+}
+
+func sketchKey(node string) []byte {
+	return []byte(sketchPrefix + node)
+}
+
+// readSketchSize returns the k sketches are maintained with, or 0 if they are disabled.
+func readSketchSize(txn *badger.Txn) (int, error) {
+	item, err := txn.Get(metaKey(metaSketchSizeKey))
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var k uint64
+	err = item.Value(func(val []byte) error {
+		k = binary.BigEndian.Uint64(val)
+		return nil
+	})
+	return int(k), err
+}
+
+// openSketches makes the persisted sketch size match the WithMinHashSketches option.
+func (g *Graph) openSketches() error {
+	drop := false
+	err := g.DB.Update(func(txn *badger.Txn) error {
+		k, err := readSketchSize(txn)
+		if err != nil || k == g.sketchSize || (k == 0 && g.sketchSize <= 0) {
+			return err
+		}
+		if g.sketchSize <= 0 {
+			drop = true
+			return txn.Delete(metaKey(metaSketchSizeKey))
+		}
+		return txn.Set(metaKey(metaSketchSizeKey), binary.BigEndian.AppendUint64(nil, uint64(g.sketchSize)))
+	})
+	if err != nil || !drop {
+		return err
+	}
+	return g.deletePrefix([]byte(sketchPrefix))
+}
+
+// minHash returns the i-th hash of a neighbor from its FNV-1a hash base, mixed with the seed
+// i by the splitmix64 finalizer.
+func minHash(base uint64, i int) uint64 {
+	z := base + uint64(i+1)*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func hashNode(node string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(node))
+	return h.Sum64()
+}
+
+func newSketch(k int) []uint64 {
+	sketch := make([]uint64, k)
+	for i := range sketch {
+		sketch[i] = math.MaxUint64
+	}
+	return sketch
+}
+
+// addToSketch folds neighbor into sketch.
+func addToSketch(sketch []uint64, neighbor string) {
+	base := hashNode(neighbor)
+	for i := range sketch {
+		if h := minHash(base, i); h < sketch[i] {
+			sketch[i] = h
+		}
+	}
+}
+
+func buildSketch(k int, dstNodes map[string]bool) []uint64 {
+	sketch := newSketch(k)
+	for neighbor := range dstNodes {
+		addToSketch(sketch, neighbor)
+	}
+	return sketch
+}
+
+func encodeSketch(sketch []uint64, stale bool) []byte {
+	val := make([]byte, 1, 1+8*len(sketch))
+	if stale {
+		val[0] = sketchStale
+	}
+	for _, h := range sketch {
+		val = binary.BigEndian.AppendUint64(val, h)
+	}
+	return val
+}
+
+// readSketch returns the sketch of node, or nil if it is missing, stale or of another size.
+func readSketch(txn *badger.Txn, k int, node string) ([]uint64, error) {
+	item, err := txn.Get(sketchKey(node))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var sketch []uint64
+	err = item.Value(func(val []byte) error {
+		if val[0] == sketchStale || len(val) != 1+8*k {
+			return nil
+		}
+		sketch = make([]uint64, k)
+		for i := range sketch {
+			sketch[i] = binary.BigEndian.Uint64(val[1+8*i:])
+		}
+		return nil
+	})
+	return sketch, err
+}
+
+// updateSketch updates the sketch of from for its edge list changing from old to dstNodes.
+func updateSketch(txn *badger.Txn, k int, from string, old map[string]bool, dstNodes map[string]bool) error {
+	if dstNodes == nil {
+		return txn.Delete(sketchKey(from))
+	}
+	for to := range old {
+		if !dstNodes[to] {
+			return txn.Set(sketchKey(from), encodeSketch(nil, true))
+		}
+	}
+
+	var sketch []uint64
+	if len(old) == 0 {
+		sketch = newSketch(k)
+	} else {
+		var err error
+		sketch, err = readSketch(txn, k, from)
+		if err != nil || sketch == nil {
+			// A missing sketch is rebuilt by the next read, there is nothing to fold into.
+			return err
+		}
+	}
+	changed := len(old) == 0
+	for to := range dstNodes {
+		if !old[to] {
+			addToSketch(sketch, to)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return txn.Set(sketchKey(from), encodeSketch(sketch, false))
+}
+
+// sketchReader reads sketches in a read-write transaction, rebuilding the ones that are stale.
+type sketchReader struct {
+	g       *Graph
+	txn     *badger.Txn
+	k       int
+	rebuilt bool
+}
+
+func (g *Graph) newSketchReader(txn *badger.Txn) (*sketchReader, error) {
+	k, err := readSketchSize(txn)
+	if err != nil {
+		return nil, err
+	}
+	if k == 0 {
+		return nil, ErrNoSketches
+	}
+	return &sketchReader{g: g, txn: txn, k: k}, nil
+}
+
+// sketch returns the sketch of node. Nodes without an edge list have an empty neighborhood.
+func (r *sketchReader) sketch(node string) ([]uint64, error) {
+	node, err := r.g.resolveID(r.txn, node)
+	if err != nil {
+		return nil, err
+	}
+	sketch, err := readSketch(r.txn, r.k, node)
+	if err != nil || sketch != nil {
+		return sketch, err
+	}
+
+	dstNodes, exists, err := readEdgeMap(r.txn, node)
+	if err != nil {
+		return nil, err
+	}
+	sketch = buildSketch(r.k, dstNodes)
+	if exists {
+		// Sketches that don't fit in the transaction are rebuilt again by a later read.
+		err = r.txn.Set(sketchKey(node), encodeSketch(sketch, false))
+		if err == nil {
+			r.rebuilt = true
+		} else if err != badger.ErrTxnTooBig {
+			return nil, err
+		}
+	}
+	return sketch, nil
+}
+
+// commit stores the rebuilt sketches. A conflict only means they are rebuilt again by a
+// later read, so it isn't an error of the read.
+func (r *sketchReader) commit() error {
+	if !r.rebuilt {
+		return nil
+	}
+	err := r.txn.Commit()
+	if errors.Is(err, badger.ErrConflict) {
+		return nil
+	}
+	return err
+}
+
+func estimateJaccard(a []uint64, b []uint64) float64 {
+	same := 0
+	for i := range a {
+		if a[i] == b[i] && a[i] != math.MaxUint64 {
+			same++
+		}
+	}
+	return float64(same) / float64(len(a))
+}
+
+// ApproxJaccard estimates the Jaccard similarity of the out-neighborhoods of a and b from
+// their MinHash sketches, in O(k) once the sketches are fresh. Nodes without edges have an
+// empty neighborhood, which has a similarity of 0 to every node.
+// Neighbors are hashed as they are stored, so edges pointing at a redirected ID only count
+// as pointing at the canonical ID once ResolveRedirects has rewritten them.
+func (g *Graph) ApproxJaccard(a string, b string) (float64, error) {
+	a, b = g.nodeID(a), g.nodeID(b)
+	if err := validateNodeID(a); err != nil {
+		return 0, err
+	}
+	if err := validateNodeID(b); err != nil {
+		return 0, err
+	}
+
+	end, err := g.begin("ApproxJaccard")
+	if err != nil {
+		return 0, err
+	}
+	defer end()
+	txn := g.DB.NewTransaction(true)
+	defer txn.Discard()
+	reader, err := g.newSketchReader(txn)
+	if err != nil {
+		return 0, err
+	}
+	sketchA, err := reader.sketch(a)
+	if err != nil {
+		return 0, err
+	}
+	sketchB, err := reader.sketch(b)
+	if err != nil {
+		return 0, err
+	}
+	return estimateJaccard(sketchA, sketchB), reader.commit()
+}
+
+type SimilarNode struct {
+	Node       string
+	Similarity float64
+}
+
+// SimilarNodes ranks candidates by the ApproxJaccard similarity of their out-neighborhood to
+// the one of node and returns the topK most similar, most similar first and ties in node
+// order. A topK of 0 returns every candidate. node itself and duplicate candidates are skipped.
+func (g *Graph) SimilarNodes(node string, candidates []string, topK int) ([]SimilarNode, error) {
+	node = g.nodeID(node)
+	candidates = g.nodeIDs(candidates)
+	if err := validateNodeID(node); err != nil {
+		return nil, err
+	}
+	for _, candidate := range candidates {
+		if err := validateNodeID(candidate); err != nil {
+			return nil, err
+		}
+	}
+
+	end, err := g.begin("SimilarNodes")
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	txn := g.DB.NewTransaction(true)
+	defer txn.Discard()
+	reader, err := g.newSketchReader(txn)
+	if err != nil {
+		return nil, err
+	}
+	sketch, err := reader.sketch(node)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{node: true}
+	ranked := make([]SimilarNode, 0, len(candidates))
+	for _, candidate := range candidates {
+		if seen[candidate] {
+			continue
+		}
+		seen[candidate] = true
+		other, err := reader.sketch(candidate)
+		if err != nil {
+			return nil, err
+		}
+		ranked = append(ranked, SimilarNode{Node: candidate, Similarity: estimateJaccard(sketch, other)})
+	}
+	if err := reader.commit(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Similarity != ranked[j].Similarity {
+			return ranked[i].Similarity > ranked[j].Similarity
+		}
+		return ranked[i].Node < ranked[j].Node
+	})
+	if topK > 0 && len(ranked) > topK {
+		ranked = ranked[:topK]
+	}
+	return ranked, nil
+}
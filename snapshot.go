@@ -0,0 +1,124 @@
+package Onyx
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// WithSnapshotPool serves the reads called without a transaction from a shared read-only
+// transaction instead of a new one per call. The shared snapshot is replaced by a fresh one
+// once it is older than maxStaleness, so such reads may miss the commits of the last
+// maxStaleness, including the caller's own. Writes and reads passing their own transaction
+// are unaffected.
+func WithSnapshotPool(maxStaleness time.Duration) Option {
+	return func(g *Graph) {
+		g.snapshots = &snapshotPool{maxStaleness: maxStaleness}
+	}
+}
+
+// snapshotPool hands out the shared snapshot. A replaced snapshot is discarded when the last
+// read using it releases it.
+type snapshotPool struct {
+	maxStaleness time.Duration
+
+	mu      sync.Mutex
+	current *snapshot
+}
+
+type snapshot struct {
+	txn *badger.Txn
+	// takenAt is taken before the transaction is started, so the snapshot contains every
+	// commit that happened before it.
+	takenAt time.Time
+	// refs counts the reads using the snapshot, guarded by snapshotPool.mu.
+	refs    int
+	retired bool
+}
+
+// readTxn returns the read-only transaction for a read called without one, and the function
+// to call instead of Discard when done with it.
+func (g *Graph) readTxn() (*badger.Txn, func()) {
+	if g.snapshots == nil {
+		txn := g.DB.NewTransaction(false)
+		return txn, txn.Discard
+	}
+	return g.snapshots.acquire(g.DB)
+}
+
+func (p *snapshotPool) acquire(db *badger.DB) (*badger.Txn, func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current == nil || time.Since(p.current.takenAt) >= p.maxStaleness {
+		p.retire()
+		takenAt := time.Now()
+		p.current = &snapshot{txn: db.NewTransaction(false), takenAt: takenAt}
+	}
+	s := p.current
+	s.refs++
+
+	var once sync.Once
+	return s.txn, func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if s.refs--; s.refs == 0 && s.retired {
+				s.txn.Discard()
+			}
+		})
+	}
+}
+
+// retire stops handing out the current snapshot, discarding it if no read is using it.
+func (p *snapshotPool) retire() {
+	s := p.current
+	if s == nil {
+		return
+	}
+	p.current = nil
+	s.retired = true
+	if s.refs == 0 {
+		s.txn.Discard()
+	}
+}
+
+func (p *snapshotPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retire()
+}
+
+// age returns how old the current snapshot is, 0 if there is none.
+func (p *snapshotPool) age() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current == nil {
+		return 0
+	}
+	return time.Since(p.current.takenAt)
+}
+
+// Generation returns the commit timestamp the reads called without a transaction see: it
+// grows with every commit to the database, including the graph's own bookkeeping writes, so
+// two reads at the same generation see the same data. With a snapshot pool it is the one of
+// the shared snapshot.
+func (g *Graph) Generation() (uint64, error) {
+	end, err := g.begin("Generation")
+	if err != nil {
+		return 0, err
+	}
+	defer end()
+	txn, release := g.readTxn()
+	defer release()
+	return txn.ReadTs(), nil
+}
+
+// MaxStaleness returns how far behind the latest commits the reads called without a
+// transaction may be, the maxStaleness of WithSnapshotPool, and 0 without a snapshot pool.
+func (g *Graph) MaxStaleness() time.Duration {
+	if g.snapshots == nil {
+		return 0
+	}
+	return g.snapshots.maxStaleness
+}
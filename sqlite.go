@@ -0,0 +1,549 @@
+package Onyx
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// sqliteSchema are the tables ExportSQLite creates. Property values are BLOBs, so they keep
+// their bytes whatever they hold, and the weight of an edge is a REAL. SQLite has no NaN and
+// no REAL can hold the bits of every weight, so a weight that isn't finite is left NULL and
+// written as a raw weight property instead.
+const sqliteSchema = `CREATE TABLE nodes(id TEXT PRIMARY KEY NOT NULL);
+CREATE TABLE node_properties(node TEXT NOT NULL, name TEXT NOT NULL, value BLOB NOT NULL, PRIMARY KEY(node, name));
+CREATE TABLE edges(src TEXT NOT NULL, dst TEXT NOT NULL, weight REAL, PRIMARY KEY(src, dst));
+CREATE TABLE edge_properties(src TEXT NOT NULL, dst TEXT NOT NULL, name TEXT NOT NULL, value BLOB NOT NULL, PRIMARY KEY(src, dst, name));
+`
+
+// sqliteText quotes s as an SQL string literal. Text that isn't valid UTF-8 or holds a NUL,
+// which the sqlite3 shell cuts the literal at, is written as a cast blob.
+func sqliteText(s string) string {
+	if !utf8.ValidString(s) || strings.ContainsRune(s, 0) {
+		return "CAST(" + sqliteBlob([]byte(s)) + " AS TEXT)"
+	}
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func sqliteBlob(value []byte) string {
+	return "X'" + hex.EncodeToString(value) + "'"
+}
+
+// ExportSQLite writes the graph to w as an SQL script that creates and fills a SQLite
+// database, for example with "sqlite3 graph.db < graph.sql". See sqliteSchema for the tables.
+func (g *Graph) ExportSQLite(w io.Writer, opts ExportOptions, txn *badger.Txn) error {
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("ExportSQLite")
+		if err != nil {
+			return err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	doc, err := g.exportGraph(opts, txn)
+	if err != nil {
+		return err
+	}
+
+	b := bufio.NewWriter(w)
+	b.WriteString("PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n")
+	b.WriteString(sqliteSchema)
+	for _, node := range doc.Nodes {
+		fmt.Fprintf(b, "INSERT INTO nodes VALUES(%s);\n", sqliteText(node.ID))
+		props, err := decodeExportedProperties(node.Properties)
+		if err != nil {
+			return err
+		}
+		for _, name := range sortedPropertyNames(props) {
+			fmt.Fprintf(b, "INSERT INTO node_properties VALUES(%s,%s,%s);\n",
+				sqliteText(node.ID), sqliteText(name), sqliteBlob(props[name]))
+		}
+	}
+	for _, edge := range doc.Edges {
+		props, err := decodeExportedProperties(edge.Properties)
+		if err != nil {
+			return err
+		}
+		weight := "NULL"
+		if edge.Weight != nil {
+			if math.IsNaN(*edge.Weight) || math.IsInf(*edge.Weight, 0) {
+				props[WeightProperty] = encodeFloat64(*edge.Weight)
+			} else {
+				weight = strconv.FormatFloat(*edge.Weight, 'g', -1, 64)
+			}
+		}
+		from, to := sqliteText(edge.From), sqliteText(edge.To)
+		fmt.Fprintf(b, "INSERT INTO edges VALUES(%s,%s,%s);\n", from, to, weight)
+		for _, name := range sortedPropertyNames(props) {
+			fmt.Fprintf(b, "INSERT INTO edge_properties VALUES(%s,%s,%s,%s);\n",
+				from, to, sqliteText(name), sqliteBlob(props[name]))
+		}
+	}
+	b.WriteString("COMMIT;\n")
+	return b.Flush()
+}
+
+// ImportSQLite adds the nodes, edges and properties of an SQL script written by ExportSQLite,
+// or by the sqlite3 shell's .dump of a database with the same tables, to the graph, as
+// ImportJSONWithStats does. Only the INSERT statements into the tables of sqliteSchema are
+// read; everything else in the script is skipped.
+func (g *Graph) ImportSQLite(r io.Reader, opts ImportOptions) (ImportStats, error) {
+	var stats ImportStats
+	end, err := g.begin("ImportSQLite")
+	if err != nil {
+		return stats, err
+	}
+	defer end()
+
+	script, err := io.ReadAll(r)
+	if err != nil {
+		return stats, err
+	}
+	doc, err := parseSQLiteScript(string(script))
+	if err != nil {
+		return stats, err
+	}
+	return g.importGraph(doc, opts, "ImportSQLite")
+}
+
+func parseSQLiteScript(script string) (*exportedGraph, error) {
+	doc := &exportedGraph{}
+	nodeIndex := make(map[string]int)
+	nodeProps := make(map[string]map[string][]byte)
+	type edgeKey struct{ from, to string }
+	edgeIndex := make(map[edgeKey]int)
+	edgeProps := make(map[edgeKey]map[string][]byte)
+	addNode := func(id string) {
+		if _, ok := nodeIndex[id]; !ok {
+			nodeIndex[id] = len(doc.Nodes)
+			doc.Nodes = append(doc.Nodes, exportedNode{ID: id})
+		}
+	}
+	columns := map[string]int{"nodes": 1, "node_properties": 3, "edges": 3, "edge_properties": 4}
+
+	p := &sqlParser{s: script}
+	for {
+		table, rows, err := p.statement()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			if want, ok := columns[table]; !ok {
+				continue
+			} else if len(row) != want {
+				return nil, fmt.Errorf("onyx: SQLite %s row has %d values, want %d", table, len(row), want)
+			}
+			for i, v := range row {
+				if v.null && (table != "edges" || i != 2) {
+					return nil, fmt.Errorf("onyx: SQLite %s row has a NULL value", table)
+				}
+			}
+			switch table {
+			case "nodes":
+				addNode(string(row[0].bytes))
+			case "node_properties":
+				node := string(row[0].bytes)
+				addNode(node)
+				if nodeProps[node] == nil {
+					nodeProps[node] = make(map[string][]byte)
+				}
+				nodeProps[node][string(row[1].bytes)] = row[2].bytes
+			case "edges":
+				key := edgeKey{string(row[0].bytes), string(row[1].bytes)}
+				edge := exportedEdge{From: key.from, To: key.to}
+				if !row[2].null {
+					weight, ok := row[2].number()
+					if !ok {
+						return nil, fmt.Errorf("onyx: SQLite edge %q->%q has weight %q", key.from, key.to, row[2].bytes)
+					}
+					edge.Weight = &weight
+				}
+				if i, ok := edgeIndex[key]; ok {
+					doc.Edges[i] = edge
+				} else {
+					edgeIndex[key] = len(doc.Edges)
+					doc.Edges = append(doc.Edges, edge)
+				}
+			case "edge_properties":
+				key := edgeKey{string(row[0].bytes), string(row[1].bytes)}
+				if edgeProps[key] == nil {
+					edgeProps[key] = make(map[string][]byte)
+				}
+				edgeProps[key][string(row[2].bytes)] = row[3].bytes
+			}
+		}
+	}
+
+	for node, props := range nodeProps {
+		doc.Nodes[nodeIndex[node]].Properties = encodeExportedProperties(props)
+	}
+	for key, props := range edgeProps {
+		i, ok := edgeIndex[key]
+		if !ok {
+			return nil, fmt.Errorf("onyx: SQLite edge_properties refer to missing edge %q->%q", key.from, key.to)
+		}
+		doc.Edges[i].Properties = encodeExportedProperties(props)
+	}
+	return doc, nil
+}
+
+// sqlValue is a value of an INSERT statement: NULL, text, a blob, or a number with its text.
+type sqlValue struct {
+	null    bool
+	numeric bool
+	bytes   []byte
+}
+
+func (v sqlValue) number() (float64, bool) {
+	if !v.numeric {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(string(v.bytes), 64)
+	return f, err == nil || math.IsInf(f, 0)
+}
+
+// sqlParser reads the statements of an SQL script as far as ImportSQLite needs: the values of
+// INSERT statements, written as literals or with the CAST, replace, char and unistr
+// expressions the sqlite3 shell's .dump uses.
+type sqlParser struct {
+	s   string
+	pos int
+}
+
+func (p *sqlParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("onyx: SQL at offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// skipSpace skips whitespace and comments.
+func (p *sqlParser) skipSpace() {
+	for p.pos < len(p.s) {
+		switch {
+		case strings.ContainsRune(" \t\r\n", rune(p.s[p.pos])):
+			p.pos++
+		case strings.HasPrefix(p.s[p.pos:], "--"):
+			if i := strings.IndexByte(p.s[p.pos:], '\n'); i >= 0 {
+				p.pos += i + 1
+			} else {
+				p.pos = len(p.s)
+			}
+		case strings.HasPrefix(p.s[p.pos:], "/*"):
+			if i := strings.Index(p.s[p.pos+2:], "*/"); i >= 0 {
+				p.pos += i + 4
+			} else {
+				p.pos = len(p.s)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *sqlParser) word() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if c != '_' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !('0' <= c && c <= '9') {
+			break
+		}
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// accept consumes the punctuation tok if it comes next.
+func (p *sqlParser) accept(tok string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.s[p.pos:], tok) {
+		p.pos += len(tok)
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expect(tok string) error {
+	if !p.accept(tok) {
+		return p.errorf("expected %q", tok)
+	}
+	return nil
+}
+
+// quoted reads a string quoted with q, in which q is escaped by doubling it.
+func (p *sqlParser) quoted(q byte) (string, error) {
+	var b strings.Builder
+	for p.pos++; p.pos < len(p.s); p.pos++ {
+		if p.s[p.pos] == q {
+			if p.pos+1 < len(p.s) && p.s[p.pos+1] == q {
+				p.pos++
+			} else {
+				p.pos++
+				return b.String(), nil
+			}
+		}
+		b.WriteByte(p.s[p.pos])
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// skipStatement skips to the end of the statement, past the semicolon.
+func (p *sqlParser) skipStatement() error {
+	for ; p.pos < len(p.s); p.skipSpace() {
+		switch c := p.s[p.pos]; c {
+		case '\'', '"', '`':
+			if _, err := p.quoted(c); err != nil {
+				return err
+			}
+		case ';':
+			p.pos++
+			return nil
+		default:
+			p.pos++
+		}
+	}
+	return nil
+}
+
+// statement reads the next statement. For an INSERT it returns the table and the rows of
+// values, every other statement is skipped. It returns io.EOF at the end of the script.
+func (p *sqlParser) statement() (string, [][]sqlValue, error) {
+	p.skipSpace()
+	if p.pos == len(p.s) {
+		return "", nil, io.EOF
+	}
+	start := p.pos
+	if !strings.EqualFold(p.word(), "INSERT") {
+		p.pos = start
+		return "", nil, p.skipStatement()
+	}
+	if !strings.EqualFold(p.word(), "INTO") {
+		return "", nil, p.errorf("expected INTO")
+	}
+	p.skipSpace()
+	var table string
+	if p.pos < len(p.s) && p.s[p.pos] == '"' {
+		name, err := p.quoted('"')
+		if err != nil {
+			return "", nil, err
+		}
+		table = name
+	} else {
+		table = p.word()
+	}
+	if p.accept("(") {
+		// The columns are expected in the order of the schema.
+		p.pos--
+		if err := p.skipParens(); err != nil {
+			return "", nil, err
+		}
+	}
+	if !strings.EqualFold(p.word(), "VALUES") {
+		return "", nil, p.errorf("expected VALUES")
+	}
+	var rows [][]sqlValue
+	for {
+		if err := p.expect("("); err != nil {
+			return "", nil, err
+		}
+		var row []sqlValue
+		for {
+			v, err := p.value()
+			if err != nil {
+				return "", nil, err
+			}
+			row = append(row, v)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return "", nil, err
+		}
+		rows = append(rows, row)
+		if !p.accept(",") {
+			break
+		}
+	}
+	if p.pos < len(p.s) {
+		if err := p.expect(";"); err != nil {
+			return "", nil, err
+		}
+	}
+	return table, rows, nil
+}
+
+func (p *sqlParser) skipParens() error {
+	depth := 0
+	for ; p.pos < len(p.s); p.pos++ {
+		switch c := p.s[p.pos]; c {
+		case '\'', '"':
+			if _, err := p.quoted(c); err != nil {
+				return err
+			}
+			p.pos--
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				p.pos++
+				return nil
+			}
+		}
+	}
+	return p.errorf("unbalanced parentheses")
+}
+
+func (p *sqlParser) value() (sqlValue, error) {
+	p.skipSpace()
+	if p.pos == len(p.s) {
+		return sqlValue{}, p.errorf("expected a value")
+	}
+	switch c := p.s[p.pos]; {
+	case c == '\'':
+		s, err := p.quoted('\'')
+		return sqlValue{bytes: []byte(s)}, err
+	case c == '-' || c == '+' || c == '.' || '0' <= c && c <= '9':
+		start := p.pos
+		for p.pos++; p.pos < len(p.s) && strings.IndexByte("0123456789.eE+-", p.s[p.pos]) >= 0; p.pos++ {
+			if (p.s[p.pos] == '+' || p.s[p.pos] == '-') && p.s[p.pos-1] != 'e' && p.s[p.pos-1] != 'E' {
+				break
+			}
+		}
+		return sqlValue{numeric: true, bytes: []byte(p.s[start:p.pos])}, nil
+	}
+
+	word := p.word()
+	switch strings.ToUpper(word) {
+	case "":
+		return sqlValue{}, p.errorf("unexpected %q", p.s[p.pos])
+	case "NULL":
+		return sqlValue{null: true}, nil
+	case "X":
+		if p.pos == len(p.s) || p.s[p.pos] != '\'' {
+			return sqlValue{}, p.errorf("expected a blob literal")
+		}
+		s, err := p.quoted('\'')
+		if err != nil {
+			return sqlValue{}, err
+		}
+		value, err := hex.DecodeString(s)
+		if err != nil {
+			return sqlValue{}, p.errorf("blob literal: %v", err)
+		}
+		return sqlValue{bytes: value}, nil
+	case "CAST":
+		if err := p.expect("("); err != nil {
+			return sqlValue{}, err
+		}
+		v, err := p.value()
+		if err != nil {
+			return sqlValue{}, err
+		}
+		if !strings.EqualFold(p.word(), "AS") {
+			return sqlValue{}, p.errorf("expected AS")
+		}
+		switch typ := strings.ToUpper(p.word()); typ {
+		case "TEXT", "BLOB":
+			v.numeric = false
+		default:
+			return sqlValue{}, p.errorf("unsupported cast to %s", typ)
+		}
+		return v, p.expect(")")
+	}
+
+	// A function call.
+	if err := p.expect("("); err != nil {
+		return sqlValue{}, p.errorf("unsupported value %s", word)
+	}
+	var args []sqlValue
+	for !p.accept(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return sqlValue{}, err
+			}
+		}
+		v, err := p.value()
+		if err != nil {
+			return sqlValue{}, err
+		}
+		args = append(args, v)
+	}
+	switch strings.ToLower(word) {
+	case "replace":
+		if len(args) != 3 {
+			return sqlValue{}, p.errorf("replace takes 3 arguments")
+		}
+		return sqlValue{bytes: []byte(strings.ReplaceAll(string(args[0].bytes), string(args[1].bytes), string(args[2].bytes)))}, nil
+	case "char":
+		var b strings.Builder
+		for _, arg := range args {
+			code, err := strconv.Atoi(string(arg.bytes))
+			if err != nil || !arg.numeric {
+				return sqlValue{}, p.errorf("char takes code points")
+			}
+			b.WriteRune(rune(code))
+		}
+		return sqlValue{bytes: []byte(b.String())}, nil
+	case "unistr":
+		if len(args) != 1 {
+			return sqlValue{}, p.errorf("unistr takes 1 argument")
+		}
+		s, err := unistr(string(args[0].bytes))
+		if err != nil {
+			return sqlValue{}, p.errorf("unistr: %v", err)
+		}
+		return sqlValue{bytes: []byte(s)}, nil
+	}
+	return sqlValue{}, p.errorf("unsupported function %s", word)
+}
+
+// unistr decodes the escapes of SQLite's unistr: \\, \XXXX, \uXXXX, \+XXXXXX and \UXXXXXXXX.
+func unistr(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '\\' {
+			b.WriteByte('\\')
+			i++
+			continue
+		}
+		digits, skip := 4, 1
+		if i+1 < len(s) {
+			switch s[i+1] {
+			case 'u':
+				skip = 2
+			case '+':
+				digits, skip = 6, 2
+			case 'U':
+				digits, skip = 8, 2
+			}
+		}
+		start := i + skip
+		if start+digits > len(s) {
+			return "", fmt.Errorf("truncated escape %q", s[i:])
+		}
+		code, err := strconv.ParseUint(s[start:start+digits], 16, 32)
+		if err != nil {
+			return "", fmt.Errorf("bad escape %q", s[i:start+digits])
+		}
+		b.WriteRune(rune(code))
+		i = start + digits - 1
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,260 @@
+package Onyx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Mutation stats count the edges added to and removed from each node per time bucket. The
+// counters are updated in the transaction of the mutation, so they are exact but add a
+// read-modify-write of one small key to every edge change.
+
+const defaultStatsGranularity = time.Hour
+
+// WithMutationStats counts edge additions and removals per node in buckets of granularity,
+// see MutationHistogram. A granularity of 0 means hourly buckets.
+func WithMutationStats(granularity time.Duration) Option {
+	return func(g *Graph) {
+		if granularity <= 0 {
+			granularity = defaultStatsGranularity
+		}
+		g.statsGranularity = granularity
+	}
+}
+
+// Bucket holds the edge changes of a node in the bucket starting at Start.
+type Bucket struct {
+	Start   time.Time
+	Added   uint64
+	Removed uint64
+}
+
+// mutationStatsKey returns the key of the bucket of node starting at start. With a zero
+// start it is the prefix of every bucket of node.
+func mutationStatsKey(node string, start time.Time) []byte {
+	key := []byte(mutationStatsPrefix + node + keySep)
+	if start.IsZero() {
+		return key
+	}
+	return binary.BigEndian.AppendUint64(key, uint64(start.Unix()))
+}
+
+func decodeBucketStart(key []byte) time.Time {
+	return time.Unix(int64(binary.BigEndian.Uint64(key[len(key)-8:])), 0).UTC()
+}
+
+// statsSkips holds the transactions whose mutations are not counted, see WithoutMutationStats.
+type statsSkips struct {
+	mu   sync.Mutex
+	txns map[*badger.Txn]int
+}
+
+func (s *statsSkips) add(txn *badger.Txn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.txns == nil {
+		s.txns = make(map[*badger.Txn]int)
+	}
+	s.txns[txn]++
+}
+
+func (s *statsSkips) remove(txn *badger.Txn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.txns[txn]--
+	if s.txns[txn] == 0 {
+		delete(s.txns, txn)
+	}
+}
+
+func (s *statsSkips) has(txn *badger.Txn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.txns[txn] > 0
+}
+
+// WithoutMutationStats runs fn with txn and doesn't count the edge changes fn makes in it,
+// which saves the extra writes for bulk loads. If txn is nil a new transaction is
+// committed when fn returns without an error.
+func (g *Graph) WithoutMutationStats(txn *badger.Txn, fn func(txn *badger.Txn) error) error {
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("WithoutMutationStats")
+		if err != nil {
+			return err
+		}
+		defer end()
+		txn = g.DB.NewTransaction(true)
+		defer txn.Discard()
+	}
+
+	g.statsSkips.add(txn)
+	err := fn(txn)
+	g.statsSkips.remove(txn)
+	if err != nil {
+		return err
+	}
+
+	if localTxn {
+		return txn.Commit()
+	}
+	return nil
+}
+
+// recordMutationStats counts one edge change of from in the current bucket.
+func (g *Graph) recordMutationStats(txn *badger.Txn, op ChangeOp, from string) error {
+	if g.statsGranularity == 0 || g.statsSkips.has(txn) || op == ChangeRemoveNode {
+		return nil
+	}
+
+	key := mutationStatsKey(from, time.Now().Truncate(g.statsGranularity))
+	counts := make([]byte, 16)
+	item, err := txn.Get(key)
+	if err == nil {
+		err = item.Value(func(val []byte) error {
+			if len(val) != 16 {
+				return errors.New("onyx: corrupt mutation stats bucket")
+			}
+			copy(counts, val)
+			return nil
+		})
+	}
+	if err != nil && err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	offset := 0
+	if op == ChangeRemoveEdge {
+		offset = 8
+	}
+	binary.BigEndian.PutUint64(counts[offset:], binary.BigEndian.Uint64(counts[offset:])+1)
+	return txn.Set(key, counts)
+}
+
+// MutationHistogram returns the buckets of node that start in [since, until), oldest
+// first. Buckets without changes are left out.
+func (g *Graph) MutationHistogram(node string, since time.Time, until time.Time, txn *badger.Txn) ([]Bucket, error) {
+	node = g.nodeID(node)
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("MutationHistogram")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	var buckets []Bucket
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = mutationStatsKey(node, time.Time{})
+	it := txn.NewIterator(opts)
+	seek := opts.Prefix
+	if since.After(time.Unix(0, 0)) {
+		seek = mutationStatsKey(node, since)
+	}
+	for it.Seek(seek); it.Valid(); it.Next() {
+		item := it.Item()
+		start := decodeBucketStart(item.Key())
+		if !start.Before(until) {
+			break
+		}
+		bucket := Bucket{Start: start}
+		err := item.Value(func(val []byte) error {
+			if len(val) != 16 {
+				return errors.New("onyx: corrupt mutation stats bucket")
+			}
+			bucket.Added = binary.BigEndian.Uint64(val)
+			bucket.Removed = binary.BigEndian.Uint64(val[8:])
+			return nil
+		})
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		buckets = append(buckets, bucket)
+	}
+	it.Close()
+
+	return buckets, nil
+}
+
+// PruneMutationStats deletes the buckets that start before before, in batches of separate
+// transactions, and returns how many were deleted.
+func (g *Graph) PruneMutationStats(before time.Time) (int, error) {
+	end, err := g.begin("PruneMutationStats")
+	if err != nil {
+		return 0, err
+	}
+	defer end()
+
+	const batchSize = 1000
+	pruned := 0
+	var cursor []byte
+	for {
+		if g.closing() {
+			return pruned, ErrClosed
+		}
+		if err := g.faultPoint("PruneMutationStats"); err != nil {
+			return pruned, err
+		}
+		n, next, err := g.pruneMutationStatsBatch(before, cursor, batchSize)
+		pruned += n
+		if err != nil || next == nil {
+			return pruned, err
+		}
+		cursor = next
+	}
+}
+
+// pruneMutationStatsBatch scans up to batchSize buckets after cursor and deletes the old ones.
+// It returns the cursor of the next batch, or nil once every bucket has been scanned.
+func (g *Graph) pruneMutationStatsBatch(before time.Time, cursor []byte, batchSize int) (int, []byte, error) {
+	txn := g.DB.NewTransaction(true)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(mutationStatsPrefix)
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	var old [][]byte
+	var last []byte
+	scanned := 0
+	if cursor != nil {
+		it.Seek(cursor)
+	} else {
+		it.Rewind()
+	}
+	for ; it.Valid() && scanned < batchSize; it.Next() {
+		key := it.Item().Key()
+		if bytes.Equal(key, cursor) {
+			continue
+		}
+		scanned++
+		last = it.Item().KeyCopy(last[:0])
+		if decodeBucketStart(key).Before(before) {
+			old = append(old, it.Item().KeyCopy(nil))
+		}
+	}
+	it.Close()
+
+	for _, key := range old {
+		if err := txn.Delete(key); err != nil {
+			return 0, nil, err
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return 0, nil, err
+	}
+	if scanned < batchSize {
+		return len(old), nil, nil
+	}
+	return len(old), last, nil
+}
@@ -0,0 +1,566 @@
+package Onyx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Edge lists are stored in one of two layouts, told apart by the value under the node ID:
+//
+//	StorageBlob     the gob encoded edge list
+//	StoragePerEdge  an empty value, with one empty key per edge: edgeKeyPrefix + from + keySep + to
+//
+// Reads decode either layout, node by node, so a database can be read while it is converted
+// from one to the other. Writes store the edge list they write in the storage mode of the
+// graph, which replaces the other layout of that node, see writeEdgeMap.
+
+const (
+	metaStorageModeKey = "storage-mode"
+
+	journalOpConvertStorage = "convert-storage"
+	defaultConvertBatchSize = 1000
+)
+
+// StorageMode is the layout edge lists are written in, see ConvertStorageMode.
+type StorageMode int
+
+const (
+	// StorageBlob stores the edge list of a node as one value. Reading a whole edge list is
+	// one lookup, but adding or removing an edge rewrites all of it.
+	StorageBlob StorageMode = iota
+	// StoragePerEdge stores every edge as a key of its own, so adding or removing an edge of
+	// a node with many edges writes a single key. Reading an edge list is a prefix scan.
+	StoragePerEdge
+)
+
+func (m StorageMode) String() string {
+	switch m {
+	case StorageBlob:
+		return "blob"
+	case StoragePerEdge:
+		return "per-edge"
+	default:
+		return fmt.Sprintf("StorageMode(%d)", int(m))
+	}
+}
+
+func parseStorageMode(s string) (StorageMode, error) {
+	for _, m := range []StorageMode{StorageBlob, StoragePerEdge} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("onyx: unknown storage mode %q", s)
+}
+
+var ErrConversionRunning = errors.New("onyx: a storage mode conversion is already running")
+
+func init() {
+	journalOps[journalOpConvertStorage] = func(g *Graph, entry *journalEntry) error {
+		return g.runConvertStorage(context.Background(), entry, ConvertOptions{})
+	}
+}
+
+// edgeKeyPrefixOf returns the prefix of the edge keys of from.
+func edgeKeyPrefixOf(from string) []byte {
+	return []byte(edgeKeyPrefix + from + keySep)
+}
+
+func edgeKey(from string, to string) []byte {
+	return append(edgeKeyPrefixOf(from), to...)
+}
+
+// readStorageMode returns the storage mode stored in the metadata, StorageBlob if there is none.
+func readStorageMode(txn *badger.Txn) (StorageMode, error) {
+	item, err := txn.Get(metaKey(metaStorageModeKey))
+	if err == badger.ErrKeyNotFound {
+		return StorageBlob, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var mode StorageMode
+	err = item.Value(func(val []byte) error {
+		if len(val) != 1 || StorageMode(val[0]) > StoragePerEdge {
+			return fmt.Errorf("onyx: invalid storage mode %v", val)
+		}
+		mode = StorageMode(val[0])
+		return nil
+	})
+	return mode, err
+}
+
+func writeStorageMode(txn *badger.Txn, mode StorageMode) error {
+	return txn.Set(metaKey(metaStorageModeKey), []byte{byte(mode)})
+}
+
+// migrateStorageMode records the storage mode of databases that predate storage modes. The
+// schema version it brings them to keeps older versions of the library, which only read
+// StorageBlob, from opening a database that may hold edge keys.
+func migrateStorageMode(ctx context.Context, g *Graph) error {
+	return g.DB.Update(func(txn *badger.Txn) error {
+		mode, err := readStorageMode(txn)
+		if err != nil {
+			return err
+		}
+		return writeStorageMode(txn, mode)
+	})
+}
+
+// loadStorageMode sets storageMode and hasEdgeKeys from the database, when it is opened or
+// restored.
+func (g *Graph) loadStorageMode() error {
+	return g.DB.View(func(txn *badger.Txn) error {
+		mode, err := readStorageMode(txn)
+		if err != nil {
+			return err
+		}
+		g.storageMode.Store(int32(mode))
+		g.hasEdgeKeys.Store(mode == StoragePerEdge || hasKeyWithPrefix(txn, edgeKeyPrefix))
+		return nil
+	})
+}
+
+// StorageMode returns the layout edge lists are written in. During a conversion it is the
+// target of the conversion.
+func (g *Graph) StorageMode() StorageMode {
+	return StorageMode(g.storageMode.Load())
+}
+
+// decodeEdgeList returns the edge list of from given val, the value under its ID, with its
+// size: the length of val in StorageBlob layout and the total length of the edge keys in
+// StoragePerEdge layout.
+func decodeEdgeList(txn *badger.Txn, from string, val []byte) (map[string]bool, int, error) {
+	if len(val) > 0 {
+		dstNodes, err := deserializeEdgeMap(val)
+		return dstNodes, len(val), err
+	}
+	return readEdgeKeys(txn, from)
+}
+
+// readEdgeKeys returns the edge list of from stored in StoragePerEdge layout.
+func readEdgeKeys(txn *badger.Txn, from string) (map[string]bool, int, error) {
+	prefix := edgeKeyPrefixOf(from)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	dstNodes := make(map[string]bool)
+	size := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		key := it.Item().Key()
+		dstNodes[string(key[len(prefix):])] = true
+		size += len(key)
+	}
+	return dstNodes, size, nil
+}
+
+// writeEdgeKeys stores dstNodes as the edge list of from in StoragePerEdge layout, replacing
+// the edge list of from in either layout. Only the edge keys that change are written.
+func writeEdgeKeys(txn *badger.Txn, from string, dstNodes map[string]bool) error {
+	item, err := txn.Get([]byte(from))
+	var old map[string]bool
+	if err == nil && item.ValueSize() == 0 {
+		old, _, err = readEdgeKeys(txn, from)
+		if err != nil {
+			return err
+		}
+	} else if err != nil && err != badger.ErrKeyNotFound {
+		return err
+	} else if err := txn.Set([]byte(from), nil); err != nil {
+		return err
+	}
+
+	for to := range old {
+		if !dstNodes[to] {
+			if err := txn.Delete(edgeKey(from, to)); err != nil {
+				return err
+			}
+		}
+	}
+	for to := range dstNodes {
+		if !old[to] {
+			if err := txn.Set(edgeKey(from, to), nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteEdgeKeys deletes the edge keys of from.
+func deleteEdgeKeys(txn *badger.Txn, from string) error {
+	dstNodes, _, err := readEdgeKeys(txn, from)
+	if err != nil {
+		return err
+	}
+	for to := range dstNodes {
+		if err := txn.Delete(edgeKey(from, to)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type ConvertOptions struct {
+	// BatchSize is the number of keys written per transaction, defaultConvertBatchSize by
+	// default. A batch ends after the node that reaches it, so the edge list of a node is
+	// always converted in one transaction.
+	BatchSize int
+	// OnProgress, if set, is called after every batch.
+	OnProgress func(ConversionProgress)
+}
+
+// Phases of a ConvertStorageMode journal entry.
+const (
+	convertPhaseNodes = iota
+	convertPhaseVerify
+)
+
+type ConversionProgress struct {
+	Target StorageMode
+	// Verifying is set once every node has been converted and the conversion checks that
+	// none is left in the other layout.
+	Verifying bool
+	// Visited is the number of nodes visited by the current pass, Converted the number of
+	// nodes rewritten in the target layout by all of them.
+	Visited   int
+	Converted int
+	// Remaining estimates the nodes left to visit in the current pass, from the number of
+	// nodes when it started.
+	Remaining int
+	// NodesPerSecond is the rate nodes were visited at since the conversion was started or
+	// resumed in this process.
+	NodesPerSecond float64
+	Done           bool
+}
+
+// conversionRun is the in-memory state of the conversion running in this process.
+type conversionRun struct {
+	started time.Time
+	visited atomic.Int64
+}
+
+// ConvertStorageMode converts every edge list to the target layout, or finishes a conversion
+// that was interrupted, without taking the graph offline. The storage mode is switched first,
+// so writes store the edge lists they touch in the target layout from then on, while reads
+// decode both layouts. The nodes are then converted in batches of separate transactions, and
+// a verification pass checks that no node is left in the other layout, converting the ones
+// that are, until a pass finds none. A batch that conflicts with a concurrent write is run
+// again, up to the retries set by WithUpdateRetries.
+//
+// The conversion is journaled: when ctx is cancelled or a batch fails, the journal entry
+// stays, and the next ConvertStorageMode to the same target or the next NewGraph continues
+// it. Converting to the other target in the meantime fails. The database must be at the
+// latest schema version, see Migrate.
+//
+// ConvertStorageMode takes no txn and commits its own transactions, because it rewrites every
+// node of the graph: no single transaction could hold them, and the conversion only stays
+// online because each batch commits, and is journaled, on its own.
+func (g *Graph) ConvertStorageMode(ctx context.Context, target StorageMode, opts ConvertOptions) error {
+	if target != StorageBlob && target != StoragePerEdge {
+		return fmt.Errorf("onyx: unknown storage mode %v", target)
+	}
+	ctx, end, err := g.track(ctx, "ConvertStorageMode")
+	if err != nil {
+		return err
+	}
+	defer end()
+	if !g.convertMu.TryLock() {
+		return ErrConversionRunning
+	}
+	defer g.convertMu.Unlock()
+
+	current, latest, err := g.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current < latest {
+		return fmt.Errorf("onyx: storage mode conversion needs schema version %d, the database is at %d, see Migrate", latest, current)
+	}
+
+	entry, err := g.conversionJournalEntry()
+	if err != nil {
+		return err
+	}
+	var release func()
+	if entry == nil {
+		entry, release, err = g.newJournalEntry(journalOpConvertStorage, target.String())
+		if err != nil {
+			return err
+		}
+	} else if entry.Arg != target.String() {
+		return fmt.Errorf("onyx: the conversion to %s storage was interrupted, finish it first", entry.Arg)
+	} else {
+		release = g.claimJournalEntry(entry.ID)
+	}
+	defer release()
+	return g.runConvertStorage(ctx, entry, opts)
+}
+
+// conversionJournalEntry returns the journal entry of an interrupted conversion, if there is one.
+func (g *Graph) conversionJournalEntry() (*journalEntry, error) {
+	var found *journalEntry
+	err := g.DB.View(func(txn *badger.Txn) error {
+		entries, err := readJournal(txn)
+		for _, entry := range entries {
+			if entry.Op == journalOpConvertStorage {
+				found = entry
+			}
+		}
+		return err
+	})
+	return found, err
+}
+
+// StorageConversion returns the progress of the conversion started by ConvertStorageMode, and
+// false if there is none, because it is done or was never started.
+func (g *Graph) StorageConversion() (ConversionProgress, bool, error) {
+	end, err := g.begin("StorageConversion")
+	if err != nil {
+		return ConversionProgress{}, false, err
+	}
+	defer end()
+
+	entry, err := g.conversionJournalEntry()
+	if err != nil || entry == nil {
+		return ConversionProgress{}, false, err
+	}
+	progress, err := g.conversionProgress(entry)
+	return progress, true, err
+}
+
+func (g *Graph) conversionProgress(entry *journalEntry) (ConversionProgress, error) {
+	target, err := parseStorageMode(entry.Arg)
+	if err != nil {
+		return ConversionProgress{}, err
+	}
+	progress := ConversionProgress{
+		Target:    target,
+		Verifying: entry.Phase == convertPhaseVerify,
+		Visited:   entry.Counts["visited"],
+		Converted: entry.Counts["converted"],
+		Remaining: max(entry.Counts["total"]-entry.Counts["visited"], 0),
+	}
+	if run := g.conversion.Load(); run != nil {
+		if elapsed := time.Since(run.started).Seconds(); elapsed > 0 {
+			progress.NodesPerSecond = float64(run.visited.Load()) / elapsed
+		}
+	}
+	return progress, nil
+}
+
+// runConvertStorage runs the conversion journaled by entry and deletes it once a verification
+// pass found every node in the target layout.
+func (g *Graph) runConvertStorage(ctx context.Context, entry *journalEntry, opts ConvertOptions) error {
+	target, err := parseStorageMode(entry.Arg)
+	if err != nil {
+		return err
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultConvertBatchSize
+	}
+
+	// A journal entry is written before the storage mode, so the mode is set on every run.
+	// Counting the nodes reads all of them, so the transaction is retried like the batches.
+	for attempt := 0; ; attempt++ {
+		err = g.DB.Update(func(txn *badger.Txn) error {
+			if entry.Cursor == nil && entry.Counts["visited"] == 0 {
+				total, err := countNodes(txn)
+				if err != nil {
+					return err
+				}
+				entry.Counts["total"] = total
+				if err := writeJournalEntry(txn, entry); err != nil {
+					return err
+				}
+			}
+			return writeStorageMode(txn, target)
+		})
+		if err != badger.ErrConflict || attempt >= g.updateRetries {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	g.storageMode.Store(int32(target))
+	if target == StoragePerEdge {
+		g.hasEdgeKeys.Store(true)
+	}
+	g.conversion.Store(&conversionRun{started: time.Now()})
+	defer g.conversion.Store(nil)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return context.Cause(ctx)
+		}
+		if err := g.faultPoint("ConvertStorageMode"); err != nil {
+			return err
+		}
+		done, err := g.retryConvertStorageBatch(entry, target, opts.BatchSize)
+		if err != nil {
+			return err
+		}
+		if opts.OnProgress != nil {
+			progress, err := g.conversionProgress(entry)
+			if err != nil {
+				return err
+			}
+			progress.Done = done
+			opts.OnProgress(progress)
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// retryConvertStorageBatch runs convertStorageBatch, and runs it again from the same cursor
+// when its transaction conflicted with a write, up to the retries of WithUpdateRetries.
+func (g *Graph) retryConvertStorageBatch(entry *journalEntry, target StorageMode, batchSize int) (bool, error) {
+	for attempt := 0; ; attempt++ {
+		saved := *entry
+		saved.Counts = maps.Clone(entry.Counts)
+		done, err := g.convertStorageBatch(entry, target, batchSize)
+		if err != badger.ErrConflict || attempt >= g.updateRetries {
+			return done, err
+		}
+		*entry = saved
+	}
+}
+
+// convertStorageBatch converts the next nodes after the cursor of entry to target and reports
+// whether the conversion is done.
+func (g *Graph) convertStorageBatch(entry *journalEntry, target StorageMode, batchSize int) (bool, error) {
+	txn := g.DB.NewTransaction(true)
+	defer txn.Discard()
+
+	it := newNodeIterator(txn, badger.DefaultIteratorOptions)
+	if entry.Cursor != nil {
+		it.Seek(entry.Cursor)
+	} else {
+		it.Rewind()
+	}
+	visited := 0
+	convert := make(map[string]map[string]bool)
+	n := 0
+	passDone := true
+	for ; it.Valid(); it.Next() {
+		item := it.Item()
+		if bytes.Equal(item.Key(), entry.Cursor) {
+			continue
+		}
+		if n >= batchSize {
+			passDone = false
+			break
+		}
+		node := string(item.Key())
+		entry.Cursor = item.KeyCopy(nil)
+		visited++
+		n++
+		if (item.ValueSize() == 0) == (target == StoragePerEdge) {
+			continue
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			it.Close()
+			return false, err
+		}
+		dstNodes, _, err := decodeEdgeList(txn, node, val)
+		if err != nil {
+			it.Close()
+			return false, err
+		}
+		convert[node] = dstNodes
+		n += len(dstNodes)
+	}
+	it.Close()
+
+	// The edge lists don't change, so the indexes derived from them are left alone.
+	for node, dstNodes := range convert {
+		var err error
+		if target == StoragePerEdge {
+			err = writeEdgeKeys(txn, node, dstNodes)
+		} else {
+			err = writeEdgeBlob(txn, node, dstNodes)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	entry.Counts["visited"] += visited
+	entry.Counts["converted"] += len(convert)
+	entry.Counts["pass-converted"] += len(convert)
+
+	done := false
+	if passDone {
+		// Every pass that converted nodes is followed by a verification pass, and the
+		// conversion ends with a pass that converted none.
+		done = entry.Phase == convertPhaseVerify && entry.Counts["pass-converted"] == 0
+		if !done {
+			total, err := countNodes(txn)
+			if err != nil {
+				return false, err
+			}
+			entry.Phase = convertPhaseVerify
+			entry.Cursor = nil
+			entry.Counts["total"] = total
+			entry.Counts["visited"] = 0
+			entry.Counts["pass-converted"] = 0
+		}
+	}
+	var err error
+	if done {
+		err = deleteJournalEntry(txn, entry)
+	} else {
+		err = writeJournalEntry(txn, entry)
+	}
+	if err != nil {
+		return false, err
+	}
+	noEdgeKeys := done && target == StorageBlob && !hasKeyWithPrefix(txn, edgeKeyPrefix)
+	if err := txn.Commit(); err != nil {
+		return false, err
+	}
+	if run := g.conversion.Load(); run != nil {
+		run.visited.Add(int64(visited))
+	}
+	if noEdgeKeys {
+		g.hasEdgeKeys.Store(false)
+	}
+	return done, nil
+}
+
+// writeEdgeBlob stores dstNodes as the edge list of from in StorageBlob layout, deleting its
+// edge keys.
+func writeEdgeBlob(txn *badger.Txn, from string, dstNodes map[string]bool) error {
+	if err := deleteEdgeKeys(txn, from); err != nil {
+		return err
+	}
+	serializedEdgeMap, err := serializeEdgeMap(dstNodes)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(from), serializedEdgeMap)
+}
+
+// countNodes returns the number of nodes with an edge list, reading only keys.
+func countNodes(txn *badger.Txn) (int, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := newNodeIterator(txn, opts)
+	defer it.Close()
+	n := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		n++
+	}
+	return n, nil
+}
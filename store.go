@@ -0,0 +1,591 @@
+package Onyx
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// A Store keeps named graphs, such as one per tenant, each in its own badger database in a
+// subdirectory of the store directory. Graphs of a store can hold cross edges, edges whose
+// target is a node of another graph of the store, so shared nodes like a common taxonomy
+// don't have to be copied into every graph. A cross edge is stored in the graph of its source,
+// with the name of the target graph in its key, and isn't part of the edge list of its source:
+// Graph methods don't see it, the Store methods do.
+type Store struct {
+	dir      string
+	inMemory bool
+	opts     []Option
+
+	// mu guards graphs. Writes of cross edges hold it for reading, so DropGraph, which holds
+	// it for writing, sees every reference into the graph it drops.
+	mu     sync.RWMutex
+	graphs map[string]*Graph
+}
+
+var (
+	ErrGraphNotFound    = errors.New("onyx: graph not found")
+	ErrGraphExists      = errors.New("onyx: graph already exists")
+	ErrInvalidGraphName = errors.New("onyx: graph name must be non-empty and only contain letters, digits, '-' and '_'")
+)
+
+// ErrGraphReferenced is returned by DropGraph when other graphs still hold cross edges into
+// the graph to drop.
+type ErrGraphReferenced struct {
+	Graph string
+	// References counts the cross edges into Graph by the graph holding them.
+	References map[string]int
+}
+
+func (e *ErrGraphReferenced) Error() string {
+	names := make([]string, 0, len(e.References))
+	for name, n := range e.References {
+		names = append(names, fmt.Sprintf("%s (%d)", name, n))
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("onyx: graph %s is referenced by %s", e.Graph, strings.Join(names, ", "))
+}
+
+// OpenStore opens the store in dir, opening every graph it holds with opts. An in-memory
+// store keeps its graphs in memory and needs an empty dir.
+func OpenStore(dir string, inMemory bool, opts ...Option) (*Store, error) {
+	if inMemory && dir != "" {
+		return nil, ErrInMemoryPath
+	}
+	s := &Store{dir: dir, inMemory: inMemory, opts: opts, graphs: make(map[string]*Graph)}
+	if inMemory {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || validateGraphName(entry.Name()) != nil {
+			continue
+		}
+		g, err := NewGraph(filepath.Join(dir, entry.Name()), false, opts...)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("onyx: graph %s: %w", entry.Name(), err)
+		}
+		s.graphs[entry.Name()] = g
+	}
+	return s, nil
+}
+
+func validateGraphName(name string) error {
+	if name == "" {
+		return ErrInvalidGraphName
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return ErrInvalidGraphName
+		}
+	}
+	return nil
+}
+
+// CreateGraph creates the graph name, or returns ErrGraphExists.
+func (s *Store) CreateGraph(name string) (*Graph, error) {
+	if err := validateGraphName(name); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.graphs[name]; ok {
+		return nil, ErrGraphExists
+	}
+	path := ""
+	if !s.inMemory {
+		path = filepath.Join(s.dir, name)
+	}
+	g, err := NewGraph(path, s.inMemory, s.opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.graphs[name] = g
+	return g, nil
+}
+
+// Graph returns the graph name, or ErrGraphNotFound.
+func (s *Store) Graph(name string) (*Graph, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.graph(name)
+}
+
+func (s *Store) graph(name string) (*Graph, error) {
+	g, ok := s.graphs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrGraphNotFound, name)
+	}
+	return g, nil
+}
+
+// Graphs returns the names of the graphs of the store, sorted.
+func (s *Store) Graphs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.graphs))
+	for name := range s.graphs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type DropGraphOptions struct {
+	// Force drops the graph even if other graphs hold cross edges into it. Those edges are
+	// kept and point into a missing graph; traversals don't follow them.
+	Force bool
+}
+
+// DropGraph closes the graph name and deletes its database. It returns the number of cross
+// edges into the graph by the graph holding them. Unless opts.Force is set, a graph that is
+// still referenced isn't dropped and DropGraph returns an *ErrGraphReferenced.
+func (s *Store) DropGraph(name string, opts DropGraphOptions) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, err := s.graph(name)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[string]int)
+	for other, og := range s.graphs {
+		if other == name {
+			continue
+		}
+		n, err := og.countCrossRefs(name)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			refs[other] = n
+		}
+	}
+	if len(refs) > 0 && !opts.Force {
+		return refs, &ErrGraphReferenced{Graph: name, References: refs}
+	}
+
+	delete(s.graphs, name)
+	err = g.Close()
+	if err == nil && !s.inMemory {
+		err = os.RemoveAll(filepath.Join(s.dir, name))
+	}
+	return refs, err
+}
+
+// Close closes every graph of the store.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for name, g := range s.graphs {
+		if err := g.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("onyx: graph %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// QualifiedNode is a node of a named graph of a Store.
+type QualifiedNode struct {
+	Graph string
+	Node  string
+}
+
+func (n QualifiedNode) String() string {
+	return n.Graph + "/" + n.Node
+}
+
+func sortQualifiedNodes(nodes []QualifiedNode) {
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Graph != nodes[j].Graph {
+			return nodes[i].Graph < nodes[j].Graph
+		}
+		return nodes[i].Node < nodes[j].Node
+	})
+}
+
+// crossEdgeKey returns the key of the cross edge from->toGraph/to. With an empty toGraph it
+// is the prefix of all cross edges of from.
+func crossEdgeKey(from string, toGraph string, to string) []byte {
+	if toGraph == "" {
+		return []byte(crossEdgePrefix + from + keySep)
+	}
+	return []byte(crossEdgePrefix + from + keySep + toGraph + keySep + to)
+}
+
+// crossRefKey returns the key mirroring the cross edge from->toGraph/to. With an empty from
+// it is the prefix of all cross edges into toGraph.
+func crossRefKey(toGraph string, from string, to string) []byte {
+	if from == "" {
+		return []byte(crossRefPrefix + toGraph + keySep)
+	}
+	return []byte(crossRefPrefix + toGraph + keySep + from + keySep + to)
+}
+
+// AddCrossEdge adds the edge from fromGraph/from to toGraph/to. Both graphs must exist; the
+// target node doesn't have to. IDs are normalized and from is resolved like by AddEdge, each
+// in its own graph.
+func (s *Store) AddCrossEdge(fromGraph string, from string, toGraph string, to string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	g, tg, err := s.crossGraphs(fromGraph, toGraph)
+	if err != nil {
+		return err
+	}
+	from, to = g.nodeID(from), tg.nodeID(to)
+	if err := validateNodeID(from); err != nil {
+		return err
+	}
+	if err := validateNodeID(to); err != nil {
+		return err
+	}
+
+	end, err := g.begin("AddCrossEdge")
+	if err != nil {
+		return err
+	}
+	defer end()
+	txn := g.DB.NewTransaction(true)
+	defer txn.Discard()
+
+	from, err = g.resolveID(txn, from)
+	if err != nil {
+		return err
+	}
+	if err := g.addNode(txn, from); err != nil {
+		return err
+	}
+	if err := setCrossEdge(txn, from, toGraph, to); err != nil {
+		return err
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		g.recordConflict(err, from)
+	}
+	return err
+}
+
+// RemoveCrossEdge removes the edge from fromGraph/from to toGraph/to and reports whether it
+// existed. A missing edge is handled like by RemoveEdge, see WithRemoveMode.
+func (s *Store) RemoveCrossEdge(fromGraph string, from string, toGraph string, to string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	g, tg, err := s.crossGraphs(fromGraph, toGraph)
+	if err != nil {
+		return false, err
+	}
+	from, to = g.nodeID(from), tg.nodeID(to)
+
+	end, err := g.begin("RemoveCrossEdge")
+	if err != nil {
+		return false, err
+	}
+	defer end()
+	txn := g.DB.NewTransaction(true)
+	defer txn.Discard()
+
+	from, err = g.resolveID(txn, from)
+	if err != nil {
+		return false, err
+	}
+	_, err = txn.Get(crossEdgeKey(from, toGraph, to))
+	if err == badger.ErrKeyNotFound {
+		if g.removeMode == RemoveStrict {
+			return false, fmt.Errorf("%w: %s/%s->%s/%s", ErrEdgeNotFound, fromGraph, from, toGraph, to)
+		}
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := deleteCrossEdge(txn, from, toGraph, to); err != nil {
+		return false, err
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		g.recordConflict(err, from)
+		return false, err
+	}
+	return true, nil
+}
+
+// crossGraphs returns the graphs of a cross edge. s.mu must be held.
+func (s *Store) crossGraphs(fromGraph string, toGraph string) (*Graph, *Graph, error) {
+	if fromGraph == toGraph {
+		return nil, nil, errors.New("onyx: cross edges must point into another graph, use AddEdge")
+	}
+	g, err := s.graph(fromGraph)
+	if err != nil {
+		return nil, nil, err
+	}
+	tg, err := s.graph(toGraph)
+	if err != nil {
+		return nil, nil, err
+	}
+	return g, tg, nil
+}
+
+// GetEdges returns the out-neighbors of graph/from, both its edges within graph and its
+// cross edges, sorted by graph and node.
+func (s *Store) GetEdges(graph string, from string) ([]QualifiedNode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	g, err := s.graph(graph)
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := g.begin("GetEdges")
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	txn, release := g.readTxn()
+	defer release()
+
+	return s.expand(g, graph, g.nodeID(from), true, txn)
+}
+
+// expand returns the out-neighbors of from in g, which is called graph, sorted. Cross edges
+// are only included with cross set.
+func (s *Store) expand(g *Graph, graph string, from string, cross bool, txn *badger.Txn) ([]QualifiedNode, error) {
+	from, err := g.resolveID(txn, from)
+	if err != nil {
+		return nil, err
+	}
+	dstNodes, err := g.GetEdges(from, txn)
+	if err != nil {
+		return nil, err
+	}
+	neighbors := make([]QualifiedNode, 0, len(dstNodes))
+	for to := range dstNodes {
+		neighbors = append(neighbors, QualifiedNode{Graph: graph, Node: to})
+	}
+	if cross {
+		crossEdges, err := readCrossEdges(txn, from)
+		if err != nil {
+			return nil, err
+		}
+		neighbors = append(neighbors, crossEdges...)
+	}
+	sortQualifiedNodes(neighbors)
+	return neighbors, nil
+}
+
+type StoreTraversalOptions struct {
+	// MaxDepth limits how many hops from the start node are expanded. 0 means no limit.
+	MaxDepth int
+	// FollowCrossGraph also follows cross edges, and the edges of the nodes they lead to in
+	// their graphs. Without it the traversal stays in the graph of the start node.
+	FollowCrossGraph bool
+}
+
+type StoreTraversalResult struct {
+	// Order lists the visited nodes in the order they were reached.
+	Order []QualifiedNode
+	// Depth maps every visited node to its distance in hops from the start node.
+	Depth map[QualifiedNode]int
+}
+
+// BFS does a breadth first traversal from graph/start, expanding neighbors in graph and node
+// order like GetEdges. Every graph is read in one transaction. Nodes in graphs that were
+// dropped are visited but not expanded.
+func (s *Store) BFS(graph string, start string, opts StoreTraversalOptions) (*StoreTraversalResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	g, err := s.graph(graph)
+	if err != nil {
+		return nil, err
+	}
+
+	txns := make(map[string]*badger.Txn)
+	var ends []func()
+	defer func() {
+		for _, txn := range txns {
+			txn.Discard()
+		}
+		for _, end := range ends {
+			end()
+		}
+	}()
+	readTxn := func(name string, g *Graph) (*badger.Txn, error) {
+		if txn, ok := txns[name]; ok {
+			return txn, nil
+		}
+		end, err := g.begin("BFS")
+		if err != nil {
+			return nil, err
+		}
+		ends = append(ends, end)
+		txn := g.DB.NewTransaction(false)
+		txns[name] = txn
+		return txn, nil
+	}
+
+	txn, err := readTxn(graph, g)
+	if err != nil {
+		return nil, err
+	}
+	node, err := g.resolveID(txn, g.nodeID(start))
+	if err != nil {
+		return nil, err
+	}
+	first := QualifiedNode{Graph: graph, Node: node}
+	result := &StoreTraversalResult{
+		Order: []QualifiedNode{first},
+		Depth: map[QualifiedNode]int{first: 0},
+	}
+
+	frontier := []QualifiedNode{first}
+	for depth := 0; len(frontier) > 0; depth++ {
+		if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+			break
+		}
+		var next []QualifiedNode
+		for _, n := range frontier {
+			ng, ok := s.graphs[n.Graph]
+			if !ok {
+				continue
+			}
+			txn, err := readTxn(n.Graph, ng)
+			if err != nil {
+				return nil, err
+			}
+			neighbors, err := s.expand(ng, n.Graph, n.Node, opts.FollowCrossGraph, txn)
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			for _, neighbor := range neighbors {
+				if neighbor.Graph != n.Graph {
+					neighbor, err = s.resolveCrossTarget(neighbor, readTxn)
+					if err != nil {
+						return nil, err
+					}
+				}
+				if _, seen := result.Depth[neighbor]; seen {
+					continue
+				}
+				result.Depth[neighbor] = depth + 1
+				result.Order = append(result.Order, neighbor)
+				next = append(next, neighbor)
+			}
+		}
+		frontier = next
+	}
+	return result, nil
+}
+
+// resolveCrossTarget follows the redirects of the target of a cross edge in its graph.
+func (s *Store) resolveCrossTarget(n QualifiedNode, readTxn func(string, *Graph) (*badger.Txn, error)) (QualifiedNode, error) {
+	g, ok := s.graphs[n.Graph]
+	if !ok {
+		return n, nil
+	}
+	txn, err := readTxn(n.Graph, g)
+	if err != nil {
+		return n, err
+	}
+	n.Node, err = g.resolveID(txn, n.Node)
+	return n, err
+}
+
+func setCrossEdge(txn *badger.Txn, from string, toGraph string, to string) error {
+	if err := txn.Set(crossEdgeKey(from, toGraph, to), nil); err != nil {
+		return err
+	}
+	return txn.Set(crossRefKey(toGraph, from, to), nil)
+}
+
+func deleteCrossEdge(txn *badger.Txn, from string, toGraph string, to string) error {
+	if err := txn.Delete(crossEdgeKey(from, toGraph, to)); err != nil {
+		return err
+	}
+	return txn.Delete(crossRefKey(toGraph, from, to))
+}
+
+// readCrossEdges returns the cross edges of from, in key order.
+func readCrossEdges(txn *badger.Txn, from string) ([]QualifiedNode, error) {
+	prefix := crossEdgeKey(from, "", "")
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	var targets []QualifiedNode
+	for it.Rewind(); it.Valid(); it.Next() {
+		graph, node, _ := strings.Cut(string(it.Item().Key()[len(prefix):]), keySep)
+		targets = append(targets, QualifiedNode{Graph: graph, Node: node})
+	}
+	return targets, nil
+}
+
+// deleteCrossEdges deletes the cross edges of node, which every removal of a node goes through.
+func deleteCrossEdges(txn *badger.Txn, node string) error {
+	targets, err := readCrossEdges(txn, node)
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		if err := deleteCrossEdge(txn, node, t.Graph, t.Node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveCrossEdges moves the cross edges of from to to.
+func moveCrossEdges(txn *badger.Txn, from string, to string) error {
+	targets, err := readCrossEdges(txn, from)
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		if err := deleteCrossEdge(txn, from, t.Graph, t.Node); err != nil {
+			return err
+		}
+		if err := setCrossEdge(txn, to, t.Graph, t.Node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countCrossRefs returns the number of cross edges of g into the graph toGraph.
+func (g *Graph) countCrossRefs(toGraph string) (int, error) {
+	end, err := g.begin("countCrossRefs")
+	if err != nil {
+		return 0, err
+	}
+	defer end()
+	txn := g.DB.NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = crossRefKey(toGraph, "", "")
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	n := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		n++
+	}
+	return n, nil
+}
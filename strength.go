@@ -0,0 +1,234 @@
+package Onyx
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// The strength of a node is the sum of the weights of its edges, see SetEdgeWeight. Edges
+// without a weight count as 1, so on an unweighted graph strength is degree.
+
+// ErrInvalidStrength is returned when a weight added to a strength is NaN or infinite, or
+// makes the sum overflow.
+type ErrInvalidStrength struct {
+	From, To string
+	Weight   float64
+	// Overflow is set when Weight is finite but adding it overflowed the strength.
+	Overflow bool
+}
+
+func (e *ErrInvalidStrength) Error() string {
+	if e.Overflow {
+		return fmt.Sprintf("onyx: strength overflows adding weight %v of edge %s->%s", e.Weight, e.From, e.To)
+	}
+	return fmt.Sprintf("onyx: weight %v of edge %s->%s is not a finite number", e.Weight, e.From, e.To)
+}
+
+// EdgeDirection selects the out-edges or the in-edges of nodes.
+type EdgeDirection int
+
+const (
+	Outgoing EdgeDirection = iota
+	Incoming
+)
+
+type NodeStrength struct {
+	Node     string
+	Strength float64
+}
+
+// addStrength returns sum plus the weight of the edge from->to, 1 if it has none.
+func addStrength(txn *badger.Txn, sum float64, from string, to string) (float64, error) {
+	weight, err := edgeStrength(txn, from, to)
+	if err != nil {
+		return 0, err
+	}
+	return sumStrength(sum, weight, from, to)
+}
+
+// edgeStrength returns the weight of the edge from->to, 1 if it has none.
+func edgeStrength(txn *badger.Txn, from string, to string) (float64, error) {
+	weight, ok, err := readEdgeWeight(txn, from, to)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		weight = 1
+	}
+	if math.IsNaN(weight) || math.IsInf(weight, 0) {
+		return 0, &ErrInvalidStrength{From: from, To: to, Weight: weight}
+	}
+	return weight, nil
+}
+
+// sumStrength returns sum plus weight, the weight of the edge from->to.
+func sumStrength(sum float64, weight float64, from string, to string) (float64, error) {
+	if sum += weight; math.IsInf(sum, 0) {
+		return 0, &ErrInvalidStrength{From: from, To: to, Weight: weight, Overflow: true}
+	}
+	return sum, nil
+}
+
+// OutStrength returns the sum of the weights of the out-edges of node. Like GetEdges it
+// fails with badger.ErrKeyNotFound if node has no edge list.
+func (g *Graph) OutStrength(node string, txn *badger.Txn) (float64, error) {
+	node = g.nodeID(node)
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("OutStrength")
+		if err != nil {
+			return 0, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	node, err := g.resolveID(txn, node)
+	if err != nil {
+		return 0, err
+	}
+	// The weights are stored under the IDs the edge list holds, before resolving redirects.
+	dstNodes, exists, err := readEdgeMap(txn, node)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, badger.ErrKeyNotFound
+	}
+	strength := 0.0
+	for _, to := range sortedNeighbors(dstNodes) {
+		strength, err = addStrength(txn, strength, node, to)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return strength, nil
+}
+
+// InStrength returns the sum of the weights of the in-edges of node, read from the reverse
+// edge index like GetInEdges.
+func (g *Graph) InStrength(node string, txn *badger.Txn) (float64, error) {
+	node = g.nodeID(node)
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("InStrength")
+		if err != nil {
+			return 0, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	strength := 0.0
+	stale, err := g.scanInEdges(txn, node, func(from string, target string) error {
+		var err error
+		strength, err = addStrength(txn, strength, from, target)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	g.repairReverseIndex(stale)
+	return strength, nil
+}
+
+// TopKByStrength returns the k nodes with the highest out- or in-strength, highest first and
+// ties in node order. A k of 0 returns every node. It scans every edge list, and so doesn't
+// need the reverse edge index for in-strengths.
+func (g *Graph) TopKByStrength(k int, direction EdgeDirection, txn *badger.Txn) ([]NodeStrength, error) {
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("TopKByStrength")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	pass := newStrengthPass(g, txn, k, direction)
+	if err := forEachEdgeList(txn, pass.consume); err != nil {
+		return nil, err
+	}
+	return pass.finish(), nil
+}
+
+// TopKByStrengthStage is TopKByStrength as a stage of an AnalyticsPipeline. Its result is
+// the []NodeStrength of the k strongest nodes.
+func TopKByStrengthStage(k int, direction EdgeDirection) AnalyticsStage {
+	return AnalyticsStage{
+		Name: "topk-strength",
+		Pass: func(g *Graph, txn *badger.Txn) (func(string, map[string]bool) error, func() (any, error)) {
+			pass := newStrengthPass(g, txn, k, direction)
+			return pass.consume, func() (any, error) {
+				return pass.finish(), nil
+			}
+		},
+	}
+}
+
+// strengthPass sums the strengths of the nodes over one scan of the edge lists.
+type strengthPass struct {
+	txn       *badger.Txn
+	k         int
+	direction EdgeDirection
+	resolver  *redirectResolver
+	strengths map[string]float64
+}
+
+func newStrengthPass(g *Graph, txn *badger.Txn, k int, direction EdgeDirection) *strengthPass {
+	return &strengthPass{
+		txn:       txn,
+		k:         k,
+		direction: direction,
+		resolver:  g.newRedirectResolver(txn),
+		strengths: make(map[string]float64),
+	}
+}
+
+func (p *strengthPass) consume(from string, dstNodes map[string]bool) error {
+	if _, ok := p.strengths[from]; !ok {
+		p.strengths[from] = 0
+	}
+	for _, to := range sortedNeighbors(dstNodes) {
+		node := from
+		if p.direction == Incoming {
+			var err error
+			if node, err = p.resolver.resolve(to); err != nil {
+				return err
+			}
+		}
+		strength, err := addStrength(p.txn, p.strengths[node], from, to)
+		if err != nil {
+			return err
+		}
+		p.strengths[node] = strength
+	}
+	return nil
+}
+
+func (p *strengthPass) finish() []NodeStrength {
+	ranked := make([]NodeStrength, 0, len(p.strengths))
+	for node, strength := range p.strengths {
+		ranked = append(ranked, NodeStrength{Node: node, Strength: strength})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Strength != ranked[j].Strength {
+			return ranked[i].Strength > ranked[j].Strength
+		}
+		return ranked[i].Node < ranked[j].Node
+	})
+	if p.k > 0 && len(ranked) > p.k {
+		ranked = ranked[:p.k]
+	}
+	return ranked
+}
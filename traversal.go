@@ -0,0 +1,283 @@
+package Onyx
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+type TraversalOptions struct {
+	// MaxDepth limits how many hops from the start node are expanded. 0 means no limit.
+	MaxDepth int
+	// IncludeProperties attaches the properties of every visited node to the result.
+	// They are fetched in one batch per frontier level inside the traversal's transaction.
+	IncludeProperties bool
+	// PropertyAllowlist restricts IncludeProperties to the named properties. Empty means all properties.
+	PropertyAllowlist []string
+	// Explain attaches an ExplainReport of how the traversal ran to the result.
+	Explain bool
+	// OnExpand, if set, is called with every node before its neighbors are read, for example
+	// to report progress.
+	OnExpand func(node string, depth int)
+
+	ExpansionLimits
+}
+
+type TraversalResult struct {
+	// Order lists the visited nodes in the order they were reached.
+	Order []string
+	// Depth maps every visited node to its distance in hops from the start node.
+	Depth map[string]int
+	// Properties is only set when TraversalOptions.IncludeProperties is true.
+	Properties map[string]map[string][]byte
+	// Truncated holds the nodes whose neighbors were not all expanded because of the
+	// ExpansionLimits. It is nil if the traversal is complete.
+	Truncated map[string]bool
+	// Explain is only set when TraversalOptions.Explain is true.
+	Explain *ExplainReport
+}
+
+// BFS does a breadth first traversal of the graph starting from start.
+// Neighbors of a node are expanded in lexicographic order, so the result is deterministic.
+// Redirected IDs are resolved, so the result only contains canonical IDs.
+func (g *Graph) BFS(start string, opts TraversalOptions, txn *badger.Txn) (*TraversalResult, error) {
+	return g.BFSContext(context.Background(), start, opts, txn)
+}
+
+// BFSContext is BFS stopping with the error of ctx as soon as it is done, before expanding
+// the next node.
+func (g *Graph) BFSContext(ctx context.Context, start string, opts TraversalOptions, txn *badger.Txn) (*TraversalResult, error) {
+	start = g.nodeID(start)
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("BFS")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	explain := newExplainer(opts.Explain)
+	resolver := g.newRedirectResolver(txn)
+	phase := explain.now()
+	start, err := resolver.resolve(start)
+	if err != nil {
+		return nil, err
+	}
+	explain.phase("resolve", phase)
+
+	result := &TraversalResult{
+		Order: []string{start},
+		Depth: map[string]int{start: 0},
+	}
+	if opts.IncludeProperties {
+		result.Properties = make(map[string]map[string][]byte)
+	}
+
+	frontier := []string{start}
+	for depth := 0; len(frontier) > 0; depth++ {
+		if opts.IncludeProperties {
+			phase = explain.now()
+			props, err := multiGetNodeProperties(txn, frontier, opts.PropertyAllowlist)
+			if err != nil {
+				return nil, err
+			}
+			for node, p := range props {
+				result.Properties[node] = p
+			}
+			explain.keysRead(len(frontier))
+			explain.phase("properties", phase)
+		}
+
+		if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+			explain.limitTriggered(LimitMaxDepth)
+			break
+		}
+
+		var next []string
+		for _, node := range frontier {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if opts.OnExpand != nil {
+				opts.OnExpand(node, depth)
+			}
+			phase = explain.now()
+			dstNodes, size, err := readEdgeMapSize(txn, node)
+			if err != nil {
+				return nil, err
+			}
+			explain.expanded(depth, size)
+			explain.phase("expand", phase)
+
+			phase = explain.now()
+			dstNodes, err = resolver.resolveNeighbors(dstNodes)
+			if err != nil {
+				return nil, err
+			}
+			explain.phase("resolve", phase)
+
+			phase = explain.now()
+			sorted := sortedNeighbors(dstNodes)
+			neighbors, truncated, err := opts.limit(txn, node, sorted)
+			if err != nil {
+				return nil, err
+			}
+			if truncated {
+				if result.Truncated == nil {
+					result.Truncated = make(map[string]bool)
+				}
+				result.Truncated[node] = true
+				explain.truncated(depth, opts.truncatedBy(len(sorted)), opts.weightKeysRead(len(sorted)))
+			}
+			explain.phase("limit", phase)
+
+			for _, neighbor := range neighbors {
+				if _, seen := result.Depth[neighbor]; seen {
+					continue
+				}
+				result.Depth[neighbor] = depth + 1
+				result.Order = append(result.Order, neighbor)
+				next = append(next, neighbor)
+				explain.discovered(depth)
+			}
+		}
+		frontier = next
+	}
+
+	result.Explain = explain.finish(resolver)
+	return result, nil
+}
+
+// ParallelBFS is BFS with the edge lists of every frontier level read by a pool of workers,
+// which pays off when reading an edge list waits on disk. The result is the same as that of
+// BFS, including the nodes truncated by the ExpansionLimits, but Explain is not supported.
+// All workers read from txn, so like for MultiSourceNeighborhood it must be read-only, or nil.
+func (g *Graph) ParallelBFS(start string, workers int, opts TraversalOptions, txn *badger.Txn) (*TraversalResult, error) {
+	start = g.nodeID(start)
+	if opts.Explain {
+		return nil, errors.New("onyx: ParallelBFS doesn't support Explain, use BFS")
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+
+	if txn != nil && txnIsUpdate(txn) {
+		return nil, errors.New("onyx: ParallelBFS needs a read-only transaction")
+	}
+	localTxn := txn == nil
+	if localTxn {
+		end, err := g.begin("ParallelBFS")
+		if err != nil {
+			return nil, err
+		}
+		defer end()
+		var release func()
+		txn, release = g.readTxn()
+		defer release()
+	}
+
+	cache := g.newAdjacencyCache(txn, 0)
+	start, err := cache.resolve(start)
+	if err != nil {
+		return nil, err
+	}
+	result := &TraversalResult{
+		Order: []string{start},
+		Depth: map[string]int{start: 0},
+	}
+	if opts.IncludeProperties {
+		result.Properties = make(map[string]map[string][]byte)
+	}
+
+	frontier := []string{start}
+	for depth := 0; len(frontier) > 0; depth++ {
+		if opts.IncludeProperties {
+			props, err := multiGetNodeProperties(txn, frontier, opts.PropertyAllowlist)
+			if err != nil {
+				return nil, err
+			}
+			for node, p := range props {
+				result.Properties[node] = p
+			}
+		}
+		if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+			break
+		}
+		if opts.OnExpand != nil {
+			for _, node := range frontier {
+				opts.OnExpand(node, depth)
+			}
+		}
+
+		expanded, err := cache.expand(frontier, workers, opts.ExpansionLimits)
+		if err != nil {
+			return nil, err
+		}
+		// Merging in frontier order makes the result that of BFS.
+		var next []string
+		for i, node := range frontier {
+			if expanded[i].truncated {
+				if result.Truncated == nil {
+					result.Truncated = make(map[string]bool)
+				}
+				result.Truncated[node] = true
+			}
+			for _, neighbor := range expanded[i].neighbors {
+				if _, seen := result.Depth[neighbor]; seen {
+					continue
+				}
+				result.Depth[neighbor] = depth + 1
+				result.Order = append(result.Order, neighbor)
+				next = append(next, neighbor)
+			}
+		}
+		frontier = next
+	}
+	return result, nil
+}
+
+// expansion is the neighbors of a node a traversal expands, after the ExpansionLimits.
+type expansion struct {
+	neighbors []string
+	truncated bool
+}
+
+// expand returns the expansion of every node of frontier, read by up to workers goroutines.
+func (c *adjacencyCache) expand(frontier []string, workers int, limits ExpansionLimits) ([]expansion, error) {
+	expanded := make([]expansion, len(frontier))
+	errs := make([]error, len(frontier))
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, len(frontier)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(next.Add(1)) - 1; i < len(frontier); i = int(next.Add(1)) - 1 {
+				neighbors, err := c.get(frontier[i])
+				if err == nil {
+					neighbors, expanded[i].truncated, err = limits.limit(c.txn, frontier[i], neighbors)
+				}
+				expanded[i].neighbors, errs[i] = neighbors, err
+			}
+		}()
+	}
+	wg.Wait()
+	return expanded, errors.Join(errs...)
+}
+
+func sortedNeighbors(dstNodes map[string]bool) []string {
+	neighbors := make([]string, 0, len(dstNodes))
+	for neighbor := range dstNodes {
+		neighbors = append(neighbors, neighbor)
+	}
+	sort.Strings(neighbors)
+	return neighbors
+}
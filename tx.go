@@ -0,0 +1,163 @@
+package Onyx
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+const defaultUpdateRetries = 10
+
+// WithUpdateRetries sets how many times Update and UpdateWithResult re-run a closure whose
+// transaction conflicted before giving up with badger.ErrConflict.
+func WithUpdateRetries(retries int) Option {
+	return func(g *Graph) {
+		g.updateRetries = retries
+	}
+}
+
+// Tx is the read-write transaction passed to Update and UpdateWithResult closures. Its
+// methods are the graph operations run in the transaction; Txn returns the underlying
+// transaction for the operations that don't have a Tx method.
+//
+// A Tx, like the badger transaction under it, is owned by the goroutine running the closure
+// and must not be used by other goroutines, nor after the closure returned. WithTxGuard turns
+// concurrent use into a panic.
+type Tx struct {
+	g       *Graph
+	txn     *badger.Txn
+	written map[string]bool
+	guard   bool
+	inUse   atomic.Bool
+	started time.Time
+}
+
+func (g *Graph) newTx() *Tx {
+	return &Tx{g: g, txn: g.DB.NewTransaction(true), written: make(map[string]bool), guard: g.txGuard, started: time.Now()}
+}
+
+// Txn returns the underlying transaction. Operations run on it directly aren't covered by
+// WithTxGuard.
+func (tx *Tx) Txn() *badger.Txn {
+	return tx.txn
+}
+
+// wrote remembers node as written by tx, so a conflict can be attributed to it.
+func (tx *Tx) wrote(node string) {
+	tx.written[node] = true
+}
+
+func (tx *Tx) AddEdge(from string, to string) error {
+	defer tx.enter()()
+	tx.wrote(from)
+	return tx.g.AddEdge(from, to, tx.txn)
+}
+
+func (tx *Tx) RemoveEdge(from string, to string) (bool, error) {
+	defer tx.enter()()
+	tx.wrote(from)
+	return tx.g.RemoveEdge(from, to, tx.txn)
+}
+
+func (tx *Tx) SetEdges(from string, neighbors []string) (int, int, error) {
+	defer tx.enter()()
+	tx.wrote(from)
+	return tx.g.SetEdges(from, neighbors, tx.txn)
+}
+
+func (tx *Tx) GetEdges(from string) (map[string]bool, error) {
+	defer tx.enter()()
+	return tx.g.GetEdges(from, tx.txn)
+}
+
+func (tx *Tx) GetInEdges(to string) (map[string]bool, error) {
+	defer tx.enter()()
+	return tx.g.GetInEdges(to, tx.txn)
+}
+
+func (tx *Tx) HasEdge(from string, to string) (bool, error) {
+	defer tx.enter()()
+	return tx.g.HasEdge(from, to, tx.txn)
+}
+
+func (tx *Tx) SetNodeProperties(node string, props map[string][]byte) error {
+	defer tx.enter()()
+	tx.wrote(node)
+	return tx.g.SetNodeProperties(node, props, tx.txn)
+}
+
+func (tx *Tx) GetNodeProperties(node string) (map[string][]byte, error) {
+	defer tx.enter()()
+	return tx.g.GetNodeProperties(node, tx.txn)
+}
+
+func (tx *Tx) SetEdgeProperty(from string, to string, name string, value []byte) error {
+	defer tx.enter()()
+	tx.wrote(from)
+	return tx.g.SetEdgeProperty(from, to, name, value, tx.txn)
+}
+
+func (tx *Tx) GetEdgeProperties(from string, to string) (map[string][]byte, error) {
+	defer tx.enter()()
+	return tx.g.GetEdgeProperties(from, to, tx.txn)
+}
+
+// Update runs fn in a new read-write transaction and commits it. See UpdateWithResult.
+func (g *Graph) Update(fn func(tx *Tx) error) error {
+	_, err := g.UpdateWithResult(func(tx *Tx) (any, error) {
+		return nil, fn(tx)
+	})
+	return err
+}
+
+// UpdateWithResult runs fn in a new read-write transaction, commits it and returns the result
+// of fn. If the commit conflicts with another transaction, fn is run again from the start in
+// a fresh transaction, so reads must happen inside fn for the retry to see the new state:
+// the returned result is always the one computed by the attempt that committed.
+// fn may be run several times and must not have side effects outside of tx.
+// If fn returns an error the transaction is discarded and the error returned.
+func (g *Graph) UpdateWithResult(fn func(tx *Tx) (any, error)) (any, error) {
+	for attempt := 0; ; attempt++ {
+		result, err := g.runUpdate(fn)
+		if err != badger.ErrConflict || attempt >= g.updateRetries {
+			return result, err
+		}
+	}
+}
+
+func (g *Graph) runUpdate(fn func(tx *Tx) (any, error)) (any, error) {
+	end, err := g.begin("Update")
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	tx := g.newTx()
+	defer tx.txn.Discard()
+
+	result, err := fn(tx)
+	if err != nil {
+		return nil, err
+	}
+	// A goroutine the closure left running must not write while the transaction commits.
+	release := tx.enter()
+	err = tx.txn.Commit()
+	release()
+	if err != nil {
+		g.recordTxConflict(tx, err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// recordTxConflict counts err once if it is a conflict, attributed to every node written through tx.
+func (g *Graph) recordTxConflict(tx *Tx, err error) {
+	if err != badger.ErrConflict {
+		return
+	}
+	g.metrics.conflicts.Add(1)
+	for node := range tx.written {
+		g.hotspots.record(node)
+	}
+}
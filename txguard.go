@@ -0,0 +1,34 @@
+package Onyx
+
+import (
+	"errors"
+)
+
+// ErrConcurrentTx is the value the Tx guard panics with when a Tx is used by two goroutines
+// at once, see WithTxGuard.
+var ErrConcurrentTx = errors.New("onyx: Tx used by several goroutines at once, a Tx must only be used by the goroutine running the Update closure")
+
+// WithTxGuard makes every Tx check that it isn't used by two goroutines at once and panic with
+// ErrConcurrentTx if it is, instead of corrupting the edge lists written by both. The check
+// is an atomic compare and swap per call. It is on by default in test binaries, as reported
+// by testing.Testing, and in builds with the onyxdebug tag, and off otherwise.
+func WithTxGuard(on bool) Option {
+	return func(g *Graph) {
+		g.txGuard = on
+	}
+}
+
+// enter marks tx as in use until the returned function is called, panicking if it already is.
+// Tx methods call it as `defer tx.enter()()`; methods that are guarded call the graph
+// operations directly instead of other Tx methods, since the guard isn't reentrant.
+func (tx *Tx) enter() func() {
+	if !tx.guard {
+		return func() {}
+	}
+	if !tx.inUse.CompareAndSwap(false, true) {
+		panic(ErrConcurrentTx)
+	}
+	return func() {
+		tx.inUse.Store(false)
+	}
+}
@@ -0,0 +1,5 @@
+//go:build onyxdebug
+
+package Onyx
+
+const defaultTxGuard = true
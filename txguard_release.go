@@ -0,0 +1,9 @@
+//go:build !onyxdebug
+
+package Onyx
+
+import "testing"
+
+// defaultTxGuard turns the guard on in test binaries, including the tests of programs using
+// Onyx, so a shared Tx fails their tests rather than corrupting data in production.
+var defaultTxGuard = testing.Testing()
@@ -0,0 +1,190 @@
+package Onyx
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// TxStats is how big a transaction has grown, see Tx.Stats.
+type TxStats struct {
+	// PendingWrites is the number of keys set or deleted so far, counting a key written
+	// twice twice, like badger does.
+	PendingWrites int
+	// PendingBytes is badger's estimate of the size of the pending writes, the one it
+	// compares with its limit: keys, values kept in the LSM tree and a few bytes per write.
+	PendingBytes int64
+	// ReadKeys is the number of key reads tracked for conflict detection.
+	ReadKeys int
+	// Elapsed is the time since the transaction started.
+	Elapsed time.Duration
+}
+
+// Per write overhead badger adds to the size of the key and the value: the meta and
+// user-meta bytes of the entry plus the 10 bytes checkSize adds.
+const txnWriteOverhead = 2 + 10
+
+// txnFields holds the indexes of the unexported counters of badger.Txn, so the statistics
+// are the numbers badger compares with its limits rather than a recount that could drift from
+// them. They are looked up once; if a badger release renames them, TxStats only has Elapsed.
+var txnFields struct {
+	once                       sync.Once
+	count, size, reads, update []int
+}
+
+func lookupTxnFields() {
+	t := reflect.TypeOf(badger.Txn{})
+	field := func(name string, kind reflect.Kind) []int {
+		f, ok := t.FieldByName(name)
+		if !ok || f.Type.Kind() != kind {
+			return nil
+		}
+		return f.Index
+	}
+	txnFields.count = field("count", reflect.Int64)
+	txnFields.size = field("size", reflect.Int64)
+	txnFields.reads = field("reads", reflect.Slice)
+	txnFields.update = field("update", reflect.Bool)
+}
+
+// txnIsUpdate reports whether txn is a read-write transaction. If badger renames the field,
+// every transaction is taken for one.
+func txnIsUpdate(txn *badger.Txn) bool {
+	txnFields.once.Do(lookupTxnFields)
+	if txnFields.update == nil {
+		return true
+	}
+	return reflect.ValueOf(txn).Elem().FieldByIndex(txnFields.update).Bool()
+}
+
+func txnStats(txn *badger.Txn) TxStats {
+	txnFields.once.Do(lookupTxnFields)
+	var stats TxStats
+	v := reflect.ValueOf(txn).Elem()
+	if txnFields.count != nil {
+		stats.PendingWrites = int(v.FieldByIndex(txnFields.count).Int())
+	}
+	if txnFields.size != nil {
+		stats.PendingBytes = v.FieldByIndex(txnFields.size).Int()
+	}
+	if txnFields.reads != nil {
+		stats.ReadKeys = v.FieldByIndex(txnFields.reads).Len()
+	}
+	return stats
+}
+
+// Stats returns how big tx has grown so far, to decide whether to split the work of a
+// closure, see WillExceedLimits and ChunkedUpdate. The counts include the writes done through
+// Txn.
+func (tx *Tx) Stats() TxStats {
+	defer tx.enter()()
+	stats := txnStats(tx.txn)
+	stats.Elapsed = time.Since(tx.started)
+	return stats
+}
+
+// WillExceedLimits reports whether nMoreWrites more writes, of keys and values adding up to
+// approxBytes, would make tx fail with badger.ErrTxnTooBig, going by the limits of the badger
+// options the graph was opened with. Values above the value threshold only count the size of
+// their pointer in badger's estimate, so approxBytes may overestimate them.
+func (tx *Tx) WillExceedLimits(nMoreWrites int, approxBytes int64) bool {
+	stats := tx.Stats()
+	return txnWillExceed(tx.g.DB, stats, nMoreWrites, approxBytes)
+}
+
+func txnWillExceed(db *badger.DB, stats TxStats, nMoreWrites int, approxBytes int64) bool {
+	if nMoreWrites <= 0 && approxBytes <= 0 {
+		return false
+	}
+	count := int64(stats.PendingWrites + nMoreWrites)
+	size := stats.PendingBytes + approxBytes + int64(nMoreWrites)*txnWriteOverhead
+	return count >= db.MaxBatchCount() || size >= db.MaxBatchSize()
+}
+
+// ChunkedUpdate runs fn for every i from 0 to n-1 in read-write transactions, committing one
+// and starting the next whenever the following call may not fit, and returns how many calls
+// were committed. A call is expected to fit if the transaction has room for as many writes
+// and bytes as the biggest call so far, see WillExceedLimits; if a call turns out bigger and
+// fails with badger.ErrTxnTooBig, the transaction is dropped, the calls before it are run again
+// in a fresh one and committed, and the call starts the next transaction. A single call too big
+// for a transaction returns badger.ErrTxnTooBig.
+//
+// Like UpdateWithResult, conflicting commits are retried and fn may be run several times for
+// the same i, so it must not have side effects outside of tx. Unlike it, the work is not
+// atomic: when an error is returned, the calls before the returned count stay committed.
+func (g *Graph) ChunkedUpdate(n int, fn func(tx *Tx, i int) error) (int, error) {
+	end, err := g.begin("ChunkedUpdate")
+	if err != nil {
+		return 0, err
+	}
+	defer end()
+
+	var biggest TxStats
+	done, attempt := 0, 0
+	for done < n {
+		if g.closing() {
+			return done, ErrClosed
+		}
+		if done > 0 && attempt == 0 {
+			if err := g.faultPoint("ChunkedUpdate"); err != nil {
+				return done, err
+			}
+		}
+		next, err := g.runChunk(done, n, fn, &biggest)
+		if err == badger.ErrConflict && attempt < g.updateRetries {
+			attempt++
+			continue
+		}
+		if err != nil {
+			return done, err
+		}
+		done, attempt = next, 0
+	}
+	return done, nil
+}
+
+// runChunk runs fn from start in one transaction until the next call may not fit, commits it
+// and returns where the next transaction starts. biggest is updated with the most writes and
+// bytes a call took.
+func (g *Graph) runChunk(start int, n int, fn func(tx *Tx, i int) error, biggest *TxStats) (int, error) {
+	tx := g.newTx()
+	defer func() {
+		tx.txn.Discard()
+	}()
+
+	i := start
+	for ; i < n; i++ {
+		if i > start && tx.WillExceedLimits(biggest.PendingWrites, biggest.PendingBytes) {
+			break
+		}
+		before := tx.Stats()
+		err := fn(tx, i)
+		if err == badger.ErrTxnTooBig && i > start {
+			tx.txn.Discard()
+			tx = g.newTx()
+			for j := start; j < i; j++ {
+				if err := fn(tx, j); err != nil {
+					return start, err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return start, err
+		}
+		after := tx.Stats()
+		biggest.PendingWrites = max(biggest.PendingWrites, after.PendingWrites-before.PendingWrites)
+		biggest.PendingBytes = max(biggest.PendingBytes, after.PendingBytes-before.PendingBytes-int64(after.PendingWrites-before.PendingWrites)*txnWriteOverhead)
+	}
+
+	release := tx.enter()
+	err := tx.txn.Commit()
+	release()
+	if err != nil {
+		g.recordTxConflict(tx, err)
+		return start, err
+	}
+	return i, nil
+}
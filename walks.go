@@ -0,0 +1,248 @@
+package Onyx
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+type WalkCorpusOptions struct {
+	// WalksPerNode is the number of walks started from every start node. Defaults to 10.
+	WalksPerNode int
+	// WalkLength is the number of nodes in a walk, including the start node. Walks reaching a
+	// node without out-edges end early. Defaults to 80.
+	WalkLength int
+	// P and Q are the node2vec return and in-out parameters. A low P keeps walks close to where
+	// they came from, a low Q pushes them outward. Both default to 1, which gives unbiased walks.
+	P, Q float64
+	// Seed seeds the random walks. With one worker the corpus is the same for the same seed
+	// and graph.
+	Seed int64
+	// Workers is the number of goroutines generating walks. Defaults to 1. With more workers
+	// the walks are written in no particular order.
+	Workers int
+	// StartNodes restricts the start nodes to the given nodes. Empty means every node.
+	StartNodes []string
+	// StartLabel restricts the start nodes to the nodes whose LabelProperty equals it.
+	StartLabel string
+}
+
+// ExportWalkCorpus writes node2vec style biased random walks over the out-edges of the graph
+// to w, one walk per line as space separated node IDs, the input format of word2vec style
+// trainers. The rounds of walks visit the start nodes in a shuffled order, WalksPerNode times.
+// Node IDs are written as they are stored, so IDs containing whitespace split into several
+// tokens. Like ApproxJaccard, edges pointing at a redirected ID end the walk there until
+// ResolveRedirects has rewritten them.
+func (g *Graph) ExportWalkCorpus(w io.Writer, opts WalkCorpusOptions) error {
+	if opts.WalksPerNode == 0 {
+		opts.WalksPerNode = 10
+	}
+	if opts.WalkLength == 0 {
+		opts.WalkLength = 80
+	}
+	if opts.P == 0 {
+		opts.P = 1
+	}
+	if opts.Q == 0 {
+		opts.Q = 1
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.WalksPerNode < 0 || opts.WalkLength < 0 || opts.P < 0 || opts.Q < 0 {
+		return fmt.Errorf("onyx: invalid walk corpus options %+v", opts)
+	}
+
+	end, err := g.begin("ExportWalkCorpus")
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	txn := g.DB.NewTransaction(false)
+	walker, starts, err := g.loadWalker(txn, opts)
+	txn.Discard()
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	lines := make(chan string, opts.Workers)
+	work := make(chan int)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		rng := rand.New(rand.NewSource(opts.Seed + 1 + int64(i)))
+		go func() {
+			defer wg.Done()
+			walk := make([]string, 0, opts.WalkLength)
+			for start := range work {
+				walk = walker.walk(rng, start, walk[:0])
+				select {
+				case lines <- strings.Join(walk, " ") + "\n":
+				case <-stop:
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(work)
+		rng := rand.New(rand.NewSource(opts.Seed))
+		order := make([]int, len(starts))
+		for round := 0; round < opts.WalksPerNode; round++ {
+			copy(order, starts)
+			rng.Shuffle(len(order), func(i, j int) {
+				order[i], order[j] = order[j], order[i]
+			})
+			for _, start := range order {
+				if g.closing() {
+					return
+				}
+				select {
+				case work <- start:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+
+	for line := range lines {
+		if err == nil {
+			_, err = bw.WriteString(line)
+			if err != nil {
+				close(stop)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if g.closing() {
+		return ErrClosed
+	}
+	return bw.Flush()
+}
+
+// walker holds the out-edges of every node by index, sorted, so whether a node is a neighbor
+// of the previous one is a binary search.
+type walker struct {
+	nodes  []string
+	out    [][]int
+	p, q   float64
+	length int
+}
+
+// loadWalker reads the adjacency of the graph and the indexes of the start nodes, sorted.
+func (g *Graph) loadWalker(txn *badger.Txn, opts WalkCorpusOptions) (*walker, []int, error) {
+	w := &walker{p: opts.P, q: opts.Q, length: opts.WalkLength}
+	index := make(map[string]int)
+	nodeIndex := func(node string) int {
+		i, ok := index[node]
+		if !ok {
+			i = len(w.nodes)
+			index[node] = i
+			w.nodes = append(w.nodes, node)
+			w.out = append(w.out, nil)
+		}
+		return i
+	}
+	err := forEachEdgeList(txn, func(from string, dstNodes map[string]bool) error {
+		src := nodeIndex(from)
+		edges := make([]int, 0, len(dstNodes))
+		for _, to := range sortedNeighbors(dstNodes) {
+			edges = append(edges, nodeIndex(to))
+		}
+		sort.Ints(edges)
+		w.out[src] = edges
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var candidates []string
+	if len(opts.StartNodes) > 0 {
+		for _, node := range g.nodeIDs(opts.StartNodes) {
+			node, err := g.resolveID(txn, node)
+			if err != nil {
+				return nil, nil, err
+			}
+			candidates = append(candidates, node)
+		}
+	} else {
+		candidates = w.nodes
+	}
+
+	seen := make(map[int]bool)
+	var starts []int
+	for _, node := range candidates {
+		i, ok := index[node]
+		if !ok || seen[i] {
+			continue
+		}
+		if opts.StartLabel != "" {
+			props, err := readNodeProperties(txn, node, []string{LabelProperty})
+			if err != nil {
+				return nil, nil, err
+			}
+			if string(props[LabelProperty]) != opts.StartLabel {
+				continue
+			}
+		}
+		seen[i] = true
+		starts = append(starts, i)
+	}
+	sort.Slice(starts, func(a, b int) bool {
+		return w.nodes[starts[a]] < w.nodes[starts[b]]
+	})
+	return w, starts, nil
+}
+
+// walk appends a walk from start to buf. Steps are biased by rejection sampling: a uniformly
+// picked neighbor is accepted with probability proportional to its node2vec weight, 1/p for
+// going back, 1 for staying next to the previous node and 1/q for moving away from it.
+func (w *walker) walk(rng *rand.Rand, start int, buf []string) []string {
+	buf = append(buf, w.nodes[start])
+	prev, cur := -1, start
+	biased := w.p != 1 || w.q != 1
+	upper := max(1/w.p, 1, 1/w.q)
+	for len(buf) < w.length {
+		edges := w.out[cur]
+		if len(edges) == 0 {
+			break
+		}
+		next := edges[rng.Intn(len(edges))]
+		if biased && prev >= 0 {
+			for rng.Float64()*upper >= w.weight(prev, next) {
+				next = edges[rng.Intn(len(edges))]
+			}
+		}
+		buf = append(buf, w.nodes[next])
+		prev, cur = cur, next
+	}
+	return buf
+}
+
+func (w *walker) weight(prev int, next int) float64 {
+	if next == prev {
+		return 1 / w.p
+	}
+	edges := w.out[prev]
+	if i := sort.SearchInts(edges, next); i < len(edges) && edges[i] == next {
+		return 1
+	}
+	return 1 / w.q
+}